@@ -0,0 +1,175 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ufy-it/go-telegram-bot/dispatcher"
+	"github.com/ufy-it/go-telegram-bot/logger"
+)
+
+// Dispatcher is an interface for the part of the dispatcher that is managed by the admin server
+type Dispatcher interface {
+	Conversations(chatID int64) []dispatcher.ConversationInfo
+	CancelConversation(conversationID int64) (bool, error)
+	DropChat(chatID int64) (int, error)
+}
+
+// Server is an http.Handler that serves health probes and admin endpoints of the bot:
+//
+//	GET  /healthz                             - 200 while the process is alive
+//	GET  /readyz                              - 200 after the state is loaded and the bot is authorized, 503 otherwise
+//	GET  /metrics                             - metrics of the bot if the metrics handler is set
+//	GET  /admin/conversations[?chat_id=ID]    - JSON list of open conversations
+//	POST /admin/conversations/{id}/cancel     - close the conversation as if it was closed by the bot
+//	POST /admin/chats/{id}/drop               - remove conversations of the chat and their state at once
+//
+// Admin endpoints require the "Authorization: Bearer <token>" header, they are disabled if the token is empty
+type Server struct {
+	token      string
+	ready      atomic.Bool
+	mu         sync.RWMutex
+	dispatcher Dispatcher   // nil until the bot is started
+	metrics    http.Handler // handler of /metrics, nil if metrics are not exported
+	mux        *http.ServeMux
+}
+
+// NewServer creates a server that protects admin endpoints with the token
+func NewServer(token string) *Server {
+	s := &Server{token: token, mux: http.NewServeMux()}
+	s.mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	s.mux.HandleFunc("GET /readyz", s.readyz)
+	s.mux.HandleFunc("GET /metrics", s.serveMetrics)
+	if token != "" {
+		s.mux.HandleFunc("GET /admin/conversations", s.authorized(s.conversations))
+		s.mux.HandleFunc("POST /admin/conversations/{id}/cancel", s.authorized(s.cancelConversation))
+		s.mux.HandleFunc("POST /admin/chats/{id}/drop", s.authorized(s.dropChat))
+	}
+	return s
+}
+
+// SetDispatcher sets the dispatcher managed by admin endpoints
+func (s *Server) SetDispatcher(d Dispatcher) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dispatcher = d
+}
+
+// SetMetrics sets the handler of /metrics, e.g. *metrics.Prometheus
+func (s *Server) SetMetrics(handler http.Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metrics = handler
+}
+
+// SetReady sets the result of the readiness probe
+func (s *Server) SetReady(ready bool) {
+	s.ready.Store(ready)
+}
+
+// IsReady returns the result of the readiness probe
+func (s *Server) IsReady() bool {
+	return s.ready.Load()
+}
+
+// ServeHTTP serves requests to the probes and to admin endpoints
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	if !s.IsReady() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ready")
+}
+
+func (s *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	handler := s.metrics
+	s.mu.RUnlock()
+	if handler == nil {
+		http.NotFound(w, r)
+		return
+	}
+	handler.ServeHTTP(w, r)
+}
+
+// authorized checks the token, and that the dispatcher is set, before calling the handler
+func (s *Server) authorized(handler func(w http.ResponseWriter, r *http.Request, d Dispatcher)) http.HandlerFunc {
+	expected := []byte("Bearer " + s.token)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		s.mu.RLock()
+		d := s.dispatcher
+		s.mu.RUnlock()
+		if d == nil {
+			http.Error(w, "the bot is not started", http.StatusServiceUnavailable)
+			return
+		}
+		handler(w, r, d)
+	}
+}
+
+func (s *Server) conversations(w http.ResponseWriter, r *http.Request, d Dispatcher) {
+	var chatID int64
+	if value := r.URL.Query().Get("chat_id"); value != "" {
+		var err error
+		if chatID, err = strconv.ParseInt(value, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("wrong chat_id: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, d.Conversations(chatID))
+}
+
+func (s *Server) cancelConversation(w http.ResponseWriter, r *http.Request, d Dispatcher) {
+	conversationID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("wrong conversation id: %v", err), http.StatusBadRequest)
+		return
+	}
+	canceled, err := d.CancelConversation(conversationID)
+	if !canceled {
+		http.Error(w, fmt.Sprintf("no open conversation %d", conversationID), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.Warning("%v", err) // the conversation is canceled anyway
+	}
+	logger.Note("conversation %d was canceled by an admin", conversationID)
+	writeJSON(w, http.StatusOK, map[string]bool{"canceled": true})
+}
+
+func (s *Server) dropChat(w http.ResponseWriter, r *http.Request, d Dispatcher) {
+	chatID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("wrong chat id: %v", err), http.StatusBadRequest)
+		return
+	}
+	dropped, err := d.DropChat(chatID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"dropped": dropped})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Warning("cannot write admin response: %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+package admin_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ufy-it/go-telegram-bot/admin"
+	"github.com/ufy-it/go-telegram-bot/dispatcher"
+)
+
+type fakeDispatcher struct {
+	canceled []int64
+	dropped  []int64
+}
+
+func (d *fakeDispatcher) Conversations(chatID int64) []dispatcher.ConversationInfo {
+	all := []dispatcher.ConversationInfo{{ConversationID: 1, ChatID: 10, Step: 2}, {ConversationID: 2, ChatID: 20, Step: -1}}
+	result := []dispatcher.ConversationInfo{}
+	for _, conv := range all {
+		if chatID == 0 || conv.ChatID == chatID {
+			result = append(result, conv)
+		}
+	}
+	return result
+}
+
+func (d *fakeDispatcher) CancelConversation(conversationID int64) (bool, error) {
+	if conversationID != 1 {
+		return false, nil
+	}
+	d.canceled = append(d.canceled, conversationID)
+	return true, nil
+}
+
+func (d *fakeDispatcher) DropChat(chatID int64) (int, error) {
+	if chatID < 0 {
+		return 0, errors.New("cannot save")
+	}
+	d.dropped = append(d.dropped, chatID)
+	return 1, nil
+}
+
+func request(s *admin.Server, method, path, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestProbes(t *testing.T) {
+	s := admin.NewServer("")
+	if w := request(s, "GET", "/healthz", ""); w.Code != http.StatusOK {
+		t.Errorf("unexpected healthz status %d", w.Code)
+	}
+	if w := request(s, "GET", "/readyz", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected readyz status %d before the start", w.Code)
+	}
+	s.SetReady(true)
+	if w := request(s, "GET", "/readyz", ""); w.Code != http.StatusOK {
+		t.Errorf("unexpected readyz status %d after the start", w.Code)
+	}
+	s.SetDispatcher(&fakeDispatcher{})
+	if w := request(s, "GET", "/admin/conversations", ""); w.Code != http.StatusNotFound {
+		t.Errorf("admin endpoints should be disabled without a token, got status %d", w.Code)
+	}
+}
+
+func TestAdminEndpoints(t *testing.T) {
+	s := admin.NewServer("secret")
+	if w := request(s, "GET", "/admin/conversations", "secret"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status %d before the start", w.Code)
+	}
+	d := &fakeDispatcher{}
+	s.SetDispatcher(d)
+
+	if w := request(s, "GET", "/admin/conversations", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("unexpected status %d without a token", w.Code)
+	}
+	if w := request(s, "GET", "/admin/conversations", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("unexpected status %d with a wrong token", w.Code)
+	}
+
+	w := request(s, "GET", "/admin/conversations?chat_id=10", "secret")
+	var convs []dispatcher.ConversationInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &convs); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d %s (%v)", w.Code, w.Body.String(), err)
+	}
+	if len(convs) != 1 || convs[0].ConversationID != 1 || convs[0].Step != 2 {
+		t.Errorf("unexpected conversations %v", convs)
+	}
+	if w := request(s, "GET", "/admin/conversations?chat_id=abc", "secret"); w.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status %d for a wrong chat_id", w.Code)
+	}
+
+	if w := request(s, "GET", "/admin/conversations/1/cancel", "secret"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected status %d for GET cancel", w.Code)
+	}
+	if w := request(s, "POST", "/admin/conversations/1/cancel", "secret"); w.Code != http.StatusOK || len(d.canceled) != 1 {
+		t.Errorf("unexpected cancel response %d %s", w.Code, w.Body.String())
+	}
+	if w := request(s, "POST", "/admin/conversations/5/cancel", "secret"); w.Code != http.StatusNotFound {
+		t.Errorf("unexpected status %d for an unknown conversation", w.Code)
+	}
+
+	w = request(s, "POST", "/admin/chats/20/drop", "secret")
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"dropped":1}` || len(d.dropped) != 1 || d.dropped[0] != 20 {
+		t.Errorf("unexpected drop response %d %s", w.Code, w.Body.String())
+	}
+	if w := request(s, "POST", "/admin/chats/-1/drop", "secret"); w.Code != http.StatusInternalServerError {
+		t.Errorf("unexpected status %d for a failed drop", w.Code)
+	}
+}
@@ -3,44 +3,86 @@ package bot
 import (
 	"context"
 	"fmt"
-	"math/rand"
 	"net/http"
 
+	"github.com/ufy-it/go-telegram-bot/admin"
 	"github.com/ufy-it/go-telegram-bot/conversation"
 	"github.com/ufy-it/go-telegram-bot/dispatcher"
 	"github.com/ufy-it/go-telegram-bot/handlers"
 	"github.com/ufy-it/go-telegram-bot/jobs"
 	"github.com/ufy-it/go-telegram-bot/logger"
+	"github.com/ufy-it/go-telegram-bot/metrics"
+	"github.com/ufy-it/go-telegram-bot/ratelimit"
+	"github.com/ufy-it/go-telegram-bot/retry"
 	"github.com/ufy-it/go-telegram-bot/state"
+	"github.com/ufy-it/go-telegram-bot/tracing"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
 
+// Client is an interface for a Telegram Bot API client that runs the bot.
+// *tgbotapi.BotAPI implements it, as well as any wrapper that adds retries, metrics, etc.
+type Client interface {
+	dispatcher.Bot
+	GetMe() (tgbotapi.User, error)
+	GetWebhookInfo() (tgbotapi.WebhookInfo, error)
+}
+
+// fileEndpointClient is a Client that makes links to files with its own endpoint,
+// as tgbotapi.BotAPI always makes them with tgbotapi.FileEndpoint
+type fileEndpointClient struct {
+	*tgbotapi.BotAPI
+	endpoint string
+}
+
+// GetFileDirectURL returns link to the file on the file endpoint of the client
+func (c fileEndpointClient) GetFileDirectURL(fileID string) (string, error) {
+	file, err := c.GetFile(tgbotapi.FileConfig{FileID: fileID})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(c.endpoint, c.Token, file.FilePath), nil
+}
+
 // Config describes configuration oprions for the bot
 type botConfig struct {
-	apiToken           string                   // Bot API token
-	debug              bool                     // flag to indicate whether run the bot in debug
-	webHook            bool                     // flag to indicate whether to run webhook or long pulling
-	dispatcherConfig   dispatcher.Config        // configuration for the dispatcher
-	botJobs            jobs.JobDescriptionsList // list of jobs to run
+	client             Client            // pre-built Bot API client, created from apiToken if nil
+	apiToken           string            // Bot API token
+	apiEndpoint        string            // Bot API endpoint template, tgbotapi.APIEndpoint by default
+	fileEndpoint       string            // endpoint template for downloads of files, tgbotapi.FileEndpoint by default
+	debug              bool              // flag to indicate whether run the bot in debug
+	webHook            bool              // flag to indicate whether to run webhook or long pulling
+	dispatcherConfig   dispatcher.Config // configuration for the dispatcher
+	rateLimit          *ratelimit.Config // limits for outgoing messages, nil if messages are not throttled
+	retryPolicy        *retry.Policy     // policy for repeating calls failed with transient errors, nil if calls are not repeated
+	jobRunner          *jobs.Runner      // runner of the jobs
+	scheduler          *jobs.Scheduler   // scheduler of one-off tasks, nil if tasks are not used
 	updateTimeout      int
-	stateIO            state.StateIO // interface for loading and saving the bot state
-	allowBotUsers      bool          // flag that indicates whether conversation with bot users allowed
-	webHookExternalURL string        // "https://www.google.com:8443/"+bot.Token
-	webHookInternalURL string        // "0.0.0.0:8443"
-	certFile           string        // "cert.pem"
-	keyFile            string        // "key.pem"
+	stateIO            state.StateIO     // interface for loading and saving the bot state
+	allowBotUsers      bool              // flag that indicates whether conversation with bot users allowed
+	webHookExternalURL string            // "https://www.google.com:8443/"+bot.Token
+	webHookInternalURL string            // "0.0.0.0:8443"
+	certFile           string            // "cert.pem"
+	keyFile            string            // "key.pem"
+	adminAddr          string            // address of the admin server, e.g. ":8081", the server is not run if empty
+	adminServer        *admin.Server     // health probes and admin endpoints
+	metrics            metrics.Collector // collector of measurements, nil if metrics are not collected
 }
 
 // NewBot creates a new bot configuration with default values and no command handlers and jobs
 func NewBot(apiToken string) *botConfig {
+	rateLimit := ratelimit.DefaultConfig()
+	retryPolicy := retry.DefaultPolicy()
 	return &botConfig{
-		apiToken: apiToken,
-		debug:    false,
-		webHook:  false,
+		apiToken:     apiToken,
+		apiEndpoint:  tgbotapi.APIEndpoint,
+		fileEndpoint: tgbotapi.FileEndpoint,
+		debug:        false,
+		webHook:      false,
 		dispatcherConfig: dispatcher.Config{
 			MaxOpenConversations:         1000,
 			SingleMessageTrySendInterval: 10,
+			ShutdownGraceSeconds:         10,
 			ConversationConfig: conversation.Config{
 				MaxMessageQueue: 10,
 				TimeoutMinutes:  10,
@@ -53,7 +95,9 @@ func NewBot(apiToken string) *botConfig {
 			TechnicalMessageFunc: dispatcher.EmptyTechnicalMessageFunc,
 			GloabalKeyboardFunc:  nil,
 		},
-		botJobs:            jobs.JobDescriptionsList{},
+		rateLimit:          &rateLimit,
+		retryPolicy:        &retryPolicy,
+		jobRunner:          jobs.NewRunner(jobs.JobDescriptionsList{}),
 		updateTimeout:      0,
 		stateIO:            nil,
 		allowBotUsers:      false,
@@ -64,13 +108,81 @@ func NewBot(apiToken string) *botConfig {
 	}
 }
 
-// SetDebug sets debug flag for the bot (by default false)
+// NewBotWithClient creates a new bot configuration that runs with a pre-built Bot API client
+func NewBotWithClient(client Client) *botConfig {
+	c := NewBot("")
+	c.client = client
+	return c
+}
+
+// SetAdminServer runs an http server on addr with /healthz and /readyz probes and admin endpoints
+// to view open conversations, cancel a conversation or drop a chat. Admin endpoints require
+// the "Authorization: Bearer <token>" header, they are disabled if the token is empty.
+// If addr is empty, the server is not run, and AdminServer can be mounted on an own http server
+func (c *botConfig) SetAdminServer(addr, token string) *botConfig {
+	c.adminAddr = addr
+	c.adminServer = admin.NewServer(token)
+	return c
+}
+
+// WithMetrics sets collector of measurements of updates, conversations, handlers, Bot API calls and jobs.
+// If the collector is an http.Handler (e.g. metrics.NewPrometheus), the admin server serves it on /metrics.
+// Bot API calls are measured only if the bot creates the client, wrap the http client of a pre-built client with metrics.NewHTTPClient
+func (c *botConfig) WithMetrics(collector metrics.Collector) *botConfig {
+	c.metrics = collector
+	c.dispatcherConfig.Metrics = collector
+	return c
+}
+
+// WithTracer sets tracer of updates. A trace of an update starts when the bot receives the update, and goes through the dispatcher
+// to the handler step that consumes the update and messages sent by the conversation. Handlers start child spans with tracing.Start(ctx, ...)
+func (c *botConfig) WithTracer(tracer tracing.Tracer) *botConfig {
+	c.dispatcherConfig.Tracer = tracer
+	return c
+}
+
+// AdminServer returns the admin server set with SetAdminServer, nil if it is not set
+func (c *botConfig) AdminServer() *admin.Server {
+	return c.adminServer
+}
+
+// SetDebug sets debug flag for the bot (by default false). The flag is applied to a client set with NewBotWithClient
+// if the client is *tgbotapi.BotAPI
 func (c *botConfig) SetDebug(debug bool) *botConfig {
 	c.debug = debug
 	return c
 }
 
-// SetWebHook sets webhook flag for the bot (by default false), and parameters for webhook
+// SetAPIEndpoint sets Bot API endpoint template (by default tgbotapi.APIEndpoint).
+// The template should contain two %s placeholders for the token and the method name, e.g. bottest.Server.APIEndpoint()
+func (c *botConfig) SetAPIEndpoint(endpoint string) *botConfig {
+	c.apiEndpoint = endpoint
+	return c
+}
+
+// SetFileEndpoint sets endpoint template for downloads of files (by default tgbotapi.FileEndpoint).
+// The template should contain two %s placeholders for the token and the file path, e.g. bottest.Server.FileEndpoint()
+func (c *botConfig) SetFileEndpoint(endpoint string) *botConfig {
+	c.fileEndpoint = endpoint
+	return c
+}
+
+// SetRateLimit sets limits for outgoing messages (by default ratelimit.DefaultConfig() that follows Telegram flood limits).
+// Handlers that send messages faster than the limits wait, nil disables throttling
+func (c *botConfig) SetRateLimit(config *ratelimit.Config) *botConfig {
+	c.rateLimit = config
+	return c
+}
+
+// SetRetryPolicy sets policy for repeating calls to the Bot API that failed with transient errors (by default retry.DefaultPolicy()).
+// nil disables repeating
+func (c *botConfig) SetRetryPolicy(policy *retry.Policy) *botConfig {
+	c.retryPolicy = policy
+	return c
+}
+
+// SetWebHook sets webhook flag for the bot (by default false), and parameters for webhook.
+// The webhook gets a random secret path, and rejects requests without the secret token that the bot sets with setWebhook
 func (c *botConfig) SetWebHook(webHook bool, webHookExternalURL, webHookInternalUrl, certFile, keyFile string) *botConfig {
 	c.webHook = webHook
 	c.webHookExternalURL = webHookExternalURL
@@ -87,11 +199,16 @@ func (c *botConfig) SetUpdateTimeout(timeout int) *botConfig {
 }
 
 // WithJobs sets list of jobs for the bot
-func (c *botConfig) WithJobs(jobs jobs.JobDescriptionsList) *botConfig {
-	c.botJobs = jobs
+func (c *botConfig) WithJobs(jobList jobs.JobDescriptionsList) *botConfig {
+	c.jobRunner = jobs.NewRunner(jobList)
 	return c
 }
 
+// Jobs returns runner of the jobs set with WithJobs, it provides stats of job runs (last start, duration, error, failures)
+func (c *botConfig) Jobs() *jobs.Runner {
+	return c.jobRunner
+}
+
 // SetAllowBotUsers sets flag that indicates whether conversation with bot users allowed (by default false)
 func (c *botConfig) SetAllowBotUsers(allow bool) *botConfig {
 	c.allowBotUsers = allow
@@ -111,6 +228,8 @@ func (c *botConfig) SetMaxOpenConversations(max int) *botConfig {
 }
 
 // SetSingleMessageTrySendInterval sets interval in seconds between attempts to send a single message from bot to a chat (by default 10)
+//
+// Deprecated: single messages are queued in the outbox and delivered as soon as the chat is released, the interval is not used
 func (c *botConfig) SetSingleMessageTrySendInterval(interval int) *botConfig {
 	c.dispatcherConfig.SingleMessageTrySendInterval = interval
 	return c
@@ -128,6 +247,58 @@ func (c *botConfig) SetMaxMessageQueue(max int) *botConfig {
 	return c
 }
 
+// SetShutdownGracePeriod sets time in seconds for handlers to finish their work when the context of Run is canceled (by default 10).
+// The bot stops receiving updates, waits for handlers that do not wait for users, and then closes the remaining conversations
+// without messages to users and keeps them in the state, so that they continue after a restart. Run returns when all handlers returned,
+// or when the grace period is over (handlers that ignore their canceled context are logged and left behind)
+func (c *botConfig) SetShutdownGracePeriod(seconds int) *botConfig {
+	c.dispatcherConfig.ShutdownGraceSeconds = seconds
+	return c
+}
+
+// SetMaxConversationCrashes sets how many times the bot can crash while a conversation runs a step without getting an update
+// from the user (by default 0 - no limit). Conversations that wait for users during a crash are not counted. A conversation over the limit is dropped instead of being resumed, so that a conversation
+// that crashes the bot does not crash it again on every start. Graceful restarts (e.g. deploys) are not counted
+func (c *botConfig) SetMaxConversationCrashes(max int) *botConfig {
+	c.dispatcherConfig.MaxConversationCrashes = max
+	return c
+}
+
+// WithPanicHook sets a hook that gets the value of a panic recovered in a conversation (e.g. to report it).
+// The panic is logged with the stack, the user gets the UserError message and the conversation is dropped
+func (c *botConfig) WithPanicHook(hook dispatcher.PanicHookType) *botConfig {
+	c.dispatcherConfig.PanicHook = hook
+	return c
+}
+
+// SetConversationKeyStrategy sets the way updates from a chat are separated into conversations (by default conversation.PerChat).
+// Use conversation.PerChatUser to let several members of a group talk to the bot at the same time,
+// conversation.PerChatThread to run an independent conversation in each forum topic,
+// or conversation.PerChatUserThread to combine both
+func (c *botConfig) SetConversationKeyStrategy(strategy conversation.KeyStrategy) *botConfig {
+	c.dispatcherConfig.ConversationKey = strategy
+	return c
+}
+
+// SetEditedMessagesRoute sets how the bot handles edited messages (ignored by default)
+func (c *botConfig) SetEditedMessagesRoute(route dispatcher.UpdateRoute) *botConfig {
+	c.dispatcherConfig.EditedMessages = route
+	return c
+}
+
+// SetChannelPostsRoute sets how the bot handles posts in channels where it is an administrator (ignored by default)
+func (c *botConfig) SetChannelPostsRoute(route dispatcher.UpdateRoute) *botConfig {
+	c.dispatcherConfig.ChannelPosts = route
+	return c
+}
+
+// SetMessageReactionsRoute sets how the bot handles reactions on messages (ignored by default).
+// Reactions can only be ignored or start a handler, the handler gets the reaction with handlers.GetMessageReaction
+func (c *botConfig) SetMessageReactionsRoute(route dispatcher.UpdateRoute) *botConfig {
+	c.dispatcherConfig.MessageReactions = route
+	return c
+}
+
 // WithDefaultCommandHandler sets default command handler for the bot.
 // The default handler is called when no other command handler is found for a command
 func (c *botConfig) WithDefaultCommandHandler(handler handlers.HandlerCreatorType) *botConfig {
@@ -141,6 +312,77 @@ func (c *botConfig) WithCommandHandlers(handlers []handlers.CommandHandler) *bot
 	return c
 }
 
+// WithMiddlewares sets list of middlewares that wrap running of every handler, the first middleware is the outermost
+func (c *botConfig) WithMiddlewares(middlewares ...dispatcher.Middleware) *botConfig {
+	c.dispatcherConfig.Middlewares = middlewares
+	return c
+}
+
+// WithChatRegistry sets registry of chats that talked to the bot (by default records are kept in memory).
+// Use state.NewChatRegistry(stateIO) to keep the records between restarts, or implement state.ChatRegistry over a database
+func (c *botConfig) WithChatRegistry(registry state.ChatRegistry) *botConfig {
+	c.dispatcherConfig.ChatRegistry = registry
+	return c
+}
+
+// WithChatStatusHook sets a hook that is called when a user blocks the bot (or the bot is removed from a group), and when the chat is active again
+func (c *botConfig) WithChatStatusHook(hook dispatcher.ChatStatusHookType) *botConfig {
+	c.dispatcherConfig.ChatStatusHook = hook
+	return c
+}
+
+// WithOutboxIO sets storage for single messages from jobs that wait for the end of conversations (by default they are kept in memory),
+// so that the messages queued before a restart are not lost. Changes are saved in the background a second later and when the bot is stopped
+func (c *botConfig) WithOutboxIO(io state.StateIO) *botConfig {
+	c.dispatcherConfig.OutboxIO = io
+	return c
+}
+
+// WithBroadcastIO sets storage for checkpoints of broadcasts (by default checkpoints are kept in memory),
+// so that a broadcast interrupted by a restart continues from the next chat
+func (c *botConfig) WithBroadcastIO(io state.StateIO) *botConfig {
+	c.dispatcherConfig.BroadcastIO = io
+	return c
+}
+
+// WithScheduler sets scheduler of one-off tasks (e.g. reminders), handlers and jobs get it with handlers.GetScheduler(ctx).
+// Task types should be registered in the scheduler before the bot is run
+func (c *botConfig) WithScheduler(scheduler *jobs.Scheduler) *botConfig {
+	c.scheduler = scheduler
+	c.dispatcherConfig.Scheduler = nil
+	if scheduler != nil {
+		c.dispatcherConfig.Scheduler = scheduler
+	}
+	return c
+}
+
+// WithRoleResolver sets function that returns roles of a user, it is required if any command handler has RequiredRole
+func (c *botConfig) WithRoleResolver(resolver handlers.RoleResolverType) *botConfig {
+	c.dispatcherConfig.RoleResolver = resolver
+	return c
+}
+
+// SetAccessDeniedPolicy sets what the bot does if a user does not have the role required by a command handler (by default dispatcher.FallThrough).
+// With dispatcher.DenyWithMessage the bot sends dispatcher.AccessDenied technical message
+func (c *botConfig) SetAccessDeniedPolicy(policy dispatcher.AccessDeniedPolicy) *botConfig {
+	c.dispatcherConfig.AccessDeniedPolicy = policy
+	return c
+}
+
+// WithInlineQueryHandlers sets list of handlers for inline queries.
+// Inline mode should be enabled for the bot in @BotFather
+func (c *botConfig) WithInlineQueryHandlers(handlers []handlers.InlineQueryHandler) *botConfig {
+	c.dispatcherConfig.InlineQueryHandlers = handlers
+	return c
+}
+
+// WithChosenInlineResultHandler sets a hook that is called when a user chooses a result of an inline query.
+// Inline feedback should be enabled for the bot in @BotFather
+func (c *botConfig) WithChosenInlineResultHandler(handler handlers.ChosenInlineResultHandlerFunc) *botConfig {
+	c.dispatcherConfig.ChosenInlineResultHandler = handler
+	return c
+}
+
 // WithGlobalHandlers sets list of global handlers for the bot
 func (c *botConfig) WithGlobalHandlers(handlers []handlers.CommandHandler) *botConfig {
 	c.dispatcherConfig.GlobalHandlers = handlers
@@ -163,40 +405,72 @@ func (c *botConfig) WithGlobalKeyboardFunc(globalKeyboardFunc dispatcher.GlobalK
 	return c
 }
 
-const letterBytes = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
-
-func randStringBytes(n int) string {
-	b := make([]byte, n)
-	for i := range b {
-		b[i] = letterBytes[rand.Intn(len(letterBytes))]
+// allowedUpdates returns list of update kinds the bot should receive, nil for the Telegram default.
+// Telegram does not send reactions unless they are requested explicitly
+func (c *botConfig) allowedUpdates() []string {
+	if c.dispatcherConfig.MessageReactions.Policy == dispatcher.IgnoreUpdate {
+		return nil
 	}
-	return string(b)
+	return []string{"message", "edited_message", "channel_post", "edited_channel_post",
+		"inline_query", "chosen_inline_result", "callback_query", "my_chat_member", "message_reaction"}
 }
 
 // Run starts the bot and handlers conversations with uers and job runs in an infinite loop
 // The function returns error if the bot cannot be started
 // To stop the bot, cancel the context
 func (config *botConfig) Run(ctx context.Context) error {
-	bot, err := tgbotapi.NewBotAPI(config.apiToken)
-	if err != nil {
-		return fmt.Errorf("error accessing the bot: %v", err)
+	var self tgbotapi.User
+	var err error
+	if config.adminServer != nil && config.adminAddr != "" {
+		adminCtx, stopAdmin := context.WithCancel(context.WithoutCancel(ctx)) // probes and admin endpoints work until the conversations are stopped
+		defer stopAdmin()
+		serveHTTP(adminCtx, "admin", &http.Server{Addr: config.adminAddr, Handler: config.adminServer}, "", "")
+	}
+	bot := config.client
+	if bot == nil {
+		var client tgbotapi.HTTPClient = &http.Client{}
+		if config.metrics != nil {
+			client = metrics.NewHTTPClient(client, config.metrics)
+		}
+		api, err := tgbotapi.NewBotAPIWithClient(config.apiToken, config.apiEndpoint, client) // validates the token with getMe
+		if err != nil {
+			return fmt.Errorf("error accessing the bot: %v", err)
+		}
+		api.Debug = config.debug
+		bot, self = api, api.Self
+		if config.fileEndpoint != tgbotapi.FileEndpoint {
+			bot = fileEndpointClient{BotAPI: api, endpoint: config.fileEndpoint}
+		}
+	} else {
+		if api, ok := bot.(*tgbotapi.BotAPI); ok && config.debug {
+			api.Debug = true
+		} else if config.debug {
+			logger.Warning("cannot turn on the debug mode of the client %T", bot)
+		}
+		if self, err = bot.GetMe(); err != nil {
+			return fmt.Errorf("error accessing the bot: %v", err)
+		}
 	}
-	bot.Debug = config.debug
-	logger.Note("Authorized on account %s", bot.Self.UserName)
+	logger.Note("Authorized on account %s", self.UserName)
 
-	var upd tgbotapi.UpdatesChannel
+	var upd updatesChannel
 	if config.webHook {
-		salt := randStringBytes(10)
+		pathSecret, err := newSecret()
+		if err != nil {
+			return fmt.Errorf("error creating webhook path: %v", err)
+		}
+		webHookPath := "/" + pathSecret
 		var wh tgbotapi.WebhookConfig
 		if config.certFile == "" {
-			wh, err = tgbotapi.NewWebhook(config.webHookExternalURL + "/" + bot.Token + salt)
+			wh, err = tgbotapi.NewWebhook(config.webHookExternalURL + webHookPath)
 		} else {
-			wh, err = tgbotapi.NewWebhookWithCert(config.webHookExternalURL+"/"+bot.Token+salt, tgbotapi.FilePath(config.certFile))
+			wh, err = tgbotapi.NewWebhookWithCert(config.webHookExternalURL+webHookPath, tgbotapi.FilePath(config.certFile))
 		}
 		if err != nil {
 			return fmt.Errorf("error creating webhook config: %v", err)
 		}
-		_, err = bot.Request(wh)
+		wh.AllowedUpdates = config.allowedUpdates()
+		secretToken, err := setWebhook(bot, wh)
 		if err != nil {
 			return fmt.Errorf("error setting web-hook: %v", err)
 		}
@@ -208,12 +482,8 @@ func (config *botConfig) Run(ctx context.Context) error {
 			logger.Warning("[Telegram callback failed]%s", info.LastErrorMessage)
 		}
 
-		upd = bot.ListenForWebhook("/" + bot.Token + salt)
-		if config.certFile == "" {
-			go http.ListenAndServe(config.webHookInternalURL, nil)
-		} else {
-			go http.ListenAndServeTLS(config.webHookInternalURL, config.certFile, config.keyFile, nil)
-		}
+		upd = listenForWebhook(ctx, webHookPath, secretToken)
+		serveHTTP(ctx, "webhook", &http.Server{Addr: config.webHookInternalURL}, config.certFile, config.keyFile)
 	} else {
 		_, err = bot.Request(tgbotapi.DeleteWebhookConfig{DropPendingUpdates: true})
 		if err != nil {
@@ -221,22 +491,65 @@ func (config *botConfig) Run(ctx context.Context) error {
 		}
 		var ucfg tgbotapi.UpdateConfig = tgbotapi.NewUpdate(0)
 		ucfg.Timeout = config.updateTimeout
-		upd = bot.GetUpdatesChan(ucfg)
+		ucfg.AllowedUpdates = config.allowedUpdates()
+		upd = pollUpdates(ctx, bot, ucfg)
+	}
+	sender := dispatcher.NewThreadBot(bot) // sends messages to forum topics with message_thread_id
+	if config.rateLimit != nil {
+		sender = ratelimit.NewLimiter(sender, *config.rateLimit)
+	}
+	if config.retryPolicy != nil {
+		sender = retry.NewRetrier(sender, *config.retryPolicy) // each attempt passes through the rate limiter
 	}
-	disp, err := dispatcher.NewDispatcher(ctx, config.dispatcherConfig, bot, config.stateIO)
+	disp, err := dispatcher.NewDispatcher(ctx, config.dispatcherConfig, sender, config.stateIO)
 	if err != nil {
 		return err
 	}
-	jobs.RunJobs(ctx, config.botJobs, disp)
+	jobsCtx := context.WithValue(ctx, handlers.ChatRegistryVariable, disp.ChatRegistry())
+	if config.scheduler != nil {
+		jobsCtx = context.WithValue(jobsCtx, handlers.SchedulerVariable, config.scheduler)
+		go config.scheduler.Run(jobsCtx, disp)
+	}
+	if config.metrics != nil {
+		config.jobRunner.SetMetrics(config.metrics)
+	}
+	config.jobRunner.Start(jobsCtx, disp)
+	if config.adminServer != nil {
+		config.adminServer.SetDispatcher(disp)
+		if handler, ok := config.metrics.(http.Handler); ok {
+			config.adminServer.SetMetrics(handler)
+		}
+		config.adminServer.SetReady(true) // the state is loaded and the bot is authorized
+		defer config.adminServer.SetReady(false)
+		go func() {
+			<-ctx.Done()
+			config.adminServer.SetReady(false)
+		}()
+	}
+	var tracer tracing.Tracer = tracing.NopTracer{}
+	if config.dispatcherConfig.Tracer != nil {
+		tracer = config.dispatcherConfig.Tracer
+	}
 	for {
 		select {
-		case update := <-upd:
-			if update.Message != nil && update.Message.From.IsBot && !config.allowBotUsers {
+		case update, ok := <-upd:
+			if !ok {
+				logger.Note("updates channel is closed, exiting")
+				if ctx.Err() != nil {
+					<-disp.Done() // polling stops together with the context
+				}
+				return nil
+			}
+			if update.Message != nil && update.Message.From != nil && update.Message.From.IsBot && !config.allowBotUsers {
 				continue // skip message from another bot
 			}
-			disp.DispatchUpdate(&update)
+			_, span := tracer.Start(ctx, tracing.SpanReceive, tracing.Attr("update_id", update.UpdateID))
+			update.Span = span
+			disp.DispatchIncomingUpdate(&update)
+			span.End()
 		case <-ctx.Done():
-			logger.Note("context is closed, exiting")
+			logger.Note("context is closed, waiting for conversations to stop")
+			<-disp.Done()
 			return nil
 		}
 	}
@@ -0,0 +1,152 @@
+package bot
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/ufy-it/go-telegram-bot/conversation"
+	"github.com/ufy-it/go-telegram-bot/logger"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// serverShutdownTimeout is the time for requests to the webhook and admin servers to complete when the bot is stopping
+const serverShutdownTimeout = 5 * time.Second
+
+// updatesChannel is a channel of updates decoded with the fields that tgbotapi does not support
+type updatesChannel <-chan conversation.IncomingUpdate
+
+// pollUpdates starts long-polling of updates from the Bot API until the context is closed
+func pollUpdates(ctx context.Context, bot Client, config tgbotapi.UpdateConfig) updatesChannel {
+	ch := make(chan conversation.IncomingUpdate)
+	go func() {
+		defer close(ch)
+		for {
+			resp, err := bot.Request(config)
+			var updates []conversation.IncomingUpdate
+			if err == nil {
+				err = json.Unmarshal(resp.Result, &updates)
+			}
+			if err != nil {
+				logger.Error("cannot get updates: %v, retrying in 3 seconds", err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(3 * time.Second):
+				}
+				continue
+			}
+			for _, update := range updates {
+				if update.UpdateID >= config.Offset {
+					config.Offset = update.UpdateID + 1
+				}
+				select {
+				case ch <- update:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+		}
+	}()
+	return ch
+}
+
+// secretTokenHeader is the header with the secret token in requests from Telegram to the webhook
+const secretTokenHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+// newSecret returns a random string for the path and the secret token of the webhook
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// setWebhook sets the webhook with a new secret token that Telegram sends in every request to the webhook, and returns the token.
+// tgbotapi v5.5.1 cannot send secret_token, so the webhook is set with a raw call. A client that cannot make raw calls
+// sets the webhook without the token, then the returned token is empty and only the secret path protects the webhook
+func setWebhook(bot Client, wh tgbotapi.WebhookConfig) (string, error) {
+	raw, ok := bot.(conversation.RawBot)
+	if !ok {
+		logger.Warning("the client %T cannot make raw calls, the webhook is set without a secret token", bot)
+		_, err := bot.Request(wh)
+		return "", err
+	}
+	secret, err := newSecret()
+	if err != nil {
+		return "", err
+	}
+	params := make(tgbotapi.Params)
+	params["url"] = wh.URL.String()
+	params["secret_token"] = secret
+	if err = params.AddInterface("allowed_updates", wh.AllowedUpdates); err != nil {
+		return "", err
+	}
+	var files []tgbotapi.RequestFile
+	if wh.Certificate != nil {
+		files = append(files, tgbotapi.RequestFile{Name: "certificate", Data: wh.Certificate})
+	}
+	if _, err = raw.UploadFiles("setWebhook", params, files); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// listenForWebhook registers an http handler for a webhook and returns channel of updates received by it.
+// Requests without the secret token are rejected, unless the token is empty.
+// An update is confirmed to Telegram when it is taken from the channel, after the context is closed
+// updates are rejected, so that Telegram delivers them again after a restart
+func listenForWebhook(ctx context.Context, pattern, secretToken string) updatesChannel {
+	ch := make(chan conversation.IncomingUpdate)
+	http.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		if secretToken != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(secretTokenHeader)), []byte(secretToken)) != 1 {
+			http.Error(w, "wrong secret token", http.StatusForbidden)
+			return
+		}
+		var update conversation.IncomingUpdate
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		select {
+		case ch <- update:
+		case <-ctx.Done():
+			http.Error(w, "the bot is stopping", http.StatusServiceUnavailable)
+		}
+	})
+	return ch
+}
+
+// serveHTTP runs the http server (the webhook or the admin server) until the context is closed
+func serveHTTP(ctx context.Context, name string, server *http.Server, certFile, keyFile string) {
+	go func() {
+		var err error
+		if certFile == "" {
+			err = server.ListenAndServe()
+		} else {
+			err = server.ListenAndServeTLS(certFile, keyFile)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			logger.Error("%s server failed: %v", name, err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger.Error("cannot stop %s server: %v", name, err)
+		}
+	}()
+}
@@ -0,0 +1,41 @@
+// Package botapi describes the Telegram Bot API client used by the bot. It depends on nothing but tgbotapi,
+// so wrappers of the client (e.g. ratelimit and retry) can use it without depending on the dispatcher
+package botapi
+
+import (
+	"context"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Bot is an interface for a Telegram Bot API client.
+// *tgbotapi.BotAPI implements it, as well as any wrapper that adds retries, metrics, etc.
+type Bot interface {
+	Send(c tgbotapi.Chattable) (tgbotapi.Message, error)
+	GetFile(file tgbotapi.FileConfig) (tgbotapi.File, error)
+	GetFileDirectURL(fileID string) (string, error)
+	Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) // for methods that do not return a message, e.g. answers to inline queries
+}
+
+// ContextBot is a Bot that stops waiting for a call (e.g. a call delayed by ratelimit.Limiter or repeated by retry.Retrier) when the context is closed
+type ContextBot interface {
+	Bot
+	SendContext(ctx context.Context, c tgbotapi.Chattable) (tgbotapi.Message, error)
+	RequestContext(ctx context.Context, c tgbotapi.Chattable) (*tgbotapi.APIResponse, error)
+}
+
+// SendWithContext sends the message through the bot, a ContextBot stops waiting for the call when the context is closed
+func SendWithContext(ctx context.Context, bot Bot, c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	if b, ok := bot.(ContextBot); ok {
+		return b.SendContext(ctx, c)
+	}
+	return bot.Send(c)
+}
+
+// RequestWithContext makes the call through the bot, a ContextBot stops waiting for the call when the context is closed
+func RequestWithContext(ctx context.Context, bot Bot, c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	if b, ok := bot.(ContextBot); ok {
+		return b.RequestContext(ctx, c)
+	}
+	return bot.Request(c)
+}
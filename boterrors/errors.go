@@ -0,0 +1,84 @@
+// Package boterrors defines errors that the framework returns, so that callers can check them with errors.Is and errors.As
+package boterrors
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+var (
+	ErrConversationCanceled  = errors.New("conversation is canceled")     // the conversation was closed and cannot send messages anymore
+	ErrQueueFull             = errors.New("too many unprocessed updates") // the queue of a conversation or of the bot is full, the update is dropped
+	ErrBotBlockedByUser      = errors.New("bot was blocked by the user")  // the user blocked the bot, messages to them will fail until they unblock it
+	ErrChatNotFound          = errors.New("chat not found")               // the chat does not exist or the bot is not a member of it
+	ErrMessageNotModified    = errors.New("message is not modified")      // an edit did not change the message
+	ErrMessageToEditNotFound = errors.New("message to edit not found")    // the message was deleted or the ID is wrong
+	ErrChatInactive          = errors.New("chat is inactive")             // the bot does not send messages to the chat, as the user blocked it or the bot was removed from the chat
+	ErrTooManyRequests       = errors.New("too many requests")            // Telegram flood limit, APIError.RetryAfter tells how long to wait
+)
+
+// APIError is an error returned by the Bot API. errors.Is matches it with one of the sentinel errors by its kind
+type APIError struct {
+	Code        int    // HTTP status code returned by the Bot API
+	Description string // description of the error returned by the Bot API
+	RetryAfter  int    // seconds to wait before repeating the call, set for ErrTooManyRequests
+	Kind        error  // one of the sentinel errors of the package, nil for other errors
+
+	cause *tgbotapi.Error
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("telegram api error %d: %s", e.Code, e.Description)
+}
+
+// Is reports whether the error is of the kind of target
+func (e *APIError) Is(target error) bool {
+	return e.Kind != nil && target == e.Kind
+}
+
+// Unwrap returns the original tgbotapi error
+func (e *APIError) Unwrap() error {
+	return e.cause
+}
+
+// apiErrorKinds maps fragments of the Bot API error descriptions to kinds of errors
+var apiErrorKinds = []struct {
+	code     int
+	fragment string
+	kind     error
+}{
+	{http.StatusForbidden, "bot was blocked by the user", ErrBotBlockedByUser},
+	{http.StatusBadRequest, "chat not found", ErrChatNotFound},
+	{http.StatusBadRequest, "message is not modified", ErrMessageNotModified},
+	{http.StatusBadRequest, "message to edit not found", ErrMessageToEditNotFound},
+}
+
+// FromAPI converts an error from tgbotapi to *APIError, other errors are returned unchanged
+func FromAPI(err error) error {
+	var tgErr *tgbotapi.Error
+	if err == nil || !errors.As(err, &tgErr) {
+		return err
+	}
+	result := &APIError{
+		Code:        tgErr.Code,
+		Description: tgErr.Message,
+		RetryAfter:  tgErr.RetryAfter,
+		cause:       tgErr,
+	}
+	if tgErr.Code == http.StatusTooManyRequests {
+		result.Kind = ErrTooManyRequests
+		return result
+	}
+	description := strings.ToLower(tgErr.Message)
+	for _, kind := range apiErrorKinds {
+		if tgErr.Code == kind.code && strings.Contains(description, kind.fragment) {
+			result.Kind = kind.kind
+			break
+		}
+	}
+	return result
+}
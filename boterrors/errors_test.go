@@ -0,0 +1,51 @@
+package boterrors_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/ufy-it/go-telegram-bot/boterrors"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestFromAPI(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		kind error
+	}{
+		{&tgbotapi.Error{Code: 403, Message: "Forbidden: bot was blocked by the user"}, boterrors.ErrBotBlockedByUser},
+		{&tgbotapi.Error{Code: 400, Message: "Bad Request: chat not found"}, boterrors.ErrChatNotFound},
+		{&tgbotapi.Error{Code: 400, Message: "Bad Request: message is not modified: specified new message content and reply markup are exactly the same"}, boterrors.ErrMessageNotModified},
+		{&tgbotapi.Error{Code: 400, Message: "Bad Request: message to edit not found"}, boterrors.ErrMessageToEditNotFound},
+		{&tgbotapi.Error{Code: 429, Message: "Too Many Requests: retry after 5", ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 5}}, boterrors.ErrTooManyRequests},
+		{&tgbotapi.Error{Code: 400, Message: "Bad Request: message text is empty"}, nil},
+	} {
+		err := fmt.Errorf("wrapped: %w", boterrors.FromAPI(test.err))
+		var apiErr *boterrors.APIError
+		if !errors.As(err, &apiErr) {
+			t.Fatalf("expected *APIError for %v, got %T", test.err, err)
+		}
+		if apiErr.Kind != test.kind || test.kind != nil && !errors.Is(err, test.kind) {
+			t.Errorf("unexpected kind of %v: %v", test.err, apiErr.Kind)
+		}
+		if !errors.Is(err, test.err) {
+			t.Errorf("expected %v to wrap the original error", err)
+		}
+	}
+
+	err := boterrors.FromAPI(&tgbotapi.Error{Code: 429, ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 5}})
+	var apiErr *boterrors.APIError
+	if !errors.As(err, &apiErr) || apiErr.RetryAfter != 5 {
+		t.Errorf("expected RetryAfter 5, got %v", err)
+	}
+	if errors.Is(err, boterrors.ErrBotBlockedByUser) {
+		t.Errorf("flood error should not match other kinds")
+	}
+
+	other := errors.New("network error")
+	if boterrors.FromAPI(other) != other || boterrors.FromAPI(nil) != nil {
+		t.Errorf("errors that are not from the Bot API should not be changed")
+	}
+}
@@ -0,0 +1,434 @@
+package bottest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ufy-it/go-telegram-bot/conversation"
+	"github.com/ufy-it/go-telegram-bot/handlers"
+	"github.com/ufy-it/go-telegram-bot/state"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// ScriptChatID is the ID of the private chat where scripts are played
+const ScriptChatID int64 = 42
+
+// Step is a single step of a conversation script: an action of the user or an expectation about the bot reply
+type Step struct {
+	description  string
+	canStartWith bool // the step can be the first step of a script
+	run          func(d *scriptDriver) error
+}
+
+// String returns human-readable description of the step
+func (s Step) String() string {
+	return s.description
+}
+
+// UserSends is a step where the user sends a text message. The first step of a script should be UserSends,
+// its message becomes the first update of the conversation
+func UserSends(text string) Step {
+	return Step{
+		description:  fmt.Sprintf("user sends %q", text),
+		canStartWith: true,
+		run: func(d *scriptDriver) error {
+			return d.push(NewTextUpdate(ScriptChatID, text))
+		},
+	}
+}
+
+// UserPresses is a step where the user presses an inline button with the text.
+// The button is searched in the latest message of the bot that has such button
+func UserPresses(buttonText string) Step {
+	return Step{
+		description: fmt.Sprintf("user presses %q", buttonText),
+		run: func(d *scriptDriver) error {
+			for id := d.server.lastMessageID(); id > 0; id-- {
+				message, ok := d.server.Message(ScriptChatID, id)
+				if !ok {
+					continue
+				}
+				if data, err := findButtonData(message.ReplyMarkup, buttonText); err == nil {
+					return d.push(NewCallbackUpdate(NewUser(ScriptChatID), message, data))
+				}
+			}
+			return fmt.Errorf("no message with button %q, visible buttons: %s", buttonText, d.visibleButtons())
+		},
+	}
+}
+
+// ExpectText is a step that expects the bot to send a message with text matching the regular expression.
+// If buttons are listed, the message should have exactly these inline buttons (row by row, left to right)
+func ExpectText(pattern string, buttons ...string) Step {
+	re := regexp.MustCompile(pattern)
+	want := describeMessage("send", 0, fmt.Sprintf("~%q", pattern), buttons)
+	return Step{
+		description: "expect " + want,
+		run: func(d *scriptDriver) error {
+			event, err := d.next()
+			if err != nil {
+				return err
+			}
+			if !event.isSend() || !re.MatchString(event.text) || (buttons != nil && !sameButtons(buttons, event.buttons)) {
+				return diffError(want, event.String())
+			}
+			return nil
+		},
+	}
+}
+
+// ExpectEdit is a step that expects the bot to edit text of the message with messageID.
+// Messages sent by the bot in a script are numbered from 1. Buttons are checked the same way as in ExpectText
+func ExpectEdit(messageID int, pattern string, buttons ...string) Step {
+	re := regexp.MustCompile(pattern)
+	want := describeMessage("edit", messageID, fmt.Sprintf("~%q", pattern), buttons)
+	return Step{
+		description: "expect " + want,
+		run: func(d *scriptDriver) error {
+			event, err := d.next()
+			if err != nil {
+				return err
+			}
+			if event.method != "editMessageText" || event.messageID != messageID || !re.MatchString(event.text) ||
+				(buttons != nil && !sameButtons(buttons, event.buttons)) {
+				return diffError(want, event.String())
+			}
+			return nil
+		},
+	}
+}
+
+// ExpectButtons is a step that expects the bot to replace inline buttons of the message with messageID
+func ExpectButtons(messageID int, buttons ...string) Step {
+	want := describeMessage("edit buttons of", messageID, "", buttons)
+	return Step{
+		description: "expect " + want,
+		run: func(d *scriptDriver) error {
+			event, err := d.next()
+			if err != nil {
+				return err
+			}
+			if event.method != "editMessageReplyMarkup" || event.messageID != messageID || !sameButtons(buttons, event.buttons) {
+				return diffError(want, event.String())
+			}
+			return nil
+		},
+	}
+}
+
+// ExpectDelete is a step that expects the bot to delete the message with messageID
+func ExpectDelete(messageID int) Step {
+	want := describeMessage("delete", messageID, "", nil)
+	return Step{
+		description: "expect " + want,
+		run: func(d *scriptDriver) error {
+			event, err := d.next()
+			if err != nil {
+				return err
+			}
+			if event.method != "deleteMessage" || event.messageID != messageID {
+				return diffError(want, event.String())
+			}
+			return nil
+		},
+	}
+}
+
+// ExpectEnd is a step that expects the handler to finish without error and without sending anything else
+func ExpectEnd() Step {
+	return Step{
+		description: "expect the conversation to end",
+		run: func(d *scriptDriver) error {
+			if event, err := d.next(); err == nil {
+				return diffError("end of the conversation", event.String())
+			}
+			if !d.finished {
+				return diffError("end of the conversation", "handler waits for the user input")
+			}
+			if d.err != nil {
+				return diffError("end of the conversation", fmt.Sprintf("handler error: %v", d.err))
+			}
+			return nil
+		},
+	}
+}
+
+// ExpectError is a step that expects the handler to finish with an error matching the regular expression
+func ExpectError(pattern string) Step {
+	re := regexp.MustCompile(pattern)
+	want := fmt.Sprintf("handler error ~%q", pattern)
+	return Step{
+		description: "expect " + want,
+		run: func(d *scriptDriver) error {
+			if !d.finished {
+				return diffError(want, "handler waits for the user input")
+			}
+			if d.err == nil || !re.MatchString(d.err.Error()) {
+				return diffError(want, fmt.Sprintf("handler error: %v", d.err))
+			}
+			return nil
+		},
+	}
+}
+
+// RunScript plays the steps against a handler created by the creator and returns
+// an error that describes the first divergence between the script and the actual dialog
+func RunScript(creator handlers.HandlerCreatorType, steps ...Step) error {
+	if len(steps) == 0 {
+		return errors.New("script is empty")
+	}
+	d, err := newScriptDriver(creator)
+	if err != nil {
+		return err
+	}
+	defer d.close()
+	for idx, step := range steps {
+		if idx == 0 && !step.canStartWith {
+			return errors.New("script should start with UserSends step")
+		}
+		d.transcript = append(d.transcript, fmt.Sprintf("%3d. %s", idx+1, step.description))
+		if err := step.run(d); err != nil {
+			return fmt.Errorf("script diverged at step %d (%s):\n%v\ntranscript:\n%s",
+				idx+1, step.description, err, strings.Join(d.transcript, "\n"))
+		}
+	}
+	return nil
+}
+
+// AssertScript plays the steps against a handler and fails the test on the first divergence
+func AssertScript(t testing.TB, creator handlers.HandlerCreatorType, steps ...Step) {
+	t.Helper()
+	if err := RunScript(creator, steps...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// scriptConversation notifies the driver each time the handler waits for the user input
+type scriptConversation struct {
+	*conversation.BotConversation
+	waiting chan struct{}
+}
+
+func (c *scriptConversation) GetUpdateFromUser(ctx context.Context) (*tgbotapi.Update, bool) {
+	select {
+	case c.waiting <- struct{}{}:
+	case <-ctx.Done():
+	}
+	return c.BotConversation.GetUpdateFromUser(ctx)
+}
+
+// scriptEvent is a call of the Bot API that is visible to the user
+type scriptEvent struct {
+	method    string
+	messageID int
+	text      string
+	buttons   []string
+}
+
+func (e scriptEvent) isSend() bool {
+	return strings.HasPrefix(e.method, "send")
+}
+
+func (e scriptEvent) String() string {
+	switch {
+	case e.isSend():
+		return describeMessage("send", 0, fmt.Sprintf("%q", e.text), e.buttons) + fmt.Sprintf(" (message %d)", e.messageID)
+	case e.method == "editMessageText":
+		return describeMessage("edit", e.messageID, fmt.Sprintf("%q", e.text), e.buttons)
+	case e.method == "editMessageReplyMarkup":
+		return describeMessage("edit buttons of", e.messageID, "", e.buttons)
+	}
+	return describeMessage("delete", e.messageID, "", nil)
+}
+
+// scriptDriver runs a handler in a goroutine and synchronizes it with the script steps
+type scriptDriver struct {
+	server       *Server
+	creator      handlers.HandlerCreatorType
+	conversation *scriptConversation
+	botState     state.BotState
+	ctx          context.Context
+	cancel       context.CancelFunc
+	done         chan error
+	started      bool
+	finished     bool
+	err          error
+	cursor       int      // index of the first server request that was not matched by the script
+	transcript   []string // steps and bot actions so far
+}
+
+func newScriptDriver(creator handlers.HandlerCreatorType) (*scriptDriver, error) {
+	server := NewServer()
+	bot, err := tgbotapi.NewBotAPIWithAPIEndpoint("script", server.APIEndpoint())
+	if err != nil {
+		server.Close()
+		return nil, err
+	}
+	botState := state.NewBotState(state.NewMemoryState())
+	noMessage := func() error { return nil }
+	conv, err := conversation.NewConversation(ScriptChatID, bot, botState, noMessage, noMessage, noMessage,
+		func() interface{} { return nil },
+		conversation.Config{MaxMessageQueue: 1, TimeoutMinutes: 1})
+	if err != nil {
+		server.Close()
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &scriptDriver{
+		server:       server,
+		creator:      creator,
+		conversation: &scriptConversation{BotConversation: conv, waiting: make(chan struct{})},
+		botState:     botState,
+		ctx:          ctx,
+		cancel:       cancel,
+		done:         make(chan error, 1),
+		transcript:   make([]string, 0),
+	}, nil
+}
+
+func (d *scriptDriver) close() {
+	d.cancel()
+	if d.started && !d.finished {
+		<-d.done
+	}
+	d.server.Close()
+}
+
+// push delivers an update to the handler (starts the handler on the first update) and waits until the handler
+// asks for the next input or finishes
+func (d *scriptDriver) push(update tgbotapi.Update) error {
+	if d.finished {
+		return errors.New("the handler has already finished")
+	}
+	if err := d.expectNoEvents(); err != nil {
+		return err
+	}
+	if !d.started {
+		d.started = true
+		convID := d.conversation.ConversationID()
+		if err := d.botState.StartConversationWithUpdate(convID, ScriptChatID, &update); err != nil {
+			return err
+		}
+		handler := d.creator(context.WithValue(d.ctx, handlers.FirstUpdateVariable, &update), d.conversation)
+		go func() {
+			d.done <- handler.Execute(convID, d.botState)
+		}()
+	} else if err := d.conversation.PushUpdate(&update); err != nil {
+		return err
+	}
+	select {
+	case <-d.conversation.waiting:
+	case d.err = <-d.done:
+		d.finished = true
+	case <-d.ctx.Done():
+	case <-time.After(DefaultTimeout):
+		return fmt.Errorf("the handler neither asked for input nor finished in %v", DefaultTimeout)
+	}
+	return nil
+}
+
+// next returns the next visible action of the bot. Removals of inline buttons are skipped,
+// and buttons attached right after sending a message are reported as a part of the sent message
+func (d *scriptDriver) next() (scriptEvent, error) {
+	requests := d.server.Requests()
+	for d.cursor < len(requests) {
+		request := requests[d.cursor]
+		d.cursor++
+		event := scriptEvent{
+			method:    request.Method,
+			messageID: request.MessageID,
+			text:      request.Text(),
+			buttons:   flattenButtons(request.InlineKeyboard()),
+		}
+		switch {
+		case event.isSend():
+			for d.cursor < len(requests) && requests[d.cursor].Method == "editMessageReplyMarkup" &&
+				requests[d.cursor].MessageID == event.messageID {
+				event.buttons = flattenButtons(requests[d.cursor].InlineKeyboard())
+				d.cursor++
+			}
+		case event.method == "editMessageReplyMarkup" && len(event.buttons) == 0:
+			continue
+		case event.method != "editMessageText" && event.method != "editMessageReplyMarkup" && event.method != "deleteMessage":
+			continue
+		}
+		d.transcript = append(d.transcript, "       bot: "+event.String())
+		return event, nil
+	}
+	return scriptEvent{}, errors.New("no more bot actions")
+}
+
+// expectNoEvents checks that the script matched all actions of the bot before the next user action
+func (d *scriptDriver) expectNoEvents() error {
+	if event, err := d.next(); err == nil {
+		return diffError("no more bot actions before the user action", event.String())
+	}
+	return nil
+}
+
+// visibleButtons lists buttons of all messages in the chat
+func (d *scriptDriver) visibleButtons() string {
+	result := make([]string, 0)
+	for id := 1; id <= d.server.lastMessageID(); id++ {
+		if message, ok := d.server.Message(ScriptChatID, id); ok && message.ReplyMarkup != nil {
+			result = append(result, fmt.Sprintf("message %d %v", id, flattenButtons(message.ReplyMarkup.InlineKeyboard)))
+		}
+	}
+	if len(result) == 0 {
+		return "none"
+	}
+	return strings.Join(result, ", ")
+}
+
+// lastMessageID returns ID of the latest message sent by the bot
+func (s *Server) lastMessageID() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nextMessageID - 1
+}
+
+func flattenButtons(keyboard [][]tgbotapi.InlineKeyboardButton) []string {
+	result := make([]string, 0)
+	for _, row := range keyboard {
+		for _, button := range row {
+			result = append(result, button.Text)
+		}
+	}
+	return result
+}
+
+func sameButtons(want, got []string) bool {
+	if len(want) != len(got) {
+		return false
+	}
+	for i := range want {
+		if want[i] != got[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func describeMessage(action string, messageID int, text string, buttons []string) string {
+	result := action
+	if messageID != 0 {
+		result += fmt.Sprintf(" message %d", messageID)
+	}
+	if text != "" {
+		result += " text " + text
+	}
+	if buttons != nil {
+		result += fmt.Sprintf(" with buttons %v", buttons)
+	}
+	return result
+}
+
+func diffError(want, got string) error {
+	return fmt.Errorf("- want: %s\n+ got:  %s", want, got)
+}
@@ -0,0 +1,93 @@
+package bottest_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/ufy-it/go-telegram-bot/bottest"
+	"github.com/ufy-it/go-telegram-bot/handlers"
+	"github.com/ufy-it/go-telegram-bot/handlers/buttons"
+	"github.com/ufy-it/go-telegram-bot/handlers/readers"
+)
+
+func namePollHandler(ctx context.Context, conversation readers.BotConversation) handlers.Handler {
+	var data struct {
+		Name string
+	}
+	return handlers.NewStatefulHandler(&data, []handlers.ConversationStep{
+		{
+			Action: func() (handlers.StepResult, error) {
+				reply, err := readers.AskTextMessageReplyWithValidation(ctx, conversation, "What is your name?",
+					buttons.NewSingleRowButtonSet(buttons.NewAbortButton("Abort")),
+					func(text string) bool { return text != "" }, "Name cannot be empty")
+				if err != nil || reply.Exit || reply.Data == buttons.NavigationAbort {
+					return handlers.ActionResultError(err)
+				}
+				data.Name = reply.Text
+				return handlers.NextStep()
+			},
+		},
+		{
+			Action: func() (handlers.StepResult, error) {
+				msgID, err := conversation.SendTextf("Hello, %s", data.Name)
+				if err != nil {
+					return handlers.ActionResultError(err)
+				}
+				return handlers.ActionResultWithError(handlers.EndConversation, conversation.EditMessageText(msgID, "Bye, "+data.Name))
+			},
+		},
+	})
+}
+
+func TestScript(t *testing.T) {
+	bottest.AssertScript(t, namePollHandler,
+		bottest.UserSends("/start"),
+		bottest.ExpectText("name", "Abort"),
+		bottest.UserSends("Bob"),
+		bottest.ExpectText("^Hello, Bob$"),
+		bottest.ExpectEdit(2, "Bye"),
+		bottest.ExpectEnd(),
+	)
+	bottest.AssertScript(t, namePollHandler,
+		bottest.UserSends("/start"),
+		bottest.ExpectText("name"),
+		bottest.UserPresses("Abort"),
+		bottest.ExpectEnd(),
+	)
+}
+
+func TestScriptDivergence(t *testing.T) {
+	err := bottest.RunScript(namePollHandler,
+		bottest.UserSends("/start"),
+		bottest.ExpectText("name", "Abort", "Back"),
+	)
+	if err == nil {
+		t.Fatal("expected divergence")
+	}
+	for _, part := range []string{
+		"script diverged at step 2",
+		`- want: send text ~"name" with buttons [Abort Back]`,
+		`+ got:  send text "What is your name?" with buttons [Abort] (message 1)`,
+	} {
+		if !strings.Contains(err.Error(), part) {
+			t.Errorf("expected '%s' in the error:\n%v", part, err)
+		}
+	}
+
+	err = bottest.RunScript(namePollHandler,
+		bottest.UserSends("/start"),
+		bottest.UserPresses("Back"),
+	)
+	if err == nil || !strings.Contains(err.Error(), "visible buttons: message 1 [Abort]") {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	err = bottest.RunScript(namePollHandler,
+		bottest.UserSends("/start"),
+		bottest.UserSends("Bob"),
+	)
+	if err == nil || !strings.Contains(err.Error(), "- want: no more bot actions before the user action") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
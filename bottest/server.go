@@ -0,0 +1,544 @@
+// Package bottest provides an in-process fake of the Telegram Bot API,
+// so that a bot built with the framework can be tested end-to-end without a token and network
+package bottest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ufy-it/go-telegram-bot/conversation"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// DefaultTimeout is the time that Wait* methods of the Server wait for a request from the bot
+const DefaultTimeout = 5 * time.Second
+
+// shortPollInterval is the time getUpdates waits for new updates if the bot did not set a timeout
+const shortPollInterval = 100 * time.Millisecond
+
+// Request is a record about a single call of the Bot API made by the bot
+type Request struct {
+	Method    string            // name of the Bot API method, e.g. "sendMessage"
+	Params    map[string]string // parameters of the call
+	Files     map[string][]byte // files uploaded with the call, by parameter name
+	MessageID int               // ID of the message created or changed by the call (0 if there is no such message)
+}
+
+// ChatID returns chat_id parameter of the request
+func (r Request) ChatID() int64 {
+	id, _ := strconv.ParseInt(r.Params["chat_id"], 10, 64)
+	return id
+}
+
+// ThreadID returns message_thread_id parameter of the request, 0 for messages outside of forum topics
+func (r Request) ThreadID() int {
+	id, _ := strconv.Atoi(r.Params["message_thread_id"])
+	return id
+}
+
+// Text returns text of the message (or caption of a media message) sent with the request
+func (r Request) Text() string {
+	if text, ok := r.Params["text"]; ok {
+		return text
+	}
+	return r.Params["caption"]
+}
+
+// InlineKeyboard returns inline keyboard attached to the request, or nil if there is no inline keyboard
+func (r Request) InlineKeyboard() [][]tgbotapi.InlineKeyboardButton {
+	markup := parseInlineKeyboard(r.Params["reply_markup"])
+	if markup == nil {
+		return nil
+	}
+	return markup.InlineKeyboard
+}
+
+// Server is a fake of the Telegram Bot API that runs in the same process.
+// It keeps the messages sent by the bot, so that a test can inspect them and press inline buttons
+type Server struct {
+	server *httptest.Server
+
+	mu sync.Mutex // protects all fields below
+
+	self          tgbotapi.User
+	updates       []conversation.IncomingUpdate       // updates that have not been confirmed by the bot yet
+	nextUpdateID  int                                 // ID for the next injected update
+	nextMessageID int                                 // ID for the next message sent by the bot
+	messages      map[int64]map[int]*tgbotapi.Message // current state of messages sent by the bot, by chat and message ID
+	files         map[string][]byte                   // content of files by file ID, for downloads from the file endpoint
+	requests      []Request                           // log of all requests except getMe and getUpdates
+	cursor        int                                 // index of the first request that was not consumed by Wait* methods
+	webhookURL    string                              // url set by setWebhook
+	webhookSecret string                              // secret_token set by setWebhook
+	changed       chan struct{}                       // closed and replaced on every change of updates or requests
+	closed        chan struct{}                       // closed when the server is shutting down
+	closeOnce     sync.Once
+}
+
+// NewServer starts a new fake Bot API server
+func NewServer() *Server {
+	s := &Server{
+		self: tgbotapi.User{
+			ID:        1,
+			IsBot:     true,
+			FirstName: "Test Bot",
+			UserName:  "test_bot",
+		},
+		nextUpdateID:  1,
+		nextMessageID: 1,
+		messages:      make(map[int64]map[int]*tgbotapi.Message),
+		files:         make(map[string][]byte),
+		requests:      make([]Request, 0),
+		changed:       make(chan struct{}),
+		closed:        make(chan struct{}),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// Close stops the server and releases pending long-polling requests
+func (s *Server) Close() {
+	s.closeOnce.Do(func() { close(s.closed) })
+	s.server.Close()
+}
+
+// URL returns base URL of the server
+func (s *Server) URL() string {
+	return s.server.URL
+}
+
+// APIEndpoint returns endpoint template that should be passed to the bot instead of tgbotapi.APIEndpoint
+func (s *Server) APIEndpoint() string {
+	return s.server.URL + "/bot%s/%s"
+}
+
+// FileEndpoint returns endpoint template that should be passed to the bot instead of tgbotapi.FileEndpoint
+func (s *Server) FileEndpoint() string {
+	return s.server.URL + "/file/bot%s/%s"
+}
+
+// AddFile stores a file that the bot can download by the file ID, e.g. a photo sent by a user.
+// Files uploaded by the bot are stored under file IDs of the sent messages
+func (s *Server) AddFile(fileID string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[fileID] = data
+}
+
+// Self returns the user that represents the bot
+func (s *Server) Self() tgbotapi.User {
+	return s.self
+}
+
+// PushUpdate queues an update for the bot, assigns it an UpdateID and returns the queued update
+func (s *Server) PushUpdate(update tgbotapi.Update) tgbotapi.Update {
+	return s.PushThreadUpdate(update, 0)
+}
+
+// PushThreadUpdate queues an update with a message in the forum topic threadID of a supergroup
+func (s *Server) PushThreadUpdate(update tgbotapi.Update, threadID int) tgbotapi.Update {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	update.UpdateID = s.nextUpdateID
+	s.nextUpdateID++
+	s.updates = append(s.updates, conversation.IncomingUpdate{Update: update, ThreadID: threadID})
+	s.notify()
+	return update
+}
+
+// SendText sends a text message from a user to the bot in a private chat with ID chatID
+func (s *Server) SendText(chatID int64, text string) tgbotapi.Update {
+	return s.PushUpdate(NewTextUpdate(chatID, text))
+}
+
+// PressButton presses an inline button with buttonText under a message that bot sent to a private chat
+func (s *Server) PressButton(chatID int64, messageID int, buttonText string) (tgbotapi.Update, error) {
+	return s.PressButtonAs(NewUser(chatID), chatID, messageID, buttonText)
+}
+
+// PressButtonAs presses an inline button with buttonText on behalf of the user
+func (s *Server) PressButtonAs(from *tgbotapi.User, chatID int64, messageID int, buttonText string) (tgbotapi.Update, error) {
+	message, ok := s.Message(chatID, messageID)
+	if !ok {
+		return tgbotapi.Update{}, fmt.Errorf("message %d not found in chat %d", messageID, chatID)
+	}
+	data, err := findButtonData(message.ReplyMarkup, buttonText)
+	if err != nil {
+		return tgbotapi.Update{}, err
+	}
+	return s.PushUpdate(NewCallbackUpdate(from, message, data)), nil
+}
+
+// SendInlineQuery sends an inline query from the user to the bot, offset is empty for the first page of results
+func (s *Server) SendInlineQuery(from *tgbotapi.User, query, offset string) tgbotapi.Update {
+	return s.PushUpdate(NewInlineQueryUpdate(from, query, offset))
+}
+
+// Message returns the current state of a message that the bot sent to the chat
+func (s *Server) Message(chatID int64, messageID int) (tgbotapi.Message, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if message, ok := s.messages[chatID][messageID]; ok {
+		return *message, true
+	}
+	return tgbotapi.Message{}, false
+}
+
+// Requests returns a copy of all requests made by the bot (except getMe and getUpdates)
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// WebhookURL returns URL that the bot set with setWebhook
+func (s *Server) WebhookURL() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.webhookURL
+}
+
+// WebhookSecret returns the secret token that the bot set with setWebhook, Telegram sends it in the X-Telegram-Bot-Api-Secret-Token header
+func (s *Server) WebhookSecret() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.webhookSecret
+}
+
+// WaitForRequest waits for the next request with the method and marks it and all previous requests as consumed
+func (s *Server) WaitForRequest(method string, timeout time.Duration) (Request, error) {
+	deadline := time.After(timeout)
+	for {
+		s.mu.Lock()
+		for i := s.cursor; i < len(s.requests); i++ {
+			if s.requests[i].Method == method {
+				s.cursor = i + 1
+				request := s.requests[i]
+				s.mu.Unlock()
+				return request, nil
+			}
+		}
+		changed := s.changed
+		s.mu.Unlock()
+		select {
+		case <-changed:
+		case <-deadline:
+			return Request{}, fmt.Errorf("bot did not call %s in %v", method, timeout)
+		}
+	}
+}
+
+// WaitForText waits for the next sendMessage request and returns it
+func (s *Server) WaitForText(timeout time.Duration) (Request, error) {
+	return s.WaitForRequest("sendMessage", timeout)
+}
+
+// notify wakes up all goroutines waiting for a change, should be called under the lock
+func (s *Server) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// apiResponse is the envelope of every Bot API response
+type apiResponse struct {
+	Ok          bool        `json:"ok"`
+	Result      interface{} `json:"result,omitempty"`
+	ErrorCode   int         `json:"error_code,omitempty"`
+	Description string      `json:"description,omitempty"`
+}
+
+// apiError is an error that should be returned to the bot as an unsuccessful response
+type apiError struct {
+	code        int
+	description string
+}
+
+func (e apiError) Error() string {
+	return e.description
+}
+
+func badRequest(description string) error {
+	return apiError{code: http.StatusBadRequest, description: "Bad Request: " + description}
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/file/bot") {
+		s.serveFile(w, r)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/bot")
+	method := path[strings.LastIndex(path, "/")+1:]
+	request, err := parseRequest(method, r)
+	var result interface{}
+	if err == nil {
+		result, err = s.handle(r, &request)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		var aErr apiError
+		if !errors.As(err, &aErr) {
+			aErr = apiError{code: http.StatusInternalServerError, description: err.Error()}
+		}
+		w.WriteHeader(aErr.code)
+		json.NewEncoder(w).Encode(apiResponse{Ok: false, ErrorCode: aErr.code, Description: aErr.description})
+		return
+	}
+	json.NewEncoder(w).Encode(apiResponse{Ok: true, Result: result})
+}
+
+// serveFile sends content of a file from the file endpoint, the path of the file is "files/<file ID>" as returned by getFile
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request) {
+	fileID := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	s.mu.Lock()
+	data, ok := s.files[fileID]
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Write(data)
+}
+
+// parseRequest reads parameters and files of a Bot API call
+func parseRequest(method string, r *http.Request) (Request, error) {
+	request := Request{
+		Method: method,
+		Params: make(map[string]string),
+		Files:  make(map[string][]byte),
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			return request, badRequest(err.Error())
+		}
+		for name, headers := range r.MultipartForm.File {
+			file, err := headers[0].Open()
+			if err != nil {
+				return request, err
+			}
+			data, err := io.ReadAll(file)
+			file.Close()
+			if err != nil {
+				return request, err
+			}
+			request.Files[name] = data
+		}
+	} else if err := r.ParseForm(); err != nil {
+		return request, badRequest(err.Error())
+	}
+	for name, values := range r.Form {
+		request.Params[name] = values[0]
+	}
+	return request, nil
+}
+
+// handle executes a Bot API call and returns its result
+func (s *Server) handle(r *http.Request, request *Request) (interface{}, error) {
+	switch request.Method {
+	case "getMe":
+		return s.self, nil
+	case "getUpdates":
+		return s.getUpdates(r, request.Params)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result, err := s.execute(request)
+	if err == nil {
+		s.requests = append(s.requests, *request)
+		s.notify()
+	}
+	return result, err
+}
+
+// execute applies a call that changes the state of the server, should be called under the lock
+func (s *Server) execute(request *Request) (interface{}, error) {
+	params := request.Params
+	switch request.Method {
+	case "setWebhook":
+		s.webhookURL = params["url"]
+		s.webhookSecret = params["secret_token"]
+		return true, nil
+	case "deleteWebhook":
+		s.webhookURL = ""
+		s.webhookSecret = ""
+		if params["drop_pending_updates"] == "true" {
+			s.updates = nil
+		}
+		return true, nil
+	case "getWebhookInfo":
+		return tgbotapi.WebhookInfo{URL: s.webhookURL}, nil
+	case "sendMessage", "sendPhoto", "sendDocument":
+		message, err := s.newMessage(request)
+		if err != nil {
+			return nil, err
+		}
+		request.MessageID = message.MessageID
+		return message, nil
+	case "editMessageText", "editMessageReplyMarkup":
+		message, err := s.findMessage(params)
+		if err != nil {
+			return nil, badRequest("message to edit not found")
+		}
+		markup := parseInlineKeyboard(params["reply_markup"])
+		text := message.Text
+		if request.Method == "editMessageText" {
+			text = params["text"]
+		}
+		if text == message.Text && sameMarkup(markup, message.ReplyMarkup) {
+			return nil, badRequest("message is not modified: specified new message content and reply markup are exactly the same as a current content and reply markup of the message")
+		}
+		message.Text = text
+		message.ReplyMarkup = markup
+		request.MessageID = message.MessageID
+		return *message, nil
+	case "deleteMessage":
+		message, err := s.findMessage(params)
+		if err != nil {
+			return nil, badRequest("message to delete not found")
+		}
+		delete(s.messages[message.Chat.ID], message.MessageID)
+		request.MessageID = message.MessageID
+		return true, nil
+	case "answerCallbackQuery", "answerInlineQuery":
+		return true, nil
+	case "getFile":
+		fileID := params["file_id"]
+		return tgbotapi.File{FileID: fileID, FileUniqueID: fileID, FilePath: "files/" + fileID}, nil
+	}
+	return nil, apiError{code: http.StatusNotFound, description: "Not Found: method " + request.Method + " is not supported by the fake server"}
+}
+
+// getUpdates returns pending updates or waits for them (long polling)
+func (s *Server) getUpdates(r *http.Request, params map[string]string) (interface{}, error) {
+	offset, _ := strconv.Atoi(params["offset"])
+	timeout := shortPollInterval
+	if seconds, _ := strconv.Atoi(params["timeout"]); seconds > 0 {
+		timeout = time.Duration(seconds) * time.Second
+	}
+	deadline := time.After(timeout)
+	for {
+		s.mu.Lock()
+		pending := make([]conversation.IncomingUpdate, 0)
+		for _, update := range s.updates {
+			if update.UpdateID >= offset {
+				pending = append(pending, update)
+			}
+		}
+		s.updates = pending // updates below offset are confirmed by the bot
+		changed := s.changed
+		s.mu.Unlock()
+		if len(pending) > 0 {
+			return pending, nil
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return pending, nil
+		case <-r.Context().Done():
+			return pending, nil
+		case <-s.closed:
+			return pending, nil
+		}
+	}
+}
+
+// newMessage stores a message sent by the bot, should be called under the lock
+func (s *Server) newMessage(request *Request) (tgbotapi.Message, error) {
+	chatID := request.ChatID()
+	if chatID == 0 {
+		return tgbotapi.Message{}, badRequest("chat not found")
+	}
+	message := &tgbotapi.Message{
+		MessageID:   s.nextMessageID,
+		From:        &s.self,
+		Date:        int(time.Now().Unix()),
+		Chat:        &tgbotapi.Chat{ID: chatID, Type: chatType(chatID)},
+		ReplyMarkup: parseInlineKeyboard(request.Params["reply_markup"]),
+	}
+	switch request.Method {
+	case "sendMessage":
+		message.Text = request.Params["text"]
+	case "sendPhoto":
+		message.Caption = request.Params["caption"]
+		message.Photo = []tgbotapi.PhotoSize{{FileID: s.storeFile(request, "photo", message.MessageID)}}
+	case "sendDocument":
+		message.Caption = request.Params["caption"]
+		message.Document = &tgbotapi.Document{FileID: s.storeFile(request, "document", message.MessageID)}
+	}
+	if replyTo, err := strconv.Atoi(request.Params["reply_to_message_id"]); err == nil {
+		if original, ok := s.messages[chatID][replyTo]; ok {
+			message.ReplyToMessage = original
+		}
+	}
+	s.nextMessageID++
+	if _, ok := s.messages[chatID]; !ok {
+		s.messages[chatID] = make(map[int]*tgbotapi.Message)
+	}
+	s.messages[chatID][message.MessageID] = message
+	return *message, nil
+}
+
+// storeFile keeps the file uploaded with the request for downloads and returns its file ID, should be called under the lock.
+// A file sent by a file ID keeps the ID
+func (s *Server) storeFile(request *Request, field string, messageID int) string {
+	if fileID, ok := request.Params[field]; ok {
+		return fileID
+	}
+	fileID := fmt.Sprintf("%s%d", field, messageID)
+	if data, ok := request.Files[field]; ok {
+		s.files[fileID] = data
+	}
+	return fileID
+}
+
+// findMessage looks up a message by chat_id and message_id parameters, should be called under the lock
+func (s *Server) findMessage(params map[string]string) (*tgbotapi.Message, error) {
+	chatID, _ := strconv.ParseInt(params["chat_id"], 10, 64)
+	messageID, _ := strconv.Atoi(params["message_id"])
+	if message, ok := s.messages[chatID][messageID]; ok {
+		return message, nil
+	}
+	return nil, fmt.Errorf("message %d not found in chat %d", messageID, chatID)
+}
+
+// parseInlineKeyboard parses reply_markup parameter, other kinds of markup are ignored
+func parseInlineKeyboard(markup string) *tgbotapi.InlineKeyboardMarkup {
+	if markup == "" {
+		return nil
+	}
+	var keyboard tgbotapi.InlineKeyboardMarkup
+	if err := json.Unmarshal([]byte(markup), &keyboard); err != nil || len(keyboard.InlineKeyboard) == 0 {
+		return nil
+	}
+	return &keyboard
+}
+
+// sameMarkup compares two inline keyboards
+func sameMarkup(a, b *tgbotapi.InlineKeyboardMarkup) bool {
+	aJSON, _ := json.Marshal(a)
+	bJSON, _ := json.Marshal(b)
+	return string(aJSON) == string(bJSON)
+}
+
+// findButtonData returns callback data of a button with the text
+func findButtonData(markup *tgbotapi.InlineKeyboardMarkup, buttonText string) (string, error) {
+	if markup != nil {
+		for _, row := range markup.InlineKeyboard {
+			for _, button := range row {
+				if button.Text == buttonText && button.CallbackData != nil {
+					return *button.CallbackData, nil
+				}
+			}
+		}
+	}
+	return "", fmt.Errorf("no button with text '%s' in the message", buttonText)
+}
@@ -0,0 +1,609 @@
+package bottest_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ufy-it/go-telegram-bot/bot"
+	"github.com/ufy-it/go-telegram-bot/bottest"
+	"github.com/ufy-it/go-telegram-bot/dispatcher"
+	"github.com/ufy-it/go-telegram-bot/handlers"
+	"github.com/ufy-it/go-telegram-bot/handlers/buttons"
+	"github.com/ufy-it/go-telegram-bot/handlers/readers"
+	"github.com/ufy-it/go-telegram-bot/metrics"
+	"github.com/ufy-it/go-telegram-bot/state"
+	"github.com/ufy-it/go-telegram-bot/tracing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func choiceHandler(ctx context.Context, conversation readers.BotConversation) error {
+	reply, err := readers.AskOnlyButtonReply(ctx, conversation, conversation.NewMessage("Choose"),
+		buttons.NewSingleRowButtonSet(buttons.NewButton("A", "a"), buttons.NewButton("B", "b")), "Use buttons")
+	if err != nil || reply.Exit {
+		return err
+	}
+	_, err = conversation.SendTextf("You chose %s", reply.Data)
+	return err
+}
+
+func TestBotWithFakeServer(t *testing.T) {
+	server := bottest.NewServer()
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- bot.NewBot("test-token").
+			SetAPIEndpoint(server.APIEndpoint()).
+			SetUpdateTimeout(1).
+			WithCommandHandlers([]handlers.CommandHandler{
+				{
+					CommandSelector: handlers.RegExpCommandSelector("/start"),
+					HandlerCreator:  handlers.OneStepHandlerCreator(choiceHandler),
+				},
+			}).
+			Run(ctx)
+	}()
+
+	// the bot drops pending updates on start, so wait until it is ready
+	if _, err := server.WaitForRequest("deleteWebhook", bottest.DefaultTimeout); err != nil {
+		t.Fatal(err)
+	}
+	server.SendText(42, "/start")
+	question, err := server.WaitForText(bottest.DefaultTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if question.ChatID() != 42 || question.Text() != "Choose" {
+		t.Errorf("unexpected question %v", question.Params)
+	}
+	markup, err := server.WaitForRequest("editMessageReplyMarkup", bottest.DefaultTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyboard := markup.InlineKeyboard(); len(keyboard) != 1 || len(keyboard[0]) != 2 || keyboard[0][1].Text != "B" {
+		t.Errorf("unexpected keyboard %v", keyboard)
+	}
+
+	if _, err = server.PressButton(42, question.MessageID, "B"); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := server.WaitForText(bottest.DefaultTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer.Text() != "You chose b" {
+		t.Errorf("unexpected answer '%s'", answer.Text())
+	}
+	if message, ok := server.Message(42, question.MessageID); !ok || message.ReplyMarkup != nil {
+		t.Errorf("expected buttons to be removed from the question, got %v", message.ReplyMarkup)
+	}
+
+	cancel()
+	if err := <-errCh; err != nil {
+		t.Errorf("unexpected error from Run: %v", err)
+	}
+}
+
+func TestInlineQueryWithFakeServer(t *testing.T) {
+	server := bottest.NewServer()
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go bot.NewBot("test-token").
+		SetAPIEndpoint(server.APIEndpoint()).
+		WithInlineQueryHandlers([]handlers.InlineQueryHandler{
+			{
+				QuerySelector: handlers.AnyInlineQuerySelector(),
+				Handler: func(ctx context.Context, query *tgbotapi.InlineQuery, response *handlers.InlineResponse) error {
+					response.AddArticle("1", "Echo", query.Query)
+					return nil
+				},
+			},
+		}).
+		Run(ctx)
+
+	if _, err := server.WaitForRequest("deleteWebhook", bottest.DefaultTimeout); err != nil {
+		t.Fatal(err)
+	}
+	query := server.SendInlineQuery(bottest.NewUser(42), "hello", "")
+	answer, err := server.WaitForRequest("answerInlineQuery", bottest.DefaultTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer.Params["inline_query_id"] != query.InlineQuery.ID || !strings.Contains(answer.Params["results"], `"message_text":"hello"`) {
+		t.Errorf("unexpected answer %v", answer.Params)
+	}
+}
+
+func TestForumTopicWithFakeServer(t *testing.T) {
+	server := bottest.NewServer()
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go bot.NewBot("test-token").
+		SetAPIEndpoint(server.APIEndpoint()).
+		SetUpdateTimeout(1).
+		WithCommandHandlers([]handlers.CommandHandler{
+			{CommandSelector: handlers.RegExpCommandSelector("/hello"), HandlerCreator: handlers.MessageHandlerCreator("hello")},
+		}).
+		Run(ctx)
+
+	if _, err := server.WaitForRequest("deleteWebhook", bottest.DefaultTimeout); err != nil {
+		t.Fatal(err)
+	}
+	server.PushThreadUpdate(bottest.NewTextUpdate(-1001, "/hello"), 7)
+	answer, err := server.WaitForText(bottest.DefaultTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer.Text() != "hello" || answer.ThreadID() != 7 || answer.Params["reply_to_message_id"] != "" {
+		t.Errorf("expected the answer in topic 7, got %v", answer.Params)
+	}
+}
+
+func TestFilesWithFakeServer(t *testing.T) {
+	server := bottest.NewServer()
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the handler downloads the photo of the user and sends it back as a document
+	echoFile := handlers.OneStepHandlerCreator(func(ctx context.Context, conversation readers.BotConversation) error {
+		update, err := handlers.GetFirstUpdate(ctx)
+		if err != nil {
+			return err
+		}
+		data, err := conversation.GetFile(update.Message.Photo[0].FileID)
+		if err != nil {
+			return err
+		}
+		_, err = conversation.SendGeneralMessage(conversation.NewDocumentUpload(data, "got "+string(data), "file.txt"))
+		return err
+	})
+	go bot.NewBot("test-token").
+		SetAPIEndpoint(server.APIEndpoint()).
+		SetFileEndpoint(server.FileEndpoint()).
+		WithDefaultCommandHandler(echoFile).
+		Run(ctx)
+
+	if _, err := server.WaitForRequest("deleteWebhook", bottest.DefaultTimeout); err != nil {
+		t.Fatal(err)
+	}
+	server.AddFile("user-photo", []byte("photo data"))
+	update := bottest.NewTextUpdate(42, "")
+	update.Message.Photo = []tgbotapi.PhotoSize{{FileID: "user-photo"}}
+	server.PushUpdate(update)
+	document, err := server.WaitForRequest("sendDocument", bottest.DefaultTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if document.Text() != "got photo data" {
+		t.Errorf("unexpected caption '%s'", document.Text())
+	}
+	message, _ := server.Message(42, document.MessageID)
+	resp, err := http.Get(fmt.Sprintf(server.FileEndpoint(), "test-token", "files/"+message.Document.FileID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if data, _ := io.ReadAll(resp.Body); string(data) != "photo data" {
+		t.Errorf("unexpected content of the uploaded file '%s'", data)
+	}
+}
+
+func TestWebhookWithFakeServer(t *testing.T) {
+	server := bottest.NewServer()
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	go bot.NewBot("test-token").
+		SetAPIEndpoint(server.APIEndpoint()).
+		SetWebHook(true, "http://"+addr, addr, "", "").
+		WithCommandHandlers([]handlers.CommandHandler{
+			{
+				CommandSelector: handlers.RegExpCommandSelector("/start"),
+				HandlerCreator:  handlers.OneStepHandlerCreator(choiceHandler),
+			},
+		}).
+		Run(ctx)
+
+	if _, err := server.WaitForRequest("setWebhook", bottest.DefaultTimeout); err != nil {
+		t.Fatal(err)
+	}
+	url, secret := server.WebhookURL(), server.WebhookSecret()
+	if strings.Contains(url, "test-token") || len(url) < len("http://"+addr)+32 {
+		t.Errorf("the webhook path should be a long secret independent of the token, got %s", url)
+	}
+	if len(secret) < 32 {
+		t.Errorf("expected a long secret token, got %q", secret)
+	}
+	post := func(token string) int {
+		t.Helper()
+		body := `{"update_id":1,"message":{"message_id":1,"chat":{"id":42,"type":"private"},"from":{"id":42},"text":"/start","entities":[{"type":"bot_command","offset":0,"length":6}]}}`
+		deadline := time.Now().Add(bottest.DefaultTimeout)
+		for {
+			request, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+			request.Header.Set("Content-Type", "application/json")
+			if token != "" {
+				request.Header.Set("X-Telegram-Bot-Api-Secret-Token", token)
+			}
+			resp, err := http.DefaultClient.Do(request)
+			if err == nil {
+				resp.Body.Close()
+				return resp.StatusCode
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("webhook is not available: %v", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if code := post(""); code != http.StatusForbidden {
+		t.Errorf("expected an update without the secret token rejected, got %d", code)
+	}
+	if code := post("wrong"); code != http.StatusForbidden {
+		t.Errorf("expected an update with a wrong secret token rejected, got %d", code)
+	}
+	if code := post(secret); code != http.StatusOK {
+		t.Errorf("expected an update with the secret token accepted, got %d", code)
+	}
+	question, err := server.WaitForText(bottest.DefaultTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if question.ChatID() != 42 || question.Text() != "Choose" {
+		t.Errorf("unexpected question %v", question.Params)
+	}
+}
+
+func TestPressUnknownButton(t *testing.T) {
+	server := bottest.NewServer()
+	defer server.Close()
+	if _, err := server.PressButton(1, 1, "A"); err == nil {
+		t.Error("expected error for a missing message")
+	}
+	server.PushUpdate(tgbotapi.Update{})
+	if update := server.SendText(1, "/help me"); update.UpdateID != 2 || update.Message.Command() != "help" {
+		t.Errorf("unexpected update %v", update)
+	}
+}
+
+func TestConversationResumedAfterRestart(t *testing.T) {
+	server := bottest.NewServer()
+	defer server.Close()
+	stateIO := state.NewMemoryState()
+	run := func(ctx context.Context) chan error {
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- bot.NewBot("test-token").
+				SetAPIEndpoint(server.APIEndpoint()).
+				SetUpdateTimeout(1).
+				SetShutdownGracePeriod(1).
+				WithStateIO(stateIO).
+				WithCommandHandlers([]handlers.CommandHandler{
+					{
+						CommandSelector: handlers.RegExpCommandSelector("/start"),
+						HandlerCreator:  handlers.OneStepHandlerCreator(choiceHandler),
+					},
+				}).
+				Run(ctx)
+		}()
+		return errCh
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := run(ctx)
+	if _, err := server.WaitForRequest("deleteWebhook", bottest.DefaultTimeout); err != nil {
+		t.Fatal(err)
+	}
+	server.SendText(42, "/start")
+	if _, err := server.WaitForText(bottest.DefaultTimeout); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.WaitForRequest("editMessageReplyMarkup", bottest.DefaultTimeout); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := <-errCh; err != nil {
+		t.Errorf("unexpected error from Run: %v", err)
+	}
+	requests := len(server.Requests())
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	errCh = run(ctx)
+	question, err := server.WaitForText(bottest.DefaultTimeout) // the handler asks again
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.WaitForRequest("editMessageReplyMarkup", bottest.DefaultTimeout); err != nil {
+		t.Fatal(err)
+	}
+	for _, request := range server.Requests()[requests:] {
+		if request.Method == "editMessageReplyMarkup" && len(request.InlineKeyboard()) == 0 {
+			t.Errorf("buttons were removed on the shutdown: %v", request.Params)
+		}
+	}
+	if _, err = server.PressButton(42, question.MessageID, "A"); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := server.WaitForText(bottest.DefaultTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer.Text() != "You chose a" {
+		t.Errorf("unexpected answer '%s'", answer.Text())
+	}
+}
+
+func TestAdminServer(t *testing.T) {
+	server := bottest.NewServer()
+	defer server.Close()
+	config := bot.NewBot("test-token").
+		SetAPIEndpoint(server.APIEndpoint()).
+		SetUpdateTimeout(1).
+		SetAdminServer("", "secret").
+		WithCommandHandlers([]handlers.CommandHandler{
+			{
+				CommandSelector: handlers.RegExpCommandSelector("/start"),
+				HandlerCreator:  handlers.OneStepHandlerCreator(choiceHandler),
+			},
+		})
+	adminServer := httptest.NewServer(config.AdminServer())
+	defer adminServer.Close()
+	call := func(method, path string) (int, []byte) {
+		request, err := http.NewRequest(method, adminServer.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Authorization", "Bearer secret")
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		return response.StatusCode, body
+	}
+	waitFor := func(condition func() bool, what string) {
+		deadline := time.Now().Add(bottest.DefaultTimeout)
+		for !condition() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timeout waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	conversations := func() []dispatcher.ConversationInfo {
+		code, body := call("GET", "/admin/conversations")
+		var result []dispatcher.ConversationInfo
+		if err := json.Unmarshal(body, &result); code != http.StatusOK || err != nil {
+			t.Fatalf("unexpected response %d %s (%v)", code, body, err)
+		}
+		return result
+	}
+
+	if code, _ := call("GET", "/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected readyz status %d before the start", code)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- config.Run(ctx)
+	}()
+	waitFor(func() bool { code, _ := call("GET", "/readyz"); return code == http.StatusOK }, "readiness")
+
+	server.SendText(42, "/start")
+	if _, err := server.WaitForRequest("editMessageReplyMarkup", bottest.DefaultTimeout); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(func() bool { convs := conversations(); return len(convs) == 1 && convs[0].WaitingForUser }, "the conversation")
+	convs := conversations()
+	if convs[0].ChatID != 42 || convs[0].Step != 0 {
+		t.Errorf("unexpected conversation %v", convs[0])
+	}
+	if code, body := call("POST", fmt.Sprintf("/admin/conversations/%d/cancel", convs[0].ConversationID)); code != http.StatusOK {
+		t.Errorf("unexpected cancel response %d %s", code, body)
+	}
+	waitFor(func() bool { return len(conversations()) == 0 }, "the canceled conversation to be closed")
+
+	cancel()
+	if err := <-errCh; err != nil {
+		t.Errorf("unexpected error from Run: %v", err)
+	}
+	if code, _ := call("GET", "/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected readyz status %d after the stop", code)
+	}
+}
+
+func TestMetricsWithFakeServer(t *testing.T) {
+	server := bottest.NewServer()
+	defer server.Close()
+	config := bot.NewBot("test-token").
+		SetAPIEndpoint(server.APIEndpoint()).
+		SetUpdateTimeout(1).
+		SetAdminServer("", "").
+		WithMetrics(metrics.NewPrometheus("")).
+		WithCommandHandlers([]handlers.CommandHandler{
+			{
+				CommandSelector: handlers.RegExpCommandSelector("/start"),
+				HandlerCreator:  handlers.OneStepHandlerCreator(choiceHandler),
+				Name:            "start",
+			},
+		})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- config.Run(ctx)
+	}()
+	if _, err := server.WaitForRequest("deleteWebhook", bottest.DefaultTimeout); err != nil {
+		t.Fatal(err)
+	}
+	server.SendText(42, "/start")
+	question, err := server.WaitForText(bottest.DefaultTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.WaitForRequest("editMessageReplyMarkup", bottest.DefaultTimeout); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = server.PressButton(42, question.MessageID, "A"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.WaitForText(bottest.DefaultTimeout); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond) // the handler reports after the last message
+
+	w := httptest.NewRecorder()
+	config.AdminServer().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	text := w.Body.String()
+	for _, line := range []string{
+		`telegram_bot_updates_received_total{type="message"} 1`,
+		`telegram_bot_updates_received_total{type="callback_query"} 1`,
+		`telegram_bot_handler_duration_seconds_count{handler="start"} 1`,
+		`telegram_bot_step_transitions_total{handler="start",from="-1",to="0"} 1`,
+		`telegram_bot_api_request_duration_seconds_count{method="getMe"} 1`,
+		`telegram_bot_open_conversations 0`,
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Errorf("expected line '%s' in\n%s", line, text)
+		}
+	}
+
+	cancel()
+	if err := <-errCh; err != nil {
+		t.Errorf("unexpected error from Run: %v", err)
+	}
+}
+
+func TestTracingWithFakeServer(t *testing.T) {
+	server := bottest.NewServer()
+	defer server.Close()
+	recorder := tracing.NewRecorder()
+	greetHandler := func(ctx context.Context, conversation readers.BotConversation) error {
+		if _, err := conversation.SendText("What is your name?"); err != nil {
+			return err
+		}
+		reply := readers.ReadRawTextAndDataResult(ctx, conversation)
+		if reply.Exit {
+			return nil
+		}
+		_, span := tracing.Start(ctx, "db.save", tracing.Attr("name", reply.Text))
+		span.End()
+		_, err := conversation.SendTextf("Hello, %s", reply.Text)
+		return err
+	}
+	config := bot.NewBot("test-token").
+		SetAPIEndpoint(server.APIEndpoint()).
+		SetUpdateTimeout(1).
+		WithTracer(recorder).
+		WithCommandHandlers([]handlers.CommandHandler{
+			{
+				CommandSelector: handlers.RegExpCommandSelector("/start"),
+				HandlerCreator:  handlers.OneStepHandlerCreator(greetHandler),
+				Name:            "greet",
+			},
+		})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- config.Run(ctx)
+	}()
+	if _, err := server.WaitForRequest("deleteWebhook", bottest.DefaultTimeout); err != nil {
+		t.Fatal(err)
+	}
+	server.SendText(42, "/start")
+	if _, err := server.WaitForText(bottest.DefaultTimeout); err != nil {
+		t.Fatal(err)
+	}
+	server.SendText(42, "Bob")
+	if _, err := server.WaitForText(bottest.DefaultTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	var spans []tracing.SpanData
+	deadline := time.Now().Add(bottest.DefaultTimeout)
+	for handled := 0; handled < 2 && time.Now().Before(deadline); { // the span of the second update ends with the handler
+		time.Sleep(10 * time.Millisecond)
+		spans, handled = recorder.Spans(), 0
+		for _, span := range spans {
+			if span.Name == tracing.SpanHandleUpdate {
+				handled++
+			}
+		}
+	}
+	byID := make(map[string]tracing.SpanData)
+	for _, span := range spans {
+		byID[span.SpanID] = span
+	}
+	// path returns names of the span and its ancestors
+	path := func(span tracing.SpanData) string {
+		names := []string{span.Name}
+		for parent, ok := byID[span.ParentID]; ok; parent, ok = byID[parent.ParentID] {
+			if parent.TraceID != span.TraceID {
+				t.Errorf("span %s is in another trace than its child %s", parent.Name, span.Name)
+			}
+			names = append(names, parent.Name)
+		}
+		return strings.Join(names, " < ")
+	}
+	handle := "conversation.handle_update < dispatcher.dispatch < telegram.update"
+	expected := map[string]bool{
+		"dispatcher.select_handler < " + handle: false,
+		"telegram.send < " + handle:             false,
+		"db.save < " + handle:                   false,
+	}
+	for _, span := range spans {
+		if _, ok := expected[path(span)]; ok {
+			expected[path(span)] = true
+		}
+		switch span.Name {
+		case tracing.SpanSelectHandler:
+			if span.Attributes["handler"] != "greet" {
+				t.Errorf("unexpected attributes of the selection: %v", span.Attributes)
+			}
+		case tracing.SpanHandleUpdate:
+			if span.Attributes["handler"] != "greet" || span.Attributes["step"] != "0" || span.Attributes["chat_id"] != int64(42) {
+				t.Errorf("unexpected attributes of the consumed update: %v", span.Attributes)
+			}
+		case "db.save":
+			if span.Attributes["name"] != "Bob" || span.Attributes["update_id"] != nil {
+				t.Errorf("unexpected attributes of the child span: %v", span.Attributes)
+			}
+		}
+	}
+	for p, found := range expected {
+		if !found {
+			t.Errorf("expected trace %s", p)
+		}
+	}
+
+	cancel()
+	if err := <-errCh; err != nil {
+		t.Errorf("unexpected error from Run: %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package bottest
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	betterguid "github.com/kjk/betterguid"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// chatType deduces type of a chat from its ID the same way Telegram assigns IDs
+func chatType(chatID int64) string {
+	switch {
+	case chatID > 0:
+		return "private"
+	case chatID <= -1000000000000:
+		return "supergroup"
+	default:
+		return "group"
+	}
+}
+
+// NewUser creates a user with the ID
+func NewUser(userID int64) *tgbotapi.User {
+	return &tgbotapi.User{
+		ID:        userID,
+		FirstName: "User",
+		UserName:  fmt.Sprintf("user%d", userID),
+	}
+}
+
+// NewTextUpdate creates an update with a text message from a user in a private chat with ID chatID.
+// If the text starts with "/", the message is marked as a bot command
+func NewTextUpdate(chatID int64, text string) tgbotapi.Update {
+	return NewUserTextUpdate(chatID, NewUser(chatID), text)
+}
+
+// NewUserTextUpdate creates an update with a text message from the user in the chat
+func NewUserTextUpdate(chatID int64, from *tgbotapi.User, text string) tgbotapi.Update {
+	message := &tgbotapi.Message{
+		From: from,
+		Date: int(time.Now().Unix()),
+		Chat: &tgbotapi.Chat{ID: chatID, Type: chatType(chatID)},
+		Text: text,
+	}
+	if strings.HasPrefix(text, "/") {
+		length := len(text)
+		if space := strings.Index(text, " "); space > 0 {
+			length = space
+		}
+		message.Entities = []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: length}}
+	}
+	return tgbotapi.Update{Message: message}
+}
+
+// NewCallbackUpdate creates an update with a press of an inline button with data under the message
+func NewCallbackUpdate(from *tgbotapi.User, message tgbotapi.Message, data string) tgbotapi.Update {
+	return tgbotapi.Update{
+		CallbackQuery: &tgbotapi.CallbackQuery{
+			ID:      betterguid.New(),
+			From:    from,
+			Message: &message,
+			Data:    data,
+		},
+	}
+}
+
+// NewInlineQueryUpdate creates an update with an inline query from the user
+func NewInlineQueryUpdate(from *tgbotapi.User, query, offset string) tgbotapi.Update {
+	return tgbotapi.Update{
+		InlineQuery: &tgbotapi.InlineQuery{
+			ID:     betterguid.New(),
+			From:   from,
+			Query:  query,
+			Offset: offset,
+		},
+	}
+}
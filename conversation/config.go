@@ -1,7 +1,14 @@
 package conversation
 
+import "github.com/ufy-it/go-telegram-bot/tracing"
+
 // Config is struct with configuration parameters for a conversation
 type Config struct {
-	MaxMessageQueue int // the maximum size of unporcessed message queue for a conversation
-	TimeoutMinutes  int // timeout for a user's input in minutes
+	MaxMessageQueue int            // the maximum size of unporcessed message queue for a conversation
+	TimeoutMinutes  int            // timeout for a user's input in minutes
+	Tracer          tracing.Tracer // tracer of updates consumed by handlers and of sent messages, the dispatcher sets its tracer. Nothing is traced if nil
+	WaitHook        WaitHookType   // called when a handler starts and stops waiting for an update from the user, can be nil
 }
+
+// WaitHookType is a function type that is called when the handler of the conversation starts (waiting is true) and stops waiting for an update from the user
+type WaitHookType func(conversationID int64, waiting bool)
@@ -3,6 +3,7 @@ package conversation
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -10,8 +11,10 @@ import (
 	"sync"
 	"time"
 
+	"github.com/ufy-it/go-telegram-bot/boterrors"
 	"github.com/ufy-it/go-telegram-bot/logger"
 	"github.com/ufy-it/go-telegram-bot/state"
+	"github.com/ufy-it/go-telegram-bot/tracing"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
@@ -41,9 +44,28 @@ func NewConversation(
 	tooManyMessages, cancelByBot, cancelByUser SpecialMessageFuncType,
 	globalKeyboardFunc GlobalKeyboardFuncType,
 	config Config) (*BotConversation, error) {
+	return NewConversationWithKey(
+		state.ConversationKey{ChatID: chatID},
+		bot,
+		botState,
+		tooManyMessages,
+		cancelByBot,
+		cancelByUser,
+		globalKeyboardFunc,
+		config)
+}
+
+// NewConversationWithKey creates a new conversation struct for a conversation key and assigns an incremental ID to it
+func NewConversationWithKey(
+	key state.ConversationKey,
+	bot SendBot,
+	botState state.BotState,
+	tooManyMessages, cancelByBot, cancelByUser SpecialMessageFuncType,
+	globalKeyboardFunc GlobalKeyboardFuncType,
+	config Config) (*BotConversation, error) {
 	return NewConversationWithID(
 		currentConversationID,
-		chatID,
+		key,
 		bot,
 		botState,
 		tooManyMessages,
@@ -56,7 +78,8 @@ func NewConversation(
 // NewConversationWithID creates a new conversation struct with pre-defined conversation ID.
 // Should be used for starting conversations from a saved state
 func NewConversationWithID(
-	converationID, chatID int64,
+	converationID int64,
+	key state.ConversationKey,
 	bot SendBot,
 	botState state.BotState,
 	tooManyMessages, cancelByBot, cancelByUser SpecialMessageFuncType,
@@ -69,9 +92,11 @@ func NewConversationWithID(
 		currentConversationID = converationID + 1
 	}
 	result := &BotConversation{
-		updates: make(chan *tgbotapi.Update, config.MaxMessageQueue),
+		updates: make(chan *IncomingUpdate, config.MaxMessageQueue),
 
-		chatID:         chatID,
+		chatID:         key.ChatID,
+		key:            key,
+		threadID:       key.ThreadID,
 		conversationID: converationID,
 
 		bot:             bot,
@@ -84,12 +109,31 @@ func NewConversationWithID(
 
 		globalKeyboardFunc: globalKeyboardFunc,
 
-		canceled: false,
+		canceled:     false,
+		lastActivity: time.Now(),
+
+		tracer:   config.Tracer,
+		trace:    &tracing.Scope{},
+		waitHook: config.WaitHook,
 
 		messageIDForKeyboardRemove: 0,
 
 		mu: sync.Mutex{},
 	}
+	if botState != nil && key.ThreadID == 0 {
+		result.threadID = botState.GetConversationThreadID(converationID) // resumed conversation continues in its topic
+	}
+	result.log = logger.With("chat_id", key.ChatID)
+	if key.UserID != 0 {
+		result.log.Set("user_id", key.UserID)
+	}
+	if result.threadID != 0 {
+		result.log.Set("thread_id", result.threadID)
+	}
+	result.log.Set("conversation_id", converationID)
+	if result.tracer == nil {
+		result.tracer = tracing.NopTracer{}
+	}
 
 	return result, nil
 }
@@ -111,10 +155,12 @@ func GetUpdateChatID(update *tgbotapi.Update) (int64, error) {
 // BotConversation struct handlers all conversation-related data
 // and should manage all interactions between a user and a command handler
 type BotConversation struct {
-	updates chan *tgbotapi.Update //channel with incoming messages from a user
+	updates chan *IncomingUpdate //channel with incoming messages from a user
 
-	chatID         int64 // id of the telegram chat
-	conversationID int64 // unique ID of the converation object
+	chatID         int64                 // id of the telegram chat
+	key            state.ConversationKey // key that separates the conversation from other conversations in the chat
+	threadID       int                   // forum topic the conversation posts to, taken from the first update of a handler
+	conversationID int64                 // unique ID of the converation object
 
 	maxMessageQueue int     // max size of messages buffer
 	timeoutMinutes  int     // timeout from the latest message from a user in minutes before closing the conversation due to a long inactivity
@@ -126,38 +172,65 @@ type BotConversation struct {
 
 	globalKeyboardFunc GlobalKeyboardFuncType // function to generate global keyboard
 
-	canceled bool // flag that indicates that the conversation was canceled by the user
+	canceled  bool // flag that indicates that the conversation was canceled by the user
+	suspended bool // flag that indicates that the conversation was closed by a shutdown, and should be resumed from the state after a restart
+	waiting   bool // flag that indicates that the handler waits for an update from the user
+
+	lastActivity time.Time // time of the latest update from the user, or of the start of the conversation
+
+	log *logger.FieldLogger // logger with chat_id, user_id, thread_id and conversation_id of the conversation
+
+	tracer   tracing.Tracer // tracer of consumed updates and sent messages, NopTracer if the conversation is not traced
+	trace    *tracing.Scope // span of the update consumed by the handler the latest
+	waitHook WaitHookType   // hook of starts and stops of waiting for the user, can be nil
 
 	messageIDForKeyboardRemove int // id of the message that should be cleared from reply keyboard in case of user or bot cancelled the conversation
+	lastUserMessageID          int // id of the latest message from the user, bot replies to it in group conversations separated per user
 
-	mu sync.Mutex // mutex to ensure that conversation will not send any messages after close
+	mu     sync.Mutex // mutex to guard the fields of the conversation, it is not held while messages are sent
+	sendMu sync.Mutex // mutex to ensure that conversation will not send any messages after the cancel message
 }
 
 // cancelConversation cancels the conversation and sends special message to the chat
 func (c *BotConversation) cancelConversation(cancelMessage SpecialMessageFuncType) error {
+	notify, err := c.closeConversation(cancelMessage)
+	if err != nil {
+		return err
+	}
+	return notify()
+}
+
+// closeConversation cancels the conversation and returns the function that removes the reply keyboard and sends special message to the chat.
+// The function waits for messages being sent by the handler, so that the special message is the last one
+func (c *BotConversation) closeConversation(cancelMessage SpecialMessageFuncType) (SpecialMessageFuncType, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.canceled {
-		return fmt.Errorf("the conversation with chat %d is already canceled", c.chatID)
+		return nil, fmt.Errorf("the conversation with chat %d: %w", c.chatID, boterrors.ErrConversationCanceled)
 	}
 	c.canceled = true
-	if c.messageIDForKeyboardRemove != 0 {
-		upd := tgbotapi.NewEditMessageReplyMarkup(
-			c.chatID,
-			c.messageIDForKeyboardRemove,
-			tgbotapi.InlineKeyboardMarkup{
-				InlineKeyboard: make([][]tgbotapi.InlineKeyboardButton, 0),
-			})
-		_, err := c.bot.Send(upd)
+	messageIDForKeyboardRemove := c.messageIDForKeyboardRemove
+	return func() error {
+		c.sendMu.Lock()
+		defer c.sendMu.Unlock()
+		if messageIDForKeyboardRemove != 0 {
+			upd := tgbotapi.NewEditMessageReplyMarkup(
+				c.chatID,
+				messageIDForKeyboardRemove,
+				tgbotapi.InlineKeyboardMarkup{
+					InlineKeyboard: make([][]tgbotapi.InlineKeyboardButton, 0),
+				})
+			_, err := c.send(upd)
+			if err != nil {
+				c.log.Warning("error removing reply keyboard from message on cancel", "error", err)
+			}
+		}
+		err := cancelMessage()
 		if err != nil {
-			logger.Warning("error removing reply keyboard from message on cancel: %v", err)
+			return fmt.Errorf("error while sending cancel message to chat %d: %w", c.chatID, err)
 		}
-	}
-	err := cancelMessage()
-	if err != nil {
-		return fmt.Errorf("error while sending cancel message to chat %d: %v", c.chatID, err)
-	}
-	return nil
+		return nil
+	}, nil
 }
 
 // cancelByBot closes the conversation and sends "Cancel by bot message"
@@ -165,6 +238,69 @@ func (c *BotConversation) cancelByBot() error {
 	return c.cancelConversation(c.cancelByBotMessage)
 }
 
+// CancelByBot closes the conversation from the bot side (e.g. by an operator) and sends "Cancel by bot message"
+func (c *BotConversation) CancelByBot() error {
+	return c.cancelByBot()
+}
+
+// CloseByBot closes the conversation from the bot side as CancelByBot does, and returns the function that sends "Cancel by bot message",
+// so that the caller sends the message after it releases its locks
+func (c *BotConversation) CloseByBot() (SpecialMessageFuncType, error) {
+	return c.closeConversation(c.cancelByBotMessage)
+}
+
+// CloseByUser closes the conversation as CancelByUser does, and returns the function that sends "Cancel by user message",
+// so that the caller sends the message after it releases its locks
+func (c *BotConversation) CloseByUser() (SpecialMessageFuncType, error) {
+	return c.closeConversation(c.cancelByUserMessage)
+}
+
+// Logger returns the logger of the conversation, it attaches chat_id, user_id, thread_id and conversation_id to every record
+func (c *BotConversation) Logger() *logger.FieldLogger {
+	return c.log
+}
+
+// Trace returns the scope with the span of the update consumed by the handler the latest,
+// messages sent by the conversation and spans started by the handler are children of the span
+func (c *BotConversation) Trace() *tracing.Scope {
+	return c.trace
+}
+
+// traceUpdate starts the span of the update consumed by the handler, and ends the span of the previous update
+func (c *BotConversation) traceUpdate(update *IncomingUpdate) {
+	ctx := tracing.ContextWithSpan(context.Background(), update.Span)
+	_, span := c.tracer.Start(ctx, tracing.SpanHandleUpdate, c.traceAttributes(tracing.Attr("update_id", update.UpdateID))...)
+	c.trace.Replace(span)
+}
+
+// traceAttributes returns the fields of the conversation logger (chat, conversation, handler and step) as span attributes
+func (c *BotConversation) traceAttributes(attrs ...tracing.Attribute) []tracing.Attribute {
+	fields := c.log.Fields()
+	for i := 0; i+1 < len(fields); i += 2 {
+		attrs = append(attrs, tracing.Attr(fmt.Sprint(fields[i]), fields[i+1]))
+	}
+	return attrs
+}
+
+// send sends the request through the bot as a child span of the consumed update
+func (c *BotConversation) send(msg tgbotapi.Chattable) (tgbotapi.Message, error) {
+	ctx := tracing.ContextWithSpan(context.Background(), c.trace.Span())
+	_, span := c.tracer.Start(ctx, tracing.SpanSend, tracing.Attr("request", fmt.Sprintf("%T", msg)), tracing.Attr("chat_id", c.chatID))
+	defer span.End()
+	message, err := c.bot.Send(c.postToThread(msg))
+	if !isBoolResult(err) {
+		span.RecordError(err)
+	}
+	return message, err
+}
+
+// LastActivity returns time of the latest update from the user, or of the start of the conversation
+func (c *BotConversation) LastActivity() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastActivity
+}
+
 // CancelByUser tolds conversation object that user switched to another conversation
 // that will be handled by a different conversation object
 func (c *BotConversation) CancelByUser() error {
@@ -173,22 +309,69 @@ func (c *BotConversation) CancelByUser() error {
 
 // IsCanceled indicates that the conversation was canceled by a user
 func (c *BotConversation) IsCanceled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.canceled
 }
 
+// Suspend closes the conversation on a shutdown of the bot without sending messages to the user,
+// so that the conversation can be resumed from the state after a restart
+func (c *BotConversation) Suspend() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.canceled = true
+	c.suspended = true
+}
+
+// IsSuspended indicates that the conversation was closed by a shutdown of the bot
+func (c *BotConversation) IsSuspended() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.suspended
+}
+
+// IsWaitingForUser indicates that the handler waits for an update from the user and there are no unprocessed updates
+func (c *BotConversation) IsWaitingForUser() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.waiting && len(c.updates) == 0
+}
+
+// setWaiting marks that the handler waits for an update from the user
+func (c *BotConversation) setWaiting(waiting bool) {
+	c.mu.Lock()
+	c.waiting = waiting
+	c.mu.Unlock()
+	if c.waitHook != nil {
+		c.waitHook(c.conversationID, waiting)
+	}
+}
+
 // PushUpdate checks whether a conversation can accept one more message, and forwards message to handler
 func (c *BotConversation) PushUpdate(update *tgbotapi.Update) error {
-	chatID, err := GetUpdateChatID(update)
+	if update == nil {
+		return c.PushIncomingUpdate(nil)
+	}
+	return c.PushIncomingUpdate(&IncomingUpdate{Update: *update})
+}
+
+// PushIncomingUpdate checks whether a conversation can accept one more update with its forum topic, and forwards it to handler
+func (c *BotConversation) PushIncomingUpdate(update *IncomingUpdate) error {
+	key, err := GetUpdateKey(update, PerChat)
 	if err != nil {
 		return err
 	}
+	chatID := key.ChatID
 	if c.chatID != chatID {
 		return fmt.Errorf("tried to process update from UserID %d in the conversation with UserID %d", chatID, c.chatID)
 	}
 	if len(c.updates) >= c.maxMessageQueue {
 		err := c.tooManyMessagesMessage()
-		return fmt.Errorf("to many open unprocessed messages in the conversation (%v)", err)
+		return fmt.Errorf("%w in the conversation (%v)", boterrors.ErrQueueFull, err)
 	}
+	c.mu.Lock()
+	c.lastActivity = time.Now()
+	c.mu.Unlock()
 	c.updates <- update
 	return nil
 }
@@ -196,10 +379,24 @@ func (c *BotConversation) PushUpdate(update *tgbotapi.Update) error {
 // GetFirstUpdateFromUser reads the first message in the conversation, the message should start a new handler.
 // If context is closed, or conversation queue is empty, returns false
 func (c *BotConversation) GetFirstUpdateFromUser(ctx context.Context) (*tgbotapi.Update, bool) {
+	update, exit := c.GetFirstIncomingUpdateFromUser(ctx)
+	if exit {
+		return nil, true
+	}
+	return &update.Update, false
+}
+
+// GetFirstIncomingUpdateFromUser reads the first update in the conversation together with the fields unknown to tgbotapi
+func (c *BotConversation) GetFirstIncomingUpdateFromUser(ctx context.Context) (*IncomingUpdate, bool) {
 	select {
 	case <-ctx.Done():
 		return nil, true // exit the conversation, as context is closed
 	case update := <-c.updates:
+		c.mu.Lock()
+		c.threadID = update.ThreadID // the handler answers in the topic where it was started
+		c.mu.Unlock()
+		c.rememberUserMessage(&update.Update)
+		c.traceUpdate(update)
 		return update, false
 	default:
 		return nil, true // exit as there is no messages
@@ -209,31 +406,80 @@ func (c *BotConversation) GetFirstUpdateFromUser(ctx context.Context) (*tgbotapi
 // GetUpdateFromUser waits for the next message from a user,
 // and returns pointer to the message and a flag that indicates that conversation is over
 func (c *BotConversation) GetUpdateFromUser(ctx context.Context) (*tgbotapi.Update, bool) {
+	c.setWaiting(true)
+	defer c.setWaiting(false)
 	select {
 	case update := <-c.updates:
-		return update, false
+		c.rememberUserMessage(&update.Update)
+		c.traceUpdate(update)
+		return &update.Update, false
 	case <-ctx.Done():
-		if !c.canceled {
+		if !c.IsCanceled() { // a suspended conversation is closed silently
 			err := c.cancelByBot()
 			if err != nil {
-				logger.Error(err.Error())
+				c.log.Error("cannot cancel the conversation", "error", err)
 			}
 		}
 		return nil, true
 	case <-time.After(time.Duration(c.timeoutMinutes) * time.Minute):
 		err := c.cancelByBot()
 		if err != nil {
-			logger.Error(err.Error())
+			c.log.Error("cannot cancel the conversation", "error", err)
 		}
 		return nil, true
 	}
 }
 
+// rememberUserMessage records ID of a message from the user to address replies to it
+func (c *BotConversation) rememberUserMessage(update *tgbotapi.Update) {
+	if update != nil && update.Message != nil {
+		c.mu.Lock()
+		c.lastUserMessageID = update.Message.MessageID
+		c.mu.Unlock()
+	}
+}
+
+// isSeparatedPerUser indicates that the conversation is one of several conversations with different users in a group
+func (c *BotConversation) isSeparatedPerUser() bool {
+	return c.key.UserID != 0 && c.key.UserID != c.key.ChatID
+}
+
+// addressUser makes a message created by the conversation a reply to the latest message of the user,
+// so that members of a group can tell whose conversation it is
+func (c *BotConversation) addressUser(chat *tgbotapi.BaseChat) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.isSeparatedPerUser() && c.lastUserMessageID != 0 {
+		chat.ReplyToMessageID = c.lastUserMessageID
+		chat.AllowSendingWithoutReply = true
+	}
+}
+
+// postToThread makes a message to the chat of the conversation go to the topic of the conversation
+func (c *BotConversation) postToThread(msg tgbotapi.Chattable) tgbotapi.Chattable {
+	if chatID, ok := messageChatID(msg); !ok || chatID != c.chatID {
+		return msg
+	}
+	return PostToThread(msg, c.ThreadID())
+}
+
 // ChatID returns chat ID of the conversation
 func (c *BotConversation) ChatID() int64 {
 	return c.chatID
 }
 
+// Key returns key of the conversation
+func (c *BotConversation) Key() state.ConversationKey {
+	return c.key
+}
+
+// ThreadID returns forum topic the conversation posts to, 0 if the chat has no topics
+func (c *BotConversation) ThreadID() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.threadID
+}
+
 // ConverationID returns unique id of the conversation object
 func (c *BotConversation) ConversationID() int64 {
 	return c.conversationID
@@ -242,19 +488,21 @@ func (c *BotConversation) ConversationID() int64 {
 // SendGeneralMessage sends a general tgbotapi message using the Bot
 // it returns messageID of the sent message end error if occured
 func (c *BotConversation) SendGeneralMessage(msg tgbotapi.Chattable) (int, error) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if c.canceled {
-		return 0, fmt.Errorf("the conversation with chat %d is already canceled", c.chatID)
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if c.IsCanceled() {
+		return 0, fmt.Errorf("the conversation with chat %d: %w", c.chatID, boterrors.ErrConversationCanceled)
 	}
 	// ToDo: check thy we are sending message to the same chatID
-	message, err := c.bot.Send(msg)
-	return message.MessageID, err
+	message, err := c.send(msg)
+	return message.MessageID, boterrors.FromAPI(err)
 }
 func (c *BotConversation) SendGeneralMessageWithKeyboardRemoveOnExit(msg tgbotapi.Chattable) (id int, err error) {
 	id, err = c.SendGeneralMessage(msg)
 	if err == nil {
+		c.mu.Lock()
 		c.messageIDForKeyboardRemove = id
+		c.mu.Unlock()
 	}
 	return
 }
@@ -280,12 +528,18 @@ func (c *BotConversation) ReplyWithText(text string, msgID int) (int, error) {
 func (c *BotConversation) DeleteMessage(msgID int) error {
 	deleteMsg := tgbotapi.NewDeleteMessage(c.chatID, msgID)
 	_, err := c.SendGeneralMessage(deleteMsg)
-	if err.Error() == "json: cannot unmarshal bool into Go value of type tgbotapi.Message" { // bug in api
-		err = nil
+	if isBoolResult(err) {
+		return nil
 	}
 	return err
 }
 
+// isBoolResult returns true if the error is caused by tgbotapi parsing a boolean result of a successful call as a message
+func isBoolResult(err error) bool {
+	var typeErr *json.UnmarshalTypeError
+	return errors.As(err, &typeErr) && typeErr.Value == "bool"
+}
+
 // RemoveReplyMarkup removes inline button from a message
 func (c *BotConversation) RemoveReplyMarkup(msgID int) error {
 	return c.EditReplyMarkup(msgID, tgbotapi.InlineKeyboardMarkup{InlineKeyboard: make([][]tgbotapi.InlineKeyboardButton, 0)})
@@ -302,6 +556,7 @@ func (c *BotConversation) EditReplyMarkup(msgID int, markup tgbotapi.InlineKeybo
 func (c *BotConversation) NewMessage(text string) tgbotapi.MessageConfig {
 	msg := tgbotapi.NewMessage(c.chatID, text)
 	msg.ParseMode = "HTML"
+	c.addressUser(&msg.BaseChat)
 	return msg
 }
 
@@ -322,6 +577,7 @@ func (c *BotConversation) NewPhotoShare(photoFileID string, caption string) tgbo
 		},
 		ParseMode: "HTML",
 	}
+	c.addressUser(&msg.BaseChat)
 	return msg
 }
 
@@ -333,6 +589,7 @@ func (c *BotConversation) NewPhotoUpload(fileData []byte, caption string) tgbota
 	})
 	msg.Caption = caption
 	msg.ParseMode = "HTML"
+	c.addressUser(&msg.BaseChat)
 	return msg
 }
 
@@ -343,6 +600,7 @@ func (c *BotConversation) NewDocumentUpload(fileData []byte, caption string, fil
 	})
 	msg.Caption = caption
 	msg.ParseMode = "HTML"
+	c.addressUser(&msg.BaseChat)
 	return msg
 }
 
@@ -365,17 +623,17 @@ func (c *BotConversation) EditMessageTextAndInlineMarkup(messageID int, text str
 
 // AnswerButton answer callback query
 func (c *BotConversation) AnswerButton(callbackQueryID string) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	if c.canceled {
-		return fmt.Errorf("the conversation with chat %d is already canceled", c.chatID)
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if c.IsCanceled() {
+		return fmt.Errorf("the conversation with chat %d: %w", c.chatID, boterrors.ErrConversationCanceled)
 	}
 	msg := tgbotapi.NewCallback(callbackQueryID, "")
-	_, err := c.bot.Send(msg)
-	if err.Error() == "json: cannot unmarshal bool into Go value of type tgbotapi.Message" { // bug in api
-		err = nil
+	_, err := c.send(msg)
+	if isBoolResult(err) {
+		return nil
 	}
-	return err
+	return boterrors.FromAPI(err)
 }
 
 // GetFile downloads file in memory and returns it
@@ -408,7 +666,19 @@ func (c *BotConversation) GetFileInfo(fileID string) (tgbotapi.File, error) {
 	})
 }
 
-// GlobalKeyboard returns global keyboard struct generated for the chat
+// GlobalKeyboard returns global keyboard struct generated for the chat.
+// In group conversations separated per user the keyboard is shown to the user only
 func (c *BotConversation) GlobalKeyboard() interface{} {
-	return c.globalKeyboardFunc()
+	keyboard := c.globalKeyboardFunc()
+	if c.isSeparatedPerUser() {
+		switch k := keyboard.(type) {
+		case tgbotapi.ReplyKeyboardMarkup:
+			k.Selective = true
+			return k
+		case tgbotapi.ReplyKeyboardRemove:
+			k.Selective = true
+			return k
+		}
+	}
+	return keyboard
 }
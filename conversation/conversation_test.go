@@ -8,6 +8,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/ufy-it/go-telegram-bot/boterrors"
 	"github.com/ufy-it/go-telegram-bot/conversation"
 	"github.com/ufy-it/go-telegram-bot/state"
 
@@ -238,7 +239,7 @@ func TestPushUpdate(t *testing.T) {
 		t.Errorf("unexpected error: %v", err)
 	}
 	err = conv.PushUpdate(&update) // second try should not fit the queue
-	if err == nil || err.Error() != fmt.Sprintf("to many open unprocessed messages in the conversation (%v)", nil) {
+	if !errors.Is(err, boterrors.ErrQueueFull) {
 		t.Errorf("unexpected error: %v", err)
 	}
 
@@ -308,7 +309,7 @@ func TestMaxMessageQueue(t *testing.T) {
 			t.Errorf("update should be sent successfuly, but got error %v", err)
 		}
 	}
-	if err = conv.PushUpdate(&update); err == nil || err.Error() != fmt.Sprintf("to many open unprocessed messages in the conversation (%v)", nil) {
+	if err = conv.PushUpdate(&update); !errors.Is(err, boterrors.ErrQueueFull) {
 		t.Errorf("unexpected error: %v", err)
 	}
 	expectedMessage, err := json.Marshal(tgbotapi.NewMessage(13, "too many messages"))
@@ -348,3 +349,51 @@ func TestMessageCreation(t *testing.T) {
 		t.Errorf("unexpected message config %v", textMessage)
 	}
 }
+
+// errorBot returns the error on every call
+type errorBot struct {
+	dummyBot
+	err error
+}
+
+func (b *errorBot) Send(msg tgbotapi.Chattable) (tgbotapi.Message, error) {
+	return tgbotapi.Message{}, b.err
+}
+
+func TestTypedErrors(t *testing.T) {
+	config := conversation.Config{
+		MaxMessageQueue: 1,
+		TimeoutMinutes:  1,
+	}
+	bot := &errorBot{err: &tgbotapi.Error{Code: 403, Message: "Forbidden: bot was blocked by the user"}}
+	conv, err := conversation.NewConversation(9, bot, state.NewBotState(state.NewFileState("")),
+		nil, nil, func() error { return nil }, nil, config)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if _, err = conv.SendText("text"); !errors.Is(err, boterrors.ErrBotBlockedByUser) {
+		t.Errorf("expected blocked user error, got %v", err)
+	}
+
+	bot.err = &tgbotapi.Error{Code: 400, Message: "Bad Request: message is not modified"}
+	if err = conv.EditMessageText(1, "text"); !errors.Is(err, boterrors.ErrMessageNotModified) {
+		t.Errorf("expected not modified error, got %v", err)
+	}
+
+	bot.err = &json.UnmarshalTypeError{Value: "bool"} // tgbotapi cannot parse true returned by deleteMessage
+	if err = conv.DeleteMessage(1); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	bot.err = nil
+	if err = conv.DeleteMessage(1); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	conv.PushUpdate(&tgbotapi.Update{Message: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: 9}, Text: "Some update"}})
+	if err = conv.CancelByUser(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err = conv.SendText("text"); !errors.Is(err, boterrors.ErrConversationCanceled) {
+		t.Errorf("expected canceled conversation error, got %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package conversation
+
+import (
+	"errors"
+
+	"github.com/ufy-it/go-telegram-bot/state"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// KeyStrategy defines how updates from a chat are separated into conversations
+type KeyStrategy int
+
+const (
+	PerChat           KeyStrategy = iota // one conversation per chat (default)
+	PerChatUser                          // one conversation per user of a chat, so members of a group do not interfere with each other
+	PerChatThread                        // one conversation per forum topic of a chat
+	PerChatUserThread                    // one conversation per user in each forum topic of a chat
+)
+
+// GetUpdateKey returns key of the conversation that should handle the update
+func GetUpdateKey(update *IncomingUpdate, strategy KeyStrategy) (state.ConversationKey, error) {
+	if update == nil {
+		return state.ConversationKey{}, errors.New("update is nil")
+	}
+	var key state.ConversationKey
+	var from *tgbotapi.User
+	if update.MessageReaction != nil {
+		if update.MessageReaction.Chat == nil {
+			return state.ConversationKey{}, errors.New("expected chat field in message reaction, got nil")
+		}
+		key.ChatID, from = update.MessageReaction.Chat.ID, update.MessageReaction.User
+	} else {
+		chatID, err := GetUpdateChatID(&update.Update)
+		if err != nil {
+			return state.ConversationKey{}, err
+		}
+		key.ChatID, from = chatID, update.SentFrom()
+	}
+	if from != nil && (strategy == PerChatUser || strategy == PerChatUserThread) {
+		key.UserID = from.ID
+	}
+	if strategy == PerChatThread || strategy == PerChatUserThread {
+		key.ThreadID = update.ThreadID
+	}
+	return key, nil
+}
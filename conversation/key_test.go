@@ -0,0 +1,213 @@
+package conversation_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/ufy-it/go-telegram-bot/conversation"
+	"github.com/ufy-it/go-telegram-bot/state"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const topicUpdate = `{
+	"update_id": 7,
+	"message": {
+		"message_id": 3,
+		"message_thread_id": 15,
+		"is_topic_message": true,
+		"from": {"id": 10, "first_name": "User"},
+		"chat": {"id": -1001, "type": "supergroup", "is_forum": true},
+		"date": 0,
+		"text": "hi"
+	}
+}`
+
+func TestIncomingUpdateJSON(t *testing.T) {
+	var update conversation.IncomingUpdate
+	if err := json.Unmarshal([]byte(topicUpdate), &update); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if update.UpdateID != 7 || update.Message.Text != "hi" || update.ThreadID != 15 {
+		t.Errorf("Unexpected update %v with thread %d", update.Update, update.ThreadID)
+	}
+
+	data, err := json.Marshal(update)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	var decoded conversation.IncomingUpdate
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if decoded.ThreadID != 15 || decoded.Message.MessageID != 3 {
+		t.Errorf("Unexpected decoded update %s", data)
+	}
+
+	var reply conversation.IncomingUpdate
+	if err := json.Unmarshal([]byte(`{"update_id": 8, "message": {"message_id": 4, "message_thread_id": 3, "chat": {"id": -5}}}`), &reply); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if reply.ThreadID != 0 {
+		t.Errorf("Expected no thread for a reply outside of a topic, got %d", reply.ThreadID)
+	}
+}
+
+func TestGetUpdateKey(t *testing.T) {
+	var update conversation.IncomingUpdate
+	if err := json.Unmarshal([]byte(topicUpdate), &update); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	expected := map[conversation.KeyStrategy]state.ConversationKey{
+		conversation.PerChat:       {ChatID: -1001},
+		conversation.PerChatUser:   {ChatID: -1001, UserID: 10},
+		conversation.PerChatThread: {ChatID: -1001, ThreadID: 15},
+	}
+	for strategy, want := range expected {
+		key, err := conversation.GetUpdateKey(&update, strategy)
+		if err != nil || key != want {
+			t.Errorf("Strategy %d: expected key %v, got %v (%v)", strategy, want, key, err)
+		}
+	}
+	if _, err := conversation.GetUpdateKey(nil, conversation.PerChat); err == nil || err.Error() != "update is nil" {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func TestReplyToUserInGroup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conv, _ := conversation.NewConversationWithKey(state.ConversationKey{ChatID: -5, UserID: 10}, newDummyBot(),
+		state.NewBotState(state.NewMemoryState()), nil, nil, nil,
+		func() interface{} { return tgbotapi.NewRemoveKeyboard(true) }, conversation.Config{MaxMessageQueue: 1})
+
+	conv.PushUpdate(&tgbotapi.Update{Message: &tgbotapi.Message{MessageID: 21, Chat: &tgbotapi.Chat{ID: -5}}})
+	conv.GetFirstUpdateFromUser(ctx)
+
+	message := conv.NewMessage("text")
+	if message.ReplyToMessageID != 21 || !message.AllowSendingWithoutReply {
+		t.Errorf("Expected a reply to message 21, got %v", message)
+	}
+	if keyboard, ok := conv.GlobalKeyboard().(tgbotapi.ReplyKeyboardRemove); !ok || !keyboard.Selective {
+		t.Errorf("Expected a selective keyboard, got %v", conv.GlobalKeyboard())
+	}
+
+	private, _ := conversation.NewConversationWithKey(state.ConversationKey{ChatID: 10, UserID: 10}, newDummyBot(),
+		state.NewBotState(state.NewMemoryState()), nil, nil, nil, nil, conversation.Config{MaxMessageQueue: 1})
+	private.PushUpdate(&tgbotapi.Update{Message: &tgbotapi.Message{MessageID: 22, Chat: &tgbotapi.Chat{ID: 10}}})
+	private.GetFirstUpdateFromUser(ctx)
+	if message := private.NewMessage("text"); message.ReplyToMessageID != 0 {
+		t.Errorf("Expected no reply in a private chat, got %v", message)
+	}
+}
+
+func TestConversationInTopic(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bot := newDummyBot()
+	conv, _ := conversation.NewConversation(-1001, bot, state.NewBotState(state.NewMemoryState()),
+		nil, nil, nil, nil, conversation.Config{MaxMessageQueue: 1})
+	expectInTopic := func(msg tgbotapi.Chattable) {
+		t.Helper()
+		if inThread, ok := msg.(conversation.ThreadMessage); !ok || inThread.ThreadID != 15 {
+			t.Errorf("Expected a message in topic 15, got %v", msg)
+		}
+	}
+
+	var update conversation.IncomingUpdate
+	json.Unmarshal([]byte(topicUpdate), &update)
+	if err := conv.PushIncomingUpdate(&update); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	conv.GetFirstUpdateFromUser(ctx)
+	if conv.ThreadID() != 15 {
+		t.Errorf("Expected topic 15, got %d", conv.ThreadID())
+	}
+	conv.SendText("text")
+	conv.SendGeneralMessage(conv.NewDocumentUpload([]byte("data"), "caption", "file.txt"))
+	conv.SendGeneralMessage(tgbotapi.NewMessage(7, "other chat"))
+	expectInTopic(bot.SentMessages[0])
+	expectInTopic(bot.SentMessages[1])
+	if _, ok := bot.SentMessages[2].(tgbotapi.MessageConfig); !ok {
+		t.Errorf("Expected a message to another chat outside of the topic, got %v", bot.SentMessages[2])
+	}
+
+	botState := state.NewBotState(state.NewMemoryState())
+	botState.StartConversationWithKey(5, state.ConversationKey{ChatID: -1001}, 15, nil)
+	resumedBot := newDummyBot()
+	resumed, _ := conversation.NewConversationWithID(5, state.ConversationKey{ChatID: -1001}, resumedBot, botState,
+		nil, nil, nil, nil, conversation.Config{MaxMessageQueue: 1})
+	resumed.SendGeneralMessage(resumed.NewPhotoUpload([]byte("data"), "caption"))
+	expectInTopic(resumedBot.SentMessages[0])
+}
+
+// rawBot records raw calls of Bot API methods
+type rawBot struct {
+	endpoint string
+	params   tgbotapi.Params
+	files    []tgbotapi.RequestFile
+}
+
+func (b *rawBot) UploadFiles(endpoint string, params tgbotapi.Params, files []tgbotapi.RequestFile) (*tgbotapi.APIResponse, error) {
+	b.endpoint, b.params, b.files = endpoint, params, files
+	return &tgbotapi.APIResponse{Ok: true, Result: json.RawMessage(`{"message_id": 7}`)}, nil
+}
+
+func TestSendToThread(t *testing.T) {
+	bot := &rawBot{}
+	message, err := conversation.SendToThread(bot, conversation.PostToThread(tgbotapi.NewMessage(-1001, "text"), 15).(conversation.ThreadMessage))
+	if err != nil || message.MessageID != 7 {
+		t.Errorf("Unexpected result %v, %v", message, err)
+	}
+	if bot.endpoint != "sendMessage" || bot.params["message_thread_id"] != "15" || bot.params["text"] != "text" ||
+		bot.params["chat_id"] != "-1001" || bot.params["reply_to_message_id"] != "" {
+		t.Errorf("Unexpected call %s with %v", bot.endpoint, bot.params)
+	}
+
+	reply := tgbotapi.NewMessage(-1001, "reply")
+	reply.ReplyToMessageID = 3
+	conversation.SendToThread(bot, conversation.PostToThread(reply, 15).(conversation.ThreadMessage))
+	if bot.params["message_thread_id"] != "15" || bot.params["reply_to_message_id"] != "3" {
+		t.Errorf("Expected a reply in the topic, got %v", bot.params)
+	}
+
+	photo := tgbotapi.NewPhoto(-1001, tgbotapi.FileID("photo-id"))
+	photo.Caption = "caption"
+	conversation.SendToThread(bot, conversation.PostToThread(photo, 15).(conversation.ThreadMessage))
+	if bot.endpoint != "sendPhoto" || bot.params["caption"] != "caption" || len(bot.files) != 1 || bot.files[0].Name != "photo" {
+		t.Errorf("Unexpected call %s with %v and %v", bot.endpoint, bot.params, bot.files)
+	}
+
+	edit := tgbotapi.NewEditMessageText(-1001, 3, "edit")
+	if _, ok := conversation.PostToThread(edit, 15).(tgbotapi.EditMessageTextConfig); !ok {
+		t.Errorf("Expected edits to be sent as they are")
+	}
+}
+
+func TestMessageReactionJSON(t *testing.T) {
+	raw := `{"update_id": 9, "message_reaction": {"chat": {"id": -5, "type": "group"}, "message_id": 4,
+		"user": {"id": 10, "first_name": "User"}, "date": 0, "old_reaction": [],
+		"new_reaction": [{"type": "emoji", "emoji": "🔥"}]}}`
+	var update conversation.IncomingUpdate
+	if err := json.Unmarshal([]byte(raw), &update); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	reaction := update.MessageReaction
+	if update.UpdateID != 9 || reaction == nil || reaction.MessageID != 4 || len(reaction.NewReaction) != 1 || reaction.NewReaction[0].Emoji != "🔥" {
+		t.Fatalf("Unexpected reaction %v", reaction)
+	}
+	key, err := conversation.GetUpdateKey(&update, conversation.PerChatUser)
+	if err != nil || key != (state.ConversationKey{ChatID: -5, UserID: 10}) {
+		t.Errorf("Unexpected key %v (%v)", key, err)
+	}
+
+	data, err := json.Marshal(update)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	var decoded conversation.IncomingUpdate
+	if err := json.Unmarshal(data, &decoded); err != nil || decoded.MessageReaction == nil || decoded.MessageReaction.User.ID != 10 {
+		t.Errorf("Unexpected decoded update %s (%v)", data, err)
+	}
+}
@@ -0,0 +1,24 @@
+package conversation
+
+import (
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// ReactionType is a reaction on a message: an emoji, a custom emoji or a paid reaction
+type ReactionType struct {
+	Type          string `json:"type"`                      // "emoji", "custom_emoji" or "paid"
+	Emoji         string `json:"emoji,omitempty"`           // emoji of the reaction if the type is "emoji"
+	CustomEmojiID string `json:"custom_emoji_id,omitempty"` // id of the custom emoji if the type is "custom_emoji"
+}
+
+// MessageReaction is a change of reactions on a message by a user (message_reaction update).
+// tgbotapi v5.5.1 does not support reactions, so the bot decodes them itself
+type MessageReaction struct {
+	Chat        *tgbotapi.Chat `json:"chat"`                 // chat of the message
+	MessageID   int            `json:"message_id"`           // id of the message
+	User        *tgbotapi.User `json:"user,omitempty"`       // user that changed the reaction, nil for anonymous reactions
+	ActorChat   *tgbotapi.Chat `json:"actor_chat,omitempty"` // chat on behalf of which the reaction was changed, if the user is anonymous
+	Date        int            `json:"date"`                 // date of the change
+	OldReaction []ReactionType `json:"old_reaction"`         // previous reactions of the user
+	NewReaction []ReactionType `json:"new_reaction"`         // new reactions of the user
+}
@@ -0,0 +1,143 @@
+package conversation
+
+import (
+	"encoding/json"
+	"fmt"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// RawBot is a bot that makes raw calls of Bot API methods, *tgbotapi.BotAPI implements it
+type RawBot interface {
+	UploadFiles(endpoint string, params tgbotapi.Params, files []tgbotapi.RequestFile) (*tgbotapi.APIResponse, error)
+}
+
+// ThreadMessage is a text message, a photo or a document to the forum topic ThreadID.
+// tgbotapi v5.5.1 cannot send message_thread_id, so SendToThread sends the message with a raw call.
+// A bot that sends the message as a plain Chattable posts a reply to the root message of the topic, which Telegram places into the same topic
+type ThreadMessage struct {
+	tgbotapi.Chattable
+	ThreadID int
+
+	replied bool // the message replies to the root message of the topic only to get into the topic
+}
+
+// PostToThread returns the message for the forum topic threadID. The message is returned as is
+// if threadID is 0 (the chat has no topics), or if it is not a text message, a photo or a document
+func PostToThread(c tgbotapi.Chattable, threadID int) tgbotapi.Chattable {
+	if threadID == 0 {
+		return c
+	}
+	message := ThreadMessage{ThreadID: threadID}
+	switch m := c.(type) {
+	case tgbotapi.MessageConfig:
+		message.replied = replyToThread(&m.BaseChat, threadID)
+		message.Chattable = m
+	case tgbotapi.PhotoConfig:
+		message.replied = replyToThread(&m.BaseChat, threadID)
+		message.Chattable = m
+	case tgbotapi.DocumentConfig:
+		message.replied = replyToThread(&m.BaseChat, threadID)
+		message.Chattable = m
+	default:
+		return c
+	}
+	return message
+}
+
+// replyToThread makes the message reply to the root message of the topic, unless it already replies to another message
+func replyToThread(chat *tgbotapi.BaseChat, threadID int) bool {
+	if chat.ReplyToMessageID != 0 {
+		return false
+	}
+	chat.ReplyToMessageID = threadID
+	chat.AllowSendingWithoutReply = true
+	return true
+}
+
+// messageChatID returns the chat of a text message, a photo or a document, false for other calls
+func messageChatID(c tgbotapi.Chattable) (int64, bool) {
+	switch m := c.(type) {
+	case tgbotapi.MessageConfig:
+		return m.ChatID, true
+	case tgbotapi.PhotoConfig:
+		return m.ChatID, true
+	case tgbotapi.DocumentConfig:
+		return m.ChatID, true
+	}
+	return 0, false
+}
+
+// SendToThread sends the message to its forum topic with message_thread_id through a raw call of the bot
+func SendToThread(bot RawBot, message ThreadMessage) (tgbotapi.Message, error) {
+	method, params, files, err := rawCall(message.Chattable)
+	if err != nil {
+		return tgbotapi.Message{}, err
+	}
+	if message.replied {
+		delete(params, "reply_to_message_id")
+		delete(params, "allow_sending_without_reply")
+	}
+	params.AddNonZero("message_thread_id", message.ThreadID)
+	resp, err := bot.UploadFiles(method, params, files)
+	if err != nil {
+		return tgbotapi.Message{}, err
+	}
+	var result tgbotapi.Message
+	err = json.Unmarshal(resp.Result, &result)
+	return result, err
+}
+
+// rawCall returns the method, the params and the files of the call that sends the message, the same as tgbotapi makes them
+func rawCall(c tgbotapi.Chattable) (string, tgbotapi.Params, []tgbotapi.RequestFile, error) {
+	switch m := c.(type) {
+	case tgbotapi.MessageConfig:
+		params, err := baseChatParams(m.BaseChat)
+		params.AddNonEmpty("text", m.Text)
+		params.AddBool("disable_web_page_preview", m.DisableWebPagePreview)
+		params.AddNonEmpty("parse_mode", m.ParseMode)
+		if err == nil {
+			err = params.AddInterface("entities", m.Entities)
+		}
+		return "sendMessage", params, nil, err
+	case tgbotapi.PhotoConfig:
+		params, err := baseChatParams(m.BaseChat)
+		params.AddNonEmpty("caption", m.Caption)
+		params.AddNonEmpty("parse_mode", m.ParseMode)
+		if err == nil {
+			err = params.AddInterface("caption_entities", m.CaptionEntities)
+		}
+		return "sendPhoto", params, withThumb(tgbotapi.RequestFile{Name: "photo", Data: m.File}, m.Thumb), err
+	case tgbotapi.DocumentConfig:
+		params, err := baseChatParams(m.BaseChat)
+		params.AddNonEmpty("caption", m.Caption)
+		params.AddNonEmpty("parse_mode", m.ParseMode)
+		params.AddBool("disable_content_type_detection", m.DisableContentTypeDetection)
+		if err == nil {
+			err = params.AddInterface("caption_entities", m.CaptionEntities)
+		}
+		return "sendDocument", params, withThumb(tgbotapi.RequestFile{Name: "document", Data: m.File}, m.Thumb), err
+	}
+	return "", nil, nil, fmt.Errorf("cannot send %T to a forum topic", c)
+}
+
+// baseChatParams returns the params common for all messages
+func baseChatParams(chat tgbotapi.BaseChat) (tgbotapi.Params, error) {
+	params := make(tgbotapi.Params)
+	if err := params.AddFirstValid("chat_id", chat.ChatID, chat.ChannelUsername); err != nil {
+		return params, err
+	}
+	params.AddNonZero("reply_to_message_id", chat.ReplyToMessageID)
+	params.AddBool("disable_notification", chat.DisableNotification)
+	params.AddBool("allow_sending_without_reply", chat.AllowSendingWithoutReply)
+	return params, params.AddInterface("reply_markup", chat.ReplyMarkup)
+}
+
+// withThumb returns the files of the message with the thumbnail if it is set
+func withThumb(file tgbotapi.RequestFile, thumb tgbotapi.RequestFileData) []tgbotapi.RequestFile {
+	files := []tgbotapi.RequestFile{file}
+	if thumb != nil {
+		files = append(files, tgbotapi.RequestFile{Name: "thumb", Data: thumb})
+	}
+	return files
+}
@@ -0,0 +1,112 @@
+package conversation
+
+import (
+	"encoding/json"
+
+	"github.com/ufy-it/go-telegram-bot/tracing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// IncomingUpdate is an update from Telegram together with the fields that tgbotapi v5.5.1 does not decode
+type IncomingUpdate struct {
+	tgbotapi.Update
+	ThreadID        int              // forum topic (message thread) of the update, 0 if the chat has no topics
+	MessageReaction *MessageReaction // change of reactions on a message, nil for other updates
+	Span            tracing.Span     // span of processing the update, the handler that consumes the update continues its trace. nil if the update is not traced
+}
+
+// topicFields mirrors forum topic fields of a message
+type topicFields struct {
+	MessageThreadID int  `json:"message_thread_id,omitempty"`
+	IsTopicMessage  bool `json:"is_topic_message,omitempty"`
+}
+
+// updateExtraFields mirrors forum topic fields of messages and other fields unknown to tgbotapi in a raw update
+type updateExtraFields struct {
+	MessageReaction *MessageReaction `json:"message_reaction"`
+	Message         *topicFields     `json:"message"`
+	EditedMessage   *topicFields     `json:"edited_message"`
+	CallbackQuery   *struct {
+		Message *topicFields `json:"message"`
+	} `json:"callback_query"`
+}
+
+// UnmarshalJSON decodes an update, the forum topic of its message and the fields unknown to tgbotapi
+func (u *IncomingUpdate) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &u.Update); err != nil {
+		return err
+	}
+	var fields updateExtraFields
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	u.MessageReaction = fields.MessageReaction
+	u.ThreadID = 0
+	for _, message := range []*topicFields{fields.Message, fields.EditedMessage, fields.callbackMessage()} {
+		if message != nil && message.IsTopicMessage {
+			u.ThreadID = message.MessageThreadID
+		}
+	}
+	return nil
+}
+
+// MarshalJSON encodes an update, the forum topic of its message and the fields unknown to tgbotapi
+func (u IncomingUpdate) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(u.Update)
+	if err != nil || u.ThreadID == 0 && u.MessageReaction == nil {
+		return data, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	if u.MessageReaction != nil {
+		if fields["message_reaction"], err = json.Marshal(u.MessageReaction); err != nil {
+			return nil, err
+		}
+	}
+	if u.ThreadID == 0 {
+		return json.Marshal(fields)
+	}
+	for _, name := range []string{"message", "edited_message"} {
+		if message, ok := fields[name]; ok {
+			if fields[name], err = withTopic(message, u.ThreadID); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if callback, ok := fields["callback_query"]; ok {
+		var callbackFields map[string]json.RawMessage
+		if err := json.Unmarshal(callback, &callbackFields); err != nil {
+			return nil, err
+		}
+		if message, ok := callbackFields["message"]; ok {
+			if callbackFields["message"], err = withTopic(message, u.ThreadID); err != nil {
+				return nil, err
+			}
+			if fields["callback_query"], err = json.Marshal(callbackFields); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return json.Marshal(fields)
+}
+
+func (f updateExtraFields) callbackMessage() *topicFields {
+	if f.CallbackQuery == nil {
+		return nil
+	}
+	return f.CallbackQuery.Message
+}
+
+// withTopic adds forum topic fields to a raw message
+func withTopic(message json.RawMessage, threadID int) (json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(message, &fields); err != nil {
+		return nil, err
+	}
+	fields["message_thread_id"], _ = json.Marshal(threadID)
+	fields["is_topic_message"] = json.RawMessage("true")
+	return json.Marshal(fields)
+}
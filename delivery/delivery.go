@@ -0,0 +1,104 @@
+// Package delivery describes messages that the bot sends outside of conversations: single messages that wait for the end
+// of a conversation in the chat, and broadcasts to many chats. The dispatcher implements OutboxSender and Broadcaster,
+// so jobs can use them without depending on the dispatcher
+package delivery
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ufy-it/go-telegram-bot/state"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// OutboxMessage is a single message from the bot to a chat that is delivered when the chat has no ongoing conversation
+type OutboxMessage struct {
+	ChatID             int64                          `json:"chat_id"`
+	Text               string                         `json:"text,omitempty"`                // text of the message, or caption of the photo
+	ParseMode          string                         `json:"parse_mode,omitempty"`          // parse mode of the text, e.g. "HTML"
+	Photo              []byte                         `json:"photo,omitempty"`               // photo to upload, nil for text messages
+	Keyboard           *tgbotapi.InlineKeyboardMarkup `json:"keyboard,omitempty"`            // inline keyboard attached to the message
+	Priority           int                            `json:"priority,omitempty"`            // messages with higher priority are delivered first
+	ExpiresAt          time.Time                      `json:"expires_at,omitempty"`          // time after which the message is dropped, zero if it never expires
+	DuringConversation bool                           `json:"during_conversation,omitempty"` // deliver the message even if the chat has an ongoing conversation
+	QueuedAt           time.Time                      `json:"queued_at"`                     // time when the message was queued
+}
+
+// Chattable creates a message for the Bot API
+func (m *OutboxMessage) Chattable() tgbotapi.Chattable {
+	if m.Photo != nil {
+		msg := tgbotapi.NewPhoto(m.ChatID, tgbotapi.FileReader{
+			Name:   "image.png",
+			Reader: bytes.NewReader(m.Photo),
+		})
+		msg.Caption = m.Text
+		msg.ParseMode = m.ParseMode
+		if m.Keyboard != nil {
+			msg.ReplyMarkup = *m.Keyboard
+		}
+		return msg
+	}
+	msg := tgbotapi.NewMessage(m.ChatID, m.Text)
+	msg.ParseMode = m.ParseMode
+	if m.Keyboard != nil {
+		msg.ReplyMarkup = *m.Keyboard
+	}
+	return msg
+}
+
+// Expired returns true if the message should not be delivered anymore
+func (m *OutboxMessage) Expired(now time.Time) bool {
+	return !m.ExpiresAt.IsZero() && now.After(m.ExpiresAt)
+}
+
+// OutboxSender is an interface for an object that can send a single message with delivery options (priority, expiry,
+// delivery during a conversation)
+type OutboxSender interface {
+	SendOutboxMessage(ctx context.Context, message OutboxMessage) error // send the message, or queue it until the conversation in the chat is over
+}
+
+// Audience describes chats that receive a broadcast
+type Audience struct {
+	BroadcastID string  // unique ID of the broadcast, a broadcast with the same ID continues from its checkpoint
+	ChatIDs     []int64 // chats to send the message to. They are processed in ascending order, so a broadcast that continues from a checkpoint skips chats up to the last processed one
+	Parallel    int     // number of chats the message is sent to at once, 1 by default
+}
+
+// RegistryAudience creates an audience of active chats from the registry that match the filter (all active chats if the filter is nil)
+func RegistryAudience(broadcastID string, registry state.ChatRegistry, filter state.ChatFilterType) (Audience, error) {
+	chats, err := registry.GetChats(func(chat state.ChatInfo) bool {
+		return !chat.Blocked && (filter == nil || filter(chat))
+	})
+	if err != nil {
+		return Audience{}, fmt.Errorf("cannot select chats for broadcast %s: %v", broadcastID, err)
+	}
+	audience := Audience{BroadcastID: broadcastID, ChatIDs: make([]int64, 0, len(chats))}
+	for _, chat := range chats {
+		audience.ChatIDs = append(audience.ChatIDs, chat.ChatID)
+	}
+	return audience, nil
+}
+
+// BroadcastMessageFunc is a type of function that creates the message of a broadcast for the chat (any Chattable, e.g. a photo with buttons)
+type BroadcastMessageFunc func(chatID int64) tgbotapi.Chattable
+
+// BroadcastReport contains progress of a broadcast
+type BroadcastReport struct {
+	Total     int  `json:"total"`     // number of chats in the audience
+	Delivered int  `json:"delivered"` // number of chats that got the message
+	Failed    int  `json:"failed"`    // number of chats the message could not be sent to
+	Blocked   int  `json:"blocked"`   // number of chats that blocked the bot
+	Done      bool `json:"done"`      // flag that all chats of the audience are processed
+}
+
+// Broadcaster is an interface for an object that can send a message to many chats.
+// A broadcast interrupted by a restart is not continued on its own, as the message function is not saved:
+// call Broadcast again with the same audience, e.g. for each of UnfinishedBroadcasts when the bot starts
+type Broadcaster interface {
+	Broadcast(ctx context.Context, audience Audience, message BroadcastMessageFunc) (BroadcastReport, error) // send the message to all chats of the audience, might take long time
+	BroadcastProgress(broadcastID string) (BroadcastReport, bool)                                            // get progress of a broadcast
+	UnfinishedBroadcasts() []string                                                                          // get IDs of broadcasts that were started, but are not done
+}
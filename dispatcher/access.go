@@ -0,0 +1,56 @@
+package dispatcher
+
+import (
+	"context"
+
+	"github.com/ufy-it/go-telegram-bot/handlers"
+	"github.com/ufy-it/go-telegram-bot/logger"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// AccessDeniedPolicy defines what the dispatcher does if a user does not have the role required by a matching command handler
+type AccessDeniedPolicy int
+
+const (
+	FallThrough     AccessDeniedPolicy = iota // try the next handlers as if the selector did not match the command (default)
+	DenyWithMessage                           // send AccessDenied technical message and do not start any handler
+)
+
+// hasAccess returns true if the sender of the update has the role required by the command handler
+func (d *Dispatcher) hasAccess(ctx context.Context, handler handlers.CommandHandler, update *tgbotapi.Update, chatID int64) bool {
+	if handler.RequiredRole == "" {
+		return true
+	}
+	if d.roleResolver == nil {
+		logger.Warning("handler requires role %s, but role resolver is not set", handler.RequiredRole)
+		return false
+	}
+	from := update.SentFrom()
+	if from == nil {
+		return false // anonymous users and channels do not have roles
+	}
+	roles, err := d.roleResolver(ctx, from.ID, chatID)
+	if err != nil {
+		logger.Error("cannot resolve roles of user %d in chat %d: %v", from.ID, chatID, err)
+		return false
+	}
+	return handlers.HasRole(roles, handler.RequiredRole)
+}
+
+// selectCommandHandler returns creator and name of the first handler from the list that matches the update and is accessible by the user.
+// If a matching handler is not accessible and the policy is DenyWithMessage, returns nil and true. kind is used in names of handlers without a name
+func (d *Dispatcher) selectCommandHandler(ctx context.Context, list []handlers.CommandHandler, kind string, update *tgbotapi.Update, chatID int64) (handlers.HandlerCreatorType, string, bool) {
+	for i, handler := range list {
+		if !handler.CommandSelector(ctx, update) {
+			continue
+		}
+		if d.hasAccess(ctx, handler, update, chatID) {
+			return handler.HandlerCreator, handlerName(handler, kind, i), false
+		}
+		if d.accessDeniedPolicy == DenyWithMessage {
+			return nil, "", true
+		}
+	}
+	return nil, "", false
+}
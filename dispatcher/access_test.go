@@ -0,0 +1,106 @@
+package dispatcher_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/ufy-it/go-telegram-bot/dispatcher"
+	"github.com/ufy-it/go-telegram-bot/handlers"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// withAccess adds /stats commands for admins and other users, and resolves roles of users
+func withAccess(policy AccessDeniedPolicy) configOption {
+	resolver := func(ctx context.Context, userID, chatID int64) ([]handlers.Role, error) {
+		if userID == 666 {
+			return nil, errors.New("resolver failure")
+		}
+		return handlers.StaticRoleResolver(map[int64][]handlers.Role{1: {"admin"}})(ctx, userID, chatID)
+	}
+	return func(config *Config) {
+		config.Handlers.List = []handlers.CommandHandler{
+			{CommandSelector: handlers.RegExpCommandSelector("/stats"), HandlerCreator: handlers.MessageHandlerCreator("admin stats"), RequiredRole: "admin"},
+			{CommandSelector: handlers.RegExpCommandSelector("/stats"), HandlerCreator: handlers.MessageHandlerCreator("public stats")},
+		}
+		config.TechnicalMessageFunc = func(chatID int64, messageID MessageIDType) string {
+			if messageID == AccessDenied {
+				return "access denied"
+			}
+			return ""
+		}
+		config.RoleResolver = resolver
+		config.AccessDeniedPolicy = policy
+	}
+}
+
+func userUpdate(userID int64, text string) *tgbotapi.Update {
+	update := textUpdate(userID, text)
+	update.Message.From = &tgbotapi.User{ID: userID}
+	return update
+}
+
+func TestAccessFallThrough(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bot := newRecordingBot()
+	d := newTestDispatcher(t, ctx, bot, 10, withAccess(FallThrough))
+
+	d.DispatchUpdate(userUpdate(1, "/stats"))
+	bot.expectText(t, 1, "admin stats")
+	d.DispatchUpdate(userUpdate(2, "/stats"))
+	bot.expectText(t, 2, "public stats")
+	d.DispatchUpdate(userUpdate(666, "/stats"))
+	bot.expectText(t, 666, "public stats")
+}
+
+func TestAccessDeniedWithMessage(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bot := newRecordingBot()
+	d := newTestDispatcher(t, ctx, bot, 10, withAccess(DenyWithMessage))
+
+	d.DispatchUpdate(userUpdate(2, "/stats"))
+	bot.expectText(t, 2, "access denied")
+	d.DispatchUpdate(userUpdate(2, "hello"))
+	bot.expectText(t, 2, "default")
+	d.DispatchUpdate(userUpdate(1, "/stats"))
+	bot.expectText(t, 1, "admin stats")
+}
+
+func TestRolesResolvedOutsideOfLock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bot := newRecordingBot()
+	resolving := make(chan struct{}, 2) // roles are resolved by the dispatcher and by the new conversation
+	release := make(chan struct{})
+	d := newTestDispatcher(t, ctx, bot, 10, withNameHandler, func(config *Config) {
+		config.GlobalHandlers = append(config.GlobalHandlers, handlers.CommandHandler{
+			CommandSelector: handlers.RegExpCommandSelector("/admin"), HandlerCreator: handlers.MessageHandlerCreator("admin"), RequiredRole: "admin"})
+		config.RoleResolver = func(ctx context.Context, userID, chatID int64) ([]handlers.Role, error) {
+			resolving <- struct{}{}
+			<-release
+			return []handlers.Role{"admin"}, nil
+		}
+	})
+
+	d.DispatchUpdate(userUpdate(1, "/name"))
+	d.DispatchUpdate(userUpdate(1, "/admin"))
+	<-resolving
+	sent := make(chan error, 1)
+	go func() { sent <- d.SendSingleMessage(ctx, 2, "direct", nil) }()
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("the dispatcher is locked while roles are resolved")
+	}
+	close(release)
+	bot.expectText(t, 2, "direct")
+	bot.expectText(t, 1, "closed by user")
+	bot.expectText(t, 1, "admin")
+}
@@ -0,0 +1,117 @@
+package dispatcher
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ufy-it/go-telegram-bot/conversation"
+	"github.com/ufy-it/go-telegram-bot/logger"
+)
+
+// ConversationInfo describes an open conversation for operators of the bot
+type ConversationInfo struct {
+	ConversationID int64     `json:"conversation_id"`
+	ChatID         int64     `json:"chat_id"`
+	UserID         int64     `json:"user_id,omitempty"`   // set if conversations are separated per user
+	ThreadID       int       `json:"thread_id,omitempty"` // set for conversations in forum topics
+	Step           int       `json:"step"`                // index of the current step of the handler, -1 if the handler has not started yet
+	WaitingForUser bool      `json:"waiting_for_user"`    // true if the handler waits for an update from the user
+	LastActivity   time.Time `json:"last_activity"`       // time of the latest update from the user
+	IdleSeconds    int64     `json:"idle_seconds"`        // seconds since the latest update from the user
+}
+
+// Conversations returns open conversations ordered by ID. If chatID is not 0, only conversations in the chat are returned
+func (d *Dispatcher) Conversations(chatID int64) []ConversationInfo {
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	result := make([]ConversationInfo, 0, len(d.conversations))
+	for id, conv := range d.conversations {
+		if chatID != 0 && conv.c.ChatID() != chatID {
+			continue
+		}
+		step, ok := d.state.GetConversationStep(id)
+		if !ok {
+			step = -1
+		}
+		key := conv.c.Key()
+		lastActivity := conv.c.LastActivity()
+		result = append(result, ConversationInfo{
+			ConversationID: id,
+			ChatID:         key.ChatID,
+			UserID:         key.UserID,
+			ThreadID:       key.ThreadID,
+			Step:           step,
+			WaitingForUser: conv.c.IsWaitingForUser(),
+			LastActivity:   lastActivity,
+			IdleSeconds:    int64(now.Sub(lastActivity).Seconds()),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ConversationID < result[j].ConversationID })
+	return result
+}
+
+// CancelConversation closes the conversation as if it was closed by the bot: the user gets the ConversationClosedByBot message,
+// the handler gets a canceled context and the state of the conversation is removed when the handler returns.
+// Returns false if there is no such open conversation
+func (d *Dispatcher) CancelConversation(conversationID int64) (bool, error) {
+	d.mu.Lock()
+	conv, ok := d.conversations[conversationID]
+	if !ok {
+		d.mu.Unlock()
+		return false, nil
+	}
+	notify, err := conv.c.CloseByBot()
+	conv.cancel()
+	d.mu.Unlock()
+	if err == nil {
+		err = notify() // the message is sent without the lock, so that the dispatcher is not blocked by a slow chat
+	}
+	if err != nil {
+		return true, fmt.Errorf("cannot notify chat %d about the canceled conversation: %v", conv.c.ChatID(), err)
+	}
+	return true, nil
+}
+
+// DropChat removes conversations of the chat from the dispatcher and from the state at once, without waiting for their handlers,
+// so that a chat with a stuck handler is released: the next update from the chat starts a new conversation.
+// Handlers of the dropped conversations get a canceled context, and their states are not saved anymore, so they are not resumed after a restart.
+// Returns the number of dropped conversations
+func (d *Dispatcher) DropChat(chatID int64) (int, error) {
+	d.mu.Lock()
+	dropped := 0
+	var notifications []conversation.SpecialMessageFuncType
+	var lastErr error
+	for id, conv := range d.conversations {
+		if conv.c.ChatID() != chatID {
+			continue
+		}
+		if notify, err := conv.c.CloseByBot(); err == nil { // the user was notified about an already closed conversation before
+			notifications = append(notifications, notify)
+		}
+		conv.cancel()
+		delete(d.conversations, id)
+		if convID, ok := d.keyToConversationID[conv.c.Key()]; ok && convID == id {
+			delete(d.keyToConversationID, conv.c.Key())
+		}
+		if err := d.state.DropConversationState(id); err != nil {
+			lastErr = fmt.Errorf("cannot remove state of conversation %d: %v", id, err)
+		}
+		dropped++
+	}
+	if dropped > 0 {
+		d.reportConversations()
+	}
+	d.mu.Unlock()
+
+	for _, notify := range notifications {
+		if err := notify(); err != nil {
+			logger.Warning("cannot notify chat %d about the dropped conversation: %v", chatID, err)
+		}
+	}
+	if dropped > 0 {
+		logger.Note("dropped %d conversations in chat %d", dropped, chatID)
+	}
+	return dropped, lastErr
+}
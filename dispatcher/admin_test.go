@@ -0,0 +1,110 @@
+package dispatcher_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ufy-it/go-telegram-bot/conversation"
+	. "github.com/ufy-it/go-telegram-bot/dispatcher"
+	"github.com/ufy-it/go-telegram-bot/handlers"
+	"github.com/ufy-it/go-telegram-bot/handlers/readers"
+	"github.com/ufy-it/go-telegram-bot/state"
+)
+
+// waitForConversations waits until the dispatcher has n open conversations in the chat waiting for users
+func waitForConversations(t *testing.T, d *Dispatcher, chatID int64, n int) []ConversationInfo {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		convs := d.Conversations(chatID)
+		waiting := 0
+		for _, conv := range convs {
+			if conv.WaitingForUser {
+				waiting++
+			}
+		}
+		if len(convs) == n && waiting == n {
+			return convs
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d conversations waiting for users in chat %d, got %v", n, chatID, convs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAdminActions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bot := newRecordingBot()
+	release := make(chan struct{})
+	defer close(release)
+	io := state.NewMemoryState()
+	d, err := NewDispatcher(ctx, Config{
+		MaxOpenConversations: 10,
+		ConversationConfig:   conversation.Config{MaxMessageQueue: 5, TimeoutMinutes: 1},
+		Handlers: &handlers.CommandHandlers{
+			Default: handlers.MessageHandlerCreator("default"),
+			List: []handlers.CommandHandler{
+				{CommandSelector: handlers.RegExpCommandSelector("/echo"), HandlerCreator: echoHandler},
+				{CommandSelector: handlers.RegExpCommandSelector("/hang"), HandlerCreator: handlers.OneStepHandlerCreator(
+					func(ctx context.Context, conversation readers.BotConversation) error {
+						<-release // the handler ignores the context
+						return nil
+					})},
+			},
+		},
+		TechnicalMessageFunc: technicalMessageFunc,
+	}, bot, io)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.DispatchUpdate(textUpdate(1, "/echo"))
+	d.DispatchUpdate(textUpdate(2, "/echo"))
+	waitForConversations(t, d, 0, 2)
+	convs := waitForConversations(t, d, 1, 1)
+	if convs[0].ChatID != 1 || convs[0].Step != 0 || convs[0].IdleSeconds != 0 || convs[0].LastActivity.IsZero() {
+		t.Errorf("unexpected conversation info %v", convs[0])
+	}
+
+	canceled, err := d.CancelConversation(convs[0].ConversationID)
+	if !canceled || err != nil {
+		t.Errorf("expected the conversation to be canceled, got %v (%v)", canceled, err)
+	}
+	bot.expectText(t, 1, "closed by bot")
+	waitForConversations(t, d, 1, 0)
+	if canceled, err = d.CancelConversation(convs[0].ConversationID); canceled || err != nil {
+		t.Errorf("expected no conversation to cancel, got %v (%v)", canceled, err)
+	}
+	d.DispatchUpdate(textUpdate(1, "hi"))
+	bot.expectText(t, 1, "default")
+	bot.expectText(t, 1, "ended")
+
+	// a chat with a stuck handler is released at once
+	d.DispatchUpdate(textUpdate(3, "/hang"))
+	deadline := time.Now().Add(2 * time.Second)
+	for len(d.Conversations(3)) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if dropped, err := d.DropChat(3); dropped != 1 || err != nil {
+		t.Errorf("expected one dropped conversation, got %d (%v)", dropped, err)
+	}
+	bot.expectText(t, 3, "closed by bot")
+	if convs := d.Conversations(3); len(convs) != 0 {
+		t.Errorf("expected no conversations in the chat, got %v", convs)
+	}
+	saved := state.NewBotState(io)
+	if err := saved.LoadState(); err != nil || len(saved.GetConversationIDs()) != 1 {
+		t.Errorf("expected only the conversation in chat 2 in the state, got %v (%v)", saved.GetConversationIDs(), err)
+	}
+	d.DispatchUpdate(textUpdate(3, "hi"))
+	bot.expectText(t, 3, "default")
+	bot.expectText(t, 3, "ended")
+
+	if dropped, err := d.DropChat(4); dropped != 0 || err != nil {
+		t.Errorf("expected nothing to drop, got %d (%v)", dropped, err)
+	}
+	waitForConversations(t, d, 2, 1)
+}
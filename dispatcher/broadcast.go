@@ -0,0 +1,335 @@
+package dispatcher
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ufy-it/go-telegram-bot/boterrors"
+	"github.com/ufy-it/go-telegram-bot/delivery"
+	"github.com/ufy-it/go-telegram-bot/logger"
+	"github.com/ufy-it/go-telegram-bot/state"
+)
+
+// Audience describes chats that receive a broadcast
+type Audience = delivery.Audience
+
+// BroadcastMessageFunc is a type of function that creates the message of a broadcast for the chat
+type BroadcastMessageFunc = delivery.BroadcastMessageFunc
+
+// BroadcastReport contains progress of a broadcast
+type BroadcastReport = delivery.BroadcastReport
+
+// broadcastSaveEvery is the number of processed chats after which the checkpoint of a broadcast is saved,
+// so a broadcast interrupted by a crash sends the message again to at most this number of chats
+const broadcastSaveEvery = 20
+
+// finishedBroadcastTTL is the time a checkpoint of a finished broadcast is kept, so that the broadcast is not sent again
+const finishedBroadcastTTL = 7 * 24 * time.Hour
+
+// broadcastCheckpoint is a saved progress of a broadcast. Only the cursor is saved, as the audience is passed again when the broadcast continues
+type broadcastCheckpoint struct {
+	LastChatID int64           `json:"last_chat_id"`          // the latest processed chat, chats are processed in ascending order
+	Ahead      []int64         `json:"ahead,omitempty"`       // processed chats after LastChatID, when a broadcast is interrupted in the middle of a batch
+	Report     BroadcastReport `json:"report"`                // progress of the broadcast
+	FinishedAt time.Time       `json:"finished_at,omitempty"` // time when the broadcast was done
+}
+
+// processed returns the number of processed chats
+func (c *broadcastCheckpoint) processed() int {
+	return c.Report.Delivered + c.Report.Failed + c.Report.Blocked
+}
+
+// hasCursor returns true if LastChatID is set, as chat IDs can be negative
+func (c *broadcastCheckpoint) hasCursor() bool {
+	return c.processed() > len(c.Ahead)
+}
+
+// pending returns chats of the audience that are not processed yet, in ascending order without duplicates
+func (c *broadcastCheckpoint) pending(chatIDs []int64) []int64 {
+	sorted := append([]int64(nil), chatIDs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	ahead := make(map[int64]bool, len(c.Ahead))
+	for _, chatID := range c.Ahead {
+		ahead[chatID] = true
+	}
+	result := make([]int64, 0, len(sorted))
+	for i, chatID := range sorted {
+		if (i > 0 && chatID == sorted[i-1]) || (c.hasCursor() && chatID <= c.LastChatID) || ahead[chatID] {
+			continue
+		}
+		result = append(result, chatID)
+	}
+	return result
+}
+
+// recordBatch counts results of sending the message to the chats of a batch. Chats whose sending was interrupted by ctx
+// are not counted, they are processed again when the broadcast continues
+func (c *broadcastCheckpoint) recordBatch(ctx context.Context, broadcastID string, chatIDs []int64, errs []error) {
+	gap := false // an interrupted chat precedes the chat, so the cursor cannot move past it
+	for i, chatID := range chatIDs {
+		if ctx.Err() != nil && errors.Is(errs[i], ctx.Err()) {
+			gap = true
+			continue
+		}
+		c.record(broadcastID, chatID, errs[i])
+		if gap {
+			c.Ahead = append(c.Ahead, chatID)
+		} else {
+			c.LastChatID = chatID
+		}
+	}
+	ahead := c.Ahead[:0]
+	for _, chatID := range c.Ahead {
+		if chatID > c.LastChatID {
+			ahead = append(ahead, chatID)
+		}
+	}
+	c.Ahead = ahead
+}
+
+// record counts the result of sending the message to the chat
+func (c *broadcastCheckpoint) record(broadcastID string, chatID int64, err error) {
+	switch {
+	case err == nil:
+		c.Report.Delivered++
+	case errors.Is(err, boterrors.ErrChatInactive) || errors.Is(err, boterrors.ErrBotBlockedByUser):
+		c.Report.Blocked++
+	default:
+		c.Report.Failed++
+		logger.Warning("cannot send broadcast %s to chat %d: %v", broadcastID, chatID, err)
+	}
+}
+
+// broadcasts keeps checkpoints of broadcasts and saves them to io
+type broadcasts struct {
+	mu          sync.Mutex
+	checkpoints map[string]*broadcastCheckpoint
+	running     map[string]bool
+	io          state.StateIO // nil if checkpoints are kept in memory only
+}
+
+func newBroadcasts(io state.StateIO) *broadcasts {
+	b := &broadcasts{
+		checkpoints: make(map[string]*broadcastCheckpoint),
+		running:     make(map[string]bool),
+		io:          io,
+	}
+	if io == nil {
+		return b
+	}
+	data, err := io.Load()
+	if err != nil {
+		logger.Warning("cannot load broadcast checkpoints: %v, will start from blank", err)
+		return b
+	}
+	if err = json.Unmarshal(data, &b.checkpoints); err != nil {
+		logger.Warning("cannot parse broadcast checkpoints: %v, will start from blank", err)
+	}
+	now := time.Now()
+	for _, checkpoint := range b.checkpoints {
+		if checkpoint.Report.Done && checkpoint.FinishedAt.IsZero() {
+			checkpoint.FinishedAt = now // checkpoint saved before finish times were recorded
+		}
+	}
+	b.prune(now)
+	return b
+}
+
+// prune removes checkpoints of broadcasts that finished more than finishedBroadcastTTL ago, should be called under the lock
+func (b *broadcasts) prune(now time.Time) {
+	for broadcastID, checkpoint := range b.checkpoints {
+		if checkpoint.Report.Done && !b.running[broadcastID] && now.Sub(checkpoint.FinishedAt) > finishedBroadcastTTL {
+			delete(b.checkpoints, broadcastID)
+		}
+	}
+}
+
+// save writes all checkpoints to io, should be called under the lock
+func (b *broadcasts) save() error {
+	if b.io == nil {
+		return nil
+	}
+	b.prune(time.Now())
+	data, err := json.Marshal(b.checkpoints)
+	if err != nil {
+		return fmt.Errorf("cannot marshal broadcast checkpoints to json: %v", err)
+	}
+	if err = b.io.Save(data); err != nil {
+		return fmt.Errorf("cannot save broadcast checkpoints to io: %v", err)
+	}
+	return nil
+}
+
+// start returns checkpoint of the broadcast, a new one if the broadcast was not started before
+func (b *broadcasts) start(broadcastID string) (*broadcastCheckpoint, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.running[broadcastID] {
+		return nil, fmt.Errorf("broadcast %s is already running", broadcastID)
+	}
+	checkpoint, ok := b.checkpoints[broadcastID]
+	if !ok {
+		checkpoint = &broadcastCheckpoint{}
+		b.checkpoints[broadcastID] = checkpoint
+	}
+	b.running[broadcastID] = true
+	return checkpoint, nil
+}
+
+// update applies the change to the checkpoint under the lock, and saves checkpoints if save is true
+func (b *broadcasts) update(broadcastID string, save bool, change func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	change()
+	if !save {
+		return
+	}
+	if err := b.save(); err != nil {
+		logger.Error("cannot save checkpoint of broadcast %s: %v", broadcastID, err)
+	}
+}
+
+// stop marks the broadcast as not running
+func (b *broadcasts) stop(broadcastID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.running, broadcastID)
+}
+
+// report returns progress of the broadcast
+func (b *broadcasts) report(broadcastID string) (BroadcastReport, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	checkpoint, ok := b.checkpoints[broadcastID]
+	if !ok {
+		return BroadcastReport{}, false
+	}
+	return checkpoint.Report, true
+}
+
+// unfinished returns IDs of broadcasts that are not done
+func (b *broadcasts) unfinished() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	result := make([]string, 0)
+	for broadcastID, checkpoint := range b.checkpoints {
+		if !checkpoint.Report.Done {
+			result = append(result, broadcastID)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Broadcast sends a message to every chat of the audience, regardless of ongoing conversations, and blocks until all chats
+// are processed or the context is closed. Chats are processed in ascending order, Audience.Parallel chats at once.
+// Progress is saved every few chats, so a broadcast interrupted by cancellation or a restart continues after the latest
+// processed chat when Broadcast is called with the same BroadcastID and audience. The broadcast is not continued on its own
+// after a restart, as the message function is not saved: call Broadcast for each of UnfinishedBroadcasts when the bot starts.
+// Checkpoints of finished broadcasts are kept for a week. Chats that blocked the bot are skipped, a chat whose message function panics is counted as failed. Messages go through the bot of the dispatcher, so they follow the rate limits of the bot
+func (d *Dispatcher) Broadcast(ctx context.Context, audience Audience, message BroadcastMessageFunc) (BroadcastReport, error) {
+	if audience.BroadcastID == "" {
+		return BroadcastReport{}, errors.New("broadcast ID cannot be empty")
+	}
+	id := audience.BroadcastID
+	checkpoint, err := d.broadcasts.start(id)
+	if err != nil {
+		return BroadcastReport{}, err
+	}
+	defer d.broadcasts.stop(id)
+
+	var pending []int64
+	d.broadcasts.update(id, false, func() {
+		pending = checkpoint.pending(audience.ChatIDs)
+		if !checkpoint.Report.Done {
+			checkpoint.Report.Total = checkpoint.processed() + len(pending)
+		}
+	})
+	parallel := audience.Parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+	unsaved := 0
+	for {
+		var report BroadcastReport
+		d.broadcasts.update(id, false, func() { report = checkpoint.Report })
+		if report.Done {
+			return report, nil
+		}
+		if ctx.Err() != nil {
+			d.broadcasts.update(id, true, func() {})
+			return report, fmt.Errorf("broadcast %s is interrupted after %d of %d chats: %w",
+				id, report.Delivered+report.Failed+report.Blocked, report.Total, ctx.Err())
+		}
+		if len(pending) == 0 {
+			d.broadcasts.update(id, true, func() {
+				checkpoint.Report.Done = true
+				checkpoint.FinishedAt = time.Now()
+			})
+			continue
+		}
+
+		batch := pending[:parallel]
+		if len(pending) < parallel {
+			batch = pending
+		}
+		errs := d.broadcastBatch(ctx, batch, message)
+		unsaved += len(batch)
+		save := unsaved >= broadcastSaveEvery
+		if save {
+			unsaved = 0
+		}
+		d.broadcasts.update(id, save, func() { checkpoint.recordBatch(ctx, id, batch, errs) })
+		pending = pending[len(batch):] // interrupted chats of the batch are processed when the broadcast continues
+	}
+}
+
+// broadcastBatch sends the message of a broadcast to the chats at once, and returns errors in the order of the chats
+func (d *Dispatcher) broadcastBatch(ctx context.Context, chatIDs []int64, message BroadcastMessageFunc) []error {
+	errs := make([]error, len(chatIDs))
+	var wg sync.WaitGroup
+	for i, chatID := range chatIDs {
+		wg.Add(1)
+		go func(i int, chatID int64) {
+			defer wg.Done()
+			errs[i] = d.broadcastTo(ctx, chatID, message)
+		}(i, chatID)
+	}
+	wg.Wait()
+	return errs
+}
+
+// broadcastTo sends the message of a broadcast to the chat, a panic of the message function is turned into an error
+func (d *Dispatcher) broadcastTo(ctx context.Context, chatID int64, message BroadcastMessageFunc) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			logger.Error("broadcast to chat %d panicked: %v\n%s", chatID, recovered, debug.Stack())
+			err = fmt.Errorf("broadcast to chat %d panicked: %v", chatID, recovered)
+		}
+	}()
+	if !d.chats.IsChatActive(chatID) {
+		return boterrors.ErrChatInactive
+	}
+	msg := message(chatID)
+	if msg == nil {
+		return fmt.Errorf("no message for chat %d", chatID)
+	}
+	_, err = SendWithContext(ctx, d.bot, msg)
+	return d.checkBlocked(chatID, err)
+}
+
+// BroadcastProgress returns progress of the broadcast, false if the broadcast was never started
+func (d *Dispatcher) BroadcastProgress(broadcastID string) (BroadcastReport, bool) {
+	return d.broadcasts.report(broadcastID)
+}
+
+// UnfinishedBroadcasts returns IDs of broadcasts that were started, but are not done, e.g. because the bot restarted
+func (d *Dispatcher) UnfinishedBroadcasts() []string {
+	return d.broadcasts.unfinished()
+}
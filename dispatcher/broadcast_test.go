@@ -0,0 +1,210 @@
+package dispatcher_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/ufy-it/go-telegram-bot/dispatcher"
+	"github.com/ufy-it/go-telegram-bot/state"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// interruptingBot calls interrupt after the number of sent messages
+type interruptingBot struct {
+	*blockingBot
+	after     int
+	interrupt func()
+}
+
+func (b *interruptingBot) Send(msg tgbotapi.Chattable) (tgbotapi.Message, error) {
+	message, err := b.blockingBot.Send(msg)
+	if b.after--; b.after == 0 {
+		b.interrupt()
+	}
+	return message, err
+}
+
+// withBroadcastIO keeps checkpoints of broadcasts in io
+func withBroadcastIO(io state.StateIO) configOption {
+	return func(config *Config) {
+		config.TechnicalMessageFunc = EmptyTechnicalMessageFunc
+		config.BroadcastIO = io
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	io := state.NewMemoryState()
+	bot := &blockingBot{recordingBot: newRecordingBot(), blocked: map[int64]bool{3: true}}
+	audience := Audience{BroadcastID: "news", ChatIDs: []int64{1, 2, 3, 4, 5, 6}}
+	message := func(chatID int64) tgbotapi.Chattable {
+		return tgbotapi.NewPhoto(chatID, tgbotapi.FileID("photo"))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupted := &interruptingBot{blockingBot: bot, after: 3, interrupt: cancel}
+	d := newTestDispatcher(t, ctx, interrupted, 10, withBroadcastIO(io))
+	report, err := d.Broadcast(ctx, audience, message)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the broadcast to be interrupted, got %v", err)
+	}
+	if report.Delivered != 2 || report.Blocked != 1 || report.Done {
+		t.Errorf("unexpected report of the interrupted broadcast %+v", report)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background()) // restart of the bot
+	defer cancel()
+	d = newTestDispatcher(t, ctx, bot, 10, withBroadcastIO(io))
+	if progress, ok := d.BroadcastProgress("news"); !ok || progress != report {
+		t.Errorf("expected progress %+v to be restored, got %+v", report, progress)
+	}
+	if unfinished := d.UnfinishedBroadcasts(); len(unfinished) != 1 || unfinished[0] != "news" {
+		t.Errorf("expected the broadcast to be unfinished, got %v", unfinished)
+	}
+	report, err = d.Broadcast(ctx, audience, message)
+	expected := BroadcastReport{Total: 6, Delivered: 5, Blocked: 1, Done: true}
+	if err != nil || report != expected {
+		t.Errorf("unexpected report %+v (%v), expected %+v", report, err, expected)
+	}
+	received := make(map[int64]int)
+	for len(bot.sent) > 0 {
+		received[(<-bot.sent).(tgbotapi.PhotoConfig).ChatID]++
+	}
+	for _, chatID := range []int64{1, 2, 4, 5, 6} {
+		if received[chatID] != 1 {
+			t.Errorf("chat %d received %d messages", chatID, received[chatID])
+		}
+	}
+
+	if report, _ = d.Broadcast(ctx, audience, message); report != expected || len(bot.sent) != 0 {
+		t.Errorf("a finished broadcast should not be sent again")
+	}
+	if unfinished := d.UnfinishedBroadcasts(); len(unfinished) != 0 {
+		t.Errorf("expected no unfinished broadcasts, got %v", unfinished)
+	}
+}
+
+// countingIO counts saves to the memory state
+type countingIO struct {
+	state.StateIO
+	mu    sync.Mutex
+	saves int
+}
+
+func (c *countingIO) Save(data []byte) error {
+	c.mu.Lock()
+	c.saves++
+	c.mu.Unlock()
+	return c.StateIO.Save(data)
+}
+
+func TestParallelBroadcast(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bot := newRecordingBot()
+	io := &countingIO{StateIO: state.NewMemoryState()}
+	d := newTestDispatcher(t, ctx, bot, 10, withBroadcastIO(io))
+	audience := Audience{BroadcastID: "promo", Parallel: 4}
+	for chatID := int64(100); chatID > 0; chatID-- {
+		audience.ChatIDs = append(audience.ChatIDs, chatID)
+	}
+	report, err := d.Broadcast(ctx, audience, func(chatID int64) tgbotapi.Chattable {
+		return tgbotapi.NewMessage(chatID, "promo")
+	})
+	if err != nil || report != (BroadcastReport{Total: 100, Delivered: 100, Done: true}) {
+		t.Errorf("unexpected report %+v (%v)", report, err)
+	}
+	received := make(map[int64]bool)
+	for len(bot.sent) > 0 {
+		received[(<-bot.sent).(tgbotapi.MessageConfig).ChatID] = true
+	}
+	if len(received) != 100 {
+		t.Errorf("expected messages to 100 chats, got %d", len(received))
+	}
+	if io.saves > 10 {
+		t.Errorf("the checkpoint should be saved every few chats, got %d saves", io.saves)
+	}
+}
+
+// cancelingBot cancels the broadcast while the message to the chat is sent, the message is not delivered
+type cancelingBot struct {
+	*recordingBot
+	mu     sync.Mutex
+	chatID int64
+	cancel func()
+}
+
+func (b *cancelingBot) Send(msg tgbotapi.Chattable) (tgbotapi.Message, error) {
+	b.mu.Lock()
+	if message, ok := msg.(tgbotapi.MessageConfig); ok && message.ChatID == b.chatID {
+		b.chatID = 0
+		b.mu.Unlock()
+		b.cancel()
+		return tgbotapi.Message{}, context.Canceled
+	}
+	b.mu.Unlock()
+	return b.recordingBot.Send(msg)
+}
+
+func TestBroadcastInterruptedInBatch(t *testing.T) {
+	io := state.NewMemoryState()
+	audience := Audience{BroadcastID: "batch", ChatIDs: []int64{1, 2, 3, 4, 5, 6, 7, 8}, Parallel: 4}
+	message := func(chatID int64) tgbotapi.Chattable {
+		if chatID == 2 {
+			panic("bad message")
+		}
+		return tgbotapi.NewMessage(chatID, "news")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	bot := &cancelingBot{recordingBot: newRecordingBot(), chatID: 6, cancel: cancel}
+	d := newTestDispatcher(t, ctx, bot, 10, withBroadcastIO(io))
+	report, err := d.Broadcast(ctx, audience, message)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the broadcast to be interrupted, got %v", err)
+	}
+	if report.Delivered != 6 || report.Failed != 1 || report.Done {
+		t.Errorf("unexpected report of the interrupted broadcast %+v", report)
+	}
+	for len(bot.sent) > 0 {
+		<-bot.sent
+	}
+
+	ctx, cancel = context.WithCancel(context.Background()) // restart of the bot
+	defer cancel()
+	d = newTestDispatcher(t, ctx, bot.recordingBot, 10, withBroadcastIO(io))
+	report, err = d.Broadcast(ctx, audience, message)
+	expected := BroadcastReport{Total: 8, Delivered: 7, Failed: 1, Done: true}
+	if err != nil || report != expected {
+		t.Errorf("unexpected report %+v (%v), expected %+v", report, err, expected)
+	}
+	if len(bot.sent) != 1 {
+		t.Fatalf("expected only the interrupted chat to get the message, got %d messages", len(bot.sent))
+	}
+	if chatID := (<-bot.sent).(tgbotapi.MessageConfig).ChatID; chatID != 6 {
+		t.Errorf("expected the message to the interrupted chat 6, got %d", chatID)
+	}
+}
+
+func TestFinishedBroadcastsArePruned(t *testing.T) {
+	io := state.NewMemoryState()
+	io.Save([]byte(`{
+		"old": {"last_chat_id": 2, "report": {"total": 2, "delivered": 2, "done": true}, "finished_at": "2020-01-01T00:00:00Z"},
+		"recent": {"last_chat_id": 2, "report": {"total": 2, "delivered": 2, "done": true}, "finished_at": "` + time.Now().Format(time.RFC3339) + `"},
+		"unfinished": {"last_chat_id": 1, "report": {"total": 2, "delivered": 1}}
+	}`))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := newTestDispatcher(t, ctx, newRecordingBot(), 10, withBroadcastIO(io))
+	if _, ok := d.BroadcastProgress("old"); ok {
+		t.Error("expected the checkpoint of an old finished broadcast to be pruned")
+	}
+	for _, id := range []string{"recent", "unfinished"} {
+		if _, ok := d.BroadcastProgress(id); !ok {
+			t.Errorf("expected the checkpoint of broadcast %s to be kept", id)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package dispatcher
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/ufy-it/go-telegram-bot/boterrors"
+	"github.com/ufy-it/go-telegram-bot/conversation"
+	"github.com/ufy-it/go-telegram-bot/logger"
+	"github.com/ufy-it/go-telegram-bot/state"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// ChatStatusHookType is a type of function that is called when a chat is deactivated (the user blocked the bot,
+// or the bot was removed from a group) or activated again. The function is called in the background in the order of the changes,
+// so a slow hook does not delay dispatching and sending, but delays the next calls of the hook
+type ChatStatusHookType func(chatID int64, active bool)
+
+// chatStatus is a change of activity of a chat waiting for the hook
+type chatStatus struct {
+	chatID int64
+	active bool
+}
+
+// chatStatusQueue keeps changes of activity of chats for the hook
+type chatStatusQueue struct {
+	mu      sync.Mutex
+	changes []chatStatus
+	running bool // a goroutine calls the hook for the queued changes
+}
+
+// chatBot is a ContextBot of a single chat that deactivates the chat if the user blocked the bot
+type chatBot struct {
+	Bot
+	chatID int64
+	d      *Dispatcher
+}
+
+// Send sends a message of a conversation to the chat and checks whether the user blocked the bot.
+// Conversations send without a context, so waits for a throttled call are stopped together with conversations
+func (b chatBot) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	return b.SendContext(b.d.conversationsCtx, c)
+}
+
+// SendContext sends a message to the chat until the context is closed, and checks whether the user blocked the bot
+func (b chatBot) SendContext(ctx context.Context, c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	message, err := SendWithContext(ctx, b.Bot, c)
+	return message, b.d.checkBlocked(b.chatID, err)
+}
+
+// Request makes the call of a conversation and checks whether the user blocked the bot
+func (b chatBot) Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	return b.RequestContext(b.d.conversationsCtx, c)
+}
+
+// RequestContext makes the call until the context is closed, and checks whether the user blocked the bot
+func (b chatBot) RequestContext(ctx context.Context, c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	response, err := RequestWithContext(ctx, b.Bot, c)
+	return response, b.d.checkBlocked(b.chatID, err)
+}
+
+// botForChat returns a bot for the conversations in the chat
+func (d *Dispatcher) botForChat(chatID int64) Bot {
+	return chatBot{Bot: d.bot, chatID: chatID, d: d}
+}
+
+// checkBlocked deactivates the chat if the error says that the user blocked the bot, and returns the error converted with boterrors.FromAPI
+func (d *Dispatcher) checkBlocked(chatID int64, err error) error {
+	err = boterrors.FromAPI(err)
+	if errors.Is(err, boterrors.ErrBotBlockedByUser) {
+		d.setChatActive(chatID, false)
+	}
+	return err
+}
+
+// setChatActive records activity of the chat in the registry and calls the hook if the activity changed
+func (d *Dispatcher) setChatActive(chatID int64, active bool) {
+	changed, err := d.chats.SetChatActive(chatID, active)
+	if err != nil {
+		logger.Error("cannot update activity of chat %d: %v", chatID, err)
+		return
+	}
+	if !changed {
+		return
+	}
+	if active {
+		logger.Note("chat %d is active again", chatID)
+	} else {
+		logger.Note("chat %d is deactivated", chatID)
+	}
+	if d.chatStatusHook != nil {
+		d.notifyChatStatus(chatStatus{chatID, active})
+	}
+}
+
+// notifyChatStatus queues the change for the hook and starts a goroutine that calls the hook if it is not running,
+// so the hook is not called under locks of the caller
+func (d *Dispatcher) notifyChatStatus(status chatStatus) {
+	q := &d.chatStatuses
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.changes = append(q.changes, status)
+	if q.running {
+		return
+	}
+	q.running = true
+	go func() {
+		for {
+			q.mu.Lock()
+			if len(q.changes) == 0 {
+				q.running = false
+				q.mu.Unlock()
+				return
+			}
+			next := q.changes[0]
+			q.changes = q.changes[1:]
+			q.mu.Unlock()
+			d.chatStatusHook(next.chatID, next.active)
+		}
+	}()
+}
+
+// trackChat records the chat the update came from in the registry and updates its activity. Returns true if the update
+// only changes membership of the bot in the chat, so it should not be dispatched to conversations
+func (d *Dispatcher) trackChat(incoming *conversation.IncomingUpdate) bool {
+	if incoming == nil {
+		return false
+	}
+	if member := incoming.MyChatMember; member != nil {
+		status := member.NewChatMember
+		d.seeChat(&member.Chat, &member.From)
+		d.setChatActive(member.Chat.ID, !status.WasKicked() && !status.HasLeft())
+		return true
+	}
+	var chat *tgbotapi.Chat
+	switch {
+	case incoming.MessageReaction != nil:
+		chat = incoming.MessageReaction.Chat
+	case incoming.CallbackQuery != nil:
+		if incoming.CallbackQuery.Message != nil { // buttons under inline messages are not bound to a chat
+			chat = incoming.CallbackQuery.Message.Chat
+		}
+	default:
+		chat = incoming.FromChat()
+	}
+	if chat == nil {
+		return false
+	}
+	d.seeChat(chat, incoming.SentFrom())
+	if !d.chats.IsChatActive(chat.ID) {
+		d.setChatActive(chat.ID, true) // the user unblocked the bot and wrote to it again
+	}
+	return false
+}
+
+// seeChat records an update from the chat in the registry
+func (d *Dispatcher) seeChat(chat *tgbotapi.Chat, from *tgbotapi.User) {
+	info := state.ChatInfo{
+		ChatID:   chat.ID,
+		Type:     chat.Type,
+		UserName: chat.UserName,
+	}
+	if chat.IsPrivate() && from != nil {
+		info.LanguageCode = from.LanguageCode
+	}
+	if err := d.chats.SeeChat(info); err != nil {
+		logger.Error("cannot record chat %d in the registry: %v", chat.ID, err)
+	}
+}
+
+// IsChatActive returns false if the bot cannot send messages to the chat, as the user blocked the bot or the bot was removed from the group
+func (d *Dispatcher) IsChatActive(chatID int64) bool {
+	return d.chats.IsChatActive(chatID)
+}
+
+// ChatRegistry returns registry of chats that talked to the bot
+func (d *Dispatcher) ChatRegistry() state.ChatRegistry {
+	return d.chats
+}
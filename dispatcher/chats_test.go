@@ -0,0 +1,145 @@
+package dispatcher_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ufy-it/go-telegram-bot/boterrors"
+	"github.com/ufy-it/go-telegram-bot/conversation"
+	. "github.com/ufy-it/go-telegram-bot/dispatcher"
+	"github.com/ufy-it/go-telegram-bot/handlers"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// blockingBot fails to send messages to chats that blocked the bot
+type blockingBot struct {
+	*recordingBot
+	mu      sync.Mutex
+	blocked map[int64]bool
+}
+
+func (b *blockingBot) Send(msg tgbotapi.Chattable) (tgbotapi.Message, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var chatID int64
+	switch message := msg.(type) {
+	case tgbotapi.MessageConfig:
+		chatID = message.ChatID
+	case tgbotapi.PhotoConfig:
+		chatID = message.ChatID
+	}
+	if b.blocked[chatID] {
+		return tgbotapi.Message{}, &tgbotapi.Error{Code: 403, Message: "Forbidden: bot was blocked by the user"}
+	}
+	return b.recordingBot.Send(msg)
+}
+
+func (b *blockingBot) setBlocked(chatID int64, blocked bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.blocked[chatID] = blocked
+}
+
+type chatStatus struct {
+	chatID int64
+	active bool
+}
+
+func expectStatus(t *testing.T, statuses chan chatStatus, expected chatStatus) {
+	t.Helper()
+	select {
+	case status := <-statuses:
+		if status != expected {
+			t.Errorf("expected status %v, got %v", expected, status)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("status %v was not reported", expected)
+	}
+}
+
+func TestBlockedChats(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bot := &blockingBot{recordingBot: newRecordingBot(), blocked: map[int64]bool{5: true}}
+	statuses := make(chan chatStatus, 10)
+	d, err := NewDispatcher(ctx, Config{
+		MaxOpenConversations: 10,
+		ConversationConfig:   conversation.Config{MaxMessageQueue: 5, TimeoutMinutes: 1},
+		Handlers: &handlers.CommandHandlers{
+			Default: handlers.MessageHandlerCreator("default"),
+			List:    []handlers.CommandHandler{},
+		},
+		TechnicalMessageFunc: EmptyTechnicalMessageFunc,
+		ChatStatusHook: func(chatID int64, active bool) {
+			statuses <- chatStatus{chatID, active}
+		},
+	}, bot, nil)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if err = d.SendSingleMessage(ctx, 5, "reminder", nil); !errors.Is(err, boterrors.ErrBotBlockedByUser) {
+		t.Errorf("expected blocked user error, got %v", err)
+	}
+	expectStatus(t, statuses, chatStatus{5, false})
+	if d.IsChatActive(5) {
+		t.Errorf("chat 5 should be inactive")
+	}
+	if err = d.SendSingleMessage(ctx, 5, "reminder", nil); !errors.Is(err, boterrors.ErrChatInactive) {
+		t.Errorf("expected inactive chat error, got %v", err)
+	}
+
+	bot.setBlocked(5, false)
+	d.DispatchUpdate(textUpdate(5, "hello"))
+	expectStatus(t, statuses, chatStatus{5, true})
+	bot.expectText(t, 5, "default")
+	if chat, ok := d.ChatRegistry().GetChat(5); !ok || chat.Blocked || chat.LastSeen.IsZero() {
+		t.Errorf("unexpected record about chat 5: %v", chat)
+	}
+
+	d.DispatchUpdate(&tgbotapi.Update{MyChatMember: &tgbotapi.ChatMemberUpdated{
+		Chat:          tgbotapi.Chat{ID: -6, Type: "group"},
+		NewChatMember: tgbotapi.ChatMember{Status: "left"},
+	}})
+	expectStatus(t, statuses, chatStatus{-6, false})
+	d.DispatchUpdate(&tgbotapi.Update{MyChatMember: &tgbotapi.ChatMemberUpdated{
+		Chat:          tgbotapi.Chat{ID: -6, Type: "group"},
+		NewChatMember: tgbotapi.ChatMember{Status: "member"},
+	}})
+	expectStatus(t, statuses, chatStatus{-6, true})
+	select {
+	case msg := <-bot.sent:
+		t.Errorf("membership updates should not start conversations, got %v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSlowChatStatusHook(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bot := newRecordingBot()
+	release := make(chan struct{})
+	statuses := make(chan chatStatus, 10)
+	d := newTestDispatcher(t, ctx, bot, 10, func(config *Config) {
+		config.ChatStatusHook = func(chatID int64, active bool) {
+			<-release
+			statuses <- chatStatus{chatID, active}
+		}
+	})
+
+	for _, status := range []string{"left", "member"} {
+		d.DispatchUpdate(&tgbotapi.Update{MyChatMember: &tgbotapi.ChatMemberUpdated{
+			Chat:          tgbotapi.Chat{ID: -6, Type: "group"},
+			NewChatMember: tgbotapi.ChatMember{Status: status},
+		}})
+	}
+	d.DispatchUpdate(textUpdate(1, "/hello"))
+	bot.expectText(t, 1, "hello") // the dispatcher does not wait for the hook
+	close(release)
+	expectStatus(t, statuses, chatStatus{-6, false})
+	expectStatus(t, statuses, chatStatus{-6, true})
+}
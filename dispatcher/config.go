@@ -3,15 +3,37 @@ package dispatcher
 import (
 	"github.com/ufy-it/go-telegram-bot/conversation"
 	"github.com/ufy-it/go-telegram-bot/handlers"
+	"github.com/ufy-it/go-telegram-bot/metrics"
+	"github.com/ufy-it/go-telegram-bot/state"
+	"github.com/ufy-it/go-telegram-bot/tracing"
 )
 
 // Config contains configuration parameters for a new dispatcher
 type Config struct {
-	MaxOpenConversations         int                       // the maximum number of open conversations
-	SingleMessageTrySendInterval int                       // interval between several tries of send single message to a user
-	ConversationConfig           conversation.Config       // configuration for a conversation
-	Handlers                     *handlers.CommandHandlers // list of handlers for command handling
-	GlobalHandlers               []handlers.CommandHandler // list of handlers that can be started at any point of conversation
-	TechnicalMessageFunc         TechnicalMessageFuncType  // Function that provides global messages that should be send to a user in special cases
-	GloabalKeyboardFunc          GlobalKeyboardFuncType    // Function that provides global keyboard that would be attached to each global message
+	MaxOpenConversations         int                                    // the maximum number of open conversations
+	SingleMessageTrySendInterval int                                    // Deprecated: single messages are queued in the outbox until the chat is released, the interval is not used
+	ConversationConfig           conversation.Config                    // configuration for a conversation
+	Handlers                     *handlers.CommandHandlers              // list of handlers for command handling
+	GlobalHandlers               []handlers.CommandHandler              // list of handlers that can be started at any point of conversation
+	TechnicalMessageFunc         TechnicalMessageFuncType               // Function that provides global messages that should be send to a user in special cases
+	GloabalKeyboardFunc          GlobalKeyboardFuncType                 // Function that provides global keyboard that would be attached to each global message
+	ConversationKey              conversation.KeyStrategy               // the way updates from a chat are separated into conversations, one conversation per chat by default
+	InlineQueryHandlers          []handlers.InlineQueryHandler          // list of handlers for inline queries, the first matching handler answers a query
+	ChosenInlineResultHandler    handlers.ChosenInlineResultHandlerFunc // hook for inline results chosen by users, can be nil
+	Middlewares                  []Middleware                           // middlewares that wrap running of every handler, the first one is the outermost
+	RoleResolver                 handlers.RoleResolverType              // function that returns roles of a user, required if any handler has RequiredRole
+	AccessDeniedPolicy           AccessDeniedPolicy                     // what to do if a user does not have the role required by a handler, FallThrough by default
+	EditedMessages               UpdateRoute                            // routing of edited messages, ignored by default
+	ChannelPosts                 UpdateRoute                            // routing of channel posts and their edits, ignored by default
+	MessageReactions             UpdateRoute                            // routing of message reactions, ignored by default. Reactions cannot be delivered to a conversation
+	ChatRegistry                 state.ChatRegistry                     // registry of chats the bot can send messages to, kept in memory if nil
+	ChatStatusHook               ChatStatusHookType                     // hook for chats that were deactivated or activated again, can be nil
+	BroadcastIO                  state.StateIO                          // storage for checkpoints of broadcasts, kept in memory if nil
+	OutboxIO                     state.StateIO                          // storage for single messages waiting for chats to be released, kept in memory if nil
+	Scheduler                    handlers.TaskScheduler                 // scheduler of one-off tasks available to handlers with handlers.GetScheduler, can be nil
+	PanicHook                    PanicHookType                          // hook for panics recovered in conversations, can be nil
+	MaxConversationCrashes       int                                    // a conversation that ran a step during more crashes of the bot than that without an update from the user is dropped, 0 means no limit
+	ShutdownGraceSeconds         int                                    // time for handlers to finish their work after the context is canceled, conversations waiting for users are suspended right away
+	Metrics                      metrics.Collector                      // collector of measurements of updates, conversations and handlers, can be nil
+	Tracer                       tracing.Tracer                         // tracer of updates from dispatching to handlers and sent messages, can be nil
 }
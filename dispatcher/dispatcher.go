@@ -1,22 +1,43 @@
 package dispatcher
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"reflect"
 	"sync"
 	"time"
 
+	"github.com/ufy-it/go-telegram-bot/botapi"
+	"github.com/ufy-it/go-telegram-bot/boterrors"
 	"github.com/ufy-it/go-telegram-bot/conversation"
 	"github.com/ufy-it/go-telegram-bot/handlers"
 	"github.com/ufy-it/go-telegram-bot/handlers/buttons"
+	"github.com/ufy-it/go-telegram-bot/handlers/readers"
 	"github.com/ufy-it/go-telegram-bot/logger"
+	"github.com/ufy-it/go-telegram-bot/metrics"
 	"github.com/ufy-it/go-telegram-bot/state"
+	"github.com/ufy-it/go-telegram-bot/tracing"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
 
+// Bot is an interface for a Telegram Bot API client used by the dispatcher
+type Bot = botapi.Bot
+
+// ContextBot is a Bot that stops waiting for a call when the context is closed
+type ContextBot = botapi.ContextBot
+
+// SendWithContext sends the message through the bot, a ContextBot stops waiting for the call when the context is closed
+func SendWithContext(ctx context.Context, bot Bot, c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	return botapi.SendWithContext(ctx, bot, c)
+}
+
+// RequestWithContext makes the call through the bot, a ContextBot stops waiting for the call when the context is closed
+func RequestWithContext(ctx context.Context, bot Bot, c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	return botapi.RequestWithContext(ctx, bot, c)
+}
+
 // conversationWithCancel contains a conversation object and CancelFunction for the conversation context
 type conversatonWithCancel struct {
 	c      *conversation.BotConversation
@@ -29,160 +50,350 @@ type Dispatcher struct {
 
 	mu sync.Mutex //mutex to sync operations over the conversations map between main thread and handler routins
 
-	conversations          map[int64]conversatonWithCancel
-	chatIDtoConversationID map[int64]int64 // map from chatID to conversationID
-	conversationConfig     conversation.Config
-	commandHandlers        *handlers.CommandHandlers // list of command handlers
-	globalCommandHandlers  []handlers.CommandHandler // list of commands that can be started at any point of conversation
+	conversations         map[int64]conversatonWithCancel
+	keyToConversationID   map[state.ConversationKey]int64 // map from conversation key to conversationID
+	keyStrategy           conversation.KeyStrategy        // the way updates from a chat are separated into conversations
+	conversationConfig    conversation.Config
+	commandHandlers       *handlers.CommandHandlers // list of command handlers
+	globalCommandHandlers []handlers.CommandHandler // list of commands that can be started at any point of conversation
+
+	inlineQueryHandlers       []handlers.InlineQueryHandler          // list of handlers for inline queries
+	chosenInlineResultHandler handlers.ChosenInlineResultHandlerFunc // hook for inline results chosen by users
 
-	singleMessageTrySendInterval int
+	middlewares []Middleware // middlewares that wrap running of handlers
+
+	roleResolver       handlers.RoleResolverType // function that returns roles of a user, for handlers with a required role
+	accessDeniedPolicy AccessDeniedPolicy        // what to do if a user does not have the required role
+
+	editedMessages   UpdateRoute // routing of edited messages
+	channelPosts     UpdateRoute // routing of channel posts
+	messageReactions UpdateRoute // routing of message reactions
+
+	chats          state.ChatRegistry     // registry of chats that talked to the bot
+	chatStatusHook ChatStatusHookType     // hook for chats that were deactivated or activated again
+	chatStatuses   chatStatusQueue        // changes of activity of chats waiting for the hook
+	scheduler      handlers.TaskScheduler // scheduler of one-off tasks passed to handlers, can be nil
+	broadcasts     *broadcasts            // checkpoints of broadcasts
+	outbox         *outbox                // single messages waiting for chats to be released
+
+	metrics                metrics.Collector // collector of measurements, NopCollector if it is not set
+	tracer                 tracing.Tracer    // tracer of updates, NopTracer if it is not set
+	panicHook              PanicHookType     // hook for panics in conversations
+	maxConversationCrashes int               // the number of crashes without progress after which a conversation is dropped, 0 for no limit
+
+	conversationsCtx     context.Context    // parent context of conversations, it is not canceled until the end of the shutdown
+	stopConversations    context.CancelFunc // cancels contexts of all conversations
+	shutdownGraceSeconds int                // time for handlers to finish their work on a shutdown
+	running              sync.WaitGroup     // goroutines that handle conversations
+	stopping             chan struct{}      // closed when the dispatcher stops accepting updates
+	done                 chan struct{}      // closed when the dispatcher is stopped
+
+	handlingMu sync.Mutex
+	handling   map[int64]*conversation.BotConversation // conversations whose goroutines are running
 
 	globalMessagesFunc TechnicalMessageFuncType
 	globalKeyboardFunc GlobalKeyboardFuncType
 
-	bot   *tgbotapi.BotAPI
+	bot   Bot
 	state state.BotState
 
-	incomeCh chan *tgbotapi.Update
+	incomeCh chan *conversation.IncomingUpdate
+}
+
+// startHandling counts the goroutine of the conversation, should be called before the goroutine is started
+func (d *Dispatcher) startHandling(conv *conversation.BotConversation) {
+	d.handlingMu.Lock()
+	defer d.handlingMu.Unlock()
+	d.running.Add(1)
+	d.handling[conv.ConversationID()] = conv
+}
+
+// finishHandling marks the goroutine of the conversation as finished
+func (d *Dispatcher) finishHandling(conv *conversation.BotConversation) {
+	d.handlingMu.Lock()
+	defer d.handlingMu.Unlock()
+	delete(d.handling, conv.ConversationID())
+	d.running.Done()
 }
 
 // start conversation handling
 func (d *Dispatcher) handleConversation(ctx context.Context, conv *conversation.BotConversation) {
+	defer d.finishHandling(conv)
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			d.recoverConversation(ctx, conv, recovered) // a panic in a handler should not crash the bot for everyone
+		}
+	}()
+	log := conv.Logger()
 	var exit bool = false
 	for {
+		var incoming *conversation.IncomingUpdate
 		update := d.state.GetConversatonFirstUpdate(conv.ConversationID())
-		if update == nil { // if the conversation is not started from the state
+		if update != nil {
+			incoming = &conversation.IncomingUpdate{Update: *update, ThreadID: conv.ThreadID()}
+		} else { // if the conversation is not started from the state
 			d.mu.Lock() // to make sure that no new messagess will arrive to this conversation
-			update, exit = conv.GetFirstUpdateFromUser(ctx)
+			incoming, exit = conv.GetFirstIncomingUpdateFromUser(ctx)
 			if exit {
-				delete(d.conversations, conv.ConversationID())                                                    // all new messages will go to a new go-routine
-				if convID, ok := d.chatIDtoConversationID[conv.ChatID()]; ok && convID == conv.ConversationID() { // remove chatID to conversationID mapping
-					delete(d.chatIDtoConversationID, conv.ChatID())
+				if conv.IsSuspended() {
+					d.mu.Unlock()
+					return // the conversation is kept in the state to be resumed after a restart
 				}
+				delete(d.conversations, conv.ConversationID())                                              // all new messages will go to a new go-routine
+				if convID, ok := d.keyToConversationID[conv.Key()]; ok && convID == conv.ConversationID() { // remove key to conversationID mapping
+					delete(d.keyToConversationID, conv.Key())
+				}
+				d.reportConversations()
 				err := d.state.RemoveConverastionState(conv.ConversationID()) // this is still under the lock to prevent starting a new go-routine that uses the same state
 				d.mu.Unlock()
 				if err != nil {
-					logger.Error("cannot remove conversation state: %v", err)
+					log.Error("cannot remove conversation state", "error", err)
+				}
+				if ctx.Err() == nil { // deliver single messages queued while the chat was busy, unless the bot is stopping
+					go d.flushOutbox(conv.ChatID())
 				}
 				return // exit handling loop as there is no active messages, or the parent context is closed
 			} else {
 				d.mu.Unlock()
-				err := d.state.StartConversationWithUpdate(conv.ConversationID(), conv.ChatID(), update)
-				if err != nil {
-					logger.Error("cannot add conversation to state: %v", err)
+				update = &incoming.Update
+				if incoming.MessageReaction == nil { // a reaction cannot be saved as the first update, so the conversation is not resumed
+					err := d.state.StartConversationWithKey(conv.ConversationID(), conv.Key(), conv.ThreadID(), update)
+					if err != nil {
+						log.Error("cannot add conversation to state", "error", err)
+					}
 				}
 				if update.CallbackQuery != nil && update.CallbackQuery.ID != "" {
-					err = conv.AnswerButton(update.CallbackQuery.ID)
+					err := conv.AnswerButton(update.CallbackQuery.ID)
 					if err != nil {
-						logger.Error("cannot answer button: %v", err)
+						log.Error("cannot answer button", "error", err)
 					}
 				}
 			}
 		}
 
-		selectHandlerFromList := func(list []handlers.CommandHandler, firstUpdate *tgbotapi.Update) handlers.Handler {
-			for _, creator := range list {
-				if creator.CommandSelector(ctx, update) {
-					return creator.HandlerCreator(context.WithValue(ctx, handlers.FirstUpdateVariable, update), conv)
-				}
+		var creator handlers.HandlerCreatorType
+		var name string
+		handlerCtx := context.WithValue(ctx, handlers.FirstUpdateVariable, update)
+		handlerCtx = context.WithValue(handlerCtx, handlers.ChatRegistryVariable, d.chats)
+		if d.scheduler != nil {
+			handlerCtx = context.WithValue(handlerCtx, handlers.SchedulerVariable, d.scheduler)
+		}
+		handlerCtx = tracing.ContextWithTracer(conv.Trace().NewContext(handlerCtx), d.tracer)
+		selectCtx, selectSpan := d.tracer.Start(conv.Trace().NewContext(ctx), tracing.SpanSelectHandler)
+		route, special := d.routeFor(incoming)
+		dedicated := special && route.Policy == StartHandler
+		if dedicated {
+			if incoming.MessageReaction != nil {
+				handlerCtx = context.WithValue(handlerCtx, handlers.MessageReactionVariable, incoming.MessageReaction)
 			}
-			return nil
+			creator = route.Handler
+			name = updateType(incoming)
 		}
-
-		handler := selectHandlerFromList(d.globalCommandHandlers, update)
-		if handler == nil {
-			handler = selectHandlerFromList(d.commandHandlers.List, update)
+		denied := false
+		if creator == nil {
+			creator, name, denied = d.selectCommandHandler(selectCtx, d.globalCommandHandlers, "global", update, conv.ChatID())
 		}
-		if handler == nil {
-			handler = d.commandHandlers.Default(context.WithValue(ctx, handlers.FirstUpdateVariable, update), conv) // use default handler if there is no suitable
+		if creator == nil && !denied {
+			creator, name, denied = d.selectCommandHandler(selectCtx, d.commandHandlers.List, "command", update, conv.ChatID())
+		}
+		if denied {
+			selectSpan.SetAttributes(tracing.Attr("denied", true))
+			selectSpan.End()
+			conv.Trace().End()
+			err := d.state.RemoveConverastionState(conv.ConversationID())
+			if err != nil {
+				log.Error("cannot remove conversation state", "error", err)
+			}
+			err = d.sendGlobalMessage(conv.ChatID(), conv.ThreadID(), AccessDenied)
+			if err != nil {
+				log.Error("cannot send access denied message", "error", err)
+			}
+			continue // wait for the next command from the user
+		}
+		if creator == nil {
+			creator = d.commandHandlers.Default // use default handler if there is no suitable
+			name = "default"
+		}
+		selectSpan.SetAttributes(tracing.Attr("handler", name))
+		selectSpan.End()
+		tracing.SpanFromContext(handlerCtx).SetAttributes(tracing.Attr("handler", name))
+		log.Set("handler", name)
+		log.Set("step", nil) // set by the handler when it saves the step
+		handlerCtx = logger.NewContext(handlerCtx, log)
+
+		run := chainMiddlewares(d.middlewares, func(ctx context.Context, conversation readers.BotConversation, firstUpdate *tgbotapi.Update) error {
+			handler := creator(ctx, conversation)
+			return handler.Execute(conversation.ConversationID(), d.reportSteps(name, handler, conv))
+		})
+		start := time.Now()
+		err := run(handlerCtx, conv, update) // execute handler
+		if conv.IsSuspended() {
+			return // the bot is stopping, the conversation is kept in the state to be resumed after a restart
+		}
+		if conv.IsCanceled() {
+			d.metrics.HandlerFinished(name, time.Since(start), nil) // an error of a canceled conversation is not an error of the handler
+		} else {
+			d.metrics.HandlerFinished(name, time.Since(start), err)
+			tracing.SpanFromContext(handlerCtx).RecordError(err)
 		}
-
-		err := handler.Execute(conv.ConversationID(), d.state) // execute handler
 		if err != nil {
-			logger.Error("in conversation with %d got error: %v", conv.ChatID(), err)
-			if !conv.IsCanceled() {
-				err = d.sendGlobalMessage(conv.ChatID(), UserError)
+			log.Error("handler failed", "error", err)
+			if !conv.IsCanceled() && !dedicated {
+				err = d.sendGlobalMessage(conv.ChatID(), conv.ThreadID(), UserError)
 				if err != nil {
-					logger.Warning("cannot send error notification to %d", conv.ChatID())
+					log.Warning("cannot send error notification", "error", err)
 				}
 			}
 		}
+		conv.Trace().End()
+		log.Set("handler", nil)
+		log.Set("step", nil)
 		err = d.state.RemoveConverastionState(conv.ConversationID()) // clear state for the conversation
 		if err != nil {
-			logger.Error("cannot remove conversation state: %v", err)
+			log.Error("cannot remove conversation state", "error", err)
 		}
-		if !conv.IsCanceled() {
-			err = d.sendGlobalMessage(conv.ChatID(), ConversationEnded)
+		if !conv.IsCanceled() && !dedicated {
+			err = d.sendGlobalMessage(conv.ChatID(), conv.ThreadID(), ConversationEnded)
 			if err != nil {
-				logger.Error("cannot send conversation ended message: %v", err)
+				log.Error("cannot send conversation ended message", "error", err)
 			}
 		}
 	}
 }
 
-func (d *Dispatcher) dispatchUpdate(ctx context.Context, update *tgbotapi.Update) error {
+func (d *Dispatcher) dispatchUpdate(ctx context.Context, incoming *conversation.IncomingUpdate) (err error) {
+	var span tracing.Span
+	ctx, span = d.tracer.Start(tracing.ContextWithSpan(ctx, incomingSpan(incoming)), tracing.SpanDispatch, tracing.Attr("update_type", updateType(incoming)))
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+	if incoming != nil {
+		incoming.Span = span // the handler that consumes the update continues the trace
+	}
+
 	select {
 	case <-ctx.Done():
 		return errors.New("cannot dispatch update, context is closed")
 	default:
 	}
 
-	d.mu.Lock()
-	defer d.mu.Unlock()
+	if incoming != nil && incoming.InlineQuery != nil {
+		go d.handleInlineQuery(ctx, incoming.InlineQuery) // inline queries are not a part of any conversation
+		return nil
+	}
+	if incoming != nil && incoming.ChosenInlineResult != nil {
+		go d.handleChosenInlineResult(ctx, incoming.ChosenInlineResult)
+		return nil
+	}
 
-	chatID, err := conversation.GetUpdateChatID(update)
+	if d.trackChat(incoming) {
+		return nil // changes of the bot membership are not a part of any conversation
+	}
+
+	route, special := d.routeFor(incoming)
+	if special && route.Policy == IgnoreUpdate {
+		return nil
+	}
+
+	key, err := conversation.GetUpdateKey(incoming, d.keyStrategy)
 	if err != nil {
 		return err
 	}
+	chatID := key.ChatID
+	update := &incoming.Update
+	span.SetAttributes(tracing.Attr("chat_id", chatID))
+	// roles are resolved before taking the lock, so that a slow role resolver does not block other chats
+	global := !special && d.isGlobalCommand(ctx, update, chatID)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
 
-	startNewConversation := func() error {
-		conv, err := conversation.NewConversation(chatID,
-			d.bot,
+	// startNewConversation starts a handling routine of a new conversation, the routine sends the notification
+	// about the closed previous conversation first, so that the dispatching loop does not wait for the message
+	startNewConversation := func(notify conversation.SpecialMessageFuncType) error {
+		conv, err := conversation.NewConversationWithKey(key,
+			d.botForChat(chatID),
 			d.state,
-			d.generateSpecialMessageFunc(chatID, TooManyMessages),
-			d.generateSpecialMessageFunc(chatID, ConversationClosedByBot),
-			d.generateSpecialMessageFunc(chatID, ConversationClosedByUser),
+			d.generateAsyncMessageFunc(chatID, incoming.ThreadID, TooManyMessages),
+			d.generateSpecialMessageFunc(chatID, incoming.ThreadID, ConversationClosedByBot),
+			d.generateSpecialMessageFunc(chatID, incoming.ThreadID, ConversationClosedByUser),
 			d.generateGlobalKeyboardFunc(chatID),
 			d.conversationConfig)
 		if err != nil {
 			return err
 		}
 
-		err = conv.PushUpdate(update)
+		err = conv.PushIncomingUpdate(incoming)
 		if err != nil {
 			return err
 		}
 
-		convCtx, cancel := context.WithCancel(ctx)
+		convCtx, cancel := context.WithCancel(d.conversationsCtx)
 		d.conversations[conv.ConversationID()] = conversatonWithCancel{conv, cancel}
-		d.chatIDtoConversationID[chatID] = conv.ConversationID()
-		go d.handleConversation(convCtx, conv)
+		d.keyToConversationID[key] = conv.ConversationID()
+		d.reportConversations()
+		span.SetAttributes(tracing.Attr("conversation_id", conv.ConversationID()), tracing.Attr("new_conversation", true))
+		d.startHandling(conv)
+		go func() {
+			if notify != nil {
+				if err := notify(); err != nil {
+					logger.Warning("cannot notify chat %d about the closed conversation: %v", chatID, err)
+				}
+			}
+			d.handleConversation(convCtx, conv)
+		}()
 		return nil
 	}
-	if convID, ok := d.chatIDtoConversationID[chatID]; ok {
+	if convID, ok := d.keyToConversationID[key]; ok {
 		if conv, ok := d.conversations[convID]; ok {
-			if d.isGlobalCommand(ctx, update) {
-				err := conv.c.CancelByUser()
+			if special && route.Policy == StartHandler {
+				return fmt.Errorf("cannot start a dedicated handler in chat %d with an ongoing conversation, the update is dropped", chatID)
+			}
+			if global {
+				notify, err := conv.c.CloseByUser()
 				conv.cancel()
 				if err != nil {
 					return err
 				}
-				return startNewConversation()
+				return startNewConversation(notify)
+			}
+			span.SetAttributes(tracing.Attr("conversation_id", convID))
+			if d.maxConversationCrashes > 0 {
+				if err := d.state.ResetConversationCrashes(convID); err != nil {
+					logger.Error("cannot save conversation state: %v", err)
+				}
 			}
-			return conv.c.PushUpdate(update)
+			err := conv.c.PushIncomingUpdate(incoming)
+			if errors.Is(err, boterrors.ErrQueueFull) {
+				d.metrics.UpdateRejected(metrics.QueueFull)
+			}
+			return err
 		}
 	}
+	if special && route.Policy == DeliverToConversation {
+		return nil // there is no conversation to deliver the update to
+	}
 	if len(d.conversations) < d.maxOpenConversations {
-		return startNewConversation()
+		return startNewConversation(nil)
 	} else {
-		err := d.sendGlobalMessage(chatID, TooManyConversations)
-		return fmt.Errorf("to many open conversations (%v)", err)
+		d.metrics.UpdateRejected(metrics.TooManyConversations)
+		d.generateAsyncMessageFunc(chatID, incoming.ThreadID, TooManyConversations)()
+		return fmt.Errorf("to many open conversations, %w", boterrors.ErrQueueFull)
 	}
 }
 
-// sendGlobalMessage sends a message dirrectly through API
+// incomingSpan returns the span of receiving the update, nil if the update is not traced
+func incomingSpan(incoming *conversation.IncomingUpdate) tracing.Span {
+	if incoming == nil {
+		return nil
+	}
+	return incoming.Span
+}
+
+// sendGlobalMessage sends a message dirrectly through API to the forum topic threadID (0 for chats without topics)
 // this message does not handled by a conversation object
-func (d *Dispatcher) sendGlobalMessage(chatID int64, messageID MessageIDType) error {
+func (d *Dispatcher) sendGlobalMessage(chatID int64, threadID int, messageID MessageIDType) error {
 	text := d.globalMessagesFunc(chatID, messageID)
 	if text == "" {
 		return nil // skip empty message
@@ -191,14 +402,27 @@ func (d *Dispatcher) sendGlobalMessage(chatID int64, messageID MessageIDType) er
 	if d.globalKeyboardFunc != nil {
 		msg.ReplyMarkup = d.globalKeyboardFunc(chatID)
 	}
-	_, err := d.bot.Send(msg)
-	return err
+	_, err := SendWithContext(d.conversationsCtx, d.bot, conversation.PostToThread(msg, threadID))
+	return d.checkBlocked(chatID, err)
 }
 
 // generateSpecialMessageFunc creates a function that sends selected general message to the specified chat
-func (d *Dispatcher) generateSpecialMessageFunc(chatID int64, messageID MessageIDType) conversation.SpecialMessageFuncType {
+func (d *Dispatcher) generateSpecialMessageFunc(chatID int64, threadID int, messageID MessageIDType) conversation.SpecialMessageFuncType {
 	return func() error {
-		return d.sendGlobalMessage(chatID, messageID)
+		return d.sendGlobalMessage(chatID, threadID, messageID)
+	}
+}
+
+// generateAsyncMessageFunc creates a function that sends selected general message to the specified chat in the background,
+// it is used for messages sent from the dispatching loop, so that a throttled chat does not delay updates from other chats
+func (d *Dispatcher) generateAsyncMessageFunc(chatID int64, threadID int, messageID MessageIDType) conversation.SpecialMessageFuncType {
+	return func() error {
+		go func() {
+			if err := d.sendGlobalMessage(chatID, threadID, messageID); err != nil {
+				logger.Warning("cannot send technical message to chat %d: %v", chatID, err)
+			}
+		}()
+		return nil
 	}
 }
 
@@ -229,26 +453,87 @@ func (d *Dispatcher) dispatchLoop(ctx context.Context) {
 	}
 }
 
+// isNil returns true for nil, and for a nil pointer (e.g. (*tgbotapi.BotAPI)(nil)) in a non-nil interface
+func isNil(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Func, reflect.Chan, reflect.Slice, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
 // NewDispatcher creates a new Dispatcher objects and starts a separate thread to clear old conversations
-func NewDispatcher(ctx context.Context, config Config, bot *tgbotapi.BotAPI, stateIO state.StateIO) (*Dispatcher, error) {
+func NewDispatcher(ctx context.Context, config Config, bot Bot, stateIO state.StateIO) (*Dispatcher, error) {
+	if isNil(bot) {
+		return nil, errors.New("bot cannot be nil")
+	}
 	d := &Dispatcher{
-		conversations:                make(map[int64]conversatonWithCancel),
-		chatIDtoConversationID:       make(map[int64]int64),
-		conversationConfig:           config.ConversationConfig,
-		maxOpenConversations:         config.MaxOpenConversations,
-		singleMessageTrySendInterval: config.SingleMessageTrySendInterval,
-		bot:                          bot,
-		mu:                           sync.Mutex{},
-		state:                        state.NewBotState(stateIO),
-		incomeCh:                     make(chan *tgbotapi.Update),
-		commandHandlers:              config.Handlers,
-		globalCommandHandlers:        config.GlobalHandlers,
-		globalMessagesFunc:           config.TechnicalMessageFunc,
-		globalKeyboardFunc:           config.GloabalKeyboardFunc,
+		conversations:             make(map[int64]conversatonWithCancel),
+		keyToConversationID:       make(map[state.ConversationKey]int64),
+		keyStrategy:               config.ConversationKey,
+		conversationConfig:        config.ConversationConfig,
+		maxOpenConversations:      config.MaxOpenConversations,
+		bot:                       bot,
+		mu:                        sync.Mutex{},
+		state:                     state.NewBotState(stateIO),
+		incomeCh:                  make(chan *conversation.IncomingUpdate),
+		commandHandlers:           config.Handlers,
+		globalCommandHandlers:     config.GlobalHandlers,
+		inlineQueryHandlers:       config.InlineQueryHandlers,
+		chosenInlineResultHandler: config.ChosenInlineResultHandler,
+		middlewares:               config.Middlewares,
+		roleResolver:              config.RoleResolver,
+		accessDeniedPolicy:        config.AccessDeniedPolicy,
+		editedMessages:            config.EditedMessages,
+		channelPosts:              config.ChannelPosts,
+		messageReactions:          config.MessageReactions,
+		chats:                     config.ChatRegistry,
+		chatStatusHook:            config.ChatStatusHook,
+		scheduler:                 config.Scheduler,
+		broadcasts:                newBroadcasts(config.BroadcastIO),
+		outbox:                    newOutbox(config.OutboxIO),
+		metrics:                   config.Metrics,
+		tracer:                    config.Tracer,
+		panicHook:                 config.PanicHook,
+		maxConversationCrashes:    config.MaxConversationCrashes,
+		shutdownGraceSeconds:      config.ShutdownGraceSeconds,
+		handling:                  make(map[int64]*conversation.BotConversation),
+		stopping:                  make(chan struct{}),
+		done:                      make(chan struct{}),
+		globalMessagesFunc:        config.TechnicalMessageFunc,
+		globalKeyboardFunc:        config.GloabalKeyboardFunc,
 	}
 	if d.commandHandlers == nil {
 		return nil, errors.New("handlers cannot be nil")
 	}
+	// conversations are not canceled together with the context, so that handlers have time to finish on a shutdown
+	d.conversationsCtx, d.stopConversations = context.WithCancel(context.WithoutCancel(ctx))
+	if err := validateRoutes(config); err != nil {
+		return nil, err
+	}
+
+	if d.chats == nil {
+		d.chats = state.NewMemoryChatRegistry()
+	}
+
+	if d.metrics == nil {
+		d.metrics = metrics.NopCollector{}
+	}
+	if d.tracer == nil {
+		d.tracer = tracing.NopTracer{}
+	}
+	d.conversationConfig.Tracer = d.tracer
+	if d.maxConversationCrashes > 0 { // crashes are counted only for conversations that run a step
+		d.conversationConfig.WaitHook = func(conversationID int64, waiting bool) {
+			if err := d.state.SetConversationInStep(conversationID, !waiting); err != nil {
+				logger.Error("cannot save conversation state: %v", err)
+			}
+		}
+	}
 
 	if d.globalMessagesFunc == nil {
 		d.globalMessagesFunc = EmptyTechnicalMessageFunc
@@ -260,100 +545,107 @@ func NewDispatcher(ctx context.Context, config Config, bot *tgbotapi.BotAPI, sta
 		logger.Warning("cannot load previouse state: %v, will start from blank", err)
 	}
 
+	var crashes map[int64]int
+	if d.maxConversationCrashes > 0 { // the state is saved once to count crashes of the bot
+		if crashes, err = d.state.Open(); err != nil {
+			logger.Error("cannot save the state: %v", err)
+		}
+	}
+
 	// resume conversations from the state
 	for _, conversationID := range d.state.GetConversationIDs() {
-		chatID := d.state.GetConversationChatID(conversationID)
+		if d.quarantined(conversationID, crashes[conversationID]) {
+			continue
+		}
+		key := d.state.GetConversationKey(conversationID)
+		chatID := key.ChatID
+		threadID := d.state.GetConversationThreadID(conversationID)
 		conv, err := conversation.NewConversationWithID(
 			conversationID,
-			chatID,
-			d.bot,
+			key,
+			d.botForChat(chatID),
 			d.state,
-			d.generateSpecialMessageFunc(chatID, TooManyConversations),
-			d.generateSpecialMessageFunc(chatID, ConversationClosedByBot),
-			d.generateSpecialMessageFunc(chatID, ConversationClosedByUser),
+			d.generateAsyncMessageFunc(chatID, threadID, TooManyConversations),
+			d.generateSpecialMessageFunc(chatID, threadID, ConversationClosedByBot),
+			d.generateSpecialMessageFunc(chatID, threadID, ConversationClosedByUser),
 			d.generateGlobalKeyboardFunc(chatID),
 			d.conversationConfig)
 		if err != nil {
 			logger.Error(err.Error())
 			continue
 		}
-		convCtx, cancel := context.WithCancel(ctx)
+		convCtx, cancel := context.WithCancel(d.conversationsCtx)
 		d.conversations[conversationID] = conversatonWithCancel{conv, cancel}
-		d.chatIDtoConversationID[chatID] = conversationID
+		d.keyToConversationID[key] = conversationID
 		if _, ok := d.conversations[conversationID]; !ok {
 			logger.Warning("cannot start conversation with %d from state", conversationID)
 		} else {
+			d.startHandling(conv)
 			go d.handleConversation(convCtx, conv)
 		}
 	}
-	go d.dispatchLoop(ctx) // start the dispaching loop
+	d.mu.Lock()
+	d.reportConversations()
+	d.mu.Unlock()
+	go d.flushAllOutboxes() // deliver messages queued before a restart
+	go d.dispatchLoop(ctx)  // start the dispaching loop
+	go func() {
+		<-ctx.Done()
+		d.shutdown()
+	}()
 	return d, nil
 }
 
-// isGlobalCommand returns true if a user started a global command
-func (d *Dispatcher) isGlobalCommand(ctx context.Context, update *tgbotapi.Update) bool {
-	for _, creator := range d.globalCommandHandlers {
-		if creator.CommandSelector(ctx, update) {
+// isGlobalCommand returns true if a user started a global command that they have access to
+func (d *Dispatcher) isGlobalCommand(ctx context.Context, update *tgbotapi.Update, chatID int64) bool {
+	for _, handler := range d.globalCommandHandlers {
+		if handler.CommandSelector(ctx, update) && d.hasAccess(ctx, handler, update, chatID) {
 			return true
 		}
 	}
 	return false
 }
 
-func (d *Dispatcher) sendSingleGeneralMessage(ctx context.Context, chatID int64, message tgbotapi.Chattable) error {
-	closedErr := errors.New("cannot send a message, context closed")
-	for {
-		select {
-		case <-ctx.Done():
-			return closedErr
-		default:
-		}
-		d.mu.Lock()
-		if _, ongoingConversation := d.chatIDtoConversationID[chatID]; !ongoingConversation {
-			_, err := d.bot.Send(message)
-			d.mu.Unlock()
-			return err
+// hasConversationInChat returns true if there is an ongoing conversation in the chat. Should be called under the lock
+func (d *Dispatcher) hasConversationInChat(chatID int64) bool {
+	for key := range d.keyToConversationID {
+		if key.ChatID == chatID {
+			return true
 		}
-		d.mu.Unlock()
-		time.Sleep(time.Duration(time.Duration(d.singleMessageTrySendInterval) * time.Second))
 	}
+	return false
 }
 
-// SendSingleMessage waits until the conversation with chatID is closed and sends a single message from bot to a user
+// SendSingleMessage sends a single message from bot to a user, or queues it until the conversation with chatID is closed
 func (d *Dispatcher) SendSingleMessage(ctx context.Context, chatID int64, text string, keyboard *buttons.ButtonSet) error {
-	msg := tgbotapi.NewMessage(chatID, text)
-	if keyboard != nil && !keyboard.IsEmpty() {
-		msg.ReplyMarkup = keyboard.GetInlineKeyboard()
-	}
-	return d.sendSingleGeneralMessage(ctx, chatID, msg)
+	return d.SendOutboxMessage(ctx, OutboxMessage{ChatID: chatID, Text: text, Keyboard: keyboardMarkup(keyboard)})
 }
 
-// SendSingleMessageWithMarkup waits until the conversation with chatID is closed and sends a single message with HTML markup from bot to a user
+// SendSingleMessageWithMarkup sends a single message with HTML markup from bot to a user, or queues it until the conversation with chatID is closed
 func (d *Dispatcher) SendSingleMessageWithMarkup(ctx context.Context, chatID int64, text string, keyboard *buttons.ButtonSet) error {
-	msg := tgbotapi.NewMessage(chatID, text)
-	msg.ParseMode = "HTML"
-	if keyboard != nil && !keyboard.IsEmpty() {
-		msg.ReplyMarkup = keyboard.GetInlineKeyboard()
-	}
-	return d.sendSingleGeneralMessage(ctx, chatID, msg)
+	return d.SendOutboxMessage(ctx, OutboxMessage{ChatID: chatID, Text: text, ParseMode: "HTML", Keyboard: keyboardMarkup(keyboard)})
 }
 
+// SendSinglePhoto sends a single photo with HTML caption from bot to a user, or queues it until the conversation with chatID is closed
 func (d *Dispatcher) SendSinglePhoto(ctx context.Context, chatID int64, photo []byte, caption string, keyboard *buttons.ButtonSet) error {
-	msg := tgbotapi.NewPhoto(chatID, tgbotapi.FileReader{
-		Name:   "image.png",
-		Reader: bytes.NewReader(photo),
-	})
-	msg.ParseMode = "HTML"
-	if keyboard != nil && !keyboard.IsEmpty() {
-		msg.ReplyMarkup = keyboard.GetInlineKeyboard()
-	}
-	if caption != "" {
-		msg.Caption = caption
-	}
-	return d.sendSingleGeneralMessage(ctx, chatID, msg)
+	return d.SendOutboxMessage(ctx, OutboxMessage{ChatID: chatID, Text: caption, ParseMode: "HTML", Photo: photo, Keyboard: keyboardMarkup(keyboard)})
 }
 
 // DispatchUpdate routes an update to the target conversation, or creates a new conversation
 func (d *Dispatcher) DispatchUpdate(update *tgbotapi.Update) {
-	d.incomeCh <- update
+	if update == nil {
+		d.DispatchIncomingUpdate(nil)
+		return
+	}
+	d.DispatchIncomingUpdate(&conversation.IncomingUpdate{Update: *update})
+}
+
+// DispatchIncomingUpdate routes an update with the fields decoded by the bot to the target conversation, or creates a new conversation
+func (d *Dispatcher) DispatchIncomingUpdate(update *conversation.IncomingUpdate) {
+	d.metrics.UpdateReceived(updateType(update))
+	select {
+	case d.incomeCh <- update:
+	case <-d.stopping:
+		logger.Warning("the dispatcher is stopping, the update is dropped")
+	}
 }
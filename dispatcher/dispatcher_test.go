@@ -0,0 +1,280 @@
+package dispatcher_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ufy-it/go-telegram-bot/conversation"
+	. "github.com/ufy-it/go-telegram-bot/dispatcher"
+	"github.com/ufy-it/go-telegram-bot/handlers"
+	"github.com/ufy-it/go-telegram-bot/handlers/readers"
+	"github.com/ufy-it/go-telegram-bot/state"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+type recordingBot struct {
+	sent chan tgbotapi.Chattable
+}
+
+func newRecordingBot() *recordingBot {
+	return &recordingBot{sent: make(chan tgbotapi.Chattable, 100)}
+}
+
+func (b *recordingBot) Send(msg tgbotapi.Chattable) (tgbotapi.Message, error) {
+	b.sent <- msg
+	return tgbotapi.Message{MessageID: 1}, nil
+}
+
+func (b *recordingBot) Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	b.sent <- c
+	return &tgbotapi.APIResponse{Ok: true}, nil
+}
+
+func (b *recordingBot) GetFile(config tgbotapi.FileConfig) (tgbotapi.File, error) {
+	return tgbotapi.File{}, nil
+}
+
+func (b *recordingBot) GetFileDirectURL(fileID string) (string, error) {
+	return "", nil
+}
+
+// collectReplies waits for n text messages and maps the replied message ID, or the forum topic, to the text
+func (b *recordingBot) collectReplies(t *testing.T, n int) map[int]string {
+	t.Helper()
+	replies := make(map[int]string)
+	for i := 0; i < n; i++ {
+		select {
+		case msg := <-b.sent:
+			if inThread, ok := msg.(conversation.ThreadMessage); ok {
+				replies[inThread.ThreadID] = inThread.Chattable.(tgbotapi.MessageConfig).Text
+			} else if message, ok := msg.(tgbotapi.MessageConfig); ok && message.ReplyToMessageID != 0 {
+				replies[message.ReplyToMessageID] = message.Text
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("only %d of %d messages were sent", i, n)
+			return replies
+		}
+	}
+	return replies
+}
+
+// expectText waits for a text message sent through the bot
+func (b *recordingBot) expectText(t *testing.T, chatID int64, text string) {
+	t.Helper()
+	select {
+	case msg := <-b.sent:
+		message, ok := msg.(tgbotapi.MessageConfig)
+		if !ok || message.ChatID != chatID || message.Text != text {
+			t.Errorf("expected message '%s' to chat %d, got %v", text, chatID, msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("message '%s' was not sent", text)
+	}
+}
+
+var technicalMessages = map[MessageIDType]string{
+	TooManyMessages:          "too many messages",
+	TooManyConversations:     "too many conversations",
+	UserError:                "error",
+	ConversationClosedByBot:  "closed by bot",
+	ConversationClosedByUser: "closed by user",
+	ConversationEnded:        "ended",
+}
+
+func technicalMessageFunc(chatID int64, messageID MessageIDType) string {
+	return technicalMessages[messageID]
+}
+
+func textUpdate(chatID int64, text string) *tgbotapi.Update {
+	return &tgbotapi.Update{Message: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: chatID}, Text: text}}
+}
+
+func userTextUpdate(chatID, userID int64, messageID int, text string) *tgbotapi.Update {
+	update := textUpdate(chatID, text)
+	update.Message.MessageID = messageID
+	update.Message.From = &tgbotapi.User{ID: userID}
+	return update
+}
+
+// echoHandler waits for one more message from a user and repeats it
+var echoHandler = handlers.OneStepHandlerCreator(func(ctx context.Context, conversation readers.BotConversation) error {
+	reply := readers.ReadRawTextAndDataResult(ctx, conversation)
+	if reply.Exit {
+		return nil
+	}
+	_, err := conversation.SendText("echo " + reply.Text)
+	return err
+})
+
+// configOption changes the config of a test dispatcher
+type configOption func(config *Config)
+
+func newTestDispatcher(t *testing.T, ctx context.Context, bot Bot, maxConversations int, options ...configOption) *Dispatcher {
+	return newTestDispatcherWithKey(t, ctx, bot, maxConversations, conversation.PerChat, options...)
+}
+
+func newTestDispatcherWithKey(t *testing.T, ctx context.Context, bot Bot, maxConversations int, key conversation.KeyStrategy, options ...configOption) *Dispatcher {
+	config := Config{
+		ConversationKey:      key,
+		MaxOpenConversations: maxConversations,
+		ConversationConfig:   conversation.Config{MaxMessageQueue: 5, TimeoutMinutes: 1},
+		Handlers: &handlers.CommandHandlers{
+			Default: handlers.MessageHandlerCreator("default"),
+			List: []handlers.CommandHandler{
+				{CommandSelector: handlers.RegExpCommandSelector("/hello"), HandlerCreator: handlers.MessageHandlerCreator("hello")},
+				{CommandSelector: handlers.RegExpCommandSelector("/echo"), HandlerCreator: echoHandler},
+				{CommandSelector: handlers.RegExpCommandSelector("/fail"), HandlerCreator: handlers.OneStepHandlerCreator(
+					func(ctx context.Context, conversation readers.BotConversation) error {
+						return errors.New("failure")
+					})},
+			},
+		},
+		GlobalHandlers: []handlers.CommandHandler{
+			{CommandSelector: handlers.RegExpCommandSelector("/cancel"), HandlerCreator: handlers.MessageHandlerCreator("canceled")},
+		},
+		TechnicalMessageFunc: technicalMessageFunc,
+	}
+	for _, option := range options {
+		option(&config)
+	}
+	d, err := NewDispatcher(ctx, config, bot, state.NewMemoryState())
+	if err != nil {
+		t.Fatalf("cannot create dispatcher: %v", err)
+	}
+	return d
+}
+
+func TestNewDispatcherWithNilBot(t *testing.T) {
+	_, err := NewDispatcher(context.Background(), Config{Handlers: &handlers.CommandHandlers{}}, nil, nil)
+	if err == nil || err.Error() != "bot cannot be nil" {
+		t.Errorf("unexpected error %v", err)
+	}
+	var api *tgbotapi.BotAPI
+	_, err = NewDispatcher(context.Background(), Config{Handlers: &handlers.CommandHandlers{}}, api, nil)
+	if err == nil || err.Error() != "bot cannot be nil" {
+		t.Errorf("unexpected error for a nil client %v", err)
+	}
+}
+
+func TestDispatchToCommandHandlers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bot := newRecordingBot()
+	d := newTestDispatcher(t, ctx, bot, 10)
+
+	d.DispatchUpdate(textUpdate(1, "/hello"))
+	bot.expectText(t, 1, "hello")
+	bot.expectText(t, 1, "ended")
+
+	d.DispatchUpdate(textUpdate(2, "unknown"))
+	bot.expectText(t, 2, "default")
+	bot.expectText(t, 2, "ended")
+
+	d.DispatchUpdate(textUpdate(3, "/echo"))
+	d.DispatchUpdate(textUpdate(3, "ping"))
+	bot.expectText(t, 3, "echo ping")
+	bot.expectText(t, 3, "ended")
+
+	d.DispatchUpdate(textUpdate(4, "/fail"))
+	bot.expectText(t, 4, "error")
+	bot.expectText(t, 4, "ended")
+}
+
+func TestGlobalCommandCancelsConversation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bot := newRecordingBot()
+	d := newTestDispatcher(t, ctx, bot, 10)
+
+	d.DispatchUpdate(textUpdate(1, "/echo"))
+	d.DispatchUpdate(textUpdate(1, "/cancel"))
+	bot.expectText(t, 1, "closed by user")
+	bot.expectText(t, 1, "canceled")
+	bot.expectText(t, 1, "ended")
+}
+
+// stallingBot holds messages to a chat until it is released
+type stallingBot struct {
+	*recordingBot
+	chatID  int64
+	release chan struct{}
+}
+
+func (b *stallingBot) Send(msg tgbotapi.Chattable) (tgbotapi.Message, error) {
+	if message, ok := msg.(tgbotapi.MessageConfig); ok && message.ChatID == b.chatID {
+		<-b.release
+	}
+	return b.recordingBot.Send(msg)
+}
+
+func TestStalledChatDoesNotBlockDispatching(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bot := &stallingBot{recordingBot: newRecordingBot(), chatID: 1, release: make(chan struct{})}
+	d := newTestDispatcher(t, ctx, bot, 10)
+
+	d.DispatchUpdate(textUpdate(1, "/echo"))
+	d.DispatchUpdate(textUpdate(1, "/cancel")) // the message about the closed conversation is stalled
+	d.DispatchUpdate(textUpdate(2, "/hello"))
+	bot.expectText(t, 2, "hello")
+	bot.expectText(t, 2, "ended")
+
+	close(bot.release)
+	bot.expectText(t, 1, "closed by user")
+	bot.expectText(t, 1, "canceled")
+	bot.expectText(t, 1, "ended")
+}
+
+func TestTooManyConversations(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bot := newRecordingBot()
+	d := newTestDispatcher(t, ctx, bot, 1)
+
+	d.DispatchUpdate(textUpdate(1, "/echo"))
+	d.DispatchUpdate(textUpdate(2, "/hello"))
+	bot.expectText(t, 2, "too many conversations")
+	d.DispatchUpdate(textUpdate(1, "pong"))
+	bot.expectText(t, 1, "echo pong")
+	bot.expectText(t, 1, "ended")
+}
+
+func TestConversationPerUserInGroup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bot := newRecordingBot()
+	d := newTestDispatcherWithKey(t, ctx, bot, 10, conversation.PerChatUser)
+
+	d.DispatchUpdate(userTextUpdate(-5, 10, 1, "/echo"))
+	d.DispatchUpdate(userTextUpdate(-5, 11, 2, "/echo"))
+	d.DispatchUpdate(userTextUpdate(-5, 10, 3, "first"))
+	d.DispatchUpdate(userTextUpdate(-5, 11, 4, "second"))
+
+	replies := bot.collectReplies(t, 4) // two echoes and two technical messages
+	if replies[3] != "echo first" || replies[4] != "echo second" {
+		t.Errorf("unexpected replies %v", replies)
+	}
+}
+
+func TestConversationPerTopic(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bot := newRecordingBot()
+	d := newTestDispatcherWithKey(t, ctx, bot, 10, conversation.PerChatThread)
+	inTopic := func(text string, threadID int) *conversation.IncomingUpdate {
+		return &conversation.IncomingUpdate{Update: *textUpdate(-1001, text), ThreadID: threadID}
+	}
+
+	d.DispatchIncomingUpdate(inTopic("/echo", 5))
+	d.DispatchIncomingUpdate(inTopic("/echo", 6))
+	d.DispatchIncomingUpdate(inTopic("five", 5))
+	d.DispatchIncomingUpdate(inTopic("six", 6))
+
+	replies := bot.collectReplies(t, 4)
+	if len(replies) != 2 || replies[5] != "ended" || replies[6] != "ended" {
+		t.Errorf("unexpected replies %v", replies)
+	}
+}
@@ -10,6 +10,7 @@ const (
 	ConversationClosedByBot                       // a message to send to user if a conversation was cancelled by the bot
 	ConversationClosedByUser                      // a message to send to user if them switched to another global command
 	ConversationEnded                             // a message to send to user after conversation was ended successfully
+	AccessDenied                                  // a message to send to user if they do not have the role required by a command
 )
 
 // TechnicalMessageFuncType type of a function that should return technical messages for a dedicated user
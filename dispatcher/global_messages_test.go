@@ -14,6 +14,7 @@ func TestEmptyGlobalMessageFunc(t *testing.T) {
 		ConversationClosedByBot,
 		ConversationClosedByUser,
 		ConversationEnded,
+		AccessDenied,
 	}
 	for _, id := range messageIDs {
 		if EmptyTechnicalMessageFunc(777, id) != "" {
@@ -0,0 +1,57 @@
+package dispatcher
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/ufy-it/go-telegram-bot/handlers"
+	"github.com/ufy-it/go-telegram-bot/logger"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// handleInlineQuery answers an inline query with the first matching inline handler.
+// Queries without a matching handler, or with a failed or panicked handler, get an empty answer, so that the client does not wait for results
+func (d *Dispatcher) handleInlineQuery(ctx context.Context, query *tgbotapi.InlineQuery) {
+	response, err := d.inlineResponse(ctx, query)
+	if err != nil {
+		logger.Error("cannot handle inline query from %d: %v", query.From.ID, err)
+		response = handlers.NewInlineResponse(query) // drop partial results
+	}
+	if _, err := d.bot.Request(response.Config()); err != nil {
+		logger.Error("cannot answer inline query: %v", err)
+	}
+}
+
+// inlineResponse fills the response with the first matching inline handler, a panic of the handler is turned into an error
+func (d *Dispatcher) inlineResponse(ctx context.Context, query *tgbotapi.InlineQuery) (response *handlers.InlineResponse, err error) {
+	response = handlers.NewInlineResponse(query)
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			logger.Error("inline handler panicked: %v\n%s", recovered, debug.Stack())
+			err = fmt.Errorf("inline handler panicked: %v", recovered)
+		}
+	}()
+	for _, handler := range d.inlineQueryHandlers {
+		if handler.QuerySelector(ctx, query) {
+			return response, handler.Handler(ctx, query, response)
+		}
+	}
+	return response, nil
+}
+
+// handleChosenInlineResult passes a result chosen by a user to the hook from the configuration
+func (d *Dispatcher) handleChosenInlineResult(ctx context.Context, result *tgbotapi.ChosenInlineResult) {
+	if d.chosenInlineResultHandler == nil {
+		return
+	}
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			logger.Error("chosen inline result hook panicked on %s: %v\n%s", result.ResultID, recovered, debug.Stack())
+		}
+	}()
+	if err := d.chosenInlineResultHandler(ctx, result); err != nil {
+		logger.Error("cannot handle chosen inline result %s: %v", result.ResultID, err)
+	}
+}
@@ -0,0 +1,86 @@
+package dispatcher_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ufy-it/go-telegram-bot/conversation"
+	. "github.com/ufy-it/go-telegram-bot/dispatcher"
+	"github.com/ufy-it/go-telegram-bot/handlers"
+	"github.com/ufy-it/go-telegram-bot/state"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestInlineQueries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bot := newRecordingBot()
+	chosen := make(chan string, 1)
+	d, err := NewDispatcher(ctx, Config{
+		ConversationConfig: conversation.Config{MaxMessageQueue: 5, TimeoutMinutes: 1},
+		Handlers:           &handlers.CommandHandlers{Default: handlers.MessageHandlerCreator("default")},
+		InlineQueryHandlers: []handlers.InlineQueryHandler{
+			{QuerySelector: handlers.RegExpInlineQuerySelector("^fail"), Handler: func(ctx context.Context, query *tgbotapi.InlineQuery, response *handlers.InlineResponse) error {
+				return errors.New("failure")
+			}},
+			{QuerySelector: handlers.RegExpInlineQuerySelector("^panic"), Handler: func(ctx context.Context, query *tgbotapi.InlineQuery, response *handlers.InlineResponse) error {
+				response.AddArticle("1", "Partial", "partial")
+				panic("bad handler")
+			}},
+			{QuerySelector: handlers.RegExpInlineQuerySelector("^cat"), Handler: func(ctx context.Context, query *tgbotapi.InlineQuery, response *handlers.InlineResponse) error {
+				response.AddArticle("1", "Cat", "<b>cat</b>").AddCachedPhoto("2", "cat-photo")
+				return nil
+			}},
+		},
+		ChosenInlineResultHandler: func(ctx context.Context, result *tgbotapi.ChosenInlineResult) error {
+			if result.ResultID == "panic" {
+				panic("bad hook")
+			}
+			chosen <- result.ResultID
+			return nil
+		},
+	}, bot, state.NewMemoryState())
+	if err != nil {
+		t.Fatalf("cannot create dispatcher: %v", err)
+	}
+	expectAnswer := func(queryID string, results int) {
+		t.Helper()
+		select {
+		case msg := <-bot.sent:
+			answer, ok := msg.(tgbotapi.InlineConfig)
+			if !ok || answer.InlineQueryID != queryID || len(answer.Results) != results {
+				t.Errorf("expected answer to %s with %d results, got %v", queryID, results, msg)
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("query %s was not answered", queryID)
+		}
+	}
+	from := &tgbotapi.User{ID: 10}
+
+	d.DispatchUpdate(&tgbotapi.Update{InlineQuery: &tgbotapi.InlineQuery{ID: "q1", From: from, Query: "cats"}})
+	expectAnswer("q1", 2)
+	d.DispatchUpdate(&tgbotapi.Update{InlineQuery: &tgbotapi.InlineQuery{ID: "q2", From: from, Query: "dogs"}})
+	expectAnswer("q2", 0)
+	d.DispatchUpdate(&tgbotapi.Update{InlineQuery: &tgbotapi.InlineQuery{ID: "q3", From: from, Query: "fail"}})
+	expectAnswer("q3", 0)
+	d.DispatchUpdate(&tgbotapi.Update{InlineQuery: &tgbotapi.InlineQuery{ID: "q4", From: from, Query: "panic"}})
+	expectAnswer("q4", 0)
+	d.DispatchUpdate(&tgbotapi.Update{ChosenInlineResult: &tgbotapi.ChosenInlineResult{ResultID: "panic", From: from, Query: "cats"}})
+	d.DispatchUpdate(&tgbotapi.Update{ChosenInlineResult: &tgbotapi.ChosenInlineResult{ResultID: "1", From: from, Query: "cats"}})
+	select {
+	case id := <-chosen:
+		if id != "1" {
+			t.Errorf("unexpected chosen result %s", id)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("chosen result was not handled")
+	}
+	select {
+	case msg := <-bot.sent:
+		t.Errorf("unexpected message %v", msg)
+	default:
+	}
+}
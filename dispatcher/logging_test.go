@@ -0,0 +1,90 @@
+package dispatcher_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/ufy-it/go-telegram-bot/conversation"
+	. "github.com/ufy-it/go-telegram-bot/dispatcher"
+	"github.com/ufy-it/go-telegram-bot/handlers"
+	"github.com/ufy-it/go-telegram-bot/handlers/readers"
+	"github.com/ufy-it/go-telegram-bot/logger"
+	"github.com/ufy-it/go-telegram-bot/state"
+)
+
+// recordingLogger remembers fields of records by their messages
+type recordingLogger struct {
+	mu      sync.Mutex
+	records map[string]map[string]interface{}
+}
+
+func (r *recordingLogger) Log(level logger.Level, msg string, keyvals ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fields := make(map[string]interface{})
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		fields[fmt.Sprint(keyvals[i])] = keyvals[i+1]
+	}
+	r.records[msg] = fields
+}
+
+func (r *recordingLogger) fields(msg string) map[string]interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.records[msg]
+}
+
+func TestConversationLogFields(t *testing.T) {
+	recorder := &recordingLogger{records: make(map[string]map[string]interface{})}
+	logger.SetStructuredLogger(recorder)
+	defer logger.SetLogger(logger.DefaultLogger())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bot := newRecordingBot()
+	greet := func(ctx context.Context, conversation readers.BotConversation) handlers.Handler {
+		return handlers.NewStatelessHandler([]handlers.ConversationStep{
+			{
+				Name: "ask",
+				Action: func() (handlers.StepResult, error) {
+					logger.FromContext(ctx).Note("asking")
+					return handlers.NextStep()
+				},
+			},
+			{
+				Name: "reply",
+				Action: func() (handlers.StepResult, error) {
+					logger.FromContext(ctx).Note("replying")
+					_, err := conversation.SendText("hello")
+					return handlers.ActionResultWithError(handlers.EndConversation, err)
+				},
+			},
+		})
+	}
+	d, err := NewDispatcher(ctx, Config{
+		MaxOpenConversations: 1,
+		ConversationConfig:   conversation.Config{MaxMessageQueue: 1, TimeoutMinutes: 1},
+		Handlers: &handlers.CommandHandlers{
+			Default: handlers.MessageHandlerCreator("default"),
+			List: []handlers.CommandHandler{
+				{CommandSelector: handlers.RegExpCommandSelector("/greet"), HandlerCreator: greet, Name: "greet"},
+			},
+		},
+		TechnicalMessageFunc: technicalMessageFunc,
+	}, bot, state.NewMemoryState())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.DispatchUpdate(textUpdate(5, "/greet"))
+	bot.expectText(t, 5, "hello")
+	bot.expectText(t, 5, "ended")
+	for msg, step := range map[string]string{"asking": "ask", "replying": "reply"} {
+		fields := recorder.fields(msg)
+		if fields["chat_id"] != int64(5) || fields["handler"] != "greet" || fields["step"] != step || fields["conversation_id"] == nil {
+			t.Errorf("unexpected fields of '%s': %v", msg, fields)
+		}
+	}
+}
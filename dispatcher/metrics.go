@@ -0,0 +1,107 @@
+package dispatcher
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/ufy-it/go-telegram-bot/conversation"
+	"github.com/ufy-it/go-telegram-bot/handlers"
+	"github.com/ufy-it/go-telegram-bot/logger"
+	"github.com/ufy-it/go-telegram-bot/state"
+	"github.com/ufy-it/go-telegram-bot/tracing"
+)
+
+// updateType returns the type of the update as it is named in the Bot API
+func updateType(update *conversation.IncomingUpdate) string {
+	switch {
+	case update == nil:
+		return "unknown"
+	case update.MessageReaction != nil:
+		return "message_reaction"
+	case update.Message != nil:
+		return "message"
+	case update.EditedMessage != nil:
+		return "edited_message"
+	case update.ChannelPost != nil:
+		return "channel_post"
+	case update.EditedChannelPost != nil:
+		return "edited_channel_post"
+	case update.CallbackQuery != nil:
+		return "callback_query"
+	case update.InlineQuery != nil:
+		return "inline_query"
+	case update.ChosenInlineResult != nil:
+		return "chosen_inline_result"
+	case update.MyChatMember != nil:
+		return "my_chat_member"
+	case update.ChatMember != nil:
+		return "chat_member"
+	case update.ChatJoinRequest != nil:
+		return "chat_join_request"
+	}
+	return "other"
+}
+
+// handlerName returns the name of the handler for metrics, kind and index are used for handlers without a name
+func handlerName(handler handlers.CommandHandler, kind string, index int) string {
+	if handler.Name != "" {
+		return handler.Name
+	}
+	return fmt.Sprintf("%s_%d", kind, index)
+}
+
+// reportConversations reports the number of open conversations. Should be called under the lock
+func (d *Dispatcher) reportConversations() {
+	d.metrics.OpenConversations(len(d.conversations), d.maxOpenConversations)
+}
+
+// stepReporter is a BotState for a handler that reports transitions between steps of the handler,
+// and sets the name of the current step in the logger of the conversation
+type stepReporter struct {
+	state.BotState
+	d       *Dispatcher
+	handler string
+	namer   handlers.StepNamer // nil if the handler does not name its steps
+	log     *logger.FieldLogger
+	trace   *tracing.Scope // span of the update consumed by the handler the latest
+	step    int            // the latest saved step, -1 before the first step
+}
+
+// reportSteps returns the state for the handler of the conversation
+func (d *Dispatcher) reportSteps(name string, handler handlers.Handler, conv *conversation.BotConversation) state.BotState {
+	namer, _ := handler.(handlers.StepNamer)
+	return &stepReporter{BotState: d.state, d: d, handler: name, namer: namer, log: conv.Logger(), trace: conv.Trace(), step: -1}
+}
+
+// setStep sets the name of the step in the logger, the index is used for steps without a name
+func (s *stepReporter) setStep(step int) {
+	name := ""
+	if s.namer != nil {
+		name = s.namer.StepName(step)
+	}
+	if name == "" {
+		name = strconv.Itoa(step)
+	}
+	if span := s.trace.Span(); span != nil && s.step < 0 {
+		span.SetAttributes(tracing.Attr("step", name)) // the first update of the conversation is consumed by the first step
+	}
+	s.log.Set("step", name)
+}
+
+// GetConversationStepAndData returns the step and the data of the conversation and remembers the step of a resumed handler
+func (s *stepReporter) GetConversationStepAndData(conversationID int64) (int, interface{}) {
+	step, data := s.BotState.GetConversationStepAndData(conversationID)
+	if data != nil {
+		s.setStep(step)
+		s.step = step // the handler is resumed from the step without saving it again
+	}
+	return step, data
+}
+
+// SaveConversationStepAndData saves the step and reports the transition
+func (s *stepReporter) SaveConversationStepAndData(conversationID int64, step int, data interface{}) error {
+	s.d.metrics.StepTransition(s.handler, s.step, step)
+	s.setStep(step)
+	s.step = step
+	return s.BotState.SaveConversationStepAndData(conversationID, step, data)
+}
@@ -0,0 +1,121 @@
+package dispatcher_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ufy-it/go-telegram-bot/conversation"
+	. "github.com/ufy-it/go-telegram-bot/dispatcher"
+	"github.com/ufy-it/go-telegram-bot/handlers"
+	"github.com/ufy-it/go-telegram-bot/handlers/readers"
+	"github.com/ufy-it/go-telegram-bot/metrics"
+	"github.com/ufy-it/go-telegram-bot/state"
+)
+
+// countingCollector counts measurements by their description
+type countingCollector struct {
+	metrics.NopCollector
+	mu     sync.Mutex
+	counts map[string]int
+	open   int
+}
+
+func (c *countingCollector) inc(format string, args ...interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[fmt.Sprintf(format, args...)]++
+}
+
+func (c *countingCollector) UpdateReceived(updateType string) { c.inc("update %s", updateType) }
+func (c *countingCollector) UpdateRejected(reason string)     { c.inc("rejected %s", reason) }
+func (c *countingCollector) HandlerFinished(handler string, duration time.Duration, err error) {
+	c.inc("handler %s %v", handler, err)
+}
+func (c *countingCollector) StepTransition(handler string, from, to int) {
+	c.inc("step %s %d->%d", handler, from, to)
+}
+func (c *countingCollector) OpenConversations(open, max int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.open = open
+}
+
+// expect waits until the measurement is counted n times
+func (c *countingCollector) expect(t *testing.T, what string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		c.mu.Lock()
+		count := c.counts[what]
+		c.mu.Unlock()
+		if count == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("expected '%s' %d times, got %d", what, n, count)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDispatcherMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bot := newRecordingBot()
+	collector := &countingCollector{counts: make(map[string]int)}
+	release := make(chan struct{})
+	d, err := NewDispatcher(ctx, Config{
+		MaxOpenConversations: 1,
+		ConversationConfig:   conversation.Config{MaxMessageQueue: 1, TimeoutMinutes: 1},
+		Handlers: &handlers.CommandHandlers{
+			Default: handlers.MessageHandlerCreator("default"),
+			List: []handlers.CommandHandler{
+				{CommandSelector: handlers.RegExpCommandSelector("/echo"), HandlerCreator: echoHandler, Name: "echo"},
+				{CommandSelector: handlers.RegExpCommandSelector("/hang"), HandlerCreator: handlers.OneStepHandlerCreator(
+					func(ctx context.Context, conversation readers.BotConversation) error {
+						<-release
+						return nil
+					})},
+			},
+		},
+		TechnicalMessageFunc: technicalMessageFunc,
+		Metrics:              collector,
+	}, bot, state.NewMemoryState())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.DispatchUpdate(textUpdate(1, "/echo"))
+	waitForConversations(t, d, 1, 1) // the queue holds one update
+	d.DispatchUpdate(textUpdate(1, "ping"))
+	bot.expectText(t, 1, "echo ping")
+	bot.expectText(t, 1, "ended")
+	collector.expect(t, "handler echo <nil>", 1)
+	collector.expect(t, "step echo -1->0", 1)
+
+	d.DispatchUpdate(textUpdate(2, "/hang"))
+	deadline := time.Now().Add(2 * time.Second)
+	for convs := d.Conversations(2); (len(convs) == 0 || convs[0].Step != 0) && time.Now().Before(deadline); convs = d.Conversations(2) { // the handler took the first update
+		time.Sleep(10 * time.Millisecond)
+	}
+	d.DispatchUpdate(textUpdate(3, "hi"))
+	bot.expectText(t, 3, "too many conversations")
+	collector.expect(t, "rejected too_many_conversations", 1)
+	d.DispatchUpdate(textUpdate(2, "a"))
+	d.DispatchUpdate(textUpdate(2, "b"))
+	bot.expectText(t, 2, "too many messages")
+	collector.expect(t, "rejected queue_full", 1)
+	collector.mu.Lock()
+	if collector.open != 1 {
+		t.Errorf("expected 1 open conversation, got %d", collector.open)
+	}
+	collector.mu.Unlock()
+
+	close(release)
+	collector.expect(t, "handler command_1 <nil>", 1)
+	collector.expect(t, "update message", 6)
+}
@@ -0,0 +1,25 @@
+package dispatcher
+
+import (
+	"context"
+
+	"github.com/ufy-it/go-telegram-bot/handlers/readers"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// HandlerRunner creates and executes the handler selected for the first update of a conversation.
+// The first update is also available in the context with handlers.GetFirstUpdate
+type HandlerRunner func(ctx context.Context, conversation readers.BotConversation, firstUpdate *tgbotapi.Update) error
+
+// Middleware wraps running of handlers. A middleware can enrich the context passed to the next runner,
+// skip the next runner to short-circuit the conversation, and observe the returned error and the duration of the handler
+type Middleware func(next HandlerRunner) HandlerRunner
+
+// chainMiddlewares wraps the runner with middlewares, the first middleware in the list is the outermost
+func chainMiddlewares(middlewares []Middleware, runner HandlerRunner) HandlerRunner {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		runner = middlewares[i](runner)
+	}
+	return runner
+}
@@ -0,0 +1,73 @@
+package dispatcher_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ufy-it/go-telegram-bot/conversation"
+	. "github.com/ufy-it/go-telegram-bot/dispatcher"
+	"github.com/ufy-it/go-telegram-bot/handlers"
+	"github.com/ufy-it/go-telegram-bot/handlers/readers"
+	"github.com/ufy-it/go-telegram-bot/state"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+type greetingKey struct{}
+
+func TestMiddlewares(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bot := newRecordingBot()
+	observed := make(chan error, 10)
+
+	observer := func(next HandlerRunner) HandlerRunner {
+		return func(ctx context.Context, conversation readers.BotConversation, firstUpdate *tgbotapi.Update) error {
+			err := next(ctx, conversation, firstUpdate)
+			observed <- err
+			return err
+		}
+	}
+	banned := func(next HandlerRunner) HandlerRunner {
+		return func(ctx context.Context, conversation readers.BotConversation, firstUpdate *tgbotapi.Update) error {
+			if conversation.ChatID() == 13 {
+				return errors.New("banned")
+			}
+			return next(context.WithValue(ctx, greetingKey{}, "hi"), conversation, firstUpdate)
+		}
+	}
+	greeting := handlers.OneStepHandlerCreator(func(ctx context.Context, conversation readers.BotConversation) error {
+		update, err := handlers.GetFirstUpdate(ctx)
+		if err != nil {
+			return err
+		}
+		_, err = conversation.SendText(ctx.Value(greetingKey{}).(string) + " " + update.Message.Text)
+		return err
+	})
+
+	d, err := NewDispatcher(ctx, Config{
+		MaxOpenConversations: 10,
+		ConversationConfig:   conversation.Config{MaxMessageQueue: 5, TimeoutMinutes: 1},
+		Handlers:             &handlers.CommandHandlers{Default: greeting},
+		TechnicalMessageFunc: technicalMessageFunc,
+		Middlewares:          []Middleware{observer, banned},
+	}, bot, state.NewMemoryState())
+	if err != nil {
+		t.Fatalf("cannot create dispatcher: %v", err)
+	}
+
+	d.DispatchUpdate(textUpdate(1, "there"))
+	bot.expectText(t, 1, "hi there")
+	bot.expectText(t, 1, "ended")
+	if err := <-observed; err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	d.DispatchUpdate(textUpdate(13, "there"))
+	bot.expectText(t, 13, "error")
+	bot.expectText(t, 13, "ended")
+	if err := <-observed; err == nil || err.Error() != "banned" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,329 @@
+package dispatcher
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ufy-it/go-telegram-bot/boterrors"
+	"github.com/ufy-it/go-telegram-bot/delivery"
+	"github.com/ufy-it/go-telegram-bot/handlers/buttons"
+	"github.com/ufy-it/go-telegram-bot/logger"
+	"github.com/ufy-it/go-telegram-bot/state"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// OutboxMessage is a single message from the bot to a chat that is delivered when the chat has no ongoing conversation
+type OutboxMessage = delivery.OutboxMessage
+
+// outboxSaveDelay is the delay of the background save of the outbox after a change, changes made during the delay are saved together
+const outboxSaveDelay = time.Second
+
+// outboxRetryDelay is the delay of the first retry of a queue whose message failed with a transient error, it doubles with every failed retry
+const outboxRetryDelay = time.Second
+
+// outboxMaxRetryDelay is the maximum delay between retries of a queue
+const outboxMaxRetryDelay = 5 * time.Minute
+
+// outbox keeps queues of messages waiting for the chats to be released, and saves them to io in the background.
+// A message is removed from its queue after it is delivered, so a message sent right before a crash can be delivered twice.
+// Changes of the last second can be lost after a crash, they are saved when the dispatcher is stopped
+type outbox struct {
+	mu       sync.Mutex
+	saveMu   sync.Mutex // keeps the order of saves to io
+	queues   map[int64][]*OutboxMessage
+	flushing map[int64]*chatLock // locks of chats whose queues are being delivered
+	retries  map[int64]*outboxRetry
+	io       state.StateIO // nil if queues are kept in memory only
+	pending  bool          // a background save is scheduled
+	stopped  bool          // retries are not scheduled anymore
+}
+
+// chatLock serializes deliveries of the queue of a chat
+type chatLock struct {
+	sync.Mutex
+	users int // number of goroutines that hold or wait for the lock
+}
+
+// outboxRetry is a scheduled delivery of the queue of a chat after a transient error
+type outboxRetry struct {
+	timer    *time.Timer // nil if no retry is scheduled
+	attempts int         // number of failed deliveries in a row
+}
+
+func newOutbox(io state.StateIO) *outbox {
+	o := &outbox{
+		queues:   make(map[int64][]*OutboxMessage),
+		flushing: make(map[int64]*chatLock),
+		retries:  make(map[int64]*outboxRetry),
+		io:       io,
+	}
+	if io == nil {
+		return o
+	}
+	data, err := io.Load()
+	if err != nil {
+		logger.Warning("cannot load outbox: %v, will start from blank", err)
+		return o
+	}
+	var messages []*OutboxMessage
+	if err = json.Unmarshal(data, &messages); err != nil {
+		logger.Warning("cannot parse outbox: %v, will start from blank", err)
+		return o
+	}
+	for _, message := range messages {
+		o.queues[message.ChatID] = append(o.queues[message.ChatID], message)
+	}
+	return o
+}
+
+// saveLater schedules a background save of the queues, should be called under the lock
+func (o *outbox) saveLater() {
+	if o.io == nil || o.pending {
+		return
+	}
+	o.pending = true
+	time.AfterFunc(outboxSaveDelay, o.save)
+}
+
+// save writes all queues to io
+func (o *outbox) save() {
+	o.saveMu.Lock()
+	defer o.saveMu.Unlock()
+	o.mu.Lock()
+	o.pending = false
+	messages := make([]*OutboxMessage, 0)
+	for _, queue := range o.queues {
+		messages = append(messages, queue...)
+	}
+	o.mu.Unlock()
+	sort.SliceStable(messages, func(i, j int) bool { return messages[i].QueuedAt.Before(messages[j].QueuedAt) })
+	data, err := json.Marshal(messages) // queued messages are not changed, so they are read without the lock
+	if err == nil {
+		err = o.io.Save(data)
+	}
+	if err != nil {
+		logger.Error("cannot save outbox: %v", err)
+	}
+}
+
+// stop cancels scheduled retries and saves the queues
+func (o *outbox) stop() {
+	o.mu.Lock()
+	o.stopped = true
+	for _, retry := range o.retries {
+		if retry.timer != nil {
+			retry.timer.Stop()
+		}
+	}
+	o.retries = make(map[int64]*outboxRetry)
+	o.mu.Unlock()
+	if o.io != nil {
+		o.save()
+	}
+}
+
+// retryLater schedules the flush of the queue of the chat with a delay that grows with failed attempts.
+// Does nothing if a retry of the chat is scheduled already
+func (o *outbox) retryLater(chatID int64, flush func()) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.stopped {
+		return
+	}
+	retry, ok := o.retries[chatID]
+	if !ok {
+		retry = &outboxRetry{}
+		o.retries[chatID] = retry
+	}
+	if retry.timer != nil {
+		return
+	}
+	delay := outboxRetryDelay << retry.attempts
+	if delay <= 0 || delay > outboxMaxRetryDelay {
+		delay = outboxMaxRetryDelay
+	} else {
+		retry.attempts++
+	}
+	retry.timer = time.AfterFunc(delay, func() {
+		o.mu.Lock()
+		retry.timer = nil
+		o.mu.Unlock()
+		flush()
+	})
+}
+
+// delivered resets the retries of the chat after a successful flush
+func (o *outbox) delivered(chatID int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if retry, ok := o.retries[chatID]; ok && retry.timer == nil {
+		delete(o.retries, chatID)
+	}
+}
+
+// push adds the message to the queue of its chat
+func (o *outbox) push(message *OutboxMessage) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.queues[message.ChatID] = append(o.queues[message.ChatID], message)
+	o.saveLater()
+}
+
+// next returns the queued message of the chat with the highest priority, nil if the queue is empty
+func (o *outbox) next(chatID int64) *OutboxMessage {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var next *OutboxMessage
+	for _, message := range o.queues[chatID] {
+		if next == nil || message.Priority > next.Priority {
+			next = message
+		}
+	}
+	return next
+}
+
+// remove removes the message from the queue of its chat
+func (o *outbox) remove(message *OutboxMessage) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	queue := o.queues[message.ChatID]
+	for i := range queue {
+		if queue[i] == message {
+			queue = append(queue[:i:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(queue) == 0 {
+		delete(o.queues, message.ChatID)
+	} else {
+		o.queues[message.ChatID] = queue
+	}
+	o.saveLater()
+}
+
+// lockChat waits until no other goroutine delivers the queue of the chat, and returns the function that releases the chat
+func (o *outbox) lockChat(chatID int64) func() {
+	o.mu.Lock()
+	lock, ok := o.flushing[chatID]
+	if !ok {
+		lock = &chatLock{}
+		o.flushing[chatID] = lock
+	}
+	lock.users++
+	o.mu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		lock.users--
+		if lock.users == 0 {
+			delete(o.flushing, chatID)
+		}
+	}
+}
+
+// chats returns chats that have queued messages
+func (o *outbox) chats() []int64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	chats := make([]int64, 0, len(o.queues))
+	for chatID := range o.queues {
+		chats = append(chats, chatID)
+	}
+	return chats
+}
+
+// SendOutboxMessage sends the message if the chat has no ongoing conversation (or if the message should be delivered
+// during a conversation), otherwise queues it until the conversation is over. Returns error of sending, or nil if the message is queued
+func (d *Dispatcher) SendOutboxMessage(ctx context.Context, message OutboxMessage) error {
+	select {
+	case <-ctx.Done():
+		return fmt.Errorf("cannot send a message, context closed: %w", ctx.Err())
+	default:
+	}
+	if !d.chats.IsChatActive(message.ChatID) {
+		return fmt.Errorf("the message to chat %d is skipped: %w", message.ChatID, boterrors.ErrChatInactive)
+	}
+	if message.QueuedAt.IsZero() {
+		message.QueuedAt = time.Now()
+	}
+	d.mu.Lock()
+	if !message.DuringConversation && d.hasConversationInChat(message.ChatID) {
+		d.outbox.push(&message)
+		d.mu.Unlock()
+		return nil
+	}
+	d.mu.Unlock()
+	return d.sendOutboxMessage(ctx, &message)
+}
+
+// sendOutboxMessage sends the message through the bot
+func (d *Dispatcher) sendOutboxMessage(ctx context.Context, message *OutboxMessage) error {
+	_, err := SendWithContext(ctx, d.bot, message.Chattable())
+	return d.checkBlocked(message.ChatID, err)
+}
+
+// rejected returns true if the Bot API refused to deliver the message, so repeating the call later is useless
+func rejected(err error) bool {
+	var apiErr *boterrors.APIError
+	return errors.As(err, &apiErr) && apiErr.Code < http.StatusInternalServerError && apiErr.Code != http.StatusTooManyRequests
+}
+
+// flushOutbox delivers messages queued for the chat while it has no ongoing conversation.
+// Messages are sent without the lock of the dispatcher, if a conversation starts meanwhile the rest of the queue waits for its end.
+// A message that failed with a transient error stays in the queue, the queue is flushed again after a backoff
+func (d *Dispatcher) flushOutbox(chatID int64) {
+	unlock := d.outbox.lockChat(chatID)
+	defer unlock()
+	for {
+		d.mu.Lock()
+		busy := d.hasConversationInChat(chatID)
+		d.mu.Unlock()
+		if busy {
+			return
+		}
+		message := d.outbox.next(chatID)
+		if message == nil {
+			d.outbox.delivered(chatID)
+			return
+		}
+		if message.Expired(time.Now()) {
+			logger.Note("message to chat %d queued at %v is expired", chatID, message.QueuedAt)
+		} else if !d.chats.IsChatActive(chatID) {
+			logger.Note("message to inactive chat %d is dropped", chatID)
+		} else if err := d.sendOutboxMessage(d.conversationsCtx, message); err != nil {
+			if !rejected(err) {
+				logger.Warning("cannot deliver queued message to chat %d, will try later: %v", chatID, err)
+				d.outbox.retryLater(chatID, func() { d.flushOutbox(chatID) })
+				return
+			}
+			logger.Error("cannot deliver queued message to chat %d: %v", chatID, err)
+		}
+		d.outbox.remove(message)
+	}
+}
+
+// flushAllOutboxes delivers queued messages to all chats without ongoing conversations, e.g. messages restored after a restart
+func (d *Dispatcher) flushAllOutboxes() {
+	for _, chatID := range d.outbox.chats() {
+		d.flushOutbox(chatID)
+	}
+}
+
+// keyboardMarkup returns inline keyboard of the button set, nil if the set is empty
+func keyboardMarkup(keyboard *buttons.ButtonSet) *tgbotapi.InlineKeyboardMarkup {
+	if keyboard == nil || keyboard.IsEmpty() {
+		return nil
+	}
+	markup := keyboard.GetInlineKeyboard()
+	return &markup
+}
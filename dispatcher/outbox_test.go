@@ -0,0 +1,158 @@
+package dispatcher_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/ufy-it/go-telegram-bot/dispatcher"
+	"github.com/ufy-it/go-telegram-bot/handlers"
+	"github.com/ufy-it/go-telegram-bot/handlers/readers"
+	"github.com/ufy-it/go-telegram-bot/state"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// askHandler asks a question and waits for the answer
+var askHandler = handlers.OneStepHandlerCreator(func(ctx context.Context, conversation readers.BotConversation) error {
+	if _, err := conversation.SendText("question"); err != nil {
+		return err
+	}
+	readers.ReadRawTextAndDataResult(ctx, conversation)
+	return nil
+})
+
+// withOutbox makes askHandler the default handler and keeps queued messages in io
+func withOutbox(io state.StateIO) configOption {
+	return func(config *Config) {
+		config.Handlers.Default = askHandler
+		config.TechnicalMessageFunc = EmptyTechnicalMessageFunc
+		config.OutboxIO = io
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bot := newRecordingBot()
+	d := newTestDispatcher(t, ctx, bot, 10, withOutbox(nil))
+
+	if err := d.SendSingleMessage(ctx, 7, "idle chat", nil); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	bot.expectText(t, 7, "idle chat")
+
+	d.DispatchUpdate(textUpdate(7, "start"))
+	bot.expectText(t, 7, "question")
+	d.SendOutboxMessage(ctx, OutboxMessage{ChatID: 7, Text: "low"})
+	d.SendOutboxMessage(ctx, OutboxMessage{ChatID: 7, Text: "expired", ExpiresAt: time.Now().Add(-time.Second)})
+	d.SendOutboxMessage(ctx, OutboxMessage{ChatID: 7, Text: "high", Priority: 1})
+	d.SendOutboxMessage(ctx, OutboxMessage{ChatID: 7, Text: "urgent", DuringConversation: true})
+	bot.expectText(t, 7, "urgent")
+
+	d.DispatchUpdate(textUpdate(7, "answer"))
+	bot.expectText(t, 7, "high")
+	bot.expectText(t, 7, "low")
+	select {
+	case msg := <-bot.sent:
+		t.Errorf("unexpected message %v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestOutboxAfterRestart(t *testing.T) {
+	io := state.NewMemoryState()
+	ctx, cancel := context.WithCancel(context.Background())
+	bot := newRecordingBot()
+	d := newTestDispatcher(t, ctx, bot, 10, withOutbox(io))
+	d.DispatchUpdate(textUpdate(8, "start"))
+	bot.expectText(t, 8, "question")
+	d.SendSingleMessage(ctx, 8, "reminder", nil)
+	cancel()
+	<-d.Done() // the queue is saved when the dispatcher is stopped
+
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	newTestDispatcher(t, ctx, bot, 10, withOutbox(io))
+	bot.expectText(t, 8, "reminder")
+}
+
+// unreachableBot fails to send the message with the text once, as if the Bot API was unreachable
+type unreachableBot struct {
+	*recordingBot
+	mu   sync.Mutex
+	text string
+}
+
+func (b *unreachableBot) Send(msg tgbotapi.Chattable) (tgbotapi.Message, error) {
+	b.mu.Lock()
+	if message, ok := msg.(tgbotapi.MessageConfig); ok && message.Text == b.text {
+		b.text = ""
+		b.mu.Unlock()
+		return tgbotapi.Message{}, errors.New("connection reset")
+	}
+	b.mu.Unlock()
+	return b.recordingBot.Send(msg)
+}
+
+func (b *unreachableBot) failed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.text == ""
+}
+
+func TestOutboxKeepsUndeliveredMessages(t *testing.T) {
+	io := state.NewMemoryState()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bot := &unreachableBot{recordingBot: newRecordingBot(), text: "reminder"}
+	d := newTestDispatcher(t, ctx, bot, 10, withOutbox(io))
+
+	d.DispatchUpdate(textUpdate(9, "start"))
+	bot.expectText(t, 9, "question")
+	d.SendSingleMessage(ctx, 9, "reminder", nil)
+	d.DispatchUpdate(textUpdate(9, "answer"))
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !bot.failed() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !bot.failed() {
+		t.Fatal("the message was not sent")
+	}
+	bot.expectText(t, 9, "reminder") // the queue is flushed again after a backoff, without new conversations in the chat
+	deadline = time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if data, _ := io.Load(); string(data) == "[]" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	data, _ := io.Load()
+	t.Errorf("delivered message should be removed from the saved outbox, got %s", data)
+}
+
+func TestOutboxSavesInBackground(t *testing.T) {
+	io := state.NewMemoryState()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bot := newRecordingBot()
+	d := newTestDispatcher(t, ctx, bot, 10, withOutbox(io))
+	d.DispatchUpdate(textUpdate(10, "start"))
+	bot.expectText(t, 10, "question")
+	for i := 0; i < 3; i++ {
+		d.SendSingleMessage(ctx, 10, "reminder", nil)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		if data, _ := io.Load(); strings.Count(string(data), "reminder") == 3 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	data, _ := io.Load()
+	t.Errorf("expected 3 queued messages saved, got %s", data)
+}
@@ -0,0 +1,66 @@
+package dispatcher
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/ufy-it/go-telegram-bot/conversation"
+	"github.com/ufy-it/go-telegram-bot/logger"
+)
+
+// PanicHookType is a type of function that is called with the value of a panic recovered in a conversation
+type PanicHookType func(chatID int64, conversationID int64, recovered interface{})
+
+// recoverConversation cleans up after a panic in the conversation: the user gets the UserError message,
+// the conversation is removed from the dispatcher and from the state, so that it is not resumed after a restart
+func (d *Dispatcher) recoverConversation(ctx context.Context, conv *conversation.BotConversation, recovered interface{}) {
+	log := conv.Logger()
+	log.Error("conversation panicked", "panic", recovered, "stack", string(debug.Stack()))
+	if span := conv.Trace().Span(); span != nil {
+		span.RecordError(fmt.Errorf("panic: %v", recovered))
+	}
+	conv.Trace().End()
+	stopping := ctx.Err() != nil // checked before the context of the conversation is canceled
+	d.mu.Lock()
+	if c, ok := d.conversations[conv.ConversationID()]; ok {
+		c.cancel()
+		delete(d.conversations, conv.ConversationID())
+		d.reportConversations()
+	}
+	if convID, ok := d.keyToConversationID[conv.Key()]; ok && convID == conv.ConversationID() {
+		delete(d.keyToConversationID, conv.Key())
+	}
+	d.state.RemoveConverastionState(conv.ConversationID()) // the state might be removed already
+	d.mu.Unlock()
+
+	if d.panicHook != nil {
+		d.panicHook(conv.ChatID(), conv.ConversationID(), recovered)
+	}
+	if stopping {
+		return
+	}
+	if err := d.sendGlobalMessage(conv.ChatID(), conv.ThreadID(), UserError); err != nil {
+		log.Warning("cannot send error notification", "error", err)
+	}
+	go d.flushOutbox(conv.ChatID())
+}
+
+// quarantined returns true if the bot crashed more times than allowed while the conversation ran a step without getting updates
+// from the user, e.g. because the conversation crashes the bot. Such a conversation is removed from the state instead of being resumed
+func (d *Dispatcher) quarantined(conversationID int64, crashes int) bool {
+	if d.maxConversationCrashes <= 0 || crashes <= d.maxConversationCrashes {
+		return false
+	}
+	key := d.state.GetConversationKey(conversationID)
+	threadID := d.state.GetConversationThreadID(conversationID)
+	log := logger.With("chat_id", key.ChatID, "conversation_id", conversationID)
+	log.Warning("the bot crashed too many times while the conversation ran a step, it is dropped", "crashes", crashes)
+	if err := d.state.RemoveConverastionState(conversationID); err != nil {
+		log.Error("cannot remove conversation state", "error", err)
+	}
+	if err := d.sendGlobalMessage(key.ChatID, threadID, UserError); err != nil {
+		log.Warning("cannot send error notification", "error", err)
+	}
+	return true
+}
@@ -0,0 +1,199 @@
+package dispatcher_test
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ufy-it/go-telegram-bot/conversation"
+	. "github.com/ufy-it/go-telegram-bot/dispatcher"
+	"github.com/ufy-it/go-telegram-bot/handlers"
+	"github.com/ufy-it/go-telegram-bot/handlers/readers"
+	"github.com/ufy-it/go-telegram-bot/state"
+)
+
+func TestPanicInHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bot := newRecordingBot()
+	panics := make(chan interface{}, 1)
+	io := state.NewMemoryState()
+	d, err := NewDispatcher(ctx, Config{
+		MaxOpenConversations: 10,
+		ConversationConfig:   conversation.Config{MaxMessageQueue: 5, TimeoutMinutes: 1},
+		Handlers: &handlers.CommandHandlers{
+			Default: handlers.MessageHandlerCreator("default"),
+			List: []handlers.CommandHandler{
+				{CommandSelector: handlers.RegExpCommandSelector("/panic"), HandlerCreator: handlers.OneStepHandlerCreator(
+					func(ctx context.Context, conversation readers.BotConversation) error {
+						var user *struct{ Name string }
+						_, err := conversation.SendText(user.Name) // nil pointer dereference
+						return err
+					})},
+			},
+		},
+		TechnicalMessageFunc: technicalMessageFunc,
+		PanicHook: func(chatID int64, conversationID int64, recovered interface{}) {
+			panics <- recovered
+		},
+	}, bot, io)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d.DispatchUpdate(textUpdate(1, "/panic"))
+	bot.expectText(t, 1, "error")
+	select {
+	case recovered := <-panics:
+		if err, ok := recovered.(error); !ok || err.Error() != "runtime error: invalid memory address or nil pointer dereference" {
+			t.Errorf("unexpected panic value %v", recovered)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("the panic hook was not called")
+	}
+	saved := state.NewBotState(io)
+	if err := saved.LoadState(); err != nil || len(saved.GetConversationIDs()) != 0 {
+		t.Errorf("expected no conversations in the state, got %v (%v)", saved.GetConversationIDs(), err)
+	}
+
+	// the bot still works for the chat and for others
+	d.DispatchUpdate(textUpdate(1, "hi"))
+	bot.expectText(t, 1, "default")
+	bot.expectText(t, 1, "ended")
+	d.DispatchUpdate(textUpdate(2, "hi"))
+	bot.expectText(t, 2, "default")
+	bot.expectText(t, 2, "ended")
+}
+
+// crashingIO is a state io of a bot that can crash, the crashed bot does not save anything
+type crashingIO struct {
+	state.StateIO
+	mu      sync.Mutex
+	crashed bool
+}
+
+func (c *crashingIO) Save(data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.crashed {
+		return nil
+	}
+	return c.StateIO.Save(data)
+}
+
+func (c *crashingIO) crash() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.crashed = true
+}
+
+// savedInStep returns true if the saved state marks that the conversation runs a step
+func savedInStep(t *testing.T, io state.StateIO, conversationID int64) bool {
+	t.Helper()
+	data, err := io.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved struct {
+		Conversations map[int64]state.ConversationState `json:"conversations"`
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	return saved.Conversations[conversationID].InStep
+}
+
+func TestQuarantineOfResumedConversations(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	io := state.NewMemoryState()
+	saved := state.NewBotState(io)
+	if err := saved.StartConversationWithKey(5, state.ConversationKey{ChatID: 1}, 0, textUpdate(1, "/stuck")); err != nil {
+		t.Fatal(err)
+	}
+	if err := saved.StartConversationWithKey(6, state.ConversationKey{ChatID: 2}, 0, textUpdate(2, "/echo")); err != nil {
+		t.Fatal(err)
+	}
+	stuckHandler := handlers.OneStepHandlerCreator(func(ctx context.Context, conversation readers.BotConversation) error {
+		<-ctx.Done() // the step runs without waiting for the user, e.g. it crashes the bot
+		return nil
+	})
+	config := Config{
+		MaxOpenConversations: 10,
+		ConversationConfig:   conversation.Config{MaxMessageQueue: 5, TimeoutMinutes: 1},
+		Handlers: &handlers.CommandHandlers{
+			Default: echoHandler,
+			List:    []handlers.CommandHandler{{CommandSelector: handlers.RegExpCommandSelector("/stuck"), HandlerCreator: stuckHandler}},
+		},
+		TechnicalMessageFunc:   technicalMessageFunc,
+		MaxConversationCrashes: 1,
+	}
+	expectNoMessages := func(bot *recordingBot) {
+		t.Helper()
+		select {
+		case msg := <-bot.sent:
+			t.Errorf("unexpected message %v", msg)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	waitForIdle := func() {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for savedInStep(t, io, 6) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if savedInStep(t, io, 6) {
+			t.Fatal("the resumed conversation does not wait for the user")
+		}
+	}
+
+	// graceful restarts are not crashes
+	for i := 0; i < 3; i++ {
+		stopCtx, stop := context.WithCancel(ctx)
+		bot := newRecordingBot()
+		d, err := NewDispatcher(stopCtx, config, bot, io)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitForIdle()
+		stop()
+		<-d.Done()
+		expectNoMessages(bot)
+	}
+
+	// the bot crashes twice while the conversation in chat 1 runs a step, the first crash is allowed.
+	// The conversation in chat 2 waits for the user, so the crashes are not its fault
+	for i := 0; i < 2; i++ {
+		bot := newRecordingBot()
+		crashing := &crashingIO{StateIO: io}
+		if _, err := NewDispatcher(ctx, config, bot, crashing); err != nil {
+			t.Fatal(err)
+		}
+		waitForIdle()
+		crashing.crash()
+		expectNoMessages(bot)
+	}
+	if !savedInStep(t, io, 5) {
+		t.Error("expected the stuck conversation saved in a step")
+	}
+
+	third := newRecordingBot()
+	d, err := NewDispatcher(ctx, config, third, io)
+	if err != nil {
+		t.Fatal(err)
+	}
+	third.expectText(t, 1, "error")
+	expectNoMessages(third)
+	saved = state.NewBotState(io)
+	if err := saved.LoadState(); err != nil || len(saved.GetConversationIDs()) != 1 || saved.GetConversationChatID(6) != 2 {
+		t.Errorf("expected only the idle conversation in the state, got %v (%v)", saved.GetConversationIDs(), err)
+	}
+	d.DispatchUpdate(textUpdate(2, "ping"))
+	third.expectText(t, 2, "echo ping")
+	third.expectText(t, 2, "ended")
+	d.DispatchUpdate(textUpdate(1, "/echo"))
+	d.DispatchUpdate(textUpdate(1, "ping"))
+	third.expectText(t, 1, "echo ping")
+}
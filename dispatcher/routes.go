@@ -0,0 +1,66 @@
+package dispatcher
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ufy-it/go-telegram-bot/conversation"
+	"github.com/ufy-it/go-telegram-bot/handlers"
+)
+
+// UpdatePolicy defines what the dispatcher does with updates of a kind that is not a message or a button press
+type UpdatePolicy int
+
+const (
+	IgnoreUpdate          UpdatePolicy = iota // drop updates of the kind (default)
+	DeliverToConversation                     // pass updates to the ongoing conversation, drop them if there is no conversation
+	StartHandler                              // start a new conversation with the handler of the route, drop updates if there is an ongoing conversation
+)
+
+// Conversations started by StartHandler routes do not send technical messages when they end or fail,
+// as they often run in channels or as a side effect of a user action
+
+// UpdateRoute defines how the dispatcher routes updates of a kind
+type UpdateRoute struct {
+	Policy  UpdatePolicy                // what to do with updates of the kind
+	Handler handlers.HandlerCreatorType // handler to start for StartHandler policy
+}
+
+// validate checks that the route can be used for updates of the kind
+func (r UpdateRoute) validate(kind string) error {
+	if r.Policy == StartHandler && r.Handler == nil {
+		return fmt.Errorf("route for %s starts a handler, but the handler is nil", kind)
+	}
+	return nil
+}
+
+// routeFor returns route for an update of a special kind, and false for messages and button presses
+// that are routed to command handlers
+func (d *Dispatcher) routeFor(update *conversation.IncomingUpdate) (UpdateRoute, bool) {
+	switch {
+	case update == nil:
+		return UpdateRoute{}, false
+	case update.MessageReaction != nil:
+		return d.messageReactions, true
+	case update.EditedMessage != nil:
+		return d.editedMessages, true
+	case update.ChannelPost != nil || update.EditedChannelPost != nil:
+		return d.channelPosts, true
+	}
+	return UpdateRoute{}, false
+}
+
+// validateRoutes checks routes from the dispatcher configuration
+func validateRoutes(config Config) error {
+	if config.MessageReactions.Policy == DeliverToConversation {
+		// conversations read tgbotapi updates that cannot hold a reaction
+		return errors.New("message reactions cannot be delivered to a conversation")
+	}
+	if err := config.EditedMessages.validate("edited messages"); err != nil {
+		return err
+	}
+	if err := config.ChannelPosts.validate("channel posts"); err != nil {
+		return err
+	}
+	return config.MessageReactions.validate("message reactions")
+}
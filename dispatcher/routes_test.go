@@ -0,0 +1,152 @@
+package dispatcher_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ufy-it/go-telegram-bot/conversation"
+	. "github.com/ufy-it/go-telegram-bot/dispatcher"
+	"github.com/ufy-it/go-telegram-bot/handlers"
+	"github.com/ufy-it/go-telegram-bot/handlers/readers"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// editHandler asks for a name and confirms the latest version of the answer
+var editHandler = handlers.OneStepHandlerCreator(func(ctx context.Context, conversation readers.BotConversation) error {
+	answer := readers.ReadTextAndDataResult(ctx, conversation)
+	if answer.Exit {
+		return nil
+	}
+	for {
+		update, exit := conversation.GetUpdateFromUser(ctx)
+		if exit {
+			return nil
+		}
+		if readers.ParseUserTextAndDataReply(update, exit).Text != "" {
+			return errors.New("an edit is taken as a new answer")
+		}
+		if edited, ok := readers.EditedAnswer(update, answer.MessageID); ok {
+			_, err := conversation.SendText("edited to " + edited.Text)
+			return err
+		}
+	}
+})
+
+// reactionHandler reports the emoji of the reaction that started the conversation
+var reactionHandler = handlers.OneStepHandlerCreator(func(ctx context.Context, conversation readers.BotConversation) error {
+	reaction, err := handlers.GetMessageReaction(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = conversation.SendText("reaction " + reaction.NewReaction[0].Emoji)
+	return err
+})
+
+// withNameHandler adds /name command that reports edits of the answer
+func withNameHandler(config *Config) {
+	config.Handlers.List = append(config.Handlers.List, handlers.CommandHandler{CommandSelector: handlers.RegExpCommandSelector("/name"), HandlerCreator: editHandler})
+}
+
+func TestIgnoredUpdates(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bot := newRecordingBot()
+	d := newTestDispatcher(t, ctx, bot, 10, withNameHandler)
+
+	d.DispatchUpdate(&tgbotapi.Update{EditedMessage: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: 1}, Text: "/name"}})
+	d.DispatchUpdate(&tgbotapi.Update{ChannelPost: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: -100}, Text: "post"}})
+	d.DispatchIncomingUpdate(&conversation.IncomingUpdate{MessageReaction: &conversation.MessageReaction{Chat: &tgbotapi.Chat{ID: 1}}})
+	d.DispatchUpdate(textUpdate(2, "/hello"))
+	bot.expectText(t, 2, "hello")
+}
+
+func TestEditedMessageDeliveredToConversation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bot := newRecordingBot()
+	d := newTestDispatcher(t, ctx, bot, 10, withNameHandler, func(config *Config) {
+		config.EditedMessages = UpdateRoute{Policy: DeliverToConversation}
+	})
+
+	d.DispatchUpdate(textUpdate(1, "/name"))
+	answer := textUpdate(1, "Jonh")
+	answer.Message.MessageID = 5
+	d.DispatchUpdate(answer)
+	d.DispatchUpdate(&tgbotapi.Update{EditedMessage: &tgbotapi.Message{MessageID: 5, Chat: &tgbotapi.Chat{ID: 1}, Text: "John"}})
+	bot.expectText(t, 1, "edited to John")
+	bot.expectText(t, 1, "ended")
+
+	// there is no conversation to deliver the edit to
+	d.DispatchUpdate(&tgbotapi.Update{EditedMessage: &tgbotapi.Message{MessageID: 5, Chat: &tgbotapi.Chat{ID: 1}, Text: "Jon"}})
+	select {
+	case msg := <-bot.sent:
+		t.Errorf("unexpected message %v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestEditedMessageIsNotAnAnswer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bot := newRecordingBot()
+	twoQuestions := handlers.OneStepHandlerCreator(func(ctx context.Context, conversation readers.BotConversation) error {
+		for i := 0; i < 2; i++ {
+			answer := readers.ReadTextAndDataResult(ctx, conversation)
+			if answer.Exit {
+				return nil
+			}
+			if _, err := conversation.SendText("got " + answer.Text); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	d := newTestDispatcher(t, ctx, bot, 10, func(config *Config) {
+		config.Handlers.List = append(config.Handlers.List, handlers.CommandHandler{CommandSelector: handlers.RegExpCommandSelector("/ask"), HandlerCreator: twoQuestions})
+		config.EditedMessages = UpdateRoute{Policy: DeliverToConversation}
+	})
+
+	d.DispatchUpdate(textUpdate(1, "/ask"))
+	answer := textUpdate(1, "first")
+	answer.Message.MessageID = 5
+	d.DispatchUpdate(answer)
+	bot.expectText(t, 1, "got first")
+	d.DispatchUpdate(&tgbotapi.Update{EditedMessage: &tgbotapi.Message{MessageID: 5, Chat: &tgbotapi.Chat{ID: 1}, Text: "edited"}})
+	d.DispatchUpdate(textUpdate(1, "second"))
+	bot.expectText(t, 1, "got second")
+	bot.expectText(t, 1, "ended")
+}
+
+func TestReactionStartsHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bot := newRecordingBot()
+	d := newTestDispatcher(t, ctx, bot, 10, withNameHandler, func(config *Config) {
+		config.MessageReactions = UpdateRoute{Policy: StartHandler, Handler: reactionHandler}
+	})
+
+	d.DispatchIncomingUpdate(&conversation.IncomingUpdate{MessageReaction: &conversation.MessageReaction{
+		Chat:        &tgbotapi.Chat{ID: 1},
+		MessageID:   3,
+		NewReaction: []conversation.ReactionType{{Type: "emoji", Emoji: "👍"}},
+	}})
+	bot.expectText(t, 1, "reaction 👍") // dedicated handlers do not send technical messages
+	d.DispatchUpdate(textUpdate(1, "/hello"))
+	bot.expectText(t, 1, "hello")
+}
+
+func TestInvalidRoutes(t *testing.T) {
+	invalid := []Config{
+		{MessageReactions: UpdateRoute{Policy: DeliverToConversation}},
+		{ChannelPosts: UpdateRoute{Policy: StartHandler}},
+	}
+	for _, config := range invalid {
+		config.Handlers = &handlers.CommandHandlers{}
+		if _, err := NewDispatcher(context.Background(), config, newRecordingBot(), nil); err == nil {
+			t.Errorf("expected error for routes %v", config)
+		}
+	}
+}
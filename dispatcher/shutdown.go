@@ -0,0 +1,81 @@
+package dispatcher
+
+import (
+	"time"
+
+	"github.com/ufy-it/go-telegram-bot/logger"
+)
+
+// shutdownPollInterval is the interval of checks whether handlers finished their work on a shutdown
+const shutdownPollInterval = 50 * time.Millisecond
+
+// shutdownStopTimeout is the time for handlers to return after their contexts are canceled, if the grace period is already over
+const shutdownStopTimeout = time.Second
+
+// shutdown stops accepting updates and waits for handlers that do not wait for users, but not longer than the grace period.
+// Then it freezes the state and closes the remaining conversations without messages to users, so that they are resumed after a restart.
+// The dispatcher is stopped when all handlers returned, or when the grace period (at least shutdownStopTimeout after the contexts
+// are canceled) is over. Handlers that run past the grace period cannot change the frozen state
+func (d *Dispatcher) shutdown() {
+	close(d.stopping)
+	deadline := time.Now().Add(time.Duration(d.shutdownGraceSeconds) * time.Second)
+	for !d.allWaitingForUsers() && time.Now().Before(deadline) {
+		time.Sleep(shutdownPollInterval)
+	}
+	if err := d.state.Close(); err != nil {
+		logger.Error("cannot close the state: %v", err)
+	}
+	d.outbox.stop()
+	d.mu.Lock()
+	for _, conv := range d.conversations {
+		conv.c.Suspend()
+	}
+	suspended := len(d.conversations)
+	d.mu.Unlock()
+	d.stopConversations()
+	if stopDeadline := time.Now().Add(shutdownStopTimeout); stopDeadline.After(deadline) {
+		deadline = stopDeadline
+	}
+	d.waitForHandlers(deadline)
+	logger.Note("the dispatcher is stopped, %d conversations will be resumed after a restart", suspended)
+	close(d.done)
+}
+
+// waitForHandlers waits until goroutines of all conversations return, but not longer than the deadline.
+// Conversations that are still running after the deadline are logged and left behind
+func (d *Dispatcher) waitForHandlers(deadline time.Time) {
+	stopped := make(chan struct{})
+	go func() {
+		d.running.Wait()
+		close(stopped)
+	}()
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-stopped:
+		return
+	case <-timer.C:
+	}
+	d.handlingMu.Lock()
+	defer d.handlingMu.Unlock()
+	for _, conv := range d.handling {
+		conv.Logger().Warning("the conversation has not stopped on the shutdown, it is left behind")
+	}
+}
+
+// allWaitingForUsers returns true if all open conversations wait for updates from users
+func (d *Dispatcher) allWaitingForUsers() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, conv := range d.conversations {
+		if !conv.c.IsWaitingForUser() {
+			return false
+		}
+	}
+	return true
+}
+
+// Done returns a channel that is closed when the dispatcher is stopped after its context is canceled
+func (d *Dispatcher) Done() <-chan struct{} {
+	return d.done
+}
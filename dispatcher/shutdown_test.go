@@ -0,0 +1,124 @@
+package dispatcher_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ufy-it/go-telegram-bot/conversation"
+	. "github.com/ufy-it/go-telegram-bot/dispatcher"
+	"github.com/ufy-it/go-telegram-bot/handlers"
+	"github.com/ufy-it/go-telegram-bot/handlers/readers"
+	"github.com/ufy-it/go-telegram-bot/state"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		graceSeconds int
+		busyFinishes bool
+	}{
+		{"busy handler finishes", 2, true},
+		{"grace period is over", 0, false},
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		bot := newRecordingBot()
+		io := state.NewMemoryState()
+		d, err := NewDispatcher(ctx, Config{
+			MaxOpenConversations: 10,
+			ConversationConfig:   conversation.Config{MaxMessageQueue: 5, TimeoutMinutes: 1},
+			Handlers: &handlers.CommandHandlers{
+				Default: handlers.MessageHandlerCreator("default"),
+				List: []handlers.CommandHandler{
+					{CommandSelector: handlers.RegExpCommandSelector("/echo"), HandlerCreator: echoHandler},
+					{CommandSelector: handlers.RegExpCommandSelector("/busy"), HandlerCreator: handlers.OneStepHandlerCreator(
+						func(ctx context.Context, conversation readers.BotConversation) error {
+							time.Sleep(300 * time.Millisecond) // ignores the context
+							_, err := conversation.SendText("done")
+							return err
+						})},
+				},
+			},
+			TechnicalMessageFunc: technicalMessageFunc,
+			ShutdownGraceSeconds: test.graceSeconds,
+		}, bot, io)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.DispatchUpdate(textUpdate(1, "/echo"))
+		d.DispatchUpdate(textUpdate(2, "/busy"))
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+		d.DispatchUpdate(textUpdate(3, "/echo")) // does not block after the shutdown
+		select {
+		case <-d.Done():
+		case <-time.After(3 * time.Second):
+			t.Fatalf("%s: the dispatcher is not stopped", test.name)
+		}
+
+		if test.busyFinishes {
+			bot.expectText(t, 2, "done")
+			bot.expectText(t, 2, "ended")
+		}
+		// the busy handler that is out of the grace period returned before the dispatcher is stopped, and did not send messages
+		select {
+		case msg := <-bot.sent:
+			t.Errorf("%s: unexpected message %v", test.name, msg)
+		default:
+		}
+
+		saved := state.NewBotState(io)
+		if err := saved.LoadState(); err != nil {
+			t.Fatal(err)
+		}
+		chats := map[int64]bool{}
+		for _, id := range saved.GetConversationIDs() {
+			chats[saved.GetConversationChatID(id)] = true
+		}
+		if len(chats) != 1+boolToInt(!test.busyFinishes) || !chats[1] || chats[2] == test.busyFinishes {
+			t.Errorf("%s: unexpected conversations in the state: %v", test.name, chats)
+		}
+	}
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func TestShutdownLeavesStuckHandlers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	d, err := NewDispatcher(ctx, Config{
+		MaxOpenConversations: 10,
+		ConversationConfig:   conversation.Config{MaxMessageQueue: 5, TimeoutMinutes: 1},
+		Handlers: &handlers.CommandHandlers{
+			Default: handlers.OneStepHandlerCreator(func(ctx context.Context, conversation readers.BotConversation) error {
+				close(started)
+				<-release // ignores the context
+				return nil
+			}),
+		},
+		TechnicalMessageFunc: technicalMessageFunc,
+	}, newRecordingBot(), state.NewMemoryState())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.DispatchUpdate(textUpdate(1, "/stuck"))
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("the handler has not started")
+	}
+	cancel()
+	select {
+	case <-d.Done():
+	case <-time.After(3 * time.Second):
+		t.Fatal("the dispatcher waits for the stuck handler")
+	}
+}
@@ -0,0 +1,32 @@
+package dispatcher
+
+import (
+	"github.com/ufy-it/go-telegram-bot/conversation"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// threadBot is a Bot that sends messages to forum topics with raw calls of the wrapped bot
+type threadBot struct {
+	Bot
+	raw conversation.RawBot
+}
+
+// NewThreadBot wraps a bot that makes raw calls (e.g. *tgbotapi.BotAPI), so that messages to forum topics are sent with message_thread_id.
+// The wrapper should be the closest to the client, under ratelimit.Limiter and retry.Retrier, which pass messages to topics as they are.
+// A bot that does not make raw calls is returned as is, it sends messages to topics as replies to the root messages of the topics
+func NewThreadBot(bot Bot) Bot {
+	raw, ok := bot.(conversation.RawBot)
+	if !ok {
+		return bot
+	}
+	return threadBot{Bot: bot, raw: raw}
+}
+
+// Send sends messages to forum topics with raw calls, and other messages through the wrapped bot
+func (b threadBot) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	if message, ok := c.(conversation.ThreadMessage); ok {
+		return conversation.SendToThread(b.raw, message)
+	}
+	return b.Bot.Send(c)
+}
@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"context"
+)
+
+// Role is a name of a group of users that have access to some command handlers, e.g. "admin"
+type Role string
+
+// RoleResolverType is a type of function that returns roles of a user in a chat
+type RoleResolverType func(ctx context.Context, userID, chatID int64) ([]Role, error)
+
+// StaticRoleResolver creates RoleResolver that returns roles from a map of user IDs to their roles
+func StaticRoleResolver(roles map[int64][]Role) RoleResolverType {
+	return func(ctx context.Context, userID, chatID int64) ([]Role, error) {
+		return roles[userID], nil
+	}
+}
+
+// HasRole returns true if the role is in the list of roles
+func HasRole(roles []Role, role Role) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
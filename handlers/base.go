@@ -5,8 +5,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/ufy-it/go-telegram-bot/conversation"
 	"github.com/ufy-it/go-telegram-bot/handlers/readers"
 	"github.com/ufy-it/go-telegram-bot/logger"
 	"github.com/ufy-it/go-telegram-bot/state"
@@ -15,7 +17,10 @@ import (
 type HandlerContextVariables string
 
 const (
-	FirstUpdateVariable HandlerContextVariables = "first_update"
+	FirstUpdateVariable     HandlerContextVariables = "first_update"
+	MessageReactionVariable HandlerContextVariables = "message_reaction"
+	ChatRegistryVariable    HandlerContextVariables = "chat_registry"
+	SchedulerVariable       HandlerContextVariables = "scheduler"
 )
 
 // GetFirstUpdate returns the first update for the conversation from the context
@@ -26,6 +31,38 @@ func GetFirstUpdate(ctx context.Context) (*tgbotapi.Update, error) {
 	return ctx.Value(FirstUpdateVariable).(*tgbotapi.Update), nil
 }
 
+// GetMessageReaction returns the reaction that started the conversation from the context
+func GetMessageReaction(ctx context.Context) (*conversation.MessageReaction, error) {
+	if ctx.Value(MessageReactionVariable) == nil {
+		return nil, errors.New("no message reaction")
+	}
+	return ctx.Value(MessageReactionVariable).(*conversation.MessageReaction), nil
+}
+
+// GetChatRegistry returns registry of chats that talked to the bot from the context of a handler or a job
+func GetChatRegistry(ctx context.Context) (state.ChatRegistry, error) {
+	if ctx.Value(ChatRegistryVariable) == nil {
+		return nil, errors.New("no chat registry")
+	}
+	return ctx.Value(ChatRegistryVariable).(state.ChatRegistry), nil
+}
+
+// TaskScheduler is an interface for an object that runs one-off tasks for chats at a given time (e.g. reminders).
+// In production it is jobs.Scheduler, tasks are run by task types registered in it
+type TaskScheduler interface {
+	ScheduleAt(at time.Time, chatID int64, taskType string, payload interface{}) (string, error) // schedules a task with JSON-serializable payload, returns ID of the task
+	Cancel(taskID string) (bool, error)                                                          // removes a pending task, returns false if there is no such task
+	PendingTasks(chatID int64) []state.ScheduledTask                                             // returns pending tasks of the chat ordered by time
+}
+
+// GetScheduler returns scheduler of one-off tasks from the context of a handler or a job
+func GetScheduler(ctx context.Context) (TaskScheduler, error) {
+	if ctx.Value(SchedulerVariable) == nil {
+		return nil, errors.New("no scheduler")
+	}
+	return ctx.Value(SchedulerVariable).(TaskScheduler), nil
+}
+
 // Handler is an interface for a conversation handler
 type Handler interface {
 	Execute(conversationID int64, bState state.BotState) error
@@ -41,6 +78,8 @@ type CommandSelectorType func(ctx context.Context, firstUpdate *tgbotapi.Update)
 type CommandHandler struct {
 	CommandSelector CommandSelectorType // selector for the command
 	HandlerCreator  HandlerCreatorType  // function to create a handler for the command
+	RequiredRole    Role                // role a user should have to start the handler, empty if the handler is available to everyone
+	Name            string              // name of the handler in metrics, e.g. "start", the position in the list is used if empty
 }
 
 // CommandHandlers is a structure that contains list of command handlers
@@ -117,6 +156,19 @@ func NewStatelessHandler(steps []ConversationStep) Handler {
 	}
 }
 
+// StepNamer is implemented by handlers that know names of their steps, the name of the current step is attached to log records of the conversation
+type StepNamer interface {
+	StepName(step int) string
+}
+
+// StepName returns name of the step, empty if the step has no name
+func (h *standardHandler) StepName(step int) string {
+	if step < 0 || step >= len(h.Steps) {
+		return ""
+	}
+	return h.Steps[step].Name
+}
+
 // Execute processes the conversation between a user and a handler
 func (h *standardHandler) Execute(conversationID int64, bState state.BotState) error {
 	if len(h.Steps) == 0 {
@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// MaxInlineResults is the maximum number of results Telegram accepts in a single answer to an inline query
+const MaxInlineResults = 50
+
+// InlineQuerySelectorType is a type of functor that should tell whether the inline handler matches the query
+type InlineQuerySelectorType func(ctx context.Context, query *tgbotapi.InlineQuery) bool
+
+// InlineQueryHandlerFunc is a function that fills the response to an inline query
+type InlineQueryHandlerFunc func(ctx context.Context, query *tgbotapi.InlineQuery, response *InlineResponse) error
+
+// InlineQueryHandler is a struct that contains selector of inline queries and a function to answer them
+type InlineQueryHandler struct {
+	QuerySelector InlineQuerySelectorType // selector for the query
+	Handler       InlineQueryHandlerFunc  // function to fill the response
+}
+
+// ChosenInlineResultHandlerFunc is a function that is called when a user chooses a result of an inline query.
+// Telegram sends chosen results only if inline feedback is enabled for the bot in @BotFather
+type ChosenInlineResultHandlerFunc func(ctx context.Context, result *tgbotapi.ChosenInlineResult) error
+
+// RegExpInlineQuerySelector creates InlineQuerySelector that accepts query text if it matches a regular expression
+func RegExpInlineQuerySelector(queryRe string) InlineQuerySelectorType {
+	re := regexp.MustCompile(queryRe)
+	return func(ctx context.Context, query *tgbotapi.InlineQuery) bool {
+		return query != nil && re.MatchString(query.Query)
+	}
+}
+
+// AnyInlineQuerySelector creates InlineQuerySelector that accepts any query
+func AnyInlineQuerySelector() InlineQuerySelectorType {
+	return func(ctx context.Context, query *tgbotapi.InlineQuery) bool {
+		return query != nil
+	}
+}
+
+// InlineResponse collects results of an inline query and answers with the page of them that Telegram requested.
+// A handler either adds all results, and the response cuts the requested page out of them, or adds only the page
+// that starts at Offset() and calls SetNextOffset, e.g. to load a single page from a database
+type InlineResponse struct {
+	PageSize   int  // number of results in one answer, MaxInlineResults by default
+	CacheTime  int  // time in seconds Telegram may cache the answer, 0 for the Telegram default
+	IsPersonal bool // flag that the answer is cached for the user only
+
+	queryID string
+	offset  int
+	paged   bool // the handler added a single page of results
+	next    int  // offset of the next page added by the handler, 0 for the last page
+	results []interface{}
+}
+
+// NewInlineResponse creates an empty response to the inline query
+func NewInlineResponse(query *tgbotapi.InlineQuery) *InlineResponse {
+	offset, err := strconv.Atoi(query.Offset)
+	if err != nil || offset < 0 {
+		offset = 0 // the first page
+	}
+	return &InlineResponse{
+		PageSize: MaxInlineResults,
+		queryID:  query.ID,
+		offset:   offset,
+		results:  []interface{}{},
+	}
+}
+
+// Offset returns index of the first result of the page requested by Telegram
+func (r *InlineResponse) Offset() int {
+	return r.offset
+}
+
+// SetNextOffset tells that the handler added only the page that starts at Offset(), and that the next page starts at next (0 if this is the last page)
+func (r *InlineResponse) SetNextOffset(next int) *InlineResponse {
+	r.paged = true
+	r.next = next
+	return r
+}
+
+// Add adds any of tgbotapi.InlineQueryResult* structs to the response
+func (r *InlineResponse) Add(result interface{}) *InlineResponse {
+	r.results = append(r.results, result)
+	return r
+}
+
+// AddArticle adds a result that sends a text message with HTML markup
+func (r *InlineResponse) AddArticle(id, title, text string) *InlineResponse {
+	return r.Add(tgbotapi.NewInlineQueryResultArticleHTML(id, title, text))
+}
+
+// AddPhoto adds a result that sends a photo from the URL
+func (r *InlineResponse) AddPhoto(id, url, thumbURL string) *InlineResponse {
+	return r.Add(tgbotapi.NewInlineQueryResultPhotoWithThumb(id, url, thumbURL))
+}
+
+// AddCachedPhoto adds a result that sends a photo stored on the Telegram servers
+func (r *InlineResponse) AddCachedPhoto(id, fileID string) *InlineResponse {
+	return r.Add(tgbotapi.NewInlineQueryResultCachedPhoto(id, fileID))
+}
+
+// AddCachedDocument adds a result that sends a document stored on the Telegram servers
+func (r *InlineResponse) AddCachedDocument(id, fileID, title string) *InlineResponse {
+	return r.Add(tgbotapi.NewInlineQueryResultCachedDocument(id, fileID, title))
+}
+
+// AddCachedVideo adds a result that sends a video stored on the Telegram servers
+func (r *InlineResponse) AddCachedVideo(id, fileID, title string) *InlineResponse {
+	return r.Add(tgbotapi.NewInlineQueryResultCachedVideo(id, fileID, title))
+}
+
+// AddCachedAudio adds a result that sends an audio stored on the Telegram servers
+func (r *InlineResponse) AddCachedAudio(id, fileID string) *InlineResponse {
+	return r.Add(tgbotapi.NewInlineQueryResultCachedAudio(id, fileID))
+}
+
+// Config returns answer to the inline query with the requested page of results and the offset of the next page
+func (r *InlineResponse) Config() tgbotapi.InlineConfig {
+	pageSize := r.PageSize
+	if pageSize <= 0 || pageSize > MaxInlineResults {
+		pageSize = MaxInlineResults
+	}
+	config := tgbotapi.InlineConfig{
+		InlineQueryID: r.queryID,
+		Results:       []interface{}{},
+		CacheTime:     r.CacheTime,
+		IsPersonal:    r.IsPersonal,
+	}
+	if r.paged {
+		config.Results = r.results
+		if len(config.Results) > MaxInlineResults {
+			config.Results = config.Results[:MaxInlineResults]
+		}
+		if r.next > 0 {
+			config.NextOffset = strconv.Itoa(r.next)
+		}
+		return config
+	}
+	if r.offset >= len(r.results) {
+		return config // no more results
+	}
+	end := r.offset + pageSize
+	if end < len(r.results) {
+		config.NextOffset = strconv.Itoa(end)
+	} else {
+		end = len(r.results)
+	}
+	config.Results = r.results[r.offset:end]
+	return config
+}
@@ -0,0 +1,93 @@
+package handlers_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/ufy-it/go-telegram-bot/handlers"
+)
+
+func TestRegExpInlineQuerySelector(t *testing.T) {
+	selector := handlers.RegExpInlineQuerySelector("^find ")
+	ctx := context.Background()
+	if !selector(ctx, &tgbotapi.InlineQuery{Query: "find cat"}) {
+		t.Error("'find cat' query selector failed")
+	}
+	if selector(ctx, &tgbotapi.InlineQuery{Query: "cat"}) {
+		t.Error("'cat' query selector failed")
+	}
+	if selector(ctx, nil) {
+		t.Error("nil query selector failed")
+	}
+}
+
+func TestInlineResponsePages(t *testing.T) {
+	fill := func(offset string) tgbotapi.InlineConfig {
+		response := handlers.NewInlineResponse(&tgbotapi.InlineQuery{ID: "query", Offset: offset})
+		response.PageSize = 2
+		for i := 0; i < 5; i++ {
+			response.AddArticle(fmt.Sprint(i), "title", "text")
+		}
+		return response.Config()
+	}
+	pages := []struct {
+		offset  string
+		first   string
+		results int
+		next    string
+	}{
+		{"", "0", 2, "2"},
+		{"2", "2", 2, "4"},
+		{"4", "4", 1, ""},
+	}
+	for _, page := range pages {
+		config := fill(page.offset)
+		if config.InlineQueryID != "query" || len(config.Results) != page.results || config.NextOffset != page.next {
+			t.Errorf("unexpected page for offset '%s': %v", page.offset, config)
+			continue
+		}
+		if article := config.Results[0].(tgbotapi.InlineQueryResultArticle); article.ID != page.first {
+			t.Errorf("expected page for offset '%s' to start with %s, got %s", page.offset, page.first, article.ID)
+		}
+	}
+	if config := fill("10"); len(config.Results) != 0 || config.NextOffset != "" {
+		t.Errorf("expected empty page after the last result, got %v", config)
+	}
+}
+
+func TestInlineResponsePagedByHandler(t *testing.T) {
+	fill := func(offset string) tgbotapi.InlineConfig {
+		response := handlers.NewInlineResponse(&tgbotapi.InlineQuery{ID: "query", Offset: offset})
+		next := 0
+		for i := response.Offset(); i < 5 && i < response.Offset()+2; i++ {
+			response.AddArticle(fmt.Sprint(i), "title", "text")
+			next = i + 1
+		}
+		if next >= 5 {
+			next = 0
+		}
+		return response.SetNextOffset(next).Config()
+	}
+	pages := []struct {
+		offset  string
+		first   string
+		results int
+		next    string
+	}{
+		{"", "0", 2, "2"},
+		{"2", "2", 2, "4"},
+		{"4", "4", 1, ""},
+	}
+	for _, page := range pages {
+		config := fill(page.offset)
+		if len(config.Results) != page.results || config.NextOffset != page.next {
+			t.Errorf("unexpected page for offset '%s': %v", page.offset, config)
+			continue
+		}
+		if article := config.Results[0].(tgbotapi.InlineQueryResultArticle); article.ID != page.first {
+			t.Errorf("expected page for offset '%s' to start with %s, got %s", page.offset, page.first, article.ID)
+		}
+	}
+}
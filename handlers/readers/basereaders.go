@@ -4,6 +4,8 @@ import (
 	"context"
 	"time"
 
+	"github.com/ufy-it/go-telegram-bot/logger"
+
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 )
 
@@ -57,7 +59,8 @@ type UserTimeAndDataReply struct {
 	Exit            bool
 }
 
-// ParseUserTextAndDataReply parses text message and button data from the user's input
+// ParseUserTextAndDataReply parses text message and button data from the user's input. Edits of earlier messages are ignored,
+// use EditedAnswer to get them
 func ParseUserTextAndDataReply(update *tgbotapi.Update, exit bool) UserTextAndDataReply {
 	result := UserTextAndDataReply{
 		Exit: exit,
@@ -86,3 +89,36 @@ func ReadRawTextAndDataResult(ctx context.Context, conversation BotConversation)
 	update, exit := conversation.GetUpdateFromUser(ctx)
 	return ParseUserTextAndDataReply(update, exit)
 }
+
+// ReadNewUpdateFromUser waits for an update from a user, and skips edits of earlier messages,
+// so that an edited answer to a previous question is not taken as the answer to the current one
+func ReadNewUpdateFromUser(ctx context.Context, conversation BotConversation) (*tgbotapi.Update, bool) {
+	for {
+		update, exit := conversation.GetUpdateFromUser(ctx)
+		if exit || update == nil || update.EditedMessage == nil {
+			return update, exit
+		}
+		logger.FromContext(ctx).Debug("edited message is skipped", "message_id", update.EditedMessage.MessageID)
+	}
+}
+
+// ReadTextAndDataResult waits for a new message or a button press from a user (edits of earlier messages are skipped),
+// and parses the update to UserTextAndDataReply struct
+func ReadTextAndDataResult(ctx context.Context, conversation BotConversation) UserTextAndDataReply {
+	return ParseUserTextAndDataReply(ReadNewUpdateFromUser(ctx, conversation))
+}
+
+// EditedAnswer returns the new version of a message if the update is an edit of one of the answers with answerIDs.
+// Edited messages reach a conversation only if the dispatcher delivers them (dispatcher.DeliverToConversation),
+// a handler gets them with conversation.GetUpdateFromUser, so a form can re-validate an answer that the user changed
+func EditedAnswer(update *tgbotapi.Update, answerIDs ...int) (*tgbotapi.Message, bool) {
+	if update == nil || update.EditedMessage == nil {
+		return nil, false
+	}
+	for _, id := range answerIDs {
+		if update.EditedMessage.MessageID == id {
+			return update.EditedMessage, true
+		}
+	}
+	return nil, false
+}
@@ -61,7 +61,7 @@ func AskReplyCalendarDateWithAvailability(ctx context.Context, conversation BotC
 		if !minDate.After(maxDate) {
 			err := conversation.RemoveReplyMarkup(msgID)
 			if err != nil {
-				logger.Warning("failed to remove reply makup in calendar widget: %v", err)
+				logger.FromContext(ctx).Warning("failed to remove reply makup in calendar widget", "error", err)
 			}
 		}
 	}()
@@ -216,14 +216,14 @@ func AskReplyCalendarDateWithAvailability(ctx context.Context, conversation BotC
 			}
 		}
 		changed = false
-		reply := ReadRawTextAndDataResult(ctx, conversation)
+		reply := ReadTextAndDataResult(ctx, conversation)
 		if reply.Exit {
 			return UserTimeAndDataReply{Exit: true}, nil
 		}
 		if reply.Data != "" {
 			reply.Data, err = bs.FindButtonData(reply.Data)
 			if err != nil {
-				logger.Warning("unknown button pressed in callendar widget: %v", err)
+				logger.FromContext(ctx).Warning("unknown button pressed in callendar widget", "error", err)
 				continue
 			}
 			changed = true
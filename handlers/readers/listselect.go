@@ -74,7 +74,7 @@ func SelectItemFromList(
 		if filter != "" || !prevButtons.IsEmpty() {
 			err := conversation.EditMessageText(msgID, text)
 			if err != nil {
-				logger.Warning("failed to edit message after list select: %v", err)
+				logger.FromContext(ctx).Warning("failed to edit message after list select", "error", err)
 			}
 		}
 	}()
@@ -122,14 +122,14 @@ func SelectItemFromList(
 		}
 
 		filterChanged = false
-		result := ReadRawTextAndDataResult(ctx, conversation)
+		result := ReadTextAndDataResult(ctx, conversation)
 		if result.Exit {
 			return result, nil
 		}
 		if result.Data != "" {
 			data, err := bts.FindButtonData(result.Data)
 			if err != nil {
-				logger.Warning("unknown button pressed during list select: %v", err)
+				logger.FromContext(ctx).Warning("unknown button pressed during list select", "error", err)
 			} else {
 				switch data {
 				case prevPageButtonData:
@@ -243,7 +243,7 @@ func MultySelectItemFromList(
 		if len(selected.Items) > 0 || filter != "" || !prevButtons.IsEmpty() {
 			err := conversation.EditMessageText(msgID, text)
 			if err != nil {
-				logger.Warning("failed to edit message after multy select: %v", err)
+				logger.FromContext(ctx).Warning("failed to edit message after multy select", "error", err)
 			}
 		}
 	}()
@@ -308,14 +308,14 @@ func MultySelectItemFromList(
 
 		filterChanged = false
 		selectedChanged = false
-		result := ReadRawTextAndDataResult(ctx, conversation)
+		result := ReadTextAndDataResult(ctx, conversation)
 		if result.Exit {
 			return UserSelectedListReply{Exit: true}, nil
 		}
 		if result.Data != "" {
 			data, err := bts.FindButtonData(result.Data)
 			if err != nil {
-				logger.Warning("unknown button pressed during multy select: %v", err)
+				logger.FromContext(ctx).Warning("unknown button pressed during multy select", "error", err)
 			} else {
 				switch data {
 				case prevPageButtonData:
@@ -346,7 +346,7 @@ func MultySelectItemFromList(
 				}
 				index--
 				if index < 0 || index >= len(selected.Items) {
-					logger.Warning("user asked to remove index %d that is out of range [0..%d)", index, len(selected.Items))
+					logger.FromContext(ctx).Warning("user asked to remove index that is out of range", "index", index, "items", len(selected.Items))
 				} else {
 					delete(selectedData, selected.Items[index].Data)
 					copy(selected.Items[index:], selected.Items[index+1:])
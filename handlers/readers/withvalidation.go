@@ -2,9 +2,11 @@ package readers
 
 import (
 	"context"
+	"errors"
 	"regexp"
 	"time"
 
+	"github.com/ufy-it/go-telegram-bot/boterrors"
 	"github.com/ufy-it/go-telegram-bot/handlers/buttons"
 	"github.com/ufy-it/go-telegram-bot/logger"
 
@@ -46,8 +48,8 @@ func AskGenericMessageReplyWithValidation(ctx context.Context,
 			return
 		}
 		err := conversation.RemoveReplyMarkup(sentID)
-		if err != nil {
-			logger.Warning("failed to hide reply markup in message: %v", err)
+		if err != nil && !errors.Is(err, boterrors.ErrConversationCanceled) { // a canceled conversation hides buttons on cancel, a suspended one keeps them
+			logger.FromContext(ctx).Warning("failed to hide reply markup in message", "error", err)
 		}
 	}()
 
@@ -56,7 +58,7 @@ func AskGenericMessageReplyWithValidation(ctx context.Context,
 			return nil, false, err
 		}
 
-		reply, exit := conversation.GetUpdateFromUser(ctx) // get reply from user
+		reply, exit := ReadNewUpdateFromUser(ctx, conversation) // get reply from user, edits of earlier messages are skipped
 		if exit {
 			return nil, true, nil
 		}
@@ -66,7 +68,7 @@ func AskGenericMessageReplyWithValidation(ctx context.Context,
 			if berr == nil {
 				return reply, false, nil
 			}
-			logger.Warning("unknown button pressed: %v", berr) //log unknown button press
+			logger.FromContext(ctx).Warning("unknown button pressed", "error", berr) //log unknown button press
 			continue
 		}
 		if isValid, messageOnIncorrect := validator(reply); !isValid {
@@ -86,7 +88,7 @@ func AskGenericMessageReplyWithValidation(ctx context.Context,
 		if sentID != -1 && repeatOriginalOnIncorrect { // no need to delete a message
 			err = conversation.DeleteMessage(sentID) // delete and resend original message
 			if err != nil {
-				logger.Warning("failed to delete old mesage: %v", err)
+				logger.FromContext(ctx).Warning("failed to delete old mesage", "error", err)
 			}
 			sentID, err = sendOriginalMessage()
 		}
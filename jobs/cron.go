@@ -0,0 +1,255 @@
+package jobs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is an interface for a schedule of a job
+type Schedule interface {
+	Next(after time.Time) time.Time // returns the first fire time strictly after the time, zero time if the schedule never fires again
+}
+
+// cronField describes one of the fields of a cron expression
+type cronField struct {
+	name     string
+	min, max int
+	names    map[string]int // names of values, e.g. months
+}
+
+var cronFields = []cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6, "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12}},
+	{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}},
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// CronSchedule is a schedule defined by a cron expression in a time zone
+type CronSchedule struct {
+	spec     string
+	minute   uint64
+	hour     uint64
+	dom      uint64
+	month    uint64
+	dow      uint64
+	domAny   bool // day of month is "*", so only day of week restricts days
+	dowAny   bool // day of week is "*", so only day of month restricts days
+	location *time.Location
+}
+
+// ParseCron parses a standard cron expression with 5 fields: minute, hour, day of month, month and day of week,
+// e.g. "0 9 * * mon-fri" is every weekday at 09:00. Fields support lists ("1,15"), ranges ("1-5"), steps ("*/15", "0-30/10")
+// and names of months and days ("jan", "mon"). Macros @yearly, @monthly, @weekly, @daily and @hourly are supported as well.
+// The expression can start with a time zone "CRON_TZ=Europe/Berlin", otherwise times are in the local time zone
+func ParseCron(spec string) (*CronSchedule, error) {
+	location := time.Local
+	expression := strings.TrimSpace(spec)
+	if strings.HasPrefix(expression, "CRON_TZ=") || strings.HasPrefix(expression, "TZ=") {
+		parts := strings.SplitN(expression, " ", 2)
+		name := parts[0][strings.Index(parts[0], "=")+1:]
+		var err error
+		if location, err = time.LoadLocation(name); err != nil {
+			return nil, fmt.Errorf("cron expression %q: unknown time zone %q: %v", spec, name, err)
+		}
+		expression = ""
+		if len(parts) > 1 {
+			expression = strings.TrimSpace(parts[1])
+		}
+	}
+	return parseCronInLocation(spec, expression, location)
+}
+
+// ParseCronInLocation parses a cron expression (see ParseCron) with times in the location
+func ParseCronInLocation(spec string, location *time.Location) (*CronSchedule, error) {
+	if location == nil {
+		return nil, fmt.Errorf("cron expression %q: location is nil", spec)
+	}
+	return parseCronInLocation(spec, strings.TrimSpace(spec), location)
+}
+
+// MustParseCron is like ParseCron but panics if the expression cannot be parsed, for schedules declared in code
+func MustParseCron(spec string) *CronSchedule {
+	schedule, err := ParseCron(spec)
+	if err != nil {
+		panic(err)
+	}
+	return schedule
+}
+
+func parseCronInLocation(spec, expression string, location *time.Location) (*CronSchedule, error) {
+	if macro, ok := cronMacros[strings.ToLower(expression)]; ok {
+		expression = macro
+	}
+	fields := strings.Fields(expression)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("cron expression %q: expected 5 fields (minute hour day-of-month month day-of-week), got %d", spec, len(fields))
+	}
+	schedule := &CronSchedule{spec: spec, location: location}
+	bits := []*uint64{&schedule.minute, &schedule.hour, &schedule.dom, &schedule.month, &schedule.dow}
+	for i, field := range cronFields {
+		value, err := field.parse(fields[i])
+		if err != nil {
+			return nil, fmt.Errorf("cron expression %q: %v", spec, err)
+		}
+		*bits[i] = value
+	}
+	if schedule.dow&(1<<7) != 0 {
+		schedule.dow |= 1 // 7 is Sunday as well as 0
+	}
+	schedule.domAny = fields[2] == "*" || fields[2] == "?"
+	schedule.dowAny = fields[4] == "*" || fields[4] == "?"
+	return schedule, nil
+}
+
+// parse parses a field of a cron expression to a set of bits
+func (f cronField) parse(text string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(text, ",") {
+		rangeText, step := part, 1
+		if slash := strings.Index(part, "/"); slash >= 0 {
+			var err error
+			rangeText = part[:slash]
+			if step, err = strconv.Atoi(part[slash+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("%s field %q: step %q should be a positive number", f.name, part, part[slash+1:])
+			}
+		}
+		from, to := f.min, f.max
+		switch {
+		case rangeText == "*" || rangeText == "?":
+		case strings.Contains(rangeText, "-"):
+			bounds := strings.SplitN(rangeText, "-", 2)
+			var err error
+			if from, err = f.value(bounds[0]); err != nil {
+				return 0, err
+			}
+			if to, err = f.value(bounds[1]); err != nil {
+				return 0, err
+			}
+			if from > to {
+				return 0, fmt.Errorf("%s field %q: range start %d is greater than range end %d", f.name, part, from, to)
+			}
+		default:
+			value, err := f.value(rangeText)
+			if err != nil {
+				return 0, err
+			}
+			from, to = value, value
+			if strings.Contains(part, "/") {
+				to = f.max // "5/15" means from 5 to the end with step 15
+			}
+		}
+		for value := from; value <= to; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+	return bits, nil
+}
+
+// value parses a single value of the field
+func (f cronField) value(text string) (int, error) {
+	if value, ok := f.names[strings.ToLower(text)]; ok {
+		return value, nil
+	}
+	value, err := strconv.Atoi(text)
+	if err != nil {
+		return 0, fmt.Errorf("%s field: %q is not a number", f.name, text)
+	}
+	if value < f.min || value > f.max {
+		return 0, fmt.Errorf("%s field: value %d is out of range %d-%d", f.name, value, f.min, f.max)
+	}
+	return value, nil
+}
+
+// String returns the cron expression
+func (s *CronSchedule) String() string {
+	return s.spec
+}
+
+// Location returns time zone of the schedule
+func (s *CronSchedule) Location() *time.Location {
+	return s.location
+}
+
+// matchesDay returns true if the schedule fires on the day. If both day of month and day of week are restricted,
+// a day matching any of them fires, as in the standard cron
+func (s *CronSchedule) matchesDay(wall time.Time) bool {
+	dom := s.dom&(1<<uint(wall.Day())) != 0
+	dow := s.dow&(1<<uint(wall.Weekday())) != 0
+	switch {
+	case s.domAny && s.dowAny:
+		return true
+	case s.domAny:
+		return dow
+	case s.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// Next returns the first fire time strictly after the time. The schedule follows the wall clock of its time zone:
+// a time skipped when clocks go forward is shifted by the length of the gap (02:30 fires at 03:30),
+// a time repeated when clocks go back fires once
+func (s *CronSchedule) Next(after time.Time) time.Time {
+	local := after.In(s.location)
+	// search over the wall clock represented in UTC, as UTC has no transitions
+	wall := time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), local.Minute(), 0, 0, time.UTC).Add(time.Minute)
+	limit := wall.AddDate(5, 0, 0) // expressions like "0 0 30 2 *" never fire
+	for wall.Before(limit) {
+		switch {
+		case s.month&(1<<uint(wall.Month())) == 0:
+			wall = time.Date(wall.Year(), wall.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !s.matchesDay(wall):
+			wall = time.Date(wall.Year(), wall.Month(), wall.Day()+1, 0, 0, 0, 0, time.UTC)
+		case s.hour&(1<<uint(wall.Hour())) == 0:
+			wall = wall.Truncate(time.Hour).Add(time.Hour)
+		case s.minute&(1<<uint(wall.Minute())) == 0:
+			wall = wall.Add(time.Minute)
+		default:
+			next := time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), 0, 0, s.location)
+			if next.After(after) {
+				return next
+			}
+			wall = wall.Add(time.Minute) // the wall time is repeated when clocks go back, and was already passed
+		}
+	}
+	return time.Time{}
+}
+
+// intervalSchedule fires with a fixed rate, so the time of the body does not shift the next runs
+type intervalSchedule struct {
+	first    time.Time
+	interval time.Duration // always positive
+}
+
+// newIntervalSchedule creates a schedule that fires at the first time and then every interval
+func newIntervalSchedule(first time.Time, interval time.Duration) (intervalSchedule, error) {
+	if interval <= 0 {
+		return intervalSchedule{}, fmt.Errorf("interval of a schedule should be positive, got %v", interval)
+	}
+	return intervalSchedule{first: first, interval: interval}, nil
+}
+
+// Next returns the first fire time of the interval grid strictly after the time
+func (s intervalSchedule) Next(after time.Time) time.Time {
+	if after.Before(s.first) {
+		return s.first
+	}
+	passed := after.Sub(s.first)/s.interval + 1
+	return s.first.Add(passed * s.interval)
+}
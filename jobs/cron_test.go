@@ -0,0 +1,109 @@
+package jobs_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ufy-it/go-telegram-bot/jobs"
+)
+
+func TestParseCronErrors(t *testing.T) {
+	for spec, message := range map[string]string{
+		"* * * *":                   "expected 5 fields",
+		"60 * * * *":                "minute field: value 60 is out of range 0-59",
+		"* 9-5 * * *":               "hour field \"9-5\": range start 9 is greater than range end 5",
+		"*/0 * * * *":               "step \"0\" should be a positive number",
+		"* * * foo *":               "month field: \"foo\" is not a number",
+		"CRON_TZ=Mars/Base * * * *": "unknown time zone \"Mars/Base\"",
+	} {
+		_, err := jobs.ParseCron(spec)
+		if err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("expected error with %q for %q, got %v", message, spec, err)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	at := func(text string) time.Time {
+		result, err := time.ParseInLocation("2006-01-02 15:04", text, berlin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	for _, test := range []struct {
+		spec  string
+		after string
+		next  []string
+	}{
+		{"CRON_TZ=Europe/Berlin 0 9 * * mon-fri", "2024-05-03 09:00", []string{"2024-05-06 09:00", "2024-05-07 09:00"}}, // Friday to Monday
+		{"CRON_TZ=Europe/Berlin */20 23 * * *", "2024-05-03 23:30", []string{"2024-05-03 23:40", "2024-05-04 23:00"}},
+		{"CRON_TZ=Europe/Berlin 0 0 13 * fri", "2024-09-01 00:00", []string{"2024-09-06 00:00", "2024-09-13 00:00", "2024-09-20 00:00"}}, // day of month or day of week
+		{"CRON_TZ=Europe/Berlin @monthly", "2024-01-31 12:00", []string{"2024-02-01 00:00", "2024-03-01 00:00"}},
+		{"CRON_TZ=Europe/Berlin 0 0 29 2 *", "2023-01-01 00:00", []string{"2024-02-29 00:00", "2028-02-29 00:00"}},
+		{"CRON_TZ=Europe/Berlin 30 2 * * *", "2024-03-30 12:00", []string{"2024-03-31 03:30", "2024-04-01 02:30"}}, // 02:30 is skipped on 31 March
+		{"CRON_TZ=Europe/Berlin 30 * * * *", "2024-03-31 01:00", []string{"2024-03-31 01:30", "2024-03-31 03:30", "2024-03-31 04:30"}},
+	} {
+		schedule, err := jobs.ParseCron(test.spec)
+		if err != nil {
+			t.Errorf("cannot parse %q: %v", test.spec, err)
+			continue
+		}
+		next := at(test.after)
+		for _, expected := range test.next {
+			next = schedule.Next(next)
+			if !next.Equal(at(expected)) {
+				t.Errorf("%q: expected %s, got %v", test.spec, expected, next.In(berlin))
+				break
+			}
+		}
+	}
+
+	// 02:30 happens twice on 27 October, the job fires once
+	schedule := jobs.MustParseCron("CRON_TZ=Europe/Berlin 30 2 * * *")
+	first := schedule.Next(at("2024-10-27 00:00"))
+	if second := schedule.Next(first); second.Sub(first) < 24*time.Hour {
+		t.Errorf("expected one run at 02:30 on 27 October, got %v and %v", first, second)
+	}
+
+	if next := jobs.MustParseCron("0 0 30 2 *").Next(time.Now()); !next.IsZero() {
+		t.Errorf("expected no fire time for 30 February, got %v", next)
+	}
+}
+
+// everySecond fires at the start of every second
+type everySecond struct{}
+
+func (everySecond) Next(after time.Time) time.Time {
+	return after.Truncate(time.Second).Add(time.Second)
+}
+
+func TestRunJobWithSchedule(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := make(chan time.Time, 10)
+	go jobs.RunJob(ctx, jobs.JobDescription{
+		Schedule: everySecond{},
+		Body: func(ctx context.Context, messager jobs.Messager) error {
+			c <- time.Now()
+			time.Sleep(300 * time.Millisecond) // the body time does not shift the next run
+			return nil
+		},
+	}, newMockMessager())
+	for i := 0; i < 2; i++ {
+		select {
+		case fired := <-c:
+			if fired.Sub(fired.Truncate(time.Second)) > 200*time.Millisecond {
+				t.Errorf("expected the job to fire at the start of a second, fired at %v", fired)
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("the job did not run")
+		}
+	}
+}
@@ -2,56 +2,366 @@ package jobs
 
 import (
 	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
 	"time"
 
+	"github.com/ufy-it/go-telegram-bot/delivery"
 	"github.com/ufy-it/go-telegram-bot/handlers/buttons"
 	"github.com/ufy-it/go-telegram-bot/logger"
+	"github.com/ufy-it/go-telegram-bot/metrics"
 )
 
-// Messager is an interface for an object that can send a text message to a chat. In production it should be a Dispatcher object
+// Messager is an interface for an object that can send a text message to a chat. In production it should be a Dispatcher object.
+// Errors of the Bot API are returned as *boterrors.APIError, so a job can check them with errors.Is (e.g. boterrors.ErrBotBlockedByUser).
+// Messages to chats that blocked the bot are skipped with boterrors.ErrChatInactive.
+// A message to a chat with an ongoing conversation is queued and delivered when the conversation is over
 type Messager interface {
-	SendSingleMessage(ctx context.Context, chatID int64, text string, keyboard *buttons.ButtonSet) error                // send single text message to chat with ID=chatID, might take time
-	SendSingleMessageWithMarkup(ctx context.Context, chatID int64, text string, keyboard *buttons.ButtonSet) error      // send single text message to chat with ID=chatID, might take time, allows HTML markup
-	SendSinglePhoto(ctx context.Context, chatID int64, photo []byte, caption string, keyboard *buttons.ButtonSet) error // send single photo to chat with ID=chatID, might take time
+	SendSingleMessage(ctx context.Context, chatID int64, text string, keyboard *buttons.ButtonSet) error                // send single text message to chat with ID=chatID
+	SendSingleMessageWithMarkup(ctx context.Context, chatID int64, text string, keyboard *buttons.ButtonSet) error      // send single text message to chat with ID=chatID, allows HTML markup
+	SendSinglePhoto(ctx context.Context, chatID int64, photo []byte, caption string, keyboard *buttons.ButtonSet) error // send single photo to chat with ID=chatID
 }
 
+// OutboxSender is an interface for an object that can send a single message with delivery options (priority, expiry,
+// delivery during a conversation). The Dispatcher passed to jobs as Messager implements it
+type OutboxSender = delivery.OutboxSender
+
+// Broadcaster is an interface for an object that can send a message to many chats. The Dispatcher passed to jobs as Messager implements it
+type Broadcaster = delivery.Broadcaster
+
 // JobBody a type for a job-function
 type JobBody func(ctx context.Context, messager Messager) error
 
+// OverlapPolicy tells what to do when it is time to run a job that is still running
+type OverlapPolicy int
+
+// possible overlap policies
+const (
+	SkipOverlap  OverlapPolicy = iota // skip the run (default)
+	QueueOverlap                      // run the job again right after the current run, at most one run is queued
+	AllowOverlap                      // start the run concurrently
+)
+
 // JobDescription is a struct that describes a job.
-// The job will be started after OffsetSeconds, and will run every IntervalSeconds
+// The job will be started after OffsetSeconds, and will run every IntervalSeconds counted from the previous start
+// (a job with zero IntervalSeconds runs again right after the previous run is over), or at the fire times of Schedule if it is set (e.g. jobs.MustParseCron("CRON_TZ=Europe/Berlin 0 9 * * mon-fri"))
 type JobDescription struct {
 	OffsetSeconds   int
 	IntervalSeconds int
 	Body            JobBody
+	Schedule        Schedule      // schedule of the job, OffsetSeconds and IntervalSeconds are ignored if it is set
+	Name            string        // name of the job in logs and stats, "job <index>" by default
+	TimeoutSeconds  int           // maximum execution time of a run, the context of the body is canceled after it. 0 means no limit
+	Overlap         OverlapPolicy // what to do when it is time to run the job that is still running
 }
 
 // JobDescriptionsList is a type for array of JobDescriptions
 type JobDescriptionsList []JobDescription
 
-// RunJob runs a job's Body continuously with offset and interval
-func RunJob(ctx context.Context, job JobDescription, messager Messager) {
+// firstRun returns the time of the first run of the job without a schedule that starts at the time
+func (job JobDescription) firstRun(start time.Time) time.Time {
+	return start.Add(time.Duration(job.OffsetSeconds) * time.Second)
+}
+
+// schedule returns schedule of the job that starts at the time, a job without a schedule should have a positive interval
+func (job JobDescription) schedule(start time.Time) (Schedule, error) {
+	if job.Schedule != nil {
+		return job.Schedule, nil
+	}
+	return newIntervalSchedule(job.firstRun(start), time.Duration(job.IntervalSeconds)*time.Second)
+}
+
+// JobStats contains statistics of runs of a job
+type JobStats struct {
+	Name                string
+	Running             int           // number of runs in progress
+	Abandoned           int           // number of runs that timed out or were canceled, but whose bodies ignore the context and still run
+	Runs                int           // number of finished runs
+	Skipped             int           // number of runs skipped because the job was still running
+	LastStart           time.Time     // start time of the latest run, zero if the job has not run yet
+	LastDuration        time.Duration // duration of the latest finished run
+	LastError           error         // error of the latest finished run, nil if it succeeded
+	ConsecutiveFailures int           // number of failed runs since the latest successful run
+	NextRun             time.Time     // next fire time of the job, zero if the job is not scheduled anymore
+}
+
+// jobRunner runs a job and collects its stats
+type jobRunner struct {
+	job      JobDescription
+	messager Messager
+	metrics  metrics.Collector
+
+	mu     sync.Mutex
+	stats  JobStats
+	queued bool // a run is queued until the current run is over
+}
+
+func newJobRunner(job JobDescription, name string) *jobRunner {
+	if job.Name != "" {
+		name = job.Name
+	}
+	return &jobRunner{job: job, stats: JobStats{Name: name}, metrics: metrics.NopCollector{}}
+}
+
+// getStats returns a copy of the job stats
+func (j *jobRunner) getStats() JobStats {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.stats
+}
+
+// run starts the job at the fire times of its schedule until the context is canceled
+func (j *jobRunner) run(ctx context.Context, messager Messager) {
+	j.messager = messager
+	now := time.Now()
+	if j.continuous() {
+		j.runContinuously(ctx, j.job.firstRun(now))
+		return
+	}
+	schedule, err := j.job.schedule(now)
+	if err != nil {
+		logger.Error("%s is not started: %v", j.stats.Name, err)
+		return
+	}
+	next := schedule.Next(now.Add(-time.Nanosecond)) // the first fire time can be right now
+	for !next.IsZero() {
+		j.setNextRun(next)
+		if !wait(ctx, next) {
+			return
+		}
+		j.fire(ctx)
+		next = schedule.Next(maxTime(next, time.Now()))
+	}
+	j.setNextRun(next)
+	logger.Warning("the schedule of %s has no more fire times", j.stats.Name)
+}
+
+func (j *jobRunner) setNextRun(next time.Time) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.stats.NextRun = next
+}
+
+// continuous returns true if the job has no schedule and no interval, so it runs again right after the previous run
+func (j *jobRunner) continuous() bool {
+	return j.job.Schedule == nil && j.job.IntervalSeconds <= 0
+}
+
+// runContinuously starts the job at the time, and then runs it again right after the previous run until the context is canceled
+func (j *jobRunner) runContinuously(ctx context.Context, first time.Time) {
+	j.setNextRun(first)
+	if !wait(ctx, first) {
+		return
+	}
+	for ctx.Err() == nil {
+		j.setNextRun(time.Now())
+		j.runNow(ctx)
+	}
+}
+
+// wait waits until the time, returns false if the context is canceled earlier
+func wait(ctx context.Context, until time.Time) bool {
+	timer := time.NewTimer(time.Until(until))
+	defer timer.Stop()
 	select {
 	case <-ctx.Done():
-		return
-	case <-time.After(time.Duration(job.OffsetSeconds) * time.Second):
+		return false
+	case <-timer.C:
+		return true
 	}
+}
+
+// runNow runs the job and waits for the run to finish
+func (j *jobRunner) runNow(ctx context.Context) {
+	j.mu.Lock()
+	j.stats.Running++
+	j.mu.Unlock()
+	j.runBody(ctx)
+}
+
+// fire starts a run of the job, or skips or queues it if the job is still running
+func (j *jobRunner) fire(ctx context.Context) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.stats.Running > 0 {
+		switch j.job.Overlap {
+		case SkipOverlap:
+			j.stats.Skipped++
+			j.metrics.JobRun(j.stats.Name, metrics.JobSkipped, 0)
+			logger.Warning("%s is still running, the run is skipped", j.stats.Name)
+			return
+		case QueueOverlap:
+			j.queued = true
+			return
+		}
+	}
+	j.stats.Running++
+	go j.runBody(ctx)
+}
+
+// runBody runs the body of the job, and then the queued run if there is one
+func (j *jobRunner) runBody(ctx context.Context) {
 	for {
-		err := job.Body(ctx, messager)
+		start := time.Now()
+		j.mu.Lock()
+		j.stats.LastStart = start
+		j.mu.Unlock()
+
+		outcome, err := j.execute(ctx)
+		if err != nil && ctx.Err() == nil {
+			logger.Error("got error from %s: %v", j.stats.Name, err)
+		}
+		j.metrics.JobRun(j.stats.Name, outcome, time.Since(start))
+
+		j.mu.Lock()
+		j.stats.Runs++
+		j.stats.LastDuration = time.Since(start)
+		j.stats.LastError = err
 		if err != nil {
-			logger.Error("got error from a job: %v", err)
+			j.stats.ConsecutiveFailures++
+		} else {
+			j.stats.ConsecutiveFailures = 0
 		}
-		select {
-		case <-ctx.Done():
-			return
-		case <-time.After(time.Duration(job.IntervalSeconds) * time.Second):
+		if j.queued && ctx.Err() == nil {
+			j.queued = false
+			j.mu.Unlock()
+			continue
+		}
+		j.queued = false
+		j.stats.Running--
+		j.mu.Unlock()
+		return
+	}
+}
+
+// execute runs the body with the timeout of the job. A body that does not return after the timeout
+// is left behind, so that it does not block further runs, and is counted as abandoned until it returns. Returns the outcome of the run for metrics
+func (j *jobRunner) execute(ctx context.Context) (string, error) {
+	runCtx, cancel := ctx, context.CancelFunc(func() {})
+	if j.job.TimeoutSeconds > 0 {
+		runCtx, cancel = context.WithTimeout(ctx, time.Duration(j.job.TimeoutSeconds)*time.Second)
+	}
+	defer cancel()
+	done := make(chan result, 1)
+	go func() {
+		outcome, err := j.call(runCtx)
+		done <- result{outcome, err}
+	}()
+	select {
+	case r := <-done:
+		if r.err != nil && ctx.Err() != nil {
+			return metrics.JobCanceled, r.err
+		}
+		return r.outcome, r.err
+	case <-runCtx.Done():
+		j.abandon(done)
+		if ctx.Err() != nil {
+			return metrics.JobCanceled, ctx.Err()
+		}
+		return metrics.JobTimedOut, fmt.Errorf("%s has not finished in %d seconds", j.stats.Name, j.job.TimeoutSeconds)
+	}
+}
+
+// abandon counts the run as abandoned until its body returns
+func (j *jobRunner) abandon(done <-chan result) {
+	j.mu.Lock()
+	j.stats.Abandoned++
+	j.mu.Unlock()
+	go func() {
+		r := <-done
+		j.mu.Lock()
+		j.stats.Abandoned--
+		j.mu.Unlock()
+		logger.Warning("abandoned run of %s has finished: %v", j.stats.Name, r.err)
+	}()
+}
+
+// result is an outcome of a run of the body
+type result struct {
+	outcome string
+	err     error
+}
+
+// call runs the body and turns a panic into an error
+func (j *jobRunner) call(ctx context.Context) (outcome string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("%s panicked: %v\n%s", j.stats.Name, r, debug.Stack())
+			outcome, err = metrics.JobPanicked, fmt.Errorf("%s panicked: %v", j.stats.Name, r)
 		}
+	}()
+	if err = j.job.Body(ctx, j.messager); err != nil {
+		return metrics.JobFailed, err
 	}
+	return metrics.JobSucceeded, nil
 }
 
-// RunJobs starts all jobs from the list in a separate threadsdefer cancel()
-func RunJobs(ctx context.Context, jobs JobDescriptionsList, messager Messager) {
-	for _, job := range jobs {
-		go RunJob(ctx, job, messager)
+// maxTime returns the latest of two times
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
 	}
+	return b
+}
+
+// Runner runs a list of jobs and collects their stats
+type Runner struct {
+	jobs []*jobRunner
+}
+
+// NewRunner creates a runner for the jobs
+func NewRunner(jobs JobDescriptionsList) *Runner {
+	r := &Runner{}
+	for i, job := range jobs {
+		r.jobs = append(r.jobs, newJobRunner(job, fmt.Sprintf("job %d", i)))
+	}
+	return r
+}
+
+// SetMetrics sets the collector of outcomes of job runs, it should be called before Start
+func (r *Runner) SetMetrics(collector metrics.Collector) {
+	for _, job := range r.jobs {
+		job.metrics = collector
+	}
+}
+
+// Start starts all jobs in separate threads, the jobs send messages with the messager and stop when the context is canceled.
+// The runner should be started once
+func (r *Runner) Start(ctx context.Context, messager Messager) {
+	for _, job := range r.jobs {
+		go job.run(ctx, messager)
+	}
+}
+
+// Stats returns stats of all jobs in the order of the list
+func (r *Runner) Stats() []JobStats {
+	result := make([]JobStats, 0, len(r.jobs))
+	for _, job := range r.jobs {
+		result = append(result, job.getStats())
+	}
+	return result
+}
+
+// JobStats returns stats of the job with the name, false if there is no such job
+func (r *Runner) JobStats(name string) (JobStats, bool) {
+	for _, job := range r.jobs {
+		if stats := job.getStats(); stats.Name == name {
+			return stats, true
+		}
+	}
+	return JobStats{}, false
+}
+
+// RunJob runs a job's Body at the fire times of its schedule until the context is canceled.
+// Missed fire times are skipped, overlapping runs are handled according to the job's Overlap policy
+func RunJob(ctx context.Context, job JobDescription, messager Messager) {
+	newJobRunner(job, "job").run(ctx, messager)
+}
+
+// RunJobs starts all jobs from the list in separate threads, and returns the runner to query stats of the jobs
+func RunJobs(ctx context.Context, jobs JobDescriptionsList, messager Messager) *Runner {
+	runner := NewRunner(jobs)
+	runner.Start(ctx, messager)
+	return runner
 }
@@ -5,11 +5,14 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/ufy-it/go-telegram-bot/handlers/buttons"
 	"github.com/ufy-it/go-telegram-bot/jobs"
+	"github.com/ufy-it/go-telegram-bot/metrics"
 )
 
 type mockMessage struct {
@@ -47,9 +50,9 @@ func TestJobIntervals(t *testing.T) {
 	ind := 0
 	job := func(ctx context.Context, messager jobs.Messager) error {
 		if ind < 3 {
-			c <- struct{}{}
 			messager.SendSingleMessage(ctx, int64(ind), strconv.Itoa(ind), nil)
 			ind++
+			c <- struct{}{} // signal after the message is recorded
 		}
 		return nil
 	}
@@ -112,9 +115,9 @@ func TestThreeJobsParallelRun(t *testing.T) {
 		}
 	}
 	jobs.RunJobs(ctx, jobs.JobDescriptionsList{
-		{0, 3, genJob(1)},
-		{1, 3, genJob(2)},
-		{2, 3, genJob(3)},
+		{OffsetSeconds: 0, IntervalSeconds: 3, Body: genJob(1)},
+		{OffsetSeconds: 1, IntervalSeconds: 3, Body: genJob(2)},
+		{OffsetSeconds: 2, IntervalSeconds: 3, Body: genJob(3)},
 	}, newMockMessager())
 	checkStep := func(i int) {
 		select {
@@ -138,7 +141,7 @@ func TestCloseBeforeOffset(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	c := make(chan struct{})
 	go jobs.RunJob(ctx,
-		jobs.JobDescription{1, 1, func(ctx context.Context, messager jobs.Messager) error {
+		jobs.JobDescription{OffsetSeconds: 1, IntervalSeconds: 1, Body: func(ctx context.Context, messager jobs.Messager) error {
 			c <- struct{}{}
 			return nil
 		}}, newMockMessager())
@@ -154,7 +157,7 @@ func TestCloseInInterval(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	c := make(chan struct{})
 	go jobs.RunJob(ctx,
-		jobs.JobDescription{1, 1, func(ctx context.Context, messager jobs.Messager) error {
+		jobs.JobDescription{OffsetSeconds: 1, IntervalSeconds: 1, Body: func(ctx context.Context, messager jobs.Messager) error {
 			c <- struct{}{}
 			return nil
 		}}, newMockMessager())
@@ -170,3 +173,171 @@ func TestCloseInInterval(t *testing.T) {
 	case <-time.After(time.Duration(2) * time.Second):
 	}
 }
+
+func TestJobProtections(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	started := make(chan string, 100)
+	hung := make(chan struct{})
+	defer close(hung)
+	runner := jobs.RunJobs(ctx, jobs.JobDescriptionsList{
+		{Name: "panic", IntervalSeconds: 1, Body: func(ctx context.Context, messager jobs.Messager) error {
+			started <- "panic"
+			panic("test panic")
+		}},
+		{Name: "hung", IntervalSeconds: 2, TimeoutSeconds: 1, Body: func(ctx context.Context, messager jobs.Messager) error {
+			started <- "hung"
+			<-hung // ignores the context
+			return nil
+		}},
+		{Name: "slow", IntervalSeconds: 1, Body: func(ctx context.Context, messager jobs.Messager) error {
+			started <- "slow"
+			time.Sleep(1500 * time.Millisecond)
+			return nil
+		}},
+		{Name: "queued", IntervalSeconds: 1, Overlap: jobs.QueueOverlap, Body: func(ctx context.Context, messager jobs.Messager) error {
+			started <- "queued"
+			time.Sleep(1500 * time.Millisecond)
+			return nil
+		}},
+		{Name: "concurrent", IntervalSeconds: 1, Overlap: jobs.AllowOverlap, Body: func(ctx context.Context, messager jobs.Messager) error {
+			started <- "concurrent"
+			time.Sleep(1500 * time.Millisecond)
+			return nil
+		}},
+	}, newMockMessager())
+	time.Sleep(3300 * time.Millisecond)
+	stats := runner.Stats()
+	cancel()
+	runs := map[string]int{}
+	for len(started) > 0 {
+		runs[<-started]++
+	}
+	// runs start at 0, 1, 2 and 3 seconds, the hung job runs every 2 seconds
+	for name, expected := range map[string]int{"panic": 4, "hung": 2, "slow": 2, "queued": 3, "concurrent": 4} {
+		if runs[name] != expected {
+			t.Errorf("expected %d runs of %s, got %d", expected, name, runs[name])
+		}
+	}
+
+	if len(stats) != 5 {
+		t.Fatalf("expected stats of 5 jobs, got %d", len(stats))
+	}
+	if stats[0].Name != "panic" || stats[0].ConsecutiveFailures != 4 || stats[0].LastError == nil || !strings.Contains(stats[0].LastError.Error(), "test panic") {
+		t.Errorf("unexpected stats of the panicking job: %+v", stats[0])
+	}
+	if stats[1].Name != "hung" || stats[1].Runs != 2 || stats[1].ConsecutiveFailures != 2 ||
+		stats[1].LastDuration < time.Second || stats[1].LastDuration > 1500*time.Millisecond || stats[1].Abandoned != 2 {
+		t.Errorf("unexpected stats of the hung job: %+v", stats[1])
+	}
+	if stats[2].Skipped != 2 || stats[2].Runs != 1 || stats[2].LastError != nil || stats[2].LastStart.IsZero() {
+		t.Errorf("unexpected stats of the slow job: %+v", stats[2])
+	}
+	if stats[4].Running != 2 {
+		t.Errorf("expected 2 concurrent runs, got %+v", stats[4])
+	}
+	if _, ok := runner.JobStats("hung"); !ok {
+		t.Errorf("no stats of the hung job")
+	}
+	if _, ok := runner.JobStats("unknown"); ok {
+		t.Errorf("got stats of an unknown job")
+	}
+}
+
+func TestContinuousJob(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var mu sync.Mutex
+	running, overlaps := 0, 0
+	runner := jobs.RunJobs(ctx, jobs.JobDescriptionsList{
+		{Name: "continuous", Body: func(ctx context.Context, messager jobs.Messager) error {
+			mu.Lock()
+			running++
+			if running > 1 {
+				overlaps++
+			}
+			mu.Unlock()
+			time.Sleep(100 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+			return nil
+		}},
+	}, newMockMessager())
+	time.Sleep(550 * time.Millisecond)
+	stats, _ := runner.JobStats("continuous")
+	if stats.Runs < 4 || stats.Runs > 5 || stats.Skipped != 0 {
+		t.Errorf("a job without an interval should run again right after the previous run, got %+v", stats)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if overlaps != 0 {
+		t.Errorf("runs of a job without an interval should not overlap, got %d overlaps", overlaps)
+	}
+}
+
+// outcomeCollector records outcomes of job runs
+type outcomeCollector struct {
+	metrics.NopCollector
+	mu       sync.Mutex
+	outcomes map[string]string
+}
+
+func (c *outcomeCollector) JobRun(job string, outcome string, duration time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.outcomes[job]; !ok || outcome == metrics.JobSkipped {
+		c.outcomes[job] = outcome
+	}
+}
+
+func TestJobMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	hung := make(chan struct{})
+	defer close(hung)
+	runner := jobs.NewRunner(jobs.JobDescriptionsList{
+		{Name: "ok", IntervalSeconds: 10, Body: func(ctx context.Context, messager jobs.Messager) error {
+			return nil
+		}},
+		{Name: "fail", IntervalSeconds: 10, Body: func(ctx context.Context, messager jobs.Messager) error {
+			return errors.New("failure")
+		}},
+		{Name: "panic", IntervalSeconds: 10, Body: func(ctx context.Context, messager jobs.Messager) error {
+			panic("test panic")
+		}},
+		{Name: "hung", IntervalSeconds: 10, TimeoutSeconds: 1, Body: func(ctx context.Context, messager jobs.Messager) error {
+			<-hung
+			return nil
+		}},
+		{Name: "slow", IntervalSeconds: 1, Body: func(ctx context.Context, messager jobs.Messager) error {
+			time.Sleep(1500 * time.Millisecond)
+			return nil
+		}},
+		{Name: "canceled", IntervalSeconds: 10, Body: func(ctx context.Context, messager jobs.Messager) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}},
+	})
+	collector := &outcomeCollector{outcomes: make(map[string]string)}
+	runner.SetMetrics(collector)
+	runner.Start(ctx, newMockMessager())
+	time.Sleep(1300 * time.Millisecond)
+	cancel()
+	time.Sleep(100 * time.Millisecond)
+
+	collector.mu.Lock()
+	defer collector.mu.Unlock()
+	expected := map[string]string{
+		"ok":       metrics.JobSucceeded,
+		"fail":     metrics.JobFailed,
+		"panic":    metrics.JobPanicked,
+		"hung":     metrics.JobTimedOut,
+		"slow":     metrics.JobSkipped,
+		"canceled": metrics.JobCanceled,
+	}
+	for job, outcome := range expected {
+		if collector.outcomes[job] != outcome {
+			t.Errorf("expected outcome '%s' of %s, got '%s'", outcome, job, collector.outcomes[job])
+		}
+	}
+}
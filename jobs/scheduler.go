@@ -0,0 +1,355 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	betterguid "github.com/kjk/betterguid"
+	"github.com/ufy-it/go-telegram-bot/logger"
+	"github.com/ufy-it/go-telegram-bot/state"
+)
+
+// TaskBody is a type for a function that runs a scheduled task of a registered type
+type TaskBody func(ctx context.Context, task state.ScheduledTask, messager Messager) error
+
+// CatchUpPolicy tells what to do with tasks that were due while the bot was not running
+type CatchUpPolicy struct {
+	Skip     bool          // drop missed tasks instead of running them
+	MaxDelay time.Duration // run missed tasks only if they are late by less than MaxDelay, 0 means no limit
+}
+
+// drop returns true if the task that was due before the start should not be run
+func (p CatchUpPolicy) drop(task *state.ScheduledTask, start time.Time) bool {
+	if !task.At.Before(start) {
+		return false
+	}
+	return p.Skip || (p.MaxDelay > 0 && start.Sub(task.At) > p.MaxDelay)
+}
+
+// DefaultTaskTimeout is the default maximum execution time of a scheduled task
+const DefaultTaskTimeout = 5 * time.Minute
+
+// MaxTaskInterruptions is the number of runs of a task interrupted by shutdowns, after which the task is dropped
+const MaxTaskInterruptions = 3
+
+// Scheduler runs one-off tasks for chats at a given time, e.g. reminders created by handlers.
+// Tasks are saved to the StateIO, so they survive restarts. A task is removed after it has run, failed, panicked or timed out,
+// a task interrupted by a shutdown runs again after the restart, at most MaxTaskInterruptions times
+type Scheduler struct {
+	mu      sync.Mutex
+	tasks   map[string]*state.ScheduledTask
+	running map[string]bool     // IDs of tasks being run
+	types   map[string]TaskBody // registered task types
+	io      state.StateIO       // nil if tasks are kept in memory only
+	policy  CatchUpPolicy
+	timeout time.Duration // maximum execution time of a task, 0 means no limit
+	wake    chan struct{} // signals that the earliest task might have changed
+}
+
+// NewScheduler creates a scheduler that keeps tasks in io (in memory if io is nil)
+// and applies the policy to tasks that were missed while the bot was not running
+func NewScheduler(io state.StateIO, policy CatchUpPolicy) *Scheduler {
+	s := &Scheduler{
+		tasks:   make(map[string]*state.ScheduledTask),
+		running: make(map[string]bool),
+		types:   make(map[string]TaskBody),
+		io:      io,
+		policy:  policy,
+		timeout: DefaultTaskTimeout,
+		wake:    make(chan struct{}, 1),
+	}
+	if io == nil {
+		return s
+	}
+	data, err := io.Load()
+	if err != nil {
+		logger.Warning("cannot load scheduled tasks: %v, will start from blank", err)
+		return s
+	}
+	var tasks []*state.ScheduledTask
+	if err = json.Unmarshal(data, &tasks); err != nil {
+		logger.Warning("cannot parse scheduled tasks: %v, will start from blank", err)
+		return s
+	}
+	for _, task := range tasks {
+		s.tasks[task.ID] = task
+	}
+	return s
+}
+
+// RegisterTask sets the function that runs tasks of the type. Types should be registered before the scheduler is run
+func (s *Scheduler) RegisterTask(taskType string, body TaskBody) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.types[taskType] = body
+}
+
+// SetTaskTimeout sets the maximum execution time of a task (DefaultTaskTimeout by default), the context of the task is canceled after it.
+// A task that ignores the context is left behind and removed. 0 means no limit
+func (s *Scheduler) SetTaskTimeout(timeout time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.timeout = timeout
+}
+
+// ScheduleAt schedules a task of a registered type for the chat. The payload should be JSON-serializable,
+// the task gets it in ScheduledTask.Payload. A task scheduled in the past is run immediately
+func (s *Scheduler) ScheduleAt(at time.Time, chatID int64, taskType string, payload interface{}) (string, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("cannot serialize payload of the task: %v", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.types[taskType]; !ok {
+		return "", fmt.Errorf("task type '%s' is not registered", taskType)
+	}
+	task := &state.ScheduledTask{
+		ID:        betterguid.New(),
+		Type:      taskType,
+		ChatID:    chatID,
+		At:        at,
+		Payload:   data,
+		CreatedAt: time.Now(),
+	}
+	s.tasks[task.ID] = task
+	if err = s.save(); err != nil {
+		delete(s.tasks, task.ID)
+		return "", err
+	}
+	s.notify()
+	return task.ID, nil
+}
+
+// Cancel removes a pending task, returns false if there is no such task. A task that is already running is not interrupted
+func (s *Scheduler) Cancel(taskID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	task, ok := s.tasks[taskID]
+	if !ok {
+		return false, nil
+	}
+	delete(s.tasks, taskID)
+	if err := s.save(); err != nil {
+		s.tasks[taskID] = task
+		return false, err
+	}
+	s.notify()
+	return true, nil
+}
+
+// PendingTasks returns tasks of the chat that have not run yet, ordered by time
+func (s *Scheduler) PendingTasks(chatID int64) []state.ScheduledTask {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]state.ScheduledTask, 0)
+	for _, task := range s.tasks {
+		if task.ChatID == chatID && !s.running[task.ID] {
+			result = append(result, *task)
+		}
+	}
+	sortTasks(result)
+	return result
+}
+
+// Run runs tasks when they are due until the context is canceled. Tasks get the context and the messager.
+// Tasks that were due before the start are run or dropped according to the catch-up policy
+func (s *Scheduler) Run(ctx context.Context, messager Messager) {
+	s.catchUp(time.Now())
+	for {
+		due, next := s.dueTasks(time.Now())
+		for _, task := range due {
+			go s.runTask(ctx, task, messager)
+		}
+		var timer *time.Timer
+		var fire <-chan time.Time
+		if !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			fire = timer.C
+		}
+		select {
+		case <-ctx.Done():
+		case <-s.wake:
+		case <-fire:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// catchUp drops tasks that were missed before the start if the policy says so
+func (s *Scheduler) catchUp(start time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dropped := 0
+	for id, task := range s.tasks {
+		if s.policy.drop(task, start) {
+			delete(s.tasks, id)
+			dropped++
+		}
+	}
+	if dropped == 0 {
+		return
+	}
+	logger.Warning("dropped %d scheduled tasks missed while the bot was not running", dropped)
+	if err := s.save(); err != nil {
+		logger.Error("%v", err)
+	}
+}
+
+// dueTasks marks tasks that are due as running and returns them, and returns time of the earliest pending task
+func (s *Scheduler) dueTasks(now time.Time) ([]state.ScheduledTask, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []state.ScheduledTask
+	var next time.Time
+	for id, task := range s.tasks {
+		if s.running[id] {
+			continue
+		}
+		if !task.At.After(now) {
+			s.running[id] = true
+			due = append(due, *task)
+		} else if next.IsZero() || task.At.Before(next) {
+			next = task.At
+		}
+	}
+	sortTasks(due)
+	return due, next
+}
+
+// runTask runs the task with its registered type and removes it
+func (s *Scheduler) runTask(ctx context.Context, task state.ScheduledTask, messager Messager) {
+	s.mu.Lock()
+	body, ok := s.types[task.Type]
+	timeout := s.timeout
+	s.mu.Unlock()
+	var err error
+	interrupted := false
+	if !ok {
+		err = fmt.Errorf("task type '%s' is not registered", task.Type)
+	} else {
+		interrupted, err = s.execute(ctx, timeout, task, body, messager)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.running, task.ID)
+	if interrupted && s.keepInterrupted(task.ID) {
+		return // the task runs again after the restart
+	}
+	if err != nil {
+		logger.Error("got error from the scheduled task %s (%s) for chat %d: %v", task.ID, task.Type, task.ChatID, err)
+	}
+	delete(s.tasks, task.ID)
+	if err = s.save(); err != nil {
+		logger.Error("%v", err)
+	}
+}
+
+// keepInterrupted counts the interrupted run of the task and returns true if the task should run again, should be called under the lock
+func (s *Scheduler) keepInterrupted(taskID string) bool {
+	task, ok := s.tasks[taskID]
+	if !ok {
+		return false // the task was canceled while it was running
+	}
+	task.Interrupted++
+	if task.Interrupted >= MaxTaskInterruptions {
+		logger.Error("the scheduled task %s (%s) for chat %d was interrupted by shutdowns %d times, it is dropped", task.ID, task.Type, task.ChatID, task.Interrupted)
+		return false
+	}
+	if err := s.save(); err != nil {
+		logger.Error("%v", err)
+	}
+	return true
+}
+
+// execute runs the body of the task with the timeout. A body that does not return after the timeout is left behind.
+// Returns true if the run was interrupted by the cancellation of ctx
+func (s *Scheduler) execute(ctx context.Context, timeout time.Duration, task state.ScheduledTask, body TaskBody, messager Messager) (bool, error) {
+	runCtx, cancel := ctx, context.CancelFunc(func() {})
+	if timeout > 0 {
+		runCtx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	defer cancel()
+	done := make(chan taskResult, 1)
+	go func() {
+		done <- callTask(runCtx, task, body, messager)
+	}()
+	select {
+	case r := <-done:
+		return r.err != nil && !r.panicked && ctx.Err() != nil, r.err
+	case <-runCtx.Done():
+		go func() {
+			r := <-done
+			logger.Warning("abandoned run of the scheduled task %s (%s) has finished: %v", task.ID, task.Type, r.err)
+		}()
+		if ctx.Err() != nil {
+			return true, ctx.Err()
+		}
+		return false, fmt.Errorf("the task has not finished in %v", timeout)
+	}
+}
+
+// taskResult is an outcome of a run of a task
+type taskResult struct {
+	err      error
+	panicked bool
+}
+
+// callTask runs the body of the task and turns a panic into an error
+func callTask(ctx context.Context, task state.ScheduledTask, body TaskBody, messager Messager) (result taskResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("the scheduled task %s (%s) for chat %d panicked: %v\n%s", task.ID, task.Type, task.ChatID, r, debug.Stack())
+			result = taskResult{err: fmt.Errorf("the task panicked: %v", r), panicked: true}
+		}
+	}()
+	return taskResult{err: body(ctx, task, messager)}
+}
+
+// notify wakes up Run to recalculate the earliest task
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// save writes all tasks to io, should be called under the lock
+func (s *Scheduler) save() error {
+	if s.io == nil {
+		return nil
+	}
+	tasks := make([]state.ScheduledTask, 0, len(s.tasks))
+	for _, task := range s.tasks {
+		tasks = append(tasks, *task)
+	}
+	sortTasks(tasks)
+	data, err := json.Marshal(tasks)
+	if err == nil {
+		err = s.io.Save(data)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot save scheduled tasks: %v", err)
+	}
+	return nil
+}
+
+// sortTasks orders tasks by time, and by ID for tasks with the same time
+func sortTasks(tasks []state.ScheduledTask) {
+	sort.Slice(tasks, func(i, j int) bool {
+		if tasks[i].At.Equal(tasks[j].At) {
+			return tasks[i].ID < tasks[j].ID
+		}
+		return tasks[i].At.Before(tasks[j].At)
+	})
+}
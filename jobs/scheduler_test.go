@@ -0,0 +1,233 @@
+package jobs_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ufy-it/go-telegram-bot/handlers"
+	"github.com/ufy-it/go-telegram-bot/handlers/buttons"
+	"github.com/ufy-it/go-telegram-bot/jobs"
+	"github.com/ufy-it/go-telegram-bot/state"
+)
+
+type reminder struct {
+	Text string `json:"text"`
+}
+
+// chanMessager passes texts of sent messages to a channel
+type chanMessager struct {
+	jobs.Messager
+	messages chan string
+}
+
+func newChanMessager() *chanMessager {
+	return &chanMessager{messages: make(chan string, 10)}
+}
+
+func (m *chanMessager) SendSingleMessage(ctx context.Context, chatID int64, text string, keyboard *buttons.ButtonSet) error {
+	m.messages <- text
+	return nil
+}
+
+// remindTask sends text from the payload of the task to its chat
+func remindTask(ctx context.Context, task state.ScheduledTask, messager jobs.Messager) error {
+	var payload reminder
+	if err := task.DecodePayload(&payload); err != nil {
+		return err
+	}
+	return messager.SendSingleMessage(ctx, task.ChatID, payload.Text, nil)
+}
+
+func TestSchedulerRunsTasks(t *testing.T) {
+	io := state.NewMemoryState()
+	var scheduler handlers.TaskScheduler = jobs.NewScheduler(io, jobs.CatchUpPolicy{})
+	s := scheduler.(*jobs.Scheduler)
+	s.RegisterTask("remind", remindTask)
+	if _, err := s.ScheduleAt(time.Now(), 1, "unknown", nil); err == nil {
+		t.Errorf("expected error for an unregistered task type")
+	}
+	late, err := s.ScheduleAt(time.Now().Add(200*time.Millisecond), 1, "remind", reminder{"late"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	early, _ := s.ScheduleAt(time.Now().Add(100*time.Millisecond), 1, "remind", reminder{"early"})
+	canceled, _ := s.ScheduleAt(time.Now().Add(100*time.Millisecond), 2, "remind", reminder{"canceled"})
+	if tasks := s.PendingTasks(1); len(tasks) != 2 || tasks[0].ID != early || tasks[1].ID != late {
+		t.Errorf("unexpected pending tasks: %v", tasks)
+	}
+	if ok, err := s.Cancel(canceled); !ok || err != nil {
+		t.Errorf("cannot cancel the task: %v %v", ok, err)
+	}
+	if ok, _ := s.Cancel(canceled); ok {
+		t.Errorf("the task is canceled twice")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	messager := newChanMessager()
+	go s.Run(ctx, messager)
+	for _, expected := range []string{"early", "late"} {
+		select {
+		case text := <-messager.messages:
+			if text != expected {
+				t.Errorf("expected %s, got %s", expected, text)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("task %s has not run", expected)
+		}
+	}
+	select {
+	case text := <-messager.messages:
+		t.Errorf("unexpected message %s", text)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if tasks := s.PendingTasks(1); len(tasks) != 0 {
+		t.Errorf("expected no pending tasks, got %v", tasks)
+	}
+	data, _ := io.Load()
+	var saved []state.ScheduledTask
+	if err := json.Unmarshal(data, &saved); err != nil || len(saved) != 0 {
+		t.Errorf("expected no saved tasks, got %s", data)
+	}
+}
+
+func TestSchedulerCatchUp(t *testing.T) {
+	now := time.Now()
+	tasks := []state.ScheduledTask{
+		{ID: "old", Type: "remind", ChatID: 1, At: now.Add(-2 * time.Hour), Payload: json.RawMessage(`{"text":"old"}`)},
+		{ID: "recent", Type: "remind", ChatID: 1, At: now.Add(-time.Minute), Payload: json.RawMessage(`{"text":"recent"}`)},
+		{ID: "future", Type: "remind", ChatID: 1, At: now.Add(time.Hour), Payload: json.RawMessage(`{"text":"future"}`)},
+	}
+	data, _ := json.Marshal(tasks)
+	for _, test := range []struct {
+		policy   jobs.CatchUpPolicy
+		expected []string
+	}{
+		{jobs.CatchUpPolicy{}, []string{"old", "recent"}},
+		{jobs.CatchUpPolicy{MaxDelay: time.Hour}, []string{"recent"}},
+		{jobs.CatchUpPolicy{Skip: true}, nil},
+	} {
+		io := state.NewMemoryState()
+		io.Save(data)
+		s := jobs.NewScheduler(io, test.policy)
+		s.RegisterTask("remind", remindTask)
+		if pending := s.PendingTasks(1); len(pending) != 3 {
+			t.Errorf("expected 3 tasks loaded, got %v", pending)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		messager := newChanMessager()
+		go s.Run(ctx, messager)
+		received := map[string]bool{}
+	loop:
+		for {
+			select {
+			case text := <-messager.messages:
+				received[text] = true
+			case <-time.After(200 * time.Millisecond):
+				break loop
+			}
+		}
+		cancel()
+		if len(received) != len(test.expected) {
+			t.Errorf("expected %v for %v, got %v", test.expected, test.policy, received)
+		}
+		for _, text := range test.expected {
+			if !received[text] {
+				t.Errorf("expected %v for %v, got %v", test.expected, test.policy, received)
+			}
+		}
+		if pending := s.PendingTasks(1); len(pending) != 1 || pending[0].ID != "future" {
+			t.Errorf("expected only the future task pending, got %v", pending)
+		}
+	}
+}
+
+// savedTasks returns tasks saved to io
+func savedTasks(t *testing.T, io state.StateIO) []state.ScheduledTask {
+	data, _ := io.Load()
+	var saved []state.ScheduledTask
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatalf("cannot parse saved tasks %s: %v", data, err)
+	}
+	return saved
+}
+
+func TestSchedulerDropsPanickedAndHangingTasks(t *testing.T) {
+	io := state.NewMemoryState()
+	s := jobs.NewScheduler(io, jobs.CatchUpPolicy{})
+	s.SetTaskTimeout(100 * time.Millisecond)
+	release := make(chan struct{})
+	defer close(release)
+	s.RegisterTask("panic", func(ctx context.Context, task state.ScheduledTask, messager jobs.Messager) error {
+		panic("bad task")
+	})
+	s.RegisterTask("hang", func(ctx context.Context, task state.ScheduledTask, messager jobs.Messager) error {
+		<-release // ignores the context
+		return nil
+	})
+	s.RegisterTask("remind", remindTask)
+	s.ScheduleAt(time.Now(), 1, "panic", nil)
+	s.ScheduleAt(time.Now(), 1, "hang", nil)
+	s.ScheduleAt(time.Now().Add(50*time.Millisecond), 1, "remind", reminder{"after"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	messager := newChanMessager()
+	go s.Run(ctx, messager)
+	select {
+	case text := <-messager.messages:
+		if text != "after" {
+			t.Errorf("unexpected message %s", text)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("the task after the panicked one has not run")
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(savedTasks(t, io)) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if saved := savedTasks(t, io); len(saved) != 0 {
+		t.Errorf("expected the panicked and the hanging task removed, got %v", saved)
+	}
+}
+
+func TestSchedulerDropsTasksInterruptedTooOften(t *testing.T) {
+	io := state.NewMemoryState()
+	tasks := []state.ScheduledTask{{ID: "stuck", Type: "stuck", ChatID: 1, At: time.Now()}}
+	data, _ := json.Marshal(tasks)
+	io.Save(data)
+	for i := 1; i <= jobs.MaxTaskInterruptions; i++ {
+		s := jobs.NewScheduler(io, jobs.CatchUpPolicy{})
+		started := make(chan struct{})
+		s.RegisterTask("stuck", func(ctx context.Context, task state.ScheduledTask, messager jobs.Messager) error {
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		go s.Run(ctx, newChanMessager())
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Fatalf("the task has not started on the run %d", i)
+		}
+		cancel()
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			saved := savedTasks(t, io)
+			if len(saved) == 0 || saved[0].Interrupted == i {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		saved := savedTasks(t, io)
+		if i < jobs.MaxTaskInterruptions && (len(saved) != 1 || saved[0].Interrupted != i) {
+			t.Errorf("expected the task kept after %d interruptions, got %v", i, saved)
+		}
+		if i == jobs.MaxTaskInterruptions && len(saved) != 0 {
+			t.Errorf("expected the task dropped after %d interruptions, got %v", i, saved)
+		}
+	}
+}
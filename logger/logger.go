@@ -1,6 +1,10 @@
 package logger
 
-import "log"
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
 
 // Logger is an interface for a logger object
 type Logger interface {
@@ -10,38 +14,97 @@ type Logger interface {
 	Panic(format string, params ...interface{})
 }
 
+// DebugLogger is a Logger that also prints debug messages. Debug messages go to Note of a Logger without Debug
+type DebugLogger interface {
+	Logger
+	Debug(format string, params ...interface{})
+}
+
 type defaultLogger struct{}
 
-var currentLogger Logger = defaultLogger{}
+// loggerHolder keeps loggers of different types in atomic.Value
+type loggerHolder struct {
+	logger StructuredLogger
+}
+
+var currentLogger atomic.Value
+
+// minLevel is the level of the least important records that are logged
+var minLevel atomic.Int32
+
+func init() {
+	currentLogger.Store(loggerHolder{printfLogger{defaultLogger{}}})
+	minLevel.Store(int32(LevelNote))
+}
+
+// getLogger returns the logger used by the package
+func getLogger() StructuredLogger {
+	return currentLogger.Load().(loggerHolder).logger
+}
+
+// enabled tells whether records of the level are logged
+func enabled(level Level) bool {
+	return level >= Level(minLevel.Load())
+}
 
 // DefaultLogger returns a default logger (which calls log.Printf)
 func DefaultLogger() Logger {
 	return defaultLogger{}
 }
 
-// SetLogger sets the logger to be used by the package
+// SetLogger sets the logger to be used by the package, fields of structured records are appended to messages as key=value pairs
 func SetLogger(logger Logger) {
-	currentLogger = logger
+	currentLogger.Store(loggerHolder{printfLogger{logger}})
+}
+
+// SetStructuredLogger sets the structured logger to be used by the package, e.g. NewSlogLogger(slog.Default())
+func SetStructuredLogger(logger StructuredLogger) {
+	currentLogger.Store(loggerHolder{logger})
+}
+
+// SetLevel sets the level of the least important records that are logged (LevelNote by default), LevelDebug enables debug records
+func SetLevel(level Level) {
+	minLevel.Store(int32(level))
+}
+
+// Log writes a record with key/value fields, e.g. Log(LevelWarning, "cannot send message", "chat_id", chatID, "error", err)
+func Log(level Level, msg string, keyvals ...interface{}) {
+	if !enabled(level) {
+		return
+	}
+	getLogger().Log(level, msg, keyvals...)
 }
 
 // Error prints an error message into the log
 func Error(format string, params ...interface{}) {
-	currentLogger.Error(format, params...)
+	Log(LevelError, fmt.Sprintf(format, params...))
 }
 
 // Warning prints a warning message into the log
 func Warning(format string, params ...interface{}) {
-	currentLogger.Warning(format, params...)
+	Log(LevelWarning, fmt.Sprintf(format, params...))
 }
 
 // Note prints a note into the log
 func Note(format string, params ...interface{}) {
-	currentLogger.Note(format, params...)
+	Log(LevelNote, fmt.Sprintf(format, params...))
+}
+
+// Debug prints a debug message into the log if the level is LevelDebug
+func Debug(format string, params ...interface{}) {
+	Log(LevelDebug, fmt.Sprintf(format, params...))
 }
 
 // Panic prints an error into the log and calls panic()
 func Panic(format string, params ...interface{}) {
-	currentLogger.Panic(format, params...)
+	current := getLogger()
+	if l, ok := current.(printfLogger); ok {
+		l.logger.Panic(format, params...)
+		return
+	}
+	msg := fmt.Sprintf(format, params...)
+	current.Log(LevelError, msg)
+	panic(msg)
 }
 
 // Error prints an error message into the log
@@ -59,6 +122,11 @@ func (d defaultLogger) Note(format string, params ...interface{}) {
 	log.Printf("[Note] "+format, params...)
 }
 
+// Debug prints a debug message into the log
+func (d defaultLogger) Debug(format string, params ...interface{}) {
+	log.Printf("[Debug] "+format, params...)
+}
+
 // Panic prints an error into the log and calls panic()
 func (d defaultLogger) Panic(format string, params ...interface{}) {
 	log.Panicf("[Panic] "+format, params...)
@@ -0,0 +1,34 @@
+package logger
+
+import (
+	"context"
+	"log/slog"
+)
+
+// slogLogger adapts *slog.Logger to StructuredLogger
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+// NewSlogLogger returns a structured logger that writes records to the slog logger.
+// Note records are written with slog.LevelInfo. Call SetLevel(LevelDebug) to pass debug records to slog
+func NewSlogLogger(logger *slog.Logger) StructuredLogger {
+	return slogLogger{logger: logger}
+}
+
+// Log writes the record to the slog logger
+func (s slogLogger) Log(level Level, msg string, keyvals ...interface{}) {
+	s.logger.Log(context.Background(), slogLevel(level), msg, keyvals...)
+}
+
+func slogLevel(level Level) slog.Level {
+	switch level {
+	case LevelDebug:
+		return slog.LevelDebug
+	case LevelWarning:
+		return slog.LevelWarn
+	case LevelError:
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
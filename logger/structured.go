@@ -0,0 +1,174 @@
+package logger
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Level is the importance of a log record
+type Level int
+
+// levels of log records
+const (
+	LevelDebug Level = iota
+	LevelNote
+	LevelWarning
+	LevelError
+)
+
+// String returns the name of the level
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "Debug"
+	case LevelNote:
+		return "Note"
+	case LevelWarning:
+		return "Warning"
+	case LevelError:
+		return "Error"
+	}
+	return fmt.Sprintf("Level(%d)", int(l))
+}
+
+// StructuredLogger is an interface for a logger that writes records with key/value fields,
+// keyvals are pairs of a string key and a value, as in log/slog
+type StructuredLogger interface {
+	Log(level Level, msg string, keyvals ...interface{})
+}
+
+// printfLogger adapts a printf Logger to StructuredLogger
+type printfLogger struct {
+	logger Logger
+}
+
+// Log prints the message with fields appended as key=value pairs
+func (p printfLogger) Log(level Level, msg string, keyvals ...interface{}) {
+	text := msg + FormatFields(keyvals...)
+	switch level {
+	case LevelError:
+		p.logger.Error("%s", text)
+	case LevelWarning:
+		p.logger.Warning("%s", text)
+	case LevelDebug:
+		if d, ok := p.logger.(DebugLogger); ok {
+			d.Debug("%s", text)
+			return
+		}
+		p.logger.Note("%s", text)
+	default:
+		p.logger.Note("%s", text)
+	}
+}
+
+// FormatFields formats key/value pairs as " key=value key=value", values with spaces or quotes are quoted
+func FormatFields(keyvals ...interface{}) string {
+	var b strings.Builder
+	for i := 0; i < len(keyvals); i += 2 {
+		key, value := "!BADKEY", keyvals[i]
+		if i+1 < len(keyvals) {
+			key, value = fmt.Sprint(keyvals[i]), keyvals[i+1]
+		}
+		text := fmt.Sprint(value)
+		if text == "" || strings.ContainsAny(text, " \t\n\"=") {
+			text = strconv.Quote(text)
+		}
+		b.WriteString(" " + key + "=" + text)
+	}
+	return b.String()
+}
+
+// FieldLogger writes records with fields attached to every record, e.g. chat_id and conversation_id of a conversation.
+// Fields of a logger changed with Set are seen by loggers derived from it with With
+type FieldLogger struct {
+	parent *FieldLogger
+	mu     sync.RWMutex
+	fields []interface{}
+}
+
+// With returns a logger that attaches the key/value fields to every record
+func With(keyvals ...interface{}) *FieldLogger {
+	return &FieldLogger{fields: append([]interface{}{}, keyvals...)}
+}
+
+// With returns a logger with the fields of this logger and the key/value fields
+func (l *FieldLogger) With(keyvals ...interface{}) *FieldLogger {
+	return &FieldLogger{parent: l, fields: append([]interface{}{}, keyvals...)}
+}
+
+// Set sets the field of the logger, or removes it if the value is nil
+func (l *FieldLogger) Set(key string, value interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := 0; i+1 < len(l.fields); i += 2 {
+		if l.fields[i] == key {
+			if value == nil {
+				l.fields = append(l.fields[:i], l.fields[i+2:]...)
+			} else {
+				l.fields[i+1] = value
+			}
+			return
+		}
+	}
+	if value != nil {
+		l.fields = append(l.fields, key, value)
+	}
+}
+
+// Fields returns key/value fields of the logger, fields of the parent logger go first
+func (l *FieldLogger) Fields() []interface{} {
+	if l == nil {
+		return nil
+	}
+	fields := l.parent.Fields()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return append(fields, l.fields...)
+}
+
+// Log writes a record with the fields of the logger and the key/value fields
+func (l *FieldLogger) Log(level Level, msg string, keyvals ...interface{}) {
+	if !enabled(level) {
+		return
+	}
+	Log(level, msg, append(l.Fields(), keyvals...)...)
+}
+
+// Error writes an error record
+func (l *FieldLogger) Error(msg string, keyvals ...interface{}) {
+	l.Log(LevelError, msg, keyvals...)
+}
+
+// Warning writes a warning record
+func (l *FieldLogger) Warning(msg string, keyvals ...interface{}) {
+	l.Log(LevelWarning, msg, keyvals...)
+}
+
+// Note writes a note record
+func (l *FieldLogger) Note(msg string, keyvals ...interface{}) {
+	l.Log(LevelNote, msg, keyvals...)
+}
+
+// Debug writes a debug record
+func (l *FieldLogger) Debug(msg string, keyvals ...interface{}) {
+	l.Log(LevelDebug, msg, keyvals...)
+}
+
+type contextKey struct{}
+
+// NewContext returns a context that carries the logger
+func NewContext(ctx context.Context, l *FieldLogger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns the logger carried by the context, or a logger without fields.
+// Handlers get a logger with chat_id, user_id, conversation_id, handler and step of the conversation
+func FromContext(ctx context.Context) *FieldLogger {
+	if l, ok := ctx.Value(contextKey{}).(*FieldLogger); ok {
+		return l
+	}
+	return With()
+}
@@ -0,0 +1,114 @@
+package logger_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/ufy-it/go-telegram-bot/logger"
+)
+
+// TestFieldsLogging verifies that fields are appended to messages of the default logger
+func TestFieldsLogging(t *testing.T) {
+	buf := new(bytes.Buffer)
+	log.SetOutput(buf)
+	l := logger.With("chat_id", 42).With("handler", "start")
+	l.Warning("cannot send message", "error", "chat not found")
+	if !strings.HasSuffix(buf.String(), `[Warning] cannot send message chat_id=42 handler=start error="chat not found"`+"\n") {
+		t.Errorf("Unexpected logging with fields: %s", buf.String())
+	}
+
+	buf.Reset()
+	l.Debug("skipped")
+	if buf.Len() != 0 {
+		t.Errorf("debug records should be dropped by default, got %s", buf.String())
+	}
+	logger.SetLevel(logger.LevelDebug)
+	defer logger.SetLevel(logger.LevelNote)
+	l.Debug("logged")
+	if !strings.HasSuffix(buf.String(), "[Debug] logged chat_id=42 handler=start\n") {
+		t.Errorf("Unexpected logging for debug: %s", buf.String())
+	}
+}
+
+// TestFieldLoggerSet verifies that fields changed with Set are seen by derived loggers
+func TestFieldLoggerSet(t *testing.T) {
+	root := logger.With("chat_id", 42)
+	child := root.With("order", 7)
+	root.Set("step", "ask_name")
+	if fields := fmt.Sprint(child.Fields()); fields != "[chat_id 42 step ask_name order 7]" {
+		t.Errorf("unexpected fields %s", fields)
+	}
+	root.Set("step", "ask_phone")
+	root.Set("chat_id", nil)
+	if fields := fmt.Sprint(child.Fields()); fields != "[step ask_phone order 7]" {
+		t.Errorf("unexpected fields %s", fields)
+	}
+
+	ctx := logger.NewContext(context.Background(), child)
+	if logger.FromContext(ctx) != child {
+		t.Errorf("expected the logger from the context")
+	}
+	if fields := logger.FromContext(context.Background()).Fields(); len(fields) != 0 {
+		t.Errorf("expected a logger without fields, got %v", fields)
+	}
+}
+
+type printfRecorder struct {
+	lines []string
+}
+
+func (r *printfRecorder) Error(format string, params ...interface{}) {
+	r.lines = append(r.lines, "E "+fmt.Sprintf(format, params...))
+}
+
+func (r *printfRecorder) Warning(format string, params ...interface{}) {
+	r.lines = append(r.lines, "W "+fmt.Sprintf(format, params...))
+}
+
+func (r *printfRecorder) Note(format string, params ...interface{}) {
+	r.lines = append(r.lines, "N "+fmt.Sprintf(format, params...))
+}
+
+func (r *printfRecorder) Panic(format string, params ...interface{}) {
+	panic(fmt.Sprintf(format, params...))
+}
+
+// TestSetLogger verifies that a printf logger gets structured records
+func TestSetLogger(t *testing.T) {
+	recorder := &printfRecorder{}
+	logger.SetLogger(recorder)
+	defer logger.SetLogger(logger.DefaultLogger())
+	logger.SetLevel(logger.LevelDebug)
+	defer logger.SetLevel(logger.LevelNote)
+
+	logger.Error("failed %d", 1)
+	logger.With("chat_id", 42).Note("started", "step", 0)
+	logger.Debug("details")
+	expected := []string{"E failed 1", "N started chat_id=42 step=0", "N details"}
+	if fmt.Sprint(recorder.lines) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, recorder.lines)
+	}
+}
+
+// TestSlogLogger verifies that records with fields are written to slog
+func TestSlogLogger(t *testing.T) {
+	buf := new(bytes.Buffer)
+	logger.SetStructuredLogger(logger.NewSlogLogger(slog.New(slog.NewJSONHandler(buf, nil))))
+	defer logger.SetLogger(logger.DefaultLogger())
+
+	logger.With("chat_id", 42, "conversation_id", 7).Warning("cannot send message", "error", "blocked")
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("cannot parse %s: %v", buf.String(), err)
+	}
+	if record["level"] != "WARN" || record["msg"] != "cannot send message" || record["chat_id"] != 42.0 ||
+		record["conversation_id"] != 7.0 || record["error"] != "blocked" {
+		t.Errorf("unexpected record %v", record)
+	}
+}
@@ -0,0 +1,43 @@
+// Package metrics collects measurements of the dispatcher, conversations, Bot API calls and jobs,
+// and exports them in the Prometheus text format
+package metrics
+
+import "time"
+
+// reasons of rejected updates
+const (
+	QueueFull            = "queue_full"             // the conversation has too many unprocessed updates
+	TooManyConversations = "too_many_conversations" // MaxOpenConversations is reached
+)
+
+// outcomes of job runs
+const (
+	JobSucceeded = "success"
+	JobFailed    = "error"
+	JobTimedOut  = "timeout"  // the run has not finished in the timeout of the job
+	JobPanicked  = "panic"    // the body of the job panicked
+	JobCanceled  = "canceled" // the run was interrupted by the shutdown
+	JobSkipped   = "skipped"  // the run was skipped because the previous run was not over
+)
+
+// Collector receives measurements of the bot. Methods are called from many goroutines, so they should be safe for concurrent use and fast
+type Collector interface {
+	UpdateReceived(updateType string)                                  // an update of the type (message, callback_query, etc.) is received
+	OpenConversations(open, max int)                                   // the number of open conversations changed, max is MaxOpenConversations
+	UpdateRejected(reason string)                                      // an update is dropped because of the reason (QueueFull, TooManyConversations)
+	HandlerFinished(handler string, duration time.Duration, err error) // a handler is over, the duration includes waiting for users
+	StepTransition(handler string, from, to int)                       // a handler went from a step to another one (or repeated the step), from is -1 for the first step
+	APICall(method string, duration time.Duration, err error)          // a Bot API call is finished
+	JobRun(job string, outcome string, duration time.Duration)         // a run of a job is over, or skipped
+}
+
+// NopCollector is a Collector that drops all measurements
+type NopCollector struct{}
+
+func (NopCollector) UpdateReceived(updateType string)                                  {}
+func (NopCollector) OpenConversations(open, max int)                                   {}
+func (NopCollector) UpdateRejected(reason string)                                      {}
+func (NopCollector) HandlerFinished(handler string, duration time.Duration, err error) {}
+func (NopCollector) StepTransition(handler string, from, to int)                       {}
+func (NopCollector) APICall(method string, duration time.Duration, err error)          {}
+func (NopCollector) JobRun(job string, outcome string, duration time.Duration)         {}
@@ -0,0 +1,38 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"time"
+)
+
+// HTTPClient is an interface of the http client used by tgbotapi.BotAPI
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// InstrumentedClient is an HTTPClient that reports latency and errors of Bot API calls to the collector.
+// The method of a call is the last element of the request path, e.g. sendMessage
+type InstrumentedClient struct {
+	client    HTTPClient
+	collector Collector
+}
+
+// NewHTTPClient wraps the http client of a tgbotapi.BotAPI, e.g.
+// tgbotapi.NewBotAPIWithClient(token, tgbotapi.APIEndpoint, metrics.NewHTTPClient(&http.Client{}, collector))
+func NewHTTPClient(client HTTPClient, collector Collector) *InstrumentedClient {
+	return &InstrumentedClient{client: client, collector: collector}
+}
+
+// Do sends the request and reports its latency, a failed request or a response with an error status are reported as errors
+func (c *InstrumentedClient) Do(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := c.client.Do(req)
+	reported := err
+	if err == nil && resp.StatusCode >= http.StatusBadRequest {
+		reported = fmt.Errorf("status %d", resp.StatusCode)
+	}
+	c.collector.APICall(path.Base(req.URL.Path), time.Since(start), reported)
+	return resp, err
+}
@@ -0,0 +1,234 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultNamespace is the prefix of metric names if NewPrometheus gets an empty namespace
+const DefaultNamespace = "telegram_bot"
+
+// buckets of histograms in seconds
+var (
+	handlerBuckets = []float64{0.1, 0.5, 1, 5, 15, 60, 300, 900, 3600} // handlers wait for users
+	apiBuckets     = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+	jobBuckets     = []float64{0.1, 1, 5, 15, 60, 300, 900, 3600}
+)
+
+// kinds of metrics
+const (
+	counter   = "counter"
+	gauge     = "gauge"
+	histogram = "histogram"
+)
+
+// series is a metric with a set of label values
+type series struct {
+	labelValues []string
+	value       float64  // value of a counter or a gauge
+	counts      []uint64 // observations in each bucket of a histogram (not cumulative)
+	sum         float64
+	count       uint64
+}
+
+// family is a metric with all its series
+type family struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	buckets []float64 // upper bounds of histogram buckets
+	series  map[string]*series
+}
+
+// get returns series for the label values, creates it if needed
+func (f *family) get(labelValues []string) *series {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: labelValues}
+		if f.kind == histogram {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// Prometheus is a Collector that keeps measurements in memory and serves them in the Prometheus text format, e.g. on /metrics
+type Prometheus struct {
+	namespace string
+	mu        sync.Mutex
+	families  map[string]*family
+}
+
+// NewPrometheus creates a collector with metric names prefixed by the namespace (DefaultNamespace if empty)
+func NewPrometheus(namespace string) *Prometheus {
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+	p := &Prometheus{namespace: namespace, families: make(map[string]*family)}
+	p.define("updates_received_total", "Updates received from Telegram by type.", counter, nil, "type")
+	p.define("open_conversations", "Number of open conversations.", gauge, nil)
+	p.define("max_open_conversations", "The maximum number of open conversations.", gauge, nil)
+	p.define("updates_rejected_total", "Updates dropped because of full queues by reason.", counter, nil, "reason")
+	p.define("handler_duration_seconds", "Duration of handlers including waiting for users.", histogram, handlerBuckets, "handler")
+	p.define("handler_errors_total", "Handlers finished with an error.", counter, nil, "handler")
+	p.define("step_transitions_total", "Transitions between steps of handlers, from is -1 for the first step.", counter, nil, "handler", "from", "to")
+	p.define("api_request_duration_seconds", "Latency of Bot API calls by method.", histogram, apiBuckets, "method")
+	p.define("api_errors_total", "Failed Bot API calls by method.", counter, nil, "method")
+	p.define("job_runs_total", "Runs of jobs by outcome.", counter, nil, "job", "outcome")
+	p.define("job_duration_seconds", "Duration of job runs.", histogram, jobBuckets, "job")
+	return p
+}
+
+func (p *Prometheus) define(name, help, kind string, buckets []float64, labels ...string) {
+	p.families[name] = &family{
+		name:    p.namespace + "_" + name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*series),
+	}
+}
+
+func (p *Prometheus) add(name string, delta float64, labelValues ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.families[name].get(labelValues).value += delta
+}
+
+func (p *Prometheus) set(name string, value float64, labelValues ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.families[name].get(labelValues).value = value
+}
+
+func (p *Prometheus) observe(name string, duration time.Duration, labelValues ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f := p.families[name]
+	s := f.get(labelValues)
+	seconds := duration.Seconds()
+	for i, bound := range f.buckets {
+		if seconds <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += seconds
+	s.count++
+}
+
+func (p *Prometheus) UpdateReceived(updateType string) {
+	p.add("updates_received_total", 1, updateType)
+}
+
+func (p *Prometheus) OpenConversations(open, max int) {
+	p.set("open_conversations", float64(open))
+	p.set("max_open_conversations", float64(max))
+}
+
+func (p *Prometheus) UpdateRejected(reason string) {
+	p.add("updates_rejected_total", 1, reason)
+}
+
+func (p *Prometheus) HandlerFinished(handler string, duration time.Duration, err error) {
+	p.observe("handler_duration_seconds", duration, handler)
+	if err != nil {
+		p.add("handler_errors_total", 1, handler)
+	}
+}
+
+func (p *Prometheus) StepTransition(handler string, from, to int) {
+	p.add("step_transitions_total", 1, handler, strconv.Itoa(from), strconv.Itoa(to))
+}
+
+func (p *Prometheus) APICall(method string, duration time.Duration, err error) {
+	p.observe("api_request_duration_seconds", duration, method)
+	if err != nil {
+		p.add("api_errors_total", 1, method)
+	}
+}
+
+func (p *Prometheus) JobRun(job string, outcome string, duration time.Duration) {
+	p.add("job_runs_total", 1, job, outcome)
+	if outcome != JobSkipped {
+		p.observe("job_duration_seconds", duration, job)
+	}
+}
+
+// ServeHTTP writes all metrics in the Prometheus text format
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := bufio.NewWriter(w)
+	p.write(out)
+	out.Flush()
+}
+
+// write writes families ordered by name and series ordered by label values
+func (p *Prometheus) write(out *bufio.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	names := make([]string, 0, len(p.families))
+	for name := range p.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := p.families[name]
+		fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		keys := make([]string, 0, len(f.series))
+		for key := range f.series {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s := f.series[key]
+			if f.kind != histogram {
+				fmt.Fprintf(out, "%s%s %s\n", f.name, formatLabels(f.labels, s.labelValues, ""), formatFloat(s.value))
+				continue
+			}
+			var cumulative uint64
+			for i, bound := range f.buckets {
+				cumulative += s.counts[i]
+				fmt.Fprintf(out, "%s_bucket%s %d\n", f.name, formatLabels(f.labels, s.labelValues, formatFloat(bound)), cumulative)
+			}
+			fmt.Fprintf(out, "%s_bucket%s %d\n", f.name, formatLabels(f.labels, s.labelValues, "+Inf"), s.count)
+			fmt.Fprintf(out, "%s_sum%s %s\n", f.name, formatLabels(f.labels, s.labelValues, ""), formatFloat(s.sum))
+			fmt.Fprintf(out, "%s_count%s %d\n", f.name, formatLabels(f.labels, s.labelValues, ""), s.count)
+		}
+	}
+}
+
+// formatLabels formats labels as {name="value",...}, le is added for histogram buckets if it is not empty
+func formatLabels(names, values []string, le string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, escapeLabel(values[i])))
+	}
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf(`le="%s"`, le))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
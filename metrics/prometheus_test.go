@@ -0,0 +1,118 @@
+package metrics_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ufy-it/go-telegram-bot/metrics"
+)
+
+func scrape(t *testing.T, handler http.Handler) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("unexpected response %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	return w.Body.String()
+}
+
+func expectLines(t *testing.T, text string, lines ...string) {
+	t.Helper()
+	for _, line := range lines {
+		if !strings.Contains(text, line+"\n") {
+			t.Errorf("expected line '%s' in\n%s", line, text)
+		}
+	}
+}
+
+func TestPrometheusExport(t *testing.T) {
+	p := metrics.NewPrometheus("")
+	p.UpdateReceived("message")
+	p.UpdateReceived("message")
+	p.UpdateReceived("callback_query")
+	p.OpenConversations(3, 1000)
+	p.UpdateRejected(metrics.QueueFull)
+	p.HandlerFinished("start", 2*time.Second, nil)
+	p.HandlerFinished("start", 20*time.Second, errors.New("failure"))
+	p.StepTransition("start", -1, 0)
+	p.APICall("sendMessage", 30*time.Millisecond, nil)
+	p.JobRun("report", metrics.JobTimedOut, time.Minute)
+	p.JobRun("report", metrics.JobSkipped, 0)
+	p.JobRun(`a "quoted"\job`, metrics.JobSucceeded, time.Second)
+
+	expectLines(t, scrape(t, p),
+		"# HELP telegram_bot_updates_received_total Updates received from Telegram by type.",
+		"# TYPE telegram_bot_updates_received_total counter",
+		`telegram_bot_updates_received_total{type="callback_query"} 1`,
+		`telegram_bot_updates_received_total{type="message"} 2`,
+		"# TYPE telegram_bot_open_conversations gauge",
+		"telegram_bot_open_conversations 3",
+		"telegram_bot_max_open_conversations 1000",
+		`telegram_bot_updates_rejected_total{reason="queue_full"} 1`,
+		"# TYPE telegram_bot_handler_duration_seconds histogram",
+		`telegram_bot_handler_duration_seconds_bucket{handler="start",le="1"} 0`,
+		`telegram_bot_handler_duration_seconds_bucket{handler="start",le="5"} 1`,
+		`telegram_bot_handler_duration_seconds_bucket{handler="start",le="60"} 2`,
+		`telegram_bot_handler_duration_seconds_bucket{handler="start",le="+Inf"} 2`,
+		`telegram_bot_handler_duration_seconds_sum{handler="start"} 22`,
+		`telegram_bot_handler_duration_seconds_count{handler="start"} 2`,
+		`telegram_bot_handler_errors_total{handler="start"} 1`,
+		`telegram_bot_step_transitions_total{handler="start",from="-1",to="0"} 1`,
+		`telegram_bot_api_request_duration_seconds_bucket{method="sendMessage",le="0.05"} 1`,
+		`telegram_bot_job_runs_total{job="report",outcome="skipped"} 1`,
+		`telegram_bot_job_runs_total{job="report",outcome="timeout"} 1`,
+		`telegram_bot_job_duration_seconds_count{job="report"} 1`,
+		`telegram_bot_job_runs_total{job="a \"quoted\"\\job",outcome="success"} 1`,
+	)
+}
+
+func TestPrometheusNamespace(t *testing.T) {
+	p := metrics.NewPrometheus("shop_bot")
+	p.UpdateReceived("message")
+	text := scrape(t, p)
+	expectLines(t, text, `shop_bot_updates_received_total{type="message"} 1`)
+	if strings.Contains(text, metrics.DefaultNamespace) {
+		t.Errorf("unexpected default namespace in\n%s", text)
+	}
+}
+
+type recordingCollector struct {
+	metrics.NopCollector
+	calls []string
+	errs  []error
+}
+
+func (c *recordingCollector) APICall(method string, duration time.Duration, err error) {
+	c.calls = append(c.calls, method)
+	c.errs = append(c.errs, err)
+}
+
+func TestHTTPClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/sendMessage") {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+	collector := &recordingCollector{}
+	client := metrics.NewHTTPClient(server.Client(), collector)
+	for _, method := range []string{"getMe", "sendMessage"} {
+		req, _ := http.NewRequest("POST", server.URL+"/bottoken/"+method, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if len(collector.calls) != 2 || collector.calls[0] != "getMe" || collector.calls[1] != "sendMessage" {
+		t.Errorf("unexpected methods %v", collector.calls)
+	}
+	if collector.errs[0] != nil || collector.errs[1] == nil {
+		t.Errorf("unexpected errors %v", collector.errs)
+	}
+}
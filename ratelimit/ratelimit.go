@@ -0,0 +1,326 @@
+// Package ratelimit throttles outgoing Bot API calls to stay within Telegram flood limits
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/ufy-it/go-telegram-bot/botapi"
+	"github.com/ufy-it/go-telegram-bot/logger"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Config describes limits for outgoing Bot API calls
+type Config struct {
+	GlobalRate      float64 // calls per second to all chats
+	PrivateChatRate float64 // messages per second to a private chat
+	GroupChatRate   float64 // messages per second to a group or a channel
+	Burst           int     // number of messages a chat can get at once before the per-chat rate applies
+	MaxFloodWaits   int     // how many times a call that hit the flood limit is repeated after waiting for retry_after
+}
+
+// DefaultConfig returns limits recommended by Telegram: 30 messages per second in total,
+// 1 message per second to a private chat and 20 messages per minute to a group
+func DefaultConfig() Config {
+	return Config{
+		GlobalRate:      30,
+		PrivateChatRate: 1,
+		GroupChatRate:   20.0 / 60.0,
+		Burst:           3,
+		MaxFloodWaits:   3,
+	}
+}
+
+// maxIdleBuckets is the number of per-chat buckets after which buckets of idle chats are dropped
+const maxIdleBuckets = 10000
+
+// bucket is a token bucket that allows to take tokens in advance, so that callers wait in the order of arrival
+type bucket struct {
+	rate   float64   // tokens per second
+	burst  float64   // maximum number of tokens
+	tokens float64   // available tokens, negative if tokens are reserved in advance
+	last   time.Time // time when tokens were updated
+}
+
+func newBucket(rate float64, burst int, now time.Time) *bucket {
+	return &bucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+// refill adds tokens accumulated since the last update
+func (b *bucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// reserve takes a token and returns the time to wait before it can be used
+func (b *bucket) reserve(now time.Time) time.Duration {
+	b.refill(now)
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// pause takes all tokens, so that the next token becomes available after the delay
+func (b *bucket) pause(now time.Time, delay time.Duration) {
+	b.refill(now)
+	b.tokens = math.Min(b.tokens, 1-delay.Seconds()*b.rate)
+}
+
+// idle returns true if the bucket is full, so it can be recreated without changing limits
+func (b *bucket) idle(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// Limiter is a botapi.Bot that delays calls to stay within the limits, and repeats calls rejected by Telegram
+// with 429 Too Many Requests after the time from retry_after. Callers block until their call is made,
+// SendContext and RequestContext stop waiting when the context is closed
+type Limiter struct {
+	botapi.Bot
+	config Config
+
+	mu     sync.Mutex
+	global *bucket
+	chats  map[int64]*bucket
+}
+
+// NewLimiter creates a Limiter that makes calls through the bot. Zero limits in the config are replaced with defaults
+func NewLimiter(bot botapi.Bot, config Config) *Limiter {
+	defaults := DefaultConfig()
+	if config.GlobalRate <= 0 {
+		config.GlobalRate = defaults.GlobalRate
+	}
+	if config.PrivateChatRate <= 0 {
+		config.PrivateChatRate = defaults.PrivateChatRate
+	}
+	if config.GroupChatRate <= 0 {
+		config.GroupChatRate = defaults.GroupChatRate
+	}
+	if config.Burst <= 0 {
+		config.Burst = 1
+	}
+	return &Limiter{
+		Bot:    bot,
+		config: config,
+		global: newBucket(config.GlobalRate, int(math.Max(1, config.GlobalRate)), time.Now()),
+		chats:  make(map[int64]*bucket),
+	}
+}
+
+// Send sends a message when the limits allow it
+func (l *Limiter) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	return l.SendContext(context.Background(), c)
+}
+
+// SendContext sends a message when the limits allow it, or returns the error of the context if it is closed earlier
+func (l *Limiter) SendContext(ctx context.Context, c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	var message tgbotapi.Message
+	err := l.do(ctx, c, func() (err error) {
+		message, err = botapi.SendWithContext(ctx, l.Bot, c)
+		return err
+	})
+	return message, err
+}
+
+// Request makes a call when the limits allow it
+func (l *Limiter) Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	return l.RequestContext(context.Background(), c)
+}
+
+// RequestContext makes a call when the limits allow it, or returns the error of the context if it is closed earlier
+func (l *Limiter) RequestContext(ctx context.Context, c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	var response *tgbotapi.APIResponse
+	err := l.do(ctx, c, func() (err error) {
+		response, err = botapi.RequestWithContext(ctx, l.Bot, c)
+		return err
+	})
+	return response, err
+}
+
+// do makes the call when the limits allow it, and repeats it while Telegram asks to retry after a delay.
+// The global token is taken after the wait for the chat, so that calls delayed by their chats do not hold the global rate
+func (l *Limiter) do(ctx context.Context, c tgbotapi.Chattable, call func() error) error {
+	chatID, toChat := messageChatID(c)
+	for attempt := 0; ; attempt++ {
+		if toChat {
+			if err := sleep(ctx, l.reserveChat(chatID)); err != nil {
+				return err
+			}
+		}
+		if err := sleep(ctx, l.reserveGlobal()); err != nil {
+			return err
+		}
+		err := call()
+		var apiErr *tgbotapi.Error
+		if !errors.As(err, &apiErr) || apiErr.Code != http.StatusTooManyRequests || apiErr.RetryAfter <= 0 || attempt >= l.config.MaxFloodWaits {
+			return err
+		}
+		logger.Warning("flood limit exceeded for chat %d, retrying in %d seconds", chatID, apiErr.RetryAfter)
+		l.pause(chatID, toChat, time.Duration(apiErr.RetryAfter)*time.Second)
+	}
+}
+
+// reserveChat takes a token of the chat and returns the time to wait before the call can take the global token
+func (l *Limiter) reserveChat(chatID int64) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	return l.chatBucket(chatID, now).reserve(now)
+}
+
+// reserveGlobal takes a global token and returns the time to wait before making the call
+func (l *Limiter) reserveGlobal() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.global.reserve(time.Now())
+}
+
+// sleep waits for the delay, returns the error of the context if it is closed earlier
+func sleep(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// pause stops calls to the chat, or all calls if the call was not addressed to a chat, for the delay
+func (l *Limiter) pause(chatID int64, toChat bool, delay time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if toChat {
+		l.chatBucket(chatID, now).pause(now, delay)
+	} else {
+		l.global.pause(now, delay)
+	}
+}
+
+// chatBucket returns bucket of the chat, should be called under the lock
+func (l *Limiter) chatBucket(chatID int64, now time.Time) *bucket {
+	if b, ok := l.chats[chatID]; ok {
+		return b
+	}
+	if len(l.chats) >= maxIdleBuckets {
+		for id, b := range l.chats {
+			if b.idle(now) {
+				delete(l.chats, id)
+			}
+		}
+	}
+	rate := l.config.PrivateChatRate
+	if chatID < 0 {
+		rate = l.config.GroupChatRate
+	}
+	b := newBucket(rate, l.config.Burst, now)
+	l.chats[chatID] = b
+	return b
+}
+
+// messageChatID returns the chat of a call that sends a new message. Edits, deletes and answers to queries
+// are not new messages, so only the global limit applies to them
+func messageChatID(c tgbotapi.Chattable) (int64, bool) {
+	var base tgbotapi.BaseChat
+	switch config := c.(type) {
+	case tgbotapi.MessageConfig:
+		base = config.BaseChat
+	case tgbotapi.PhotoConfig:
+		base = config.BaseChat
+	case tgbotapi.DocumentConfig:
+		base = config.BaseChat
+	case tgbotapi.AudioConfig:
+		base = config.BaseChat
+	case tgbotapi.VideoConfig:
+		base = config.BaseChat
+	case tgbotapi.AnimationConfig:
+		base = config.BaseChat
+	case tgbotapi.VoiceConfig:
+		base = config.BaseChat
+	case tgbotapi.VideoNoteConfig:
+		base = config.BaseChat
+	case tgbotapi.StickerConfig:
+		base = config.BaseChat
+	case tgbotapi.LocationConfig:
+		base = config.BaseChat
+	case tgbotapi.VenueConfig:
+		base = config.BaseChat
+	case tgbotapi.ContactConfig:
+		base = config.BaseChat
+	case tgbotapi.SendPollConfig:
+		base = config.BaseChat
+	case tgbotapi.DiceConfig:
+		base = config.BaseChat
+	case tgbotapi.ForwardConfig:
+		base = config.BaseChat
+	case tgbotapi.CopyMessageConfig:
+		base = config.BaseChat
+	case tgbotapi.InvoiceConfig:
+		base = config.BaseChat
+	case tgbotapi.GameConfig:
+		base = config.BaseChat
+	case tgbotapi.MediaGroupConfig:
+		return config.ChatID, config.ChatID != 0
+	case tgbotapi.EditMessageTextConfig, tgbotapi.EditMessageCaptionConfig, tgbotapi.EditMessageMediaConfig,
+		tgbotapi.EditMessageReplyMarkupConfig, tgbotapi.DeleteMessageConfig, tgbotapi.CallbackConfig, tgbotapi.InlineConfig:
+		return 0, false
+	default:
+		return reflectChatID(c)
+	}
+	return base.ChatID, base.ChatID != 0
+}
+
+// reflectChatID looks for the chat of a call of a type unknown to messageChatID, e.g. a config wrapped into another struct
+func reflectChatID(c tgbotapi.Chattable) (int64, bool) {
+	v := reflect.ValueOf(c)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return 0, false
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return 0, false
+	}
+	base, ok := findBaseChat(v)
+	if !ok || base.ChatID == 0 {
+		return 0, false
+	}
+	return base.ChatID, true
+}
+
+// findBaseChat looks for tgbotapi.BaseChat embedded into a config directly or through another embedded struct (e.g. BaseFile) or interface
+func findBaseChat(v reflect.Value) (tgbotapi.BaseChat, bool) {
+	for i := 0; i < v.NumField(); i++ {
+		if !v.Type().Field(i).Anonymous {
+			continue
+		}
+		embedded := v.Field(i)
+		if embedded.Kind() == reflect.Interface && !embedded.IsNil() { // e.g. a message wrapped by conversation.ThreadMessage
+			embedded = embedded.Elem()
+		}
+		if embedded.Kind() != reflect.Struct {
+			continue
+		}
+		if base, ok := embedded.Interface().(tgbotapi.BaseChat); ok {
+			return base, true
+		}
+		if base, ok := findBaseChat(embedded); ok {
+			return base, true
+		}
+	}
+	return tgbotapi.BaseChat{}, false
+}
@@ -0,0 +1,141 @@
+package ratelimit_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ufy-it/go-telegram-bot/conversation"
+	"github.com/ufy-it/go-telegram-bot/ratelimit"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// floodBot records time of calls and rejects the first floodErrors calls with 429
+type floodBot struct {
+	mu          sync.Mutex
+	calls       []time.Time
+	floodErrors int
+}
+
+func (b *floodBot) call() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls = append(b.calls, time.Now())
+	if b.floodErrors > 0 {
+		b.floodErrors--
+		return &tgbotapi.Error{Code: http.StatusTooManyRequests, Message: "Too Many Requests", ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 1}}
+	}
+	return nil
+}
+
+func (b *floodBot) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	return tgbotapi.Message{MessageID: 1}, b.call()
+}
+
+func (b *floodBot) Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	return &tgbotapi.APIResponse{Ok: true}, b.call()
+}
+
+func (b *floodBot) GetFile(config tgbotapi.FileConfig) (tgbotapi.File, error) {
+	return tgbotapi.File{}, nil
+}
+
+func (b *floodBot) GetFileDirectURL(fileID string) (string, error) {
+	return "", nil
+}
+
+func TestPerChatLimit(t *testing.T) {
+	bot := &floodBot{}
+	limiter := ratelimit.NewLimiter(bot, ratelimit.Config{GlobalRate: 1000, PrivateChatRate: 10, GroupChatRate: 5, Burst: 2})
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		if _, err := limiter.Send(tgbotapi.NewMessage(1, "text")); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	// two messages go at once, two more wait 100ms each
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond || elapsed > time.Second {
+		t.Errorf("unexpected time of 4 messages to a private chat: %v", elapsed)
+	}
+
+	start = time.Now()
+	limiter.Send(tgbotapi.NewMessage(2, "text"))
+	limiter.Send(tgbotapi.NewPhoto(3, tgbotapi.FileID("photo")))
+	limiter.Request(tgbotapi.NewEditMessageText(1, 1, "edit")) // edits do not count as new messages
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("messages to other chats and edits should not wait, waited %v", elapsed)
+	}
+
+	start = time.Now()
+	for i := 0; i < 3; i++ {
+		limiter.Send(conversation.PostToThread(tgbotapi.NewMessage(-100, "text"), 5)) // messages to forum topics count for their chats
+	}
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond {
+		t.Errorf("expected group limit to delay the third message, waited %v", elapsed)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	bot := &floodBot{floodErrors: 1}
+	limiter := ratelimit.NewLimiter(bot, ratelimit.Config{MaxFloodWaits: 1})
+
+	if _, err := limiter.Send(tgbotapi.NewMessage(1, "text")); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(bot.calls) != 2 || bot.calls[1].Sub(bot.calls[0]) < 900*time.Millisecond {
+		t.Errorf("expected the message to be repeated after retry_after, calls %v", bot.calls)
+	}
+
+	bot.floodErrors = 2
+	calls := len(bot.calls)
+	_, err := limiter.Send(tgbotapi.NewMessage(1, "text"))
+	if apiErr, ok := err.(*tgbotapi.Error); !ok || apiErr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected flood error after the last wait, got %v", err)
+	}
+	if len(bot.calls)-calls != 2 {
+		t.Errorf("expected the message to be repeated once, got %d calls", len(bot.calls)-calls)
+	}
+}
+
+func TestWaitingCalls(t *testing.T) {
+	bot := &floodBot{}
+	limiter := ratelimit.NewLimiter(bot, ratelimit.Config{GlobalRate: 2, PrivateChatRate: 1, Burst: 1})
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		go func() {
+			_, err := limiter.SendContext(ctx, tgbotapi.NewMessage(1, "text"))
+			errs <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	if _, err := limiter.Send(tgbotapi.NewMessage(2, "text")); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("calls waiting for their chat should not take the global rate, waited %v", elapsed)
+	}
+
+	cancel()
+	canceled := 0
+	for i := 0; i < 5; i++ {
+		select {
+		case err := <-errs:
+			if errors.Is(err, context.Canceled) {
+				canceled++
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("waiting calls should return when the context is closed")
+		}
+	}
+	if canceled != 4 {
+		t.Errorf("expected 4 calls to be canceled, got %d", canceled)
+	}
+}
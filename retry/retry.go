@@ -0,0 +1,221 @@
+// Package retry repeats outgoing Bot API calls that failed with transient errors
+package retry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/ufy-it/go-telegram-bot/botapi"
+	"github.com/ufy-it/go-telegram-bot/logger"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// ErrorClass is a set of flags that describe kinds of transient errors
+type ErrorClass int
+
+const (
+	NetworkError ErrorClass = 1 << iota // connection to the Bot API failed
+	Timeout                             // the call timed out, Telegram may have processed it
+	ServerError                         // the Bot API answered with 5xx or with a response that is not JSON (e.g. a proxy error page)
+)
+
+// DuplicateHookType is a type of function that is called when a call that sends a message was repeated after
+// an ambiguous error (a timeout, a broken connection or a 5xx answer) and succeeded, so the user may have got the message twice
+type DuplicateHookType func(c tgbotapi.Chattable, message tgbotapi.Message, cause error)
+
+// Policy describes which calls are repeated and how long to wait between attempts
+type Policy struct {
+	RetryOn        ErrorClass        // classes of errors to repeat calls on
+	MaxAttempts    int               // maximum number of attempts including the first one
+	InitialBackoff time.Duration     // delay before the second attempt, each next delay is twice longer
+	MaxBackoff     time.Duration     // maximum delay between attempts
+	Jitter         float64           // fraction of a delay (from 0 to 1) that is randomized to spread attempts of different calls
+	OnDuplicate    DuplicateHookType // function to call on a possible duplicate message, can be nil
+}
+
+// DefaultPolicy returns a policy that makes up to 3 attempts on network and server errors with delays from 0.5 to 5 seconds.
+// Timeouts are not repeated by default, as Telegram may have already sent the message
+func DefaultPolicy() Policy {
+	return Policy{
+		RetryOn:        NetworkError | ServerError,
+		MaxAttempts:    3,
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     5 * time.Second,
+		Jitter:         0.2,
+	}
+}
+
+// Classify returns class of a transient error, or 0 if the error is not transient
+func Classify(err error) ErrorClass {
+	if err == nil {
+		return 0
+	}
+	var apiErr *tgbotapi.Error
+	if errors.As(err, &apiErr) {
+		if apiErr.Code >= 500 {
+			return ServerError
+		}
+		return 0
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return Timeout
+	}
+	var urlErr *url.Error
+	var opErr *net.OpError
+	if errors.As(err, &urlErr) || errors.As(err, &opErr) {
+		return NetworkError
+	}
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return ServerError
+	}
+	return 0
+}
+
+// ambiguous returns true if the call could reach Telegram before the error, so Telegram may have processed it.
+// A server error is ambiguous too, as a proxy or an overloaded Bot API server can fail after the message is sent
+func ambiguous(err error) bool {
+	if class := Classify(err); class == Timeout || class == ServerError {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return false // the request was not sent
+	}
+	return Classify(err) == NetworkError
+}
+
+// idempotent returns true for calls that do not send a new message, so repeating them is harmless
+func idempotent(c tgbotapi.Chattable) bool {
+	switch c.(type) {
+	case tgbotapi.EditMessageTextConfig, tgbotapi.EditMessageCaptionConfig, tgbotapi.EditMessageMediaConfig,
+		tgbotapi.EditMessageReplyMarkupConfig, tgbotapi.EditMessageLiveLocationConfig, tgbotapi.StopMessageLiveLocationConfig,
+		tgbotapi.DeleteMessageConfig, tgbotapi.CallbackConfig, tgbotapi.InlineConfig:
+		return true
+	}
+	return false
+}
+
+// Retrier is a botapi.Bot that repeats calls failed with transient errors according to the policy.
+// Callers block until the last attempt is made, SendContext and RequestContext stop waiting when the context is closed
+type Retrier struct {
+	botapi.Bot
+	policy Policy
+}
+
+// NewRetrier creates a Retrier that makes calls through the bot. Zero attempts and delays in the policy are replaced with defaults
+func NewRetrier(bot botapi.Bot, policy Policy) *Retrier {
+	defaults := DefaultPolicy()
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = defaults.MaxAttempts
+	}
+	if policy.InitialBackoff <= 0 {
+		policy.InitialBackoff = defaults.InitialBackoff
+	}
+	if policy.MaxBackoff < policy.InitialBackoff {
+		policy.MaxBackoff = policy.InitialBackoff
+	}
+	policy.Jitter = math.Max(0, math.Min(1, policy.Jitter))
+	return &Retrier{Bot: bot, policy: policy}
+}
+
+// Send sends a message, and repeats the call on transient errors
+func (r *Retrier) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	return r.SendContext(context.Background(), c)
+}
+
+// SendContext sends a message, and repeats the call on transient errors until the context is closed
+func (r *Retrier) SendContext(ctx context.Context, c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	var message tgbotapi.Message
+	cause := r.do(ctx, func() (err error) {
+		message, err = botapi.SendWithContext(ctx, r.Bot, c)
+		return err
+	})
+	if cause.last == nil && cause.ambiguous != nil && !idempotent(c) && r.policy.OnDuplicate != nil {
+		r.policy.OnDuplicate(c, message, cause.ambiguous)
+	}
+	return message, cause.last
+}
+
+// Request makes a call, and repeats it on transient errors
+func (r *Retrier) Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	return r.RequestContext(context.Background(), c)
+}
+
+// RequestContext makes a call, and repeats it on transient errors until the context is closed
+func (r *Retrier) RequestContext(ctx context.Context, c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	var response *tgbotapi.APIResponse
+	cause := r.do(ctx, func() (err error) {
+		response, err = botapi.RequestWithContext(ctx, r.Bot, c)
+		return err
+	})
+	return response, cause.last
+}
+
+// GetFile gets file info, and repeats the call on transient errors
+func (r *Retrier) GetFile(config tgbotapi.FileConfig) (tgbotapi.File, error) {
+	var file tgbotapi.File
+	cause := r.do(context.Background(), func() (err error) {
+		file, err = r.Bot.GetFile(config)
+		return err
+	})
+	return file, cause.last
+}
+
+// GetFileDirectURL gets direct URL to the file, and repeats the call on transient errors
+func (r *Retrier) GetFileDirectURL(fileID string) (string, error) {
+	var link string
+	cause := r.do(context.Background(), func() (err error) {
+		link, err = r.Bot.GetFileDirectURL(fileID)
+		return err
+	})
+	return link, cause.last
+}
+
+// attemptErrors is a result of attempts of a call
+type attemptErrors struct {
+	last      error // error of the last attempt, nil if the call succeeded
+	ambiguous error // the first error after which Telegram may have processed the call, nil if there were no such errors
+}
+
+// do makes attempts of the call while it fails with errors of the policy classes.
+// If the context is closed during a delay, the error of the context is returned as the error of the last attempt
+func (r *Retrier) do(ctx context.Context, call func() error) attemptErrors {
+	var result attemptErrors
+	for attempt := 1; ; attempt++ {
+		result.last = call()
+		class := Classify(result.last)
+		if class&r.policy.RetryOn == 0 || attempt >= r.policy.MaxAttempts {
+			return result
+		}
+		if result.ambiguous == nil && ambiguous(result.last) {
+			result.ambiguous = result.last
+		}
+		delay := r.backoff(attempt)
+		logger.Warning("transient error in a call to the Bot API (attempt %d of %d), retrying in %v: %v", attempt, r.policy.MaxAttempts, delay, result.last)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			result.last = ctx.Err()
+			return result
+		}
+	}
+}
+
+// backoff returns delay after the attempt
+func (r *Retrier) backoff(attempt int) time.Duration {
+	delay := float64(r.policy.InitialBackoff) * math.Pow(2, float64(attempt-1))
+	delay = math.Min(delay, float64(r.policy.MaxBackoff))
+	delay -= delay * r.policy.Jitter * rand.Float64()
+	return time.Duration(delay)
+}
@@ -0,0 +1,174 @@
+package retry_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ufy-it/go-telegram-bot/retry"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// timeoutError is a net.Error that reports a timeout
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// failingBot returns errors from the list, and succeeds when the list is over
+type failingBot struct {
+	errs  []error
+	calls int
+}
+
+func (b *failingBot) next() error {
+	b.calls++
+	if len(b.errs) == 0 {
+		return nil
+	}
+	err := b.errs[0]
+	b.errs = b.errs[1:]
+	return err
+}
+
+func (b *failingBot) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	err := b.next()
+	return tgbotapi.Message{MessageID: b.calls}, err
+}
+
+func (b *failingBot) Request(c tgbotapi.Chattable) (*tgbotapi.APIResponse, error) {
+	return &tgbotapi.APIResponse{Ok: true}, b.next()
+}
+
+func (b *failingBot) GetFile(config tgbotapi.FileConfig) (tgbotapi.File, error) {
+	return tgbotapi.File{}, b.next()
+}
+
+func (b *failingBot) GetFileDirectURL(fileID string) (string, error) {
+	return "", b.next()
+}
+
+func testPolicy() retry.Policy {
+	return retry.Policy{
+		RetryOn:        retry.NetworkError | retry.ServerError | retry.Timeout,
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     5 * time.Millisecond,
+		Jitter:         0.5,
+	}
+}
+
+func TestClassify(t *testing.T) {
+	for _, test := range []struct {
+		err   error
+		class retry.ErrorClass
+	}{
+		{nil, 0},
+		{errors.New("some error"), 0},
+		{&tgbotapi.Error{Code: 502, Message: "Bad Gateway"}, retry.ServerError},
+		{&tgbotapi.Error{Code: 403, Message: "Forbidden: bot was blocked by the user"}, 0},
+		{&url.Error{Op: "Post", URL: "https://api.telegram.org", Err: errors.New("connection reset by peer")}, retry.NetworkError},
+		{&url.Error{Op: "Post", URL: "https://api.telegram.org", Err: timeoutError{}}, retry.Timeout},
+	} {
+		if class := retry.Classify(test.err); class != test.class {
+			t.Errorf("unexpected class of %v: %d, expected %d", test.err, class, test.class)
+		}
+	}
+}
+
+func TestRetrier(t *testing.T) {
+	bot := &failingBot{errs: []error{&tgbotapi.Error{Code: 500}, &tgbotapi.Error{Code: 502}}}
+	if _, err := retry.NewRetrier(bot, testPolicy()).Send(tgbotapi.NewMessage(1, "text")); err != nil || bot.calls != 3 {
+		t.Errorf("expected success after 3 attempts, got %v after %d", err, bot.calls)
+	}
+
+	bot = &failingBot{errs: []error{&tgbotapi.Error{Code: 500}, &tgbotapi.Error{Code: 500}, &tgbotapi.Error{Code: 500}}}
+	if _, err := retry.NewRetrier(bot, testPolicy()).Request(tgbotapi.NewDeleteMessage(1, 1)); err == nil || bot.calls != 3 {
+		t.Errorf("expected error after 3 attempts, got %v after %d", err, bot.calls)
+	}
+
+	bot = &failingBot{errs: []error{&tgbotapi.Error{Code: 400, Message: "Bad Request: message is not modified"}}}
+	if _, err := retry.NewRetrier(bot, testPolicy()).Send(tgbotapi.NewEditMessageText(1, 1, "text")); err == nil || bot.calls != 1 {
+		t.Errorf("expected client error without repeating, got %v after %d", err, bot.calls)
+	}
+
+	policy := testPolicy()
+	policy.RetryOn = retry.ServerError
+	bot = &failingBot{errs: []error{&url.Error{Op: "Post", Err: timeoutError{}}}}
+	if _, err := retry.NewRetrier(bot, policy).Send(tgbotapi.NewMessage(1, "text")); err == nil || bot.calls != 1 {
+		t.Errorf("expected timeout without repeating, got %v after %d", err, bot.calls)
+	}
+}
+
+func TestDuplicateHook(t *testing.T) {
+	var duplicates []int
+	policy := testPolicy()
+	policy.OnDuplicate = func(c tgbotapi.Chattable, message tgbotapi.Message, cause error) {
+		duplicates = append(duplicates, message.MessageID)
+	}
+
+	bot := &failingBot{errs: []error{&url.Error{Op: "Post", Err: timeoutError{}}}}
+	retrier := retry.NewRetrier(bot, policy)
+	if _, err := retrier.Send(tgbotapi.NewMessage(1, "text")); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if len(duplicates) != 1 || duplicates[0] != 2 {
+		t.Errorf("expected a possible duplicate with ID 2, got %v", duplicates)
+	}
+
+	bot.errs = []error{&url.Error{Op: "Post", Err: timeoutError{}}}
+	retrier.Send(tgbotapi.NewEditMessageText(1, 1, "text")) // repeated edits are harmless
+	bot.errs = []error{&url.Error{Op: "Post", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}}
+	retrier.Send(tgbotapi.NewMessage(1, "text")) // Telegram did not get the message
+	if len(duplicates) != 1 {
+		t.Errorf("unexpected duplicates %v", duplicates)
+	}
+}
+
+func TestDuplicateHookOnServerErrors(t *testing.T) {
+	var duplicates []int
+	policy := testPolicy()
+	policy.OnDuplicate = func(c tgbotapi.Chattable, message tgbotapi.Message, cause error) {
+		duplicates = append(duplicates, message.MessageID)
+	}
+	bot := &failingBot{errs: []error{&tgbotapi.Error{Code: 502, Message: "Bad Gateway"}}}
+	retrier := retry.NewRetrier(bot, policy)
+	if _, err := retrier.Send(tgbotapi.NewPhoto(1, tgbotapi.FileID("photo"))); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+	if len(duplicates) != 1 || duplicates[0] != 2 {
+		t.Errorf("expected a possible duplicate with ID 2 after a server error, got %v", duplicates)
+	}
+
+	bot.errs = []error{&tgbotapi.Error{Code: 500}}
+	retrier.Send(tgbotapi.NewEditMessageText(1, 1, "text")) // repeated edits are harmless
+	if len(duplicates) != 1 {
+		t.Errorf("unexpected duplicates %v", duplicates)
+	}
+}
+
+func TestRetrierStopsWithContext(t *testing.T) {
+	bot := &failingBot{errs: []error{&url.Error{Op: "Post", Err: errors.New("connection reset")}}}
+	policy := testPolicy()
+	policy.InitialBackoff = time.Hour
+	policy.MaxBackoff = time.Hour
+	retrier := retry.NewRetrier(bot, policy)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := retrier.SendContext(ctx, tgbotapi.NewMessage(1, "text")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the error of the context, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("the retrier should stop waiting when the context is closed")
+	}
+	if bot.calls != 1 {
+		t.Errorf("expected 1 attempt, got %d", bot.calls)
+	}
+}
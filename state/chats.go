@@ -0,0 +1,190 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ufy-it/go-telegram-bot/logger"
+)
+
+// ChatInfo is a record about a chat that talked to the bot
+type ChatInfo struct {
+	ChatID       int64     `json:"chat_id"`
+	Type         string    `json:"type"`                    // "private", "group", "supergroup" or "channel"
+	UserName     string    `json:"username,omitempty"`      // username of the user or of the public group
+	LanguageCode string    `json:"language_code,omitempty"` // language of the user, for private chats only
+	FirstSeen    time.Time `json:"first_seen"`              // time of the first update from the chat
+	LastSeen     time.Time `json:"last_seen"`               // time of the latest update from the chat
+	Blocked      bool      `json:"blocked,omitempty"`       // the user blocked the bot or the bot was removed from the chat
+}
+
+// ChatFilterType is a type of function that selects chats from the registry
+type ChatFilterType func(chat ChatInfo) bool
+
+// ChatRegistry is an interface for an object that records chats that talked to the bot
+type ChatRegistry interface {
+	SeeChat(chat ChatInfo) error                           // records an update from the chat: creates a record or updates LastSeen and the chat details, FirstSeen and Blocked are kept
+	GetChat(chatID int64) (ChatInfo, bool)                 // returns record about the chat, false if the chat is unknown
+	GetChats(filter ChatFilterType) ([]ChatInfo, error)    // returns records that match the filter (all records if the filter is nil) ordered by ChatID
+	IsChatActive(chatID int64) bool                        // returns false if the chat is blocked, unknown chats are active
+	SetChatActive(chatID int64, active bool) (bool, error) // sets activity of the chat, returns true if the activity changed
+}
+
+// lastSeenSaveInterval is the minimum interval between saves caused by updates of LastSeen only
+const lastSeenSaveInterval = time.Minute
+
+// registrySaveDelay is the delay of the background save after a change, changes made during the delay are saved together
+const registrySaveDelay = time.Second
+
+type chatRegistry struct {
+	mu       sync.RWMutex
+	saveMu   sync.Mutex // keeps the order of saves to io
+	chats    map[int64]*ChatInfo
+	io       StateIO   // nil if records are kept in memory only
+	lastSave time.Time // time of the latest save to io
+	pending  bool      // a background save is scheduled
+}
+
+// NewMemoryChatRegistry creates a ChatRegistry that keeps records in memory, so they are lost after a restart
+func NewMemoryChatRegistry() ChatRegistry {
+	return &chatRegistry{chats: make(map[int64]*ChatInfo)}
+}
+
+// NewChatRegistry creates a ChatRegistry that loads records from io, and saves them in the background a second after a change,
+// so the calls do not wait for io. Changes of LastSeen only are saved at most once a minute.
+// The latest changes can be lost after a failure
+func NewChatRegistry(io StateIO) ChatRegistry {
+	r := &chatRegistry{chats: make(map[int64]*ChatInfo), io: io}
+	data, err := io.Load()
+	if err != nil {
+		logger.Warning("cannot load chat registry: %v, will start from blank", err)
+		return r
+	}
+	var chats []*ChatInfo
+	if err = json.Unmarshal(data, &chats); err != nil {
+		logger.Warning("cannot parse chat registry: %v, will start from blank", err)
+		return r
+	}
+	for _, chat := range chats {
+		r.chats[chat.ChatID] = chat
+	}
+	return r
+}
+
+// saveLater schedules a background save of the records, should be called under the lock
+func (r *chatRegistry) saveLater() {
+	if r.io == nil || r.pending {
+		return
+	}
+	r.pending = true
+	time.AfterFunc(registrySaveDelay, func() {
+		if err := r.save(); err != nil {
+			logger.Error("%v", err)
+		}
+	})
+}
+
+// save writes all records to io
+func (r *chatRegistry) save() error {
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+	r.mu.Lock()
+	r.pending = false
+	r.lastSave = time.Now()
+	chats := make([]ChatInfo, 0, len(r.chats))
+	for _, chat := range r.chats {
+		chats = append(chats, *chat)
+	}
+	r.mu.Unlock()
+	sort.Slice(chats, func(i, j int) bool { return chats[i].ChatID < chats[j].ChatID })
+	data, err := json.Marshal(chats)
+	if err != nil {
+		return fmt.Errorf("cannot marshal chat registry to json: %v", err)
+	}
+	if err = r.io.Save(data); err != nil {
+		return fmt.Errorf("cannot save chat registry to io: %v", err)
+	}
+	return nil
+}
+
+func (r *chatRegistry) SeeChat(chat ChatInfo) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if chat.LastSeen.IsZero() {
+		chat.LastSeen = time.Now()
+	}
+	known, ok := r.chats[chat.ChatID]
+	if !ok {
+		chat.FirstSeen = chat.LastSeen
+		r.chats[chat.ChatID] = &chat
+		r.saveLater()
+		return nil
+	}
+	changed := chat.Type != "" && chat.Type != known.Type ||
+		chat.UserName != known.UserName ||
+		chat.LanguageCode != "" && chat.LanguageCode != known.LanguageCode
+	if chat.Type != "" {
+		known.Type = chat.Type
+	}
+	if chat.LanguageCode != "" {
+		known.LanguageCode = chat.LanguageCode
+	}
+	known.UserName = chat.UserName
+	known.LastSeen = chat.LastSeen
+	if changed || time.Since(r.lastSave) >= lastSeenSaveInterval {
+		r.saveLater()
+	}
+	return nil
+}
+
+func (r *chatRegistry) GetChat(chatID int64) (ChatInfo, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	chat, ok := r.chats[chatID]
+	if !ok {
+		return ChatInfo{}, false
+	}
+	return *chat, true
+}
+
+func (r *chatRegistry) GetChats(filter ChatFilterType) ([]ChatInfo, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	chats := make([]ChatInfo, 0, len(r.chats))
+	for _, chat := range r.chats {
+		if filter == nil || filter(*chat) {
+			chats = append(chats, *chat)
+		}
+	}
+	sort.Slice(chats, func(i, j int) bool { return chats[i].ChatID < chats[j].ChatID })
+	return chats, nil
+}
+
+func (r *chatRegistry) IsChatActive(chatID int64) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	chat, ok := r.chats[chatID]
+	return !ok || !chat.Blocked
+}
+
+func (r *chatRegistry) SetChatActive(chatID int64, active bool) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	chat, ok := r.chats[chatID]
+	if !ok {
+		if active {
+			return false, nil // unknown chats are active
+		}
+		now := time.Now()
+		chat = &ChatInfo{ChatID: chatID, FirstSeen: now, LastSeen: now}
+		r.chats[chatID] = chat
+	} else if chat.Blocked == !active {
+		return false, nil
+	}
+	chat.Blocked = !active
+	r.saveLater()
+	return true, nil
+}
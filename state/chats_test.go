@@ -0,0 +1,51 @@
+package state_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ufy-it/go-telegram-bot/state"
+)
+
+// reloadChatRegistry waits for the background save that blocks the chat and loads the registry from io
+func reloadChatRegistry(io state.StateIO, blockedID int64) state.ChatRegistry {
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		registry := state.NewChatRegistry(io)
+		if !registry.IsChatActive(blockedID) || time.Now().After(deadline) {
+			return registry
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestChatRegistry(t *testing.T) {
+	io := state.NewMemoryState()
+	registry := state.NewChatRegistry(io)
+	first := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	registry.SeeChat(state.ChatInfo{ChatID: 1, Type: "private", UserName: "user1", LanguageCode: "en", LastSeen: first})
+	registry.SeeChat(state.ChatInfo{ChatID: -2, Type: "group", LastSeen: first})
+	registry.SeeChat(state.ChatInfo{ChatID: 1, Type: "private", UserName: "renamed", LastSeen: first.Add(time.Hour)})
+	if changed, err := registry.SetChatActive(-2, false); !changed || err != nil {
+		t.Errorf("expected the group to be deactivated, got %v, %v", changed, err)
+	}
+	if changed, _ := registry.SetChatActive(3, true); changed {
+		t.Errorf("unknown chat should be active")
+	}
+
+	registry = reloadChatRegistry(io, -2) // reload after a restart
+	chat, ok := registry.GetChat(1)
+	expected := state.ChatInfo{ChatID: 1, Type: "private", UserName: "renamed", LanguageCode: "en", FirstSeen: first, LastSeen: first.Add(time.Hour)}
+	if !ok || chat != expected {
+		t.Errorf("unexpected record %v, expected %v", chat, expected)
+	}
+	if registry.IsChatActive(-2) || !registry.IsChatActive(1) || !registry.IsChatActive(3) {
+		t.Errorf("unexpected activity of chats after reload")
+	}
+
+	registry.SetChatActive(-2, true)
+	active, err := registry.GetChats(func(chat state.ChatInfo) bool { return !chat.Blocked })
+	if err != nil || len(active) != 2 || active[0].ChatID != -2 || active[1].ChatID != 1 {
+		t.Errorf("unexpected active chats %v, %v", active, err)
+	}
+}
@@ -12,15 +12,37 @@ import (
 // ConversationState reflects the current state of a conversation handler with "step" granularity.
 // The exact handler should be deduced from the firstMessage
 type ConversationState struct {
-	FirstUpdate *tgbotapi.Update `json:"first_update"` // initial message for a handler
-	Step        int              `json:"step"`         // the index of the stap that should be processed
-	Data        interface{}      `json:"data"`         // user-data
-	ChatID      int64            `json:"chat_id"`      // chat_id of the conversation
+	FirstUpdate *tgbotapi.Update `json:"first_update"`        // initial message for a handler
+	Step        int              `json:"step"`                // the index of the stap that should be processed
+	Data        interface{}      `json:"data"`                // user-data
+	ChatID      int64            `json:"chat_id"`             // chat_id of the conversation
+	UserID      int64            `json:"user_id,omitempty"`   // user_id of the conversation if conversations are separated per user
+	ThreadID    int              `json:"thread_id,omitempty"` // forum topic of the conversation if conversations are separated per topic
+
+	MessageThreadID int  `json:"message_thread_id,omitempty"` // forum topic the conversation posts to
+	Crashes         int  `json:"crashes,omitempty"`           // number of crashes of the bot while the conversation ran a step, since the latest update from the user
+	InStep          bool `json:"in_step,omitempty"`           // the handler runs a step and does not wait for an update from the user
+}
+
+// ConversationKey identifies the owner of a conversation: a chat, a user in the chat or a forum topic of the chat.
+// Parts of the key that are not used to separate conversations are zero
+type ConversationKey struct {
+	ChatID   int64
+	UserID   int64
+	ThreadID int
+}
+
+// Key returns key of the conversation
+func (cs *ConversationState) Key() ConversationKey {
+	return ConversationKey{ChatID: cs.ChatID, UserID: cs.UserID, ThreadID: cs.ThreadID}
 }
 
 type botState struct {
-	ConversationStates map[int64]*ConversationState `json:"conversations"` // map of all active conversation states
+	ConversationStates map[int64]*ConversationState `json:"conversations"`     // map of all active conversation states
+	Running            bool                         `json:"running,omitempty"` // flag that the state is used by a running bot, it is saved as false when the bot closes the state
+	opened             bool                         // flag that the state was opened by the bot, so it is saved on close
 	closed             bool                         // flag that indicates that state is closed and should not do any saves
+	dropped            map[int64]bool               // conversations dropped while their handlers may still run, their states are not saved anymore
 	mu                 sync.RWMutex                 // mutex to synchronize read-write operations to the map of conversation states
 	muIO               sync.Mutex                   // mutex to synchronize saving to a IO
 	io                 StateIO                      // abstraction for reading and writing states
@@ -29,22 +51,31 @@ type botState struct {
 // BotState is an interface for object that records current state of all ongoing conversations
 type BotState interface {
 	RemoveConverastionState(conversationID int64) error // removes record about a current conversation. Should be called after a high-level handler is done
+	DropConversationState(conversationID int64) error   // removes record about a conversation whose handler may still run, later saves of the conversation are refused
 	LoadState() error                                   // Load state from a file
 	Close() error                                       // Forbid furter savings
 
-	GetConversationIDs() []int64                                        // get list of conversationsIDs, if several IDs have the same ChatID, only the latest conversationID will be listed
+	GetConversationIDs() []int64                                        // get list of conversationsIDs, if several IDs have the same key, only the latest conversationID will be listed
 	GetConversatonFirstUpdate(conversationID int64) *tgbotapi.Update    // get first update of the conversation
 	GetConversationStepAndData(conversationID int64) (int, interface{}) // get data and state of the conversation
 	GetConversationChatID(conversationID int64) int64                   // get ChatID of the conversation
+	GetConversationKey(conversationID int64) ConversationKey            // get key of the conversation
+	GetConversationThreadID(conversationID int64) int                   // get forum topic the conversation posts to, 0 for unknown conversations
+	GetConversationStep(conversationID int64) (int, bool)               // get index of the current step of the conversation, false if there is no record about the conversation
+	Open() (map[int64]int, error)                                       // mark the loaded state as used by a running bot and save it. If the previous bot crashed, count the crash for every conversation that ran a step. Returns numbers of crashes of conversations
+	ResetConversationCrashes(conversationID int64) error                // reset the number of crashes when the conversation gets an update from the user
+	SetConversationInStep(conversationID int64, inStep bool) error      // mark that the handler runs a step (true) or waits for an update from the user (false), saves the state if the mark changed
 
-	StartConversationWithUpdate(conversationID int64, chatID int64, firstUpdate *tgbotapi.Update) error // create state for a conversation with first update
-	SaveConversationStepAndData(conversationID int64, step int, data interface{}) error                 // save new conversation step and data, save all states to a file
+	StartConversationWithUpdate(conversationID int64, chatID int64, firstUpdate *tgbotapi.Update) error                   // create state for a conversation with first update
+	StartConversationWithKey(conversationID int64, key ConversationKey, threadID int, firstUpdate *tgbotapi.Update) error // create state for a conversation with a key, forum topic and first update
+	SaveConversationStepAndData(conversationID int64, step int, data interface{}) error                                   // save new conversation step and data, save all states to a file
 }
 
 // NewBotState method constructs a new BotState object
 func NewBotState(io StateIO) BotState {
 	return &botState{
 		ConversationStates: make(map[int64]*ConversationState),
+		dropped:            make(map[int64]bool),
 		closed:             false,
 		io:                 io,
 	}
@@ -52,7 +83,14 @@ func NewBotState(io StateIO) BotState {
 
 func (bs *botState) RemoveConverastionState(converationID int64) error {
 	bs.mu.Lock()
+	if bs.dropped[converationID] { // the handler of the dropped conversation is done
+		delete(bs.dropped, converationID)
+		delete(bs.ConversationStates, converationID)
+		bs.mu.Unlock()
+		return nil
+	}
 	if _, ok := bs.ConversationStates[converationID]; !ok {
+		bs.mu.Unlock()
 		return fmt.Errorf("no record about conversation with %d in the BotState", converationID)
 	}
 	delete(bs.ConversationStates, converationID)
@@ -60,6 +98,33 @@ func (bs *botState) RemoveConverastionState(converationID int64) error {
 	return bs.saveState()
 }
 
+func (bs *botState) DropConversationState(conversationID int64) error {
+	bs.mu.Lock()
+	bs.dropped[conversationID] = true
+	if _, ok := bs.ConversationStates[conversationID]; !ok {
+		bs.mu.Unlock()
+		return nil
+	}
+	delete(bs.ConversationStates, conversationID)
+	bs.mu.Unlock()
+	return bs.saveState()
+}
+
+// stateToSave returns the state of the conversation to update, or an error if the conversation is dropped
+func (bs *botState) stateToSave(conversationID int64) (*ConversationState, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if bs.dropped[conversationID] {
+		return nil, fmt.Errorf("conversation %d is dropped, its state is not saved", conversationID)
+	}
+	state, ok := bs.ConversationStates[conversationID]
+	if !ok {
+		state = &ConversationState{}
+		bs.ConversationStates[conversationID] = state
+	}
+	return state, nil
+}
+
 func (bs *botState) LoadState() error {
 	bs.mu.Lock()
 	defer bs.mu.Unlock()
@@ -78,22 +143,55 @@ func (bs *botState) LoadState() error {
 }
 
 func (bs *botState) Close() error {
+	bs.muIO.Lock() // wait for the ongoing save
+	defer bs.muIO.Unlock()
 	if bs.closed {
 		return errors.New("state is already closed")
 	}
 	bs.closed = true
+	if !bs.opened {
+		return nil
+	}
+	bs.mu.Lock()
+	bs.Running = false // the next start does not count a crash
+	content, err := json.MarshalIndent(bs, "", " ")
+	bs.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("cannot marshal state to json: %v", err)
+	}
+	if err = bs.io.Save(content); err != nil {
+		return fmt.Errorf("cannot save state to io: %v", err)
+	}
 	return nil
 }
 
+func (bs *botState) Open() (map[int64]int, error) {
+	bs.muIO.Lock() //forbid saving while updating
+	bs.mu.Lock()
+	crashes := make(map[int64]int, len(bs.ConversationStates))
+	for conversationID, state := range bs.ConversationStates {
+		if bs.Running && state.InStep { // the previous bot did not close the state while the conversation ran a step
+			state.Crashes++
+		}
+		crashes[conversationID] = state.Crashes
+		state.InStep = true // a resumed handler runs its step again
+	}
+	bs.Running = true
+	bs.opened = bs.io != nil
+	bs.mu.Unlock()
+	bs.muIO.Unlock()
+	return crashes, bs.saveState()
+}
+
 // saveState first saves the state to temporary file and then renames the file to a target filename
 func (bs *botState) saveState() error {
-	if bs.closed {
-		return errors.New("the state is closed for saving")
-	}
 	bs.muIO.Lock()
 	bs.mu.RLock()
 	defer bs.mu.RUnlock()
 	defer bs.muIO.Unlock()
+	if bs.closed {
+		return errors.New("the state is closed for saving")
+	}
 
 	content, err := json.MarshalIndent(bs, "", " ")
 	if err != nil {
@@ -129,14 +227,14 @@ func (bs *botState) GetConversationIDs() []int64 {
 	bs.mu.RLock()
 	defer bs.mu.RUnlock()
 
-	chatToConversationID := make(map[int64]int64)
+	keyToConversationID := make(map[ConversationKey]int64)
 	statesToDelete := make([]int64, 0)
 	for conversationID, state := range bs.ConversationStates {
-		if prevID, ok := chatToConversationID[state.ChatID]; ok {
+		if prevID, ok := keyToConversationID[state.Key()]; ok {
 			statesToDelete = append(statesToDelete, min(prevID, conversationID))
-			chatToConversationID[state.ChatID] = max(prevID, conversationID)
+			keyToConversationID[state.Key()] = max(prevID, conversationID)
 		} else {
-			chatToConversationID[state.ChatID] = conversationID
+			keyToConversationID[state.Key()] = conversationID
 		}
 	}
 	for _, id := range statesToDelete {
@@ -184,13 +282,30 @@ func (bs *botState) GetConversationStepAndData(converationID int64) (int, interf
 }
 
 func (bs *botState) StartConversationWithUpdate(conversationID, chatID int64, firstUpdate *tgbotapi.Update) error {
-	bs.getConversatonState(conversationID).FirstUpdate = firstUpdate
-	bs.getConversatonState(conversationID).ChatID = chatID
+	return bs.StartConversationWithKey(conversationID, ConversationKey{ChatID: chatID}, 0, firstUpdate)
+}
+
+func (bs *botState) StartConversationWithKey(conversationID int64, key ConversationKey, threadID int, firstUpdate *tgbotapi.Update) error {
+	state, err := bs.stateToSave(conversationID)
+	if err != nil {
+		return err
+	}
+	bs.muIO.Lock() //forbid saving while updating
+	state.FirstUpdate = firstUpdate
+	state.ChatID = key.ChatID
+	state.UserID = key.UserID
+	state.ThreadID = key.ThreadID
+	state.MessageThreadID = threadID
+	state.InStep = true
+	bs.muIO.Unlock()
 	return bs.saveState()
 }
 
 func (bs *botState) SaveConversationStepAndData(conversationID int64, step int, data interface{}) error {
-	state := bs.getConversatonState(conversationID)
+	state, err := bs.stateToSave(conversationID)
+	if err != nil {
+		return err
+	}
 	bs.muIO.Lock() //forbid saving while updating
 	state.Data = data
 	state.Step = step
@@ -201,3 +316,62 @@ func (bs *botState) SaveConversationStepAndData(conversationID int64, step int,
 func (bs *botState) GetConversationChatID(conversationID int64) int64 {
 	return bs.getConversatonState(conversationID).ChatID
 }
+
+func (bs *botState) GetConversationKey(conversationID int64) ConversationKey {
+	return bs.getConversatonState(conversationID).Key()
+}
+
+func (bs *botState) GetConversationThreadID(conversationID int64) int {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+	if state, ok := bs.ConversationStates[conversationID]; ok {
+		return state.MessageThreadID
+	}
+	return 0
+}
+
+func (bs *botState) ResetConversationCrashes(conversationID int64) error {
+	bs.mu.RLock()
+	state, ok := bs.ConversationStates[conversationID]
+	bs.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	bs.muIO.Lock() //forbid saving while updating
+	crashes := state.Crashes
+	state.Crashes = 0
+	bs.muIO.Unlock()
+	if crashes == 0 {
+		return nil // nothing to save
+	}
+	return bs.saveState()
+}
+
+func (bs *botState) SetConversationInStep(conversationID int64, inStep bool) error {
+	bs.mu.RLock()
+	state, ok := bs.ConversationStates[conversationID]
+	bs.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	bs.muIO.Lock() //forbid saving while updating
+	changed := state.InStep != inStep && !bs.closed
+	state.InStep = inStep
+	bs.muIO.Unlock()
+	if !changed {
+		return nil // nothing to save, or the state is closed on a shutdown
+	}
+	return bs.saveState()
+}
+
+func (bs *botState) GetConversationStep(conversationID int64) (int, bool) {
+	bs.mu.RLock()
+	state, ok := bs.ConversationStates[conversationID]
+	bs.mu.RUnlock()
+	if !ok {
+		return 0, false
+	}
+	bs.muIO.Lock() // the step is updated under muIO
+	defer bs.muIO.Unlock()
+	return state.Step, true
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"sync"
 )
 
 type StateIO interface {
@@ -51,3 +52,29 @@ func (f fileStateIO) Save(file []byte) error {
 	}
 	return nil
 }
+
+type memoryStateIO struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+// NewMemoryState creates a StateIO that keeps the state in memory (e.g. for tests)
+func NewMemoryState() StateIO {
+	return &memoryStateIO{}
+}
+
+func (m *memoryStateIO) Load() ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.data == nil {
+		return nil, errors.New("no state saved in memory")
+	}
+	return append([]byte(nil), m.data...), nil
+}
+
+func (m *memoryStateIO) Save(data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.data = append([]byte(nil), data...)
+	return nil
+}
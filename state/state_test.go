@@ -92,3 +92,120 @@ func TestGetConversationStepAndData(t *testing.T) {
 		t.Errorf("unexpected step and data (%d, %v)", step, data)
 	}
 }
+
+func TestConversationKeys(t *testing.T) {
+	io := state.NewMemoryState()
+	s := state.NewBotState(io)
+	s.StartConversationWithKey(1, state.ConversationKey{ChatID: -5, UserID: 10}, 0, nil)
+	s.StartConversationWithKey(2, state.ConversationKey{ChatID: -5, UserID: 11}, 7, nil)
+	s.StartConversationWithKey(3, state.ConversationKey{ChatID: -5, UserID: 10}, 0, nil)
+
+	cs := s.GetConversationIDs()
+	sort.Slice(cs, func(i, j int) bool { return cs[i] < cs[j] })
+	if !reflect.DeepEqual(cs, []int64{2, 3}) {
+		t.Errorf("Expected conversations [2, 3], got %v", cs)
+	}
+	if key := s.GetConversationKey(3); key != (state.ConversationKey{ChatID: -5, UserID: 10}) {
+		t.Errorf("Unexpected key %v", key)
+	}
+	if chatID := s.GetConversationChatID(2); chatID != -5 {
+		t.Errorf("Expected chat -5, got %d", chatID)
+	}
+
+	loaded := state.NewBotState(io)
+	if err := loaded.LoadState(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if key := loaded.GetConversationKey(2); key != (state.ConversationKey{ChatID: -5, UserID: 11}) {
+		t.Errorf("Unexpected key after loading %v", key)
+	}
+	if threadID := loaded.GetConversationThreadID(2); threadID != 7 {
+		t.Errorf("Expected topic 7 after loading, got %d", threadID)
+	}
+	if threadID := loaded.GetConversationThreadID(100); threadID != 0 {
+		t.Errorf("Expected no topic for an unknown conversation, got %d", threadID)
+	}
+}
+
+func TestConversationCrashes(t *testing.T) {
+	io := state.NewMemoryState()
+	s := state.NewBotState(io)
+	s.StartConversationWithUpdate(1, 10, nil)
+	if crashes, err := s.Open(); err != nil || crashes[1] != 0 {
+		t.Errorf("expected no crashes of a new state, got %v (%v)", crashes, err)
+	}
+	for i := 1; i <= 2; i++ { // the bot crashes without closing the state
+		crashed := state.NewBotState(io)
+		crashed.LoadState()
+		if crashes, err := crashed.Open(); err != nil || crashes[1] != i {
+			t.Errorf("expected %d crashes, got %d (%v)", i, crashes[1], err)
+		}
+	}
+	idle := state.NewBotState(io)
+	idle.LoadState()
+	idle.Open()
+	if err := idle.SetConversationInStep(1, false); err != nil { // the conversation waits for the user when the bot crashes
+		t.Error(err)
+	}
+	loaded := state.NewBotState(io)
+	loaded.LoadState()
+	if crashes, _ := loaded.Open(); crashes[1] != 3 {
+		t.Errorf("expected the number of crashes to be saved, got %d", crashes[1])
+	}
+	if err := loaded.ResetConversationCrashes(1); err != nil {
+		t.Error(err)
+	}
+	if err := loaded.Close(); err != nil { // a graceful stop
+		t.Error(err)
+	}
+	restarted := state.NewBotState(io)
+	restarted.LoadState()
+	if crashes, _ := restarted.Open(); crashes[1] != 0 {
+		t.Errorf("a graceful restart should not be counted as a crash, got %d crashes", crashes[1])
+	}
+
+	if err := s.RemoveConverastionState(2); err == nil {
+		t.Errorf("expected error for an unknown conversation")
+	}
+	if err := s.RemoveConverastionState(1); err != nil { // the state is not locked after the error
+		t.Error(err)
+	}
+}
+
+func TestGetConversationStep(t *testing.T) {
+	s := state.NewBotState(state.NewMemoryState())
+	if _, ok := s.GetConversationStep(1); ok {
+		t.Errorf("expected no step for an unknown conversation")
+	}
+	if ids := s.GetConversationIDs(); len(ids) != 0 {
+		t.Errorf("the step should not create a record, got %v", ids)
+	}
+	s.SaveConversationStepAndData(1, 3, nil)
+	if step, ok := s.GetConversationStep(1); !ok || step != 3 {
+		t.Errorf("expected step 3, got %d (%v)", step, ok)
+	}
+}
+
+func TestDropConversationState(t *testing.T) {
+	io := state.NewMemoryState()
+	s := state.NewBotState(io)
+	s.StartConversationWithUpdate(1, 10, nil)
+	s.StartConversationWithUpdate(2, 20, nil)
+	if err := s.DropConversationState(1); err != nil {
+		t.Error(err)
+	}
+	if err := s.SaveConversationStepAndData(1, 2, nil); err == nil {
+		t.Errorf("expected error saving a dropped conversation")
+	}
+	if err := s.StartConversationWithUpdate(1, 10, nil); err == nil {
+		t.Errorf("expected error starting a dropped conversation")
+	}
+	loaded := state.NewBotState(io)
+	loaded.LoadState()
+	if ids := loaded.GetConversationIDs(); !reflect.DeepEqual(ids, []int64{2}) {
+		t.Errorf("expected only conversation 2 in the saved state, got %v", ids)
+	}
+	if err := s.RemoveConverastionState(1); err != nil { // the handler of the dropped conversation is done
+		t.Error(err)
+	}
+}
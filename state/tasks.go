@@ -0,0 +1,26 @@
+package state
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// ScheduledTask is a one-off task that should be run for a chat at a time
+type ScheduledTask struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`              // name of the registered task type that runs the task
+	ChatID    int64           `json:"chat_id"`           // chat the task belongs to
+	At        time.Time       `json:"at"`                // time when the task should be run
+	Payload   json.RawMessage `json:"payload,omitempty"` // JSON-encoded payload passed to the task
+	CreatedAt time.Time       `json:"created_at"`
+
+	Interrupted int `json:"interrupted,omitempty"` // number of runs interrupted by shutdowns of the bot
+}
+
+// DecodePayload unmarshals payload of the task into v
+func (t ScheduledTask) DecodePayload(v interface{}) error {
+	if len(t.Payload) == 0 {
+		return nil
+	}
+	return json.Unmarshal(t.Payload, v)
+}
@@ -0,0 +1,129 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// SpanData is a finished span kept by Recorder
+type SpanData struct {
+	Name       string
+	TraceID    string
+	SpanID     string
+	ParentID   string // empty for the root span of a trace
+	Attributes map[string]interface{}
+	Err        error // the latest recorded error
+	Start      time.Time
+	End        time.Time
+}
+
+// Recorder is a Tracer that keeps finished spans in memory, e.g. to check traces in tests
+type Recorder struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+// NewRecorder creates a new in-memory tracer
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// Start starts a span as a child of the current span of the context
+func (r *Recorder) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	span := &recordedSpan{
+		recorder: r,
+		data: SpanData{
+			Name:       name,
+			SpanID:     newID(8),
+			Attributes: make(map[string]interface{}),
+			Start:      time.Now(),
+		},
+	}
+	if parent := SpanFromContext(ctx).SpanContext(); parent.IsValid() {
+		span.data.TraceID = parent.TraceID
+		span.data.ParentID = parent.SpanID
+	} else {
+		span.data.TraceID = newID(16)
+	}
+	span.SetAttributes(attrs...)
+	return ContextWithSpan(ctx, span), span
+}
+
+// Spans returns finished spans in the order they were ended
+func (r *Recorder) Spans() []SpanData {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]SpanData{}, r.spans...)
+}
+
+// Reset drops finished spans
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = nil
+}
+
+// recordedSpan is a span started by Recorder
+type recordedSpan struct {
+	recorder *Recorder
+	mu       sync.Mutex
+	data     SpanData
+	ended    bool
+}
+
+// SpanContext returns IDs of the span and its trace
+func (s *recordedSpan) SpanContext() SpanContext {
+	return SpanContext{TraceID: s.data.TraceID, SpanID: s.data.SpanID}
+}
+
+// SetAttributes attaches attributes to the span
+func (s *recordedSpan) SetAttributes(attrs ...Attribute) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, attr := range attrs {
+		s.data.Attributes[attr.Key] = attr.Value
+	}
+}
+
+// RecordError marks the span as failed
+func (s *recordedSpan) RecordError(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Err = err
+}
+
+// End finishes the span and passes it to the recorder, the second call does nothing
+func (s *recordedSpan) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	data.Attributes = make(map[string]interface{}, len(s.data.Attributes))
+	for key, value := range s.data.Attributes {
+		data.Attributes[key] = value
+	}
+	s.mu.Unlock()
+
+	s.recorder.mu.Lock()
+	defer s.recorder.mu.Unlock()
+	s.recorder.spans = append(s.recorder.spans, data)
+}
+
+// newID returns a random hex ID of n bytes
+func newID(n int) string {
+	id := make([]byte, n)
+	if _, err := rand.Read(id); err != nil {
+		panic(err) // crypto/rand does not fail on supported platforms
+	}
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,83 @@
+package tracing_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ufy-it/go-telegram-bot/tracing"
+)
+
+func TestRecorder(t *testing.T) {
+	recorder := tracing.NewRecorder()
+	ctx, root := recorder.Start(context.Background(), "root", tracing.Attr("update_id", 1))
+	_, child := recorder.Start(ctx, "child")
+	child.SetAttributes(tracing.Attr("chat_id", int64(42)))
+	child.RecordError(errors.New("failure"))
+	child.RecordError(nil)
+	child.End()
+	child.End()
+	root.End()
+
+	spans := recorder.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	if spans[0].Name != "child" || spans[1].Name != "root" {
+		t.Errorf("spans should be recorded in the order they are ended, got %s, %s", spans[0].Name, spans[1].Name)
+	}
+	if spans[1].ParentID != "" || spans[0].ParentID != spans[1].SpanID || spans[0].TraceID != spans[1].TraceID {
+		t.Errorf("child span should be in the trace of the root span: %+v", spans)
+	}
+	if spans[1].Attributes["update_id"] != 1 || spans[0].Attributes["chat_id"] != int64(42) {
+		t.Errorf("unexpected attributes %v, %v", spans[1].Attributes, spans[0].Attributes)
+	}
+	if spans[0].Err == nil || spans[0].Err.Error() != "failure" || spans[1].Err != nil {
+		t.Errorf("unexpected errors %v, %v", spans[0].Err, spans[1].Err)
+	}
+
+	_, other := recorder.Start(context.Background(), "other")
+	if other.SpanContext().TraceID == spans[1].TraceID {
+		t.Errorf("a span without a parent should start a new trace")
+	}
+	recorder.Reset()
+	if len(recorder.Spans()) != 0 {
+		t.Errorf("expected no spans after reset")
+	}
+}
+
+func TestScope(t *testing.T) {
+	recorder := tracing.NewRecorder()
+	scope := &tracing.Scope{}
+	ctx := tracing.ContextWithTracer(scope.NewContext(context.Background()), recorder)
+
+	_, first := recorder.Start(context.Background(), "first")
+	scope.Replace(first)
+	_, span := tracing.Start(ctx, "query")
+	span.End()
+	_, second := recorder.Start(context.Background(), "second")
+	scope.Replace(second)
+	_, span = tracing.Start(ctx, "query")
+	span.End()
+	scope.End()
+
+	spans := recorder.Spans()
+	if len(spans) != 4 {
+		t.Fatalf("expected 4 spans, got %d", len(spans))
+	}
+	if spans[0].ParentID != first.SpanContext().SpanID || spans[1].Name != "first" ||
+		spans[2].ParentID != second.SpanContext().SpanID || spans[3].Name != "second" {
+		t.Errorf("spans should be children of the current span of the scope: %+v", spans)
+	}
+	if scope.Span() != nil {
+		t.Errorf("expected no current span after End")
+	}
+}
+
+func TestNopTracer(t *testing.T) {
+	ctx, span := tracing.Start(context.Background(), "query")
+	if span.SpanContext().IsValid() || tracing.SpanFromContext(ctx).SpanContext().IsValid() {
+		t.Errorf("spans without a tracer should not be recorded")
+	}
+	span.End()
+}
@@ -0,0 +1,158 @@
+// Package tracing follows updates from the receipt by the bot through the dispatcher and handlers to messages sent in reply.
+// Tracer can be implemented over any tracing system, e.g. OpenTelemetry, Recorder keeps spans in memory for tests
+package tracing
+
+import (
+	"context"
+	"sync"
+)
+
+// names of spans started by the bot
+const (
+	SpanReceive       = "telegram.update"            // an update is received by the bot
+	SpanDispatch      = "dispatcher.dispatch"        // the dispatcher routes the update to a conversation
+	SpanSelectHandler = "dispatcher.select_handler"  // the dispatcher selects the handler for the first update of a conversation
+	SpanHandleUpdate  = "conversation.handle_update" // a handler consumes the update, the span lasts until the next update is consumed
+	SpanSend          = "telegram.send"              // a conversation sends a request to the Bot API
+)
+
+// Attribute is a key/value pair attached to a span
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Attr returns an attribute
+func Attr(key string, value interface{}) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// SpanContext identifies a span and its trace, IDs are empty for spans that are not recorded
+type SpanContext struct {
+	TraceID string
+	SpanID  string
+}
+
+// IsValid returns true if the span context identifies a span
+func (s SpanContext) IsValid() bool {
+	return s.TraceID != "" && s.SpanID != ""
+}
+
+// Span is an operation of a trace. Methods are called from many goroutines, so they should be safe for concurrent use
+type Span interface {
+	SpanContext() SpanContext         // IDs of the span and its trace
+	SetAttributes(attrs ...Attribute) // attaches attributes to the span
+	RecordError(err error)            // marks the span as failed, nil errors are ignored
+	End()                             // finishes the span
+}
+
+// Tracer starts spans. The parent of a new span is SpanFromContext(ctx), a span without a parent starts a new trace
+type Tracer interface {
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+// NopTracer is a Tracer that starts spans that are not recorded
+type NopTracer struct{}
+
+// Start returns the context with a span that is not recorded
+func (NopTracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+// nopSpan is a span that is not recorded
+type nopSpan struct{}
+
+func (nopSpan) SpanContext() SpanContext         { return SpanContext{} }
+func (nopSpan) SetAttributes(attrs ...Attribute) {}
+func (nopSpan) RecordError(err error)            {}
+func (nopSpan) End()                             {}
+
+type tracerKey struct{}
+type spanKey struct{}
+
+// spanSource provides the current span of a context
+type spanSource interface {
+	currentSpan() Span
+}
+
+// fixedSpan is a span set with ContextWithSpan
+type fixedSpan struct {
+	span Span
+}
+
+func (f fixedSpan) currentSpan() Span {
+	return f.span
+}
+
+// ContextWithTracer returns a context that carries the tracer
+func ContextWithTracer(ctx context.Context, tracer Tracer) context.Context {
+	return context.WithValue(ctx, tracerKey{}, tracer)
+}
+
+// TracerFromContext returns the tracer carried by the context, or NopTracer
+func TracerFromContext(ctx context.Context) Tracer {
+	if tracer, ok := ctx.Value(tracerKey{}).(Tracer); ok {
+		return tracer
+	}
+	return NopTracer{}
+}
+
+// ContextWithSpan returns a context that carries the span as the parent of new spans
+func ContextWithSpan(ctx context.Context, span Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, fixedSpan{span})
+}
+
+// SpanFromContext returns the current span of the context, or a span that is not recorded
+func SpanFromContext(ctx context.Context) Span {
+	if source, ok := ctx.Value(spanKey{}).(spanSource); ok {
+		if span := source.currentSpan(); span != nil {
+			return span
+		}
+	}
+	return nopSpan{}
+}
+
+// Start starts a span with the tracer of the context as a child of the current span of the context.
+// Handlers use it to trace their own operations, e.g. database calls, as a part of the update they process
+func Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span) {
+	return TracerFromContext(ctx).Start(ctx, name, attrs...)
+}
+
+// Scope is a current span that is replaced while a context lives,
+// e.g. the span of the update that a handler consumed is replaced when the handler reads the next update
+type Scope struct {
+	mu   sync.Mutex
+	span Span
+}
+
+// NewContext returns a context whose current span is the span of the scope
+func (s *Scope) NewContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// Span returns the current span of the scope, nil if there is no span
+func (s *Scope) Span() Span {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.span
+}
+
+func (s *Scope) currentSpan() Span {
+	return s.Span()
+}
+
+// Replace ends the current span of the scope and makes the span current
+func (s *Scope) Replace(span Span) {
+	s.mu.Lock()
+	previous := s.span
+	s.span = span
+	s.mu.Unlock()
+	if previous != nil {
+		previous.End()
+	}
+}
+
+// End ends the current span of the scope
+func (s *Scope) End() {
+	s.Replace(nil)
+}